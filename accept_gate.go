@@ -0,0 +1,111 @@
+package gitkit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptGate delays or pauses accepting connections from a listener. The
+// kernel keeps completing TCP handshakes meanwhile, until the accept queue is
+// full and SYNs are dropped, like an overloaded server that cannot keep up.
+// Clients stall while connecting rather than while waiting for a response.
+// The zero value accepts connections right away.
+type AcceptGate struct {
+	mu     sync.Mutex
+	delay  time.Duration
+	paused chan struct{} // Closed on resume, nil while not paused
+}
+
+// Pause stops accepting connections until Resume is called
+func (g *AcceptGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused == nil {
+		g.paused = make(chan struct{})
+	}
+}
+
+// Resume accepts connections again after Pause
+func (g *AcceptGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused != nil {
+		close(g.paused)
+		g.paused = nil
+	}
+}
+
+// SetDelay waits for the delay before accepting each connection, limiting
+// the rate connections are established at. A zero delay disables it.
+func (g *AcceptGate) SetDelay(delay time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.delay = delay
+}
+
+// Listener wraps a listener to accept connections through the gate, e.g. the
+// one of an httptest server before starting it.
+func (g *AcceptGate) Listener(listener net.Listener) net.Listener {
+	return &gatedListener{Listener: listener, gate: g, closed: make(chan struct{})}
+}
+
+// wait blocks until the next connection may be accepted, or returns
+// net.ErrClosed if closed is closed first.
+func (g *AcceptGate) wait(closed <-chan struct{}) error {
+	g.mu.Lock()
+	delay := g.delay
+	g.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-closed:
+			timer.Stop()
+			return net.ErrClosed
+		}
+	}
+
+	for {
+		g.mu.Lock()
+		paused := g.paused
+		g.mu.Unlock()
+
+		if paused == nil {
+			return nil
+		}
+		select {
+		case <-paused:
+		case <-closed:
+			return net.ErrClosed
+		}
+	}
+}
+
+type gatedListener struct {
+	net.Listener
+	gate   *AcceptGate
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	if err := l.gate.wait(l.closed); err != nil {
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func (l *gatedListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// AcceptGate returns the gate connections to the server are accepted
+// through, to simulate connection establishment stalls.
+func (s *SSH) AcceptGate() *AcceptGate {
+	return &s.accepts
+}
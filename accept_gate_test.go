@@ -0,0 +1,87 @@
+package gitkit
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPAcceptGate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "accept-gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gate := &AcceptGate{}
+	server := httptest.NewUnstartedServer(New(Config{Dir: dir}))
+	server.Listener = gate.Listener(server.Listener)
+	server.Start()
+	defer server.Close()
+
+	url := server.URL + "/" + repo + "/info/refs?service=git-upload-pack"
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+
+	gate.Pause()
+	_, err = client.Get(url)
+	assert.Error(t, err)
+
+	gate.Resume()
+	gate.SetDelay(50 * time.Millisecond)
+	start := time.Now()
+	resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestSSHAcceptGate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "accept-gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+	server.AcceptGate().Pause()
+
+	// The kernel completes the handshake, the server never says hello
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+
+	conn.SetReadDeadline(time.Time{})
+	server.AcceptGate().Resume()
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+
+	// Stopping a paused server does not block
+	server.AcceptGate().Pause()
+	assert.NoError(t, server.Stop())
+}
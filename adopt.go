@@ -0,0 +1,168 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// adoptedRepos holds the existing repositories served from outside of the
+// store, by lockKey.
+type adoptedRepos struct {
+	mu    sync.RWMutex
+	repos map[string]adoptedRepo
+}
+
+type adoptedRepo struct {
+	name string
+	dir  string
+}
+
+func (a *adoptedRepos) add(name string, dir string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.repos == nil {
+		a.repos = map[string]adoptedRepo{}
+	}
+	a.repos[lockKey(name)] = adoptedRepo{name: name, dir: dir}
+}
+
+func (a *adoptedRepos) remove(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.repos[lockKey(name)]; !ok {
+		return false
+	}
+	delete(a.repos, lockKey(name))
+	return true
+}
+
+func (a *adoptedRepos) get(name string) (adoptedRepo, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	repo, ok := a.repos[lockKey(name)]
+	return repo, ok
+}
+
+func (a *adoptedRepos) names() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := []string{}
+	for _, repo := range a.repos {
+		names = append(names, repo.name)
+	}
+	return names
+}
+
+// adoptedStore serves the adopted repositories along with the ones of the
+// store. Deleting an adopted repository stops serving it, leaving its
+// directory untouched.
+type adoptedStore struct {
+	RepoStore
+	adopted *adoptedRepos
+}
+
+func (a *adoptedStore) Open(name string) (string, error) {
+	if repo, ok := a.adopted.get(name); ok {
+		return repo.dir, nil
+	}
+	return a.RepoStore.Open(name)
+}
+
+func (a *adoptedStore) Create(name string) (string, error) {
+	if repo, ok := a.adopted.get(name); ok {
+		return repo.dir, nil
+	}
+	return a.RepoStore.Create(name)
+}
+
+func (a *adoptedStore) Delete(name string) error {
+	if a.adopted.remove(name) {
+		return nil
+	}
+	return a.RepoStore.Delete(name)
+}
+
+func (a *adoptedStore) List() ([]string, error) {
+	names, err := a.RepoStore.List()
+	if err != nil {
+		return nil, err
+	}
+	names = append(names, a.adopted.names()...)
+	sort.Strings(names)
+	return names, nil
+}
+
+func (a *adoptedStore) Resolve(name string) string {
+	alt := name + ".git"
+	if strings.HasSuffix(name, ".git") {
+		alt = strings.TrimSuffix(name, ".git")
+	}
+	for _, candidate := range []string{name, alt} {
+		if repo, ok := a.adopted.get(candidate); ok {
+			return repo.name
+		}
+	}
+	return a.RepoStore.Resolve(name)
+}
+
+// adopt registers an existing bare repository to serve it in place under the
+// name, after checking that git accepts to use it.
+func (o repoOps) adopt(name string, dir string) error {
+	if o.config.adopted == nil {
+		return fmt.Errorf("adopting %s: server not created with New or NewSSH", name)
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return fmt.Errorf("adopting %s: %v", name, err)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("adopting %s: %v", name, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("adopting %s: %s is not a directory", name, dir)
+	}
+
+	// git refuses repositories owned by another user unless listed in
+	// safe.directory, which would fail every request for it
+	env := append(configEnv(o.config.ownershipSettings()...), o.config.ownershipEnv()...)
+	out, err := gitExec(o.config.GitPath, dir, env, "", "rev-parse", "--is-bare-repository", "--absolute-git-dir")
+	if err != nil && strings.Contains(err.Error(), "dubious ownership") {
+		return fmt.Errorf("adopting %s: %s is owned by another user and not listed in safe.directory", name, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("adopting %s: %s is not a git repository", name, dir)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 || fields[0] != "true" || filepath.Clean(fields[1]) != dir {
+		return fmt.Errorf("adopting %s: %s is not a bare repository", name, dir)
+	}
+
+	if _, err := o.config.repoStore().Open(name); err == nil {
+		return fmt.Errorf("adopting %s: a repository already exists with this name", name)
+	}
+	o.config.adopted.add(name, dir)
+	o.config.logInfo("adopt", fmt.Sprintf("%s: serving %s", name, dir))
+	return nil
+}
+
+// AdoptRepo serves an existing bare repository under the name, in place
+// rather than copying it into Config.Dir, e.g. a large local mirror. The
+// repository must be usable by git as is: owned by the user running the
+// server, or listed in safe.directory, e.g. with
+// Config.TrustAllDirectories. Pushes and other changes apply to it
+// directly, while deleting it, e.g. through the REST API, only stops serving
+// it.
+func (c *controls) AdoptRepo(name string, dir string) error {
+	return c.repoOps().adopt(name, dir)
+}
@@ -0,0 +1,92 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdoptRepo(t *testing.T) {
+	// A mirror outside of the server directory
+	mirrors := t.TempDir()
+	mirror, err := (&FSStore{Dir: mirrors}).Create("mirror.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{Dir: mirrors}).Commit("mirror.git", "master", Commit{Files: map[string]string{"file": "mirrored"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if _, err := (&FSStore{Dir: dir}).Create("existing.git"); err != nil {
+		t.Fatal(err)
+	}
+	worktree := t.TempDir()
+	if out, err := runGit(worktree, "init", "--quiet"); err != nil {
+		t.Fatal(err, out)
+	}
+
+	service := New(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	assert.NoError(t, service.AdoptRepo("adopted.git", mirror))
+
+	assert.Error(t, service.AdoptRepo("missing.git", filepath.Join(mirrors, "missing.git")))
+	assert.Error(t, service.AdoptRepo("worktree.git", worktree))
+	assert.Error(t, service.AdoptRepo("objects.git", filepath.Join(mirror, "objects")))
+	assert.Error(t, service.AdoptRepo("existing.git", mirror))
+
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err := runGit(dir, "clone", HTTPCloneURL(ts.Listener.Addr().String(), "adopted"), clone)
+	assert.NoError(t, err, out)
+	content, err := os.ReadFile(filepath.Join(clone, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mirrored", string(content))
+
+	// Changes apply to the adopted repository in place
+	commitFile(t, clone, "pushed")
+	out, err = runGit(clone, "push", "origin", "master")
+	assert.NoError(t, err, out)
+	out, err = runGit(mirror, "log", "-1", "--format=%s")
+	assert.NoError(t, err, out)
+	assert.Equal(t, "pushed\n", out)
+
+	_, err = os.Stat(filepath.Join(dir, "adopted.git"))
+	assert.True(t, os.IsNotExist(err), "adopted repositories are not copied")
+	state, err := service.State()
+	assert.NoError(t, err)
+	assert.Contains(t, state.Repos, "adopted.git")
+
+	sshServer := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	assert.NoError(t, sshServer.AdoptRepo("adopted.git", mirror))
+	out, err = runGit(dir, "ls-remote", SSHCloneURL("git", startSSH(t, sshServer), "adopted.git"))
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "refs/heads/master")
+}
+
+func TestAdoptRepoOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of the repository requires root")
+	}
+
+	mirror, err := (&FSStore{Dir: t.TempDir()}).Create("mirror.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(mirror, 65534, 65534); err != nil {
+		t.Skip(err)
+	}
+
+	service := New(Config{Dir: t.TempDir()})
+	err = service.AdoptRepo("mirror.git", mirror)
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "safe.directory")
+	}
+
+	service = New(Config{Dir: t.TempDir(), TrustAllDirectories: true})
+	assert.NoError(t, service.AdoptRepo("mirror.git", mirror))
+}
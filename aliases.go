@@ -0,0 +1,74 @@
+package gitkit
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RepoAlias routes requests for repositories matching a pattern to another
+// repository, like the renames and transfers of git hosting providers.
+type RepoAlias struct {
+	// Pattern is the requested repository name, with or without ".git". In
+	// a glob, "*" matches any part of a path segment and "?" any character
+	// but "/".
+	Pattern string `json:"pattern"`
+	// Target is the repository served instead. Its "*" are replaced by the
+	// parts of the name matched by the "*" of Pattern, in order, e.g.
+	// "old-org/*" to "new-org/*".
+	Target string `json:"target"`
+	// Redirect redirects HTTP clients to the target, like moved
+	// repositories warning clients to update their remote, instead of
+	// serving it under the requested name. SSH clients are served the
+	// target either way.
+	Redirect bool `json:"redirect,omitempty"`
+}
+
+// match returns the target of the alias for a requested name, and whether
+// the alias applies.
+func (a RepoAlias) match(name string) (string, bool) {
+	pattern := &strings.Builder{}
+	pattern.WriteString("^")
+	for _, c := range a.Pattern {
+		switch c {
+		case '*':
+			pattern.WriteString("([^/]*)")
+		case '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	pattern.WriteString("$")
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return "", false
+	}
+
+	for _, candidate := range []string{name, strings.TrimSuffix(name, ".git")} {
+		groups := re.FindStringSubmatch(candidate)
+		if groups == nil {
+			continue
+		}
+		target := a.Target
+		for _, group := range groups[1:] {
+			if !strings.Contains(target, "*") {
+				break
+			}
+			target = strings.Replace(target, "*", group, 1)
+		}
+		return target, true
+	}
+	return "", false
+}
+
+// resolveAlias returns the alias applying to a requested repository name,
+// the first matching one of Config.Aliases, with its target. It returns nil
+// for names without alias.
+func (c *Config) resolveAlias(name string) (*RepoAlias, string) {
+	for i := range c.Aliases {
+		if target, ok := c.Aliases[i].match(name); ok {
+			return &c.Aliases[i], target
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,75 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoAliasMatch(t *testing.T) {
+	for _, tc := range []struct {
+		alias  RepoAlias
+		name   string
+		target string
+		ok     bool
+	}{
+		{RepoAlias{Pattern: "old.git", Target: "new.git"}, "old.git", "new.git", true},
+		{RepoAlias{Pattern: "old", Target: "new.git"}, "old.git", "new.git", true},
+		{RepoAlias{Pattern: "old.git", Target: "new.git"}, "older.git", "", false},
+		{RepoAlias{Pattern: "old-org/*", Target: "new-org/*"}, "old-org/repo.git", "new-org/repo.git", true},
+		{RepoAlias{Pattern: "old-org/*", Target: "new-org/*"}, "old-org/team/repo.git", "", false},
+		{RepoAlias{Pattern: "*/legacy-*", Target: "*/*"}, "org/legacy-app", "org/app", true},
+		{RepoAlias{Pattern: "mirror-?", Target: "mirror"}, "mirror-1", "mirror", true},
+		{RepoAlias{Pattern: "fork-*", Target: "upstream.git"}, "fork-a.git", "upstream.git", true},
+	} {
+		target, ok := tc.alias.match(tc.name)
+		assert.Equal(t, tc.ok, ok, "%s for %s", tc.name, tc.alias.Pattern)
+		assert.Equal(t, tc.target, target, "%s for %s", tc.name, tc.alias.Pattern)
+	}
+}
+
+func TestRepoAliases(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		Dir:    dir,
+		KeyDir: filepath.Join(dir, "keys"),
+		Aliases: []RepoAlias{
+			{Pattern: "renamed.git", Target: "repo.git", Redirect: true},
+			{Pattern: "old-org/*", Target: "new-org/*"},
+		},
+	}
+	service := New(config)
+	for _, repo := range []string{"repo.git", "new-org/app.git"} {
+		if _, err := (&FSStore{Dir: dir}).Create(repo); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := service.Commit(repo, "master", Commit{Files: map[string]string{"name": repo}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder := &EventRecorder{}
+	service.OnEvent = recorder.Record
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	// Renamed repositories redirect clients, which warn about it
+	out, err := runGit(dir, "clone", HTTPCloneURL(addr, "renamed.git"), filepath.Join(t.TempDir(), "renamed"))
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "warning: redirecting to "+HTTPCloneURL(addr, "repo.git"))
+
+	out, err = runGit(dir, "clone", HTTPCloneURL(addr, "old-org/app.git"), filepath.Join(t.TempDir(), "moved"))
+	assert.NoError(t, err, out)
+	assert.NotContains(t, out, "redirecting")
+	events := recorder.Events()
+	assert.Equal(t, "new-org/app.git", events[len(events)-1].Repo)
+
+	sshServer := NewSSH(config)
+	sshAddr := startSSH(t, sshServer)
+	for _, repo := range []string{"renamed.git", "old-org/app.git"} {
+		out, err := runGit(dir, "clone", SSHCloneURL("git", sshAddr, repo), filepath.Join(t.TempDir(), "ssh"))
+		assert.NoError(t, err, out)
+	}
+}
@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UserRejection is how SSH.AllowedUsers rejects the connections of other
+// users.
+type UserRejection string
+
+const (
+	// RejectUserAuth fails every authentication attempt of other users
+	// (default), clients reporting "Permission denied (publickey)" like
+	// hosting services do for any user but git.
+	RejectUserAuth UserRejection = ""
+	// RejectUserCommand authenticates other users, rejecting their git
+	// commands with an error clients print.
+	RejectUserCommand UserRejection = "command"
+	// RejectUserDisconnect authenticates other users, closing their
+	// connection right away.
+	RejectUserDisconnect UserRejection = "disconnect"
+)
+
+// userAllowed tells whether SSH.AllowedUsers lets the user in
+func (s *SSH) userAllowed(user string) bool {
+	if len(s.AllowedUsers) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedUsers {
+		if user == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// userError returns the error rejecting the user of a connection
+func userError(conn ssh.ConnMetadata) error {
+	return fmt.Errorf("user %q is not allowed", conn.User())
+}
+
+// checkUser fails the authentication attempts of users left out of
+// SSH.AllowedUsers with RejectUserAuth.
+func (s *SSH) checkUser(conn ssh.ConnMetadata) error {
+	if s.UserRejection != RejectUserAuth || s.userAllowed(conn.User()) {
+		return nil
+	}
+	err := userError(conn)
+	s.emit(conn, Event{Type: AuthFailureEvent, Error: err.Error()})
+	return err
+}
+
+// allowUsers authenticates the clients of servers without Config.Auth but
+// with SSH.AllowedUsers rejected at authentication, whatever key they offer
+// or with no questions asked, as long as their user is allowed. The none
+// method cannot be refused per user, so clients have to offer a key or try
+// keyboard-interactive auth, which ssh skips with BatchMode.
+func (s *SSH) allowUsers(config *ssh.ServerConfig) {
+	config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if err := s.checkUser(conn); err != nil {
+			return nil, err
+		}
+		return &ssh.Permissions{}, nil
+	}
+	config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		if err := s.checkUser(conn); err != nil {
+			return nil, err
+		}
+		return &ssh.Permissions{}, nil
+	}
+}
@@ -0,0 +1,60 @@
+package gitkit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedUsers(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rejection := range []UserRejection{RejectUserAuth, RejectUserCommand, RejectUserDisconnect} {
+		for _, auth := range []bool{false, true} {
+			recorder := &EventRecorder{}
+			server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: auth})
+			server.AllowedUsers = []string{"git"}
+			server.UserRejection = rejection
+			server.OnEvent = recorder.Record
+			server.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+				return &PublicKey{Id: "client"}, nil
+			}
+			assert.NoError(t, server.Validate())
+			addr := startSSH(t, server)
+
+			out, err := runGitWithKey(dir, key, "ls-remote", SSHCloneURL("git", addr, repo))
+			assert.NoError(t, err, out)
+			assert.Contains(t, out, "refs/heads/master")
+
+			out, err = runGitWithKey(dir, key, "ls-remote", SSHCloneURL("alice", addr, repo))
+			assert.Error(t, err, out)
+			switch rejection {
+			case RejectUserAuth:
+				assert.Contains(t, out, "Permission denied", auth)
+			case RejectUserCommand:
+				assert.Contains(t, out, `user "alice" is not allowed`, auth)
+			}
+
+			failures := []string{}
+			for _, event := range recorder.Events() {
+				if event.Type == AuthFailureEvent {
+					failures = append(failures, event.Error)
+				}
+			}
+			assert.Contains(t, failures, `user "alice" is not allowed`)
+		}
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	server.UserRejection = RejectUserCommand
+	assert.Equal(t, ConfigErrors{{Field: "UserRejection", Message: "set without AllowedUsers"}}, server.Validate())
+}
@@ -0,0 +1,216 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// apiPrefix is where the REST API is served, the same as GitHub Enterprise
+// so that GitHub clients can be pointed at the server.
+const apiPrefix = "/api/v3"
+
+// APIRepo describes a hosted repository in the REST API, with the fields of
+// GitHub repository objects.
+type APIRepo struct {
+	Name          string    `json:"name"`      // Last path element, without ".git"
+	FullName      string    `json:"full_name"` // Path without ".git"
+	CloneURL      string    `json:"clone_url"`
+	DefaultBranch string    `json:"default_branch"`
+	UpdatedAt     time.Time `json:"updated_at"` // Date of the newest commit
+}
+
+// serveAPI serves the REST API enabled by Config.API
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		apiError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	route := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	req := &Request{Request: r}
+	rest := ""
+
+	switch {
+	case route == "/repositories":
+	case strings.HasPrefix(route, "/repos/"):
+		var ok bool
+		req.RepoName, req.RepoPath, rest, ok = s.apiRepo(strings.TrimPrefix(route, "/repos/"))
+		if !ok {
+			apiError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+	default:
+		apiError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if !s.authenticate(w, req) {
+		return
+	}
+	if fault := s.faults.get(req.RepoName); fault != nil && fault.delay() {
+		s.config.logError("fault", fmt.Errorf("%s: %s", req.RepoName, fault.message()))
+		writeFault(w, fault)
+		return
+	}
+
+	switch {
+	case route == "/repositories":
+		s.listAPIRepos(w, req)
+	case rest == "":
+		s.getAPIRepo(w, req)
+	case rest == "tags":
+		s.listAPITags(w, req)
+	case rest == "releases" || strings.HasPrefix(rest, "releases/"):
+		s.serveReleases(w, req, rest)
+	case strings.HasPrefix(rest, "raw/"):
+		s.serveRaw(w, req, strings.TrimPrefix(rest, "raw/"))
+	case rest == "commits" || strings.HasPrefix(rest, "commits/"):
+		s.serveCommits(w, req, strings.TrimPrefix(strings.TrimPrefix(rest, "commits"), "/"))
+	case strings.HasPrefix(rest, "compare/"):
+		s.serveCompare(w, req, strings.TrimPrefix(rest, "compare/"))
+	default:
+		apiError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// apiRepo finds the repository addressed by an API path, returning its name,
+// git directory and the rest of the path.
+func (s *Server) apiRepo(route string) (string, string, string, bool) {
+	segments := strings.Split(strings.Trim(route, "/"), "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", "", "", false
+		}
+	}
+
+	store := s.config.repoStore()
+	for i := 1; i <= len(segments); i++ {
+		name := store.Resolve(strings.Join(segments[:i], "/"))
+		if dir, err := store.Open(name); err == nil {
+			return name, dir, strings.Join(segments[i:], "/"), true
+		}
+	}
+	return "", "", "", false
+}
+
+func (s *Server) listAPIRepos(w http.ResponseWriter, r *Request) {
+	store := s.config.repoStore()
+	names, err := store.List()
+	if err != nil {
+		s.apiFail(w, "api", err)
+		return
+	}
+
+	repos := []APIRepo{}
+	for _, name := range names {
+		dir, err := store.Open(name)
+		if err != nil {
+			continue
+		}
+		repos = append(repos, s.apiRepoInfo(r, name, dir))
+	}
+	writeJSON(w, http.StatusOK, repos)
+}
+
+func (s *Server) getAPIRepo(w http.ResponseWriter, r *Request) {
+	writeJSON(w, http.StatusOK, s.apiRepoInfo(r, r.RepoName, r.RepoPath))
+}
+
+func (s *Server) apiRepoInfo(r *Request, name string, dir string) APIRepo {
+	fullName := strings.TrimSuffix(name, ".git")
+	repo := APIRepo{
+		Name:     path.Base(fullName),
+		FullName: fullName,
+		CloneURL: HTTPCloneURL(r.Host, name),
+	}
+	if r.TLS != nil {
+		repo.CloneURL = HTTPSCloneURL(r.Host, name)
+	}
+
+	if head, err := gitOutput(s.config.GitPath, dir, "symbolic-ref", "--short", "HEAD"); err == nil {
+		repo.DefaultBranch = strings.TrimSpace(string(head))
+	}
+
+	// Empty repositories were last updated when created
+	newest, _ := gitOutput(s.config.GitPath, dir, "for-each-ref", "--sort=-committerdate", "--count=1", "--format=%(committerdate:iso-strict)", "refs/heads", "refs/tags")
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(newest))); err == nil {
+		repo.UpdatedAt = t.UTC()
+	} else if info, err := os.Stat(dir); err == nil {
+		repo.UpdatedAt = info.ModTime().UTC().Truncate(time.Second)
+	}
+	return repo
+}
+
+// APITag is a tag in the REST API, with the fields of GitHub tag objects
+type APITag struct {
+	Name   string       `json:"name"`
+	Commit APICommitRef `json:"commit"`
+}
+
+// APICommitRef points to a commit in the REST API
+type APICommitRef struct {
+	SHA string `json:"sha"`
+	URL string `json:"url"`
+}
+
+// listAPITags lists the tags of a repository, newest first
+func (s *Server) listAPITags(w http.ResponseWriter, r *Request) {
+	out, err := gitOutput(s.config.GitPath, r.RepoPath, "for-each-ref", "--sort=-creatordate", "--format=%(refname:strip=2) %(objectname) %(*objectname)", "refs/tags")
+	if err != nil {
+		s.apiFail(w, "api", err)
+		return
+	}
+
+	tags := []APITag{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Annotated tags are peeled to the commit they point to
+		sha := fields[len(fields)-1]
+		tags = append(tags, APITag{
+			Name:   fields[0],
+			Commit: APICommitRef{SHA: sha, URL: apiRepoURL(r) + "/commits/" + sha},
+		})
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// apiRepoURL returns the API URL of the requested repository
+func apiRepoURL(r *Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + apiPrefix + "/repos/" + strings.TrimSuffix(r.RepoName, ".git")
+}
+
+// apiFail logs an error and answers with a 500 JSON error
+func (s *Server) apiFail(w http.ResponseWriter, context string, err error) {
+	s.config.logError(context, err)
+	apiError(w, http.StatusInternalServerError, "Internal Server Error")
+}
+
+// apiError sends a GitHub-style {"message": "..."} error
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeError(w, status, message, &ErrorHints{JSON: true})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
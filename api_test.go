@@ -0,0 +1,373 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getJSON fetches an API URL and decodes the JSON response into v
+func getJSON(t *testing.T, client *http.Client, url string, v interface{}) *http.Response {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp
+}
+
+func TestAPIRepos(t *testing.T) {
+	dir, err := os.MkdirTemp("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("git", "init", "--bare", "--initial-branch=main", filepath.Join(dir, "org", "empty.git")).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+
+	service := New(Config{Dir: dir, API: true})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	repos := []APIRepo{}
+	resp := getJSON(t, server.Client(), server.URL+"/api/v3/repositories", &repos)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Len(t, repos, 2)
+
+	assert.Equal(t, "empty", repos[0].Name)
+	assert.Equal(t, "org/empty", repos[0].FullName)
+	assert.Equal(t, server.URL+"/org/empty.git", repos[0].CloneURL)
+	assert.Equal(t, "main", repos[0].DefaultBranch)
+	assert.WithinDuration(t, time.Now(), repos[0].UpdatedAt, time.Minute)
+
+	assert.Equal(t, strings.TrimSuffix(repo, ".git"), repos[1].Name)
+	assert.Equal(t, server.URL+"/"+repo, repos[1].CloneURL)
+	assert.Equal(t, "master", repos[1].DefaultBranch)
+	assert.False(t, repos[1].UpdatedAt.IsZero())
+
+	single := APIRepo{}
+	resp = getJSON(t, server.Client(), server.URL+"/api/v3/repos/org/empty", &single)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, repos[0], single)
+
+	message := map[string]string{}
+	resp = getJSON(t, server.Client(), server.URL+"/api/v3/repos/org/missing", &message)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, "Not Found", message["message"])
+
+	resp = getJSON(t, server.Client(), server.URL+"/api/v3/repos/org/../"+repo, nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// The API is off by default
+	disabled := httptest.NewServer(New(Config{Dir: dir}))
+	defer disabled.Close()
+	resp = getJSON(t, disabled.Client(), disabled.URL+"/api/v3/repositories", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestAPITagsAndReleases(t *testing.T) {
+	dir, err := os.MkdirTemp("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git := func(args ...string) string {
+		out, err := gitOutput("git", filepath.Join(dir, repo), args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	head := git("rev-parse", "master")
+	git("tag", "v1.0.0", head)
+	git("-c", "user.email=test@gitkit.com", "-c", "user.name=test-user", "tag", "-a", "-m", "release", "v2.0.0", head)
+
+	service := New(Config{Dir: dir, API: true})
+	server := httptest.NewServer(service)
+	defer server.Close()
+	base := server.URL + "/api/v3/repos/" + strings.TrimSuffix(repo, ".git")
+
+	tags := []APITag{}
+	getJSON(t, server.Client(), base+"/tags", &tags)
+	assert.Len(t, tags, 2)
+	for _, tag := range tags {
+		assert.Equal(t, head, tag.Commit.SHA, tag.Name)
+		assert.Equal(t, base+"/commits/"+head, tag.Commit.URL)
+	}
+
+	assert.Error(t, service.AddRelease(repo, Release{Tag: "v3.0.0"}))
+	assert.NoError(t, service.AddRelease(repo, Release{Tag: "v1.0.0", Name: "First"}))
+	assert.NoError(t, service.AddRelease(repo, Release{
+		Tag:        "v2.0.0",
+		Name:       "Second",
+		Prerelease: true,
+		Assets:     []ReleaseAsset{{Name: "manifests.yaml", ContentType: "application/yaml", Data: []byte("kind: List\n")}},
+	}))
+
+	releases := []APIRelease{}
+	getJSON(t, server.Client(), base+"/releases", &releases)
+	assert.Len(t, releases, 2)
+	assert.Equal(t, "v2.0.0", releases[0].TagName)
+	assert.Equal(t, head, releases[0].TargetCommitish)
+	assert.Len(t, releases[0].Assets, 1)
+	assert.Empty(t, releases[1].Assets)
+
+	latest := APIRelease{}
+	getJSON(t, server.Client(), base+"/releases/latest", &latest)
+	assert.Equal(t, "First", latest.Name)
+
+	byTag := APIRelease{}
+	getJSON(t, server.Client(), base+"/releases/tags/v2.0.0", &byTag)
+	assert.Equal(t, releases[0], byTag)
+
+	asset := releases[0].Assets[0]
+	assert.Equal(t, 11, asset.Size)
+	for _, url := range []string{asset.BrowserDownloadURL, asset.URL} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", "application/octet-stream")
+		resp, err := server.Client().Do(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "kind: List\n", string(body))
+	}
+
+	assert.NoError(t, service.RemoveRelease(repo, "v2.0.0"))
+	resp := getJSON(t, server.Client(), asset.BrowserDownloadURL, nil)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestAPIRaw(t *testing.T) {
+	dir, err := os.MkdirTemp("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if out, err := exec.Command("git", "init", "--bare", filepath.Join(dir, "repo.git")).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+
+	service := New(Config{Dir: dir, API: true})
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	if _, err := service.Commit("repo.git", "feature/raw", Commit{Files: map[string]string{
+		"deploy/app.json": `{"kind": "Deployment"}`,
+		"logo":            png,
+		"README":          "hello\n",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	base := server.URL + "/api/v3/repos/repo/raw/feature/raw/"
+
+	examples := []struct {
+		file        string
+		contentType string
+		body        string
+	}{
+		{"deploy/app.json", "application/json", `{"kind": "Deployment"}`},
+		{"logo", "image/png", png},
+		{"README", "text/plain; charset=utf-8", "hello\n"},
+	}
+	for _, example := range examples {
+		resp, err := server.Client().Get(base + example.file)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, 200, resp.StatusCode, example.file)
+		assert.Equal(t, example.contentType, resp.Header.Get("Content-Type"), example.file)
+		assert.Equal(t, example.body, string(body), example.file)
+	}
+
+	for _, missing := range []string{"deploy", "missing.txt", "../README"} {
+		resp := getJSON(t, server.Client(), base+missing, nil)
+		assert.Equal(t, 404, resp.StatusCode, missing)
+	}
+	resp := getJSON(t, server.Client(), server.URL+"/api/v3/repos/repo/raw/unknown/README", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestAPICompare(t *testing.T) {
+	dir, err := os.MkdirTemp("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if out, err := exec.Command("git", "init", "--bare", filepath.Join(dir, "repo.git")).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+
+	service := New(Config{Dir: dir, API: true})
+	base, err := service.Commit("repo.git", "main", Commit{Files: map[string]string{
+		"a.txt":   "one\ntwo\nthree\n",
+		"old.txt": "a file that is going to be renamed\n",
+		"gone":    "bye\n",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitOutput("git", filepath.Join(dir, "repo.git"), "branch", "feature", base); err != nil {
+		t.Fatal(err)
+	}
+	head, err := service.Commit("repo.git", "feature", Commit{
+		Message: "Change files",
+		Files: map[string]string{
+			"a.txt":   "one\n2\nthree\nfour\n",
+			"new.txt": "a file that is going to be renamed\n",
+			"added":   "hello\n",
+		},
+		Remove: []string{"old.txt", "gone"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Commit("repo.git", "main", Commit{Files: map[string]string{"main.txt": "main\n"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	url := server.URL + "/api/v3/repos/repo/compare/main...feature"
+
+	comparison := APIComparison{}
+	getJSON(t, server.Client(), url, &comparison)
+	assert.Equal(t, "diverged", comparison.Status)
+	assert.Equal(t, 1, comparison.AheadBy)
+	assert.Equal(t, 1, comparison.BehindBy)
+	assert.Equal(t, base, comparison.MergeBase.SHA)
+	assert.Len(t, comparison.Commits, 1)
+	assert.Equal(t, head, comparison.Commits[0].SHA)
+	assert.Equal(t, "Change files", comparison.Commits[0].Commit.Message)
+
+	files := map[string]APIFileDiff{}
+	for _, file := range comparison.Files {
+		files[file.Filename] = file
+	}
+	assert.Len(t, files, 4)
+	assert.Equal(t, "added", files["added"].Status)
+	assert.Equal(t, "removed", files["gone"].Status)
+	assert.Equal(t, "renamed", files["new.txt"].Status)
+	assert.Equal(t, "old.txt", files["new.txt"].PreviousFilename)
+	assert.Equal(t, "modified", files["a.txt"].Status)
+	assert.Equal(t, 2, files["a.txt"].Additions)
+	assert.Equal(t, 1, files["a.txt"].Deletions)
+	assert.True(t, strings.HasPrefix(files["a.txt"].Patch, "@@ "), files["a.txt"].Patch)
+	assert.Contains(t, files["a.txt"].Patch, "+four")
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "application/vnd.github.diff")
+	resp, err := server.Client().Do(req)
+	assert.NoError(t, err)
+	diff, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(diff), "diff --git a/a.txt b/a.txt")
+	assert.NotContains(t, string(diff), "main.txt")
+
+	identical := APIComparison{}
+	getJSON(t, server.Client(), server.URL+"/api/v3/repos/repo/compare/feature...feature", &identical)
+	assert.Equal(t, "identical", identical.Status)
+	assert.Empty(t, identical.Files)
+
+	resp = getJSON(t, server.Client(), server.URL+"/api/v3/repos/repo/compare/main...missing", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestAPICommits(t *testing.T) {
+	dir, err := os.MkdirTemp("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if out, err := exec.Command("git", "init", "--bare", "--initial-branch=main", filepath.Join(dir, "repo.git")).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+
+	service := New(Config{Dir: dir, API: true})
+	server := httptest.NewServer(service)
+	defer server.Close()
+	base := server.URL + "/api/v3/repos/repo/commits"
+
+	resp := getJSON(t, server.Client(), base, nil)
+	assert.Equal(t, 409, resp.StatusCode)
+
+	revs := []string{}
+	for i := 0; i < 5; i++ {
+		rev, err := service.Commit("repo.git", "main", Commit{
+			Message:     fmt.Sprintf("Commit %d", i),
+			AuthorName:  "Jane",
+			AuthorEmail: "jane@example.com",
+			Files:       map[string]string{"file": strconv.Itoa(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs = append([]string{rev}, revs...)
+	}
+
+	commits := []APICommit{}
+	resp = getJSON(t, server.Client(), base+"?per_page=2", &commits)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Len(t, commits, 2)
+	assert.Equal(t, revs[0], commits[0].SHA)
+	assert.Equal(t, "Commit 4", commits[0].Commit.Message)
+	assert.Equal(t, "Jane", commits[0].Commit.Author.Name)
+	assert.Equal(t, "jane@example.com", commits[0].Commit.Author.Email)
+	assert.False(t, commits[0].Commit.Author.Date.IsZero())
+	assert.Equal(t,
+		`<`+base+`?page=2&per_page=2>; rel="next", <`+base+`?page=3&per_page=2>; rel="last"`,
+		resp.Header.Get("Link"))
+
+	resp = getJSON(t, server.Client(), base+"?sha=main&per_page=2&page=3", &commits)
+	assert.Len(t, commits, 1)
+	assert.Equal(t, revs[4], commits[0].SHA)
+	assert.Equal(t,
+		`<`+base+`?page=1&per_page=2&sha=main>; rel="first", <`+base+`?page=2&per_page=2&sha=main>; rel="prev"`,
+		resp.Header.Get("Link"))
+
+	resp = getJSON(t, server.Client(), base, &commits)
+	assert.Len(t, commits, 5)
+	assert.Empty(t, resp.Header.Get("Link"))
+
+	commit := APICommit{}
+	getJSON(t, server.Client(), base+"/"+revs[4], &commit)
+	assert.Equal(t, "Commit 0", commit.Commit.Message)
+	assert.Len(t, commit.Files, 1)
+	assert.Equal(t, "added", commit.Files[0].Status)
+
+	resp = getJSON(t, server.Client(), base+"?sha=missing", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+}
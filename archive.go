@@ -0,0 +1,194 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ArchiveStorage keeps repository archives, in git bundle format, outside of
+// the server so fixtures can be shared instead of regenerated.
+type ArchiveStorage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+}
+
+// DirStorage stores archives as files in a directory, e.g. a cache shared by
+// CI runners.
+type DirStorage struct {
+	Dir string
+}
+
+func (d *DirStorage) Put(key string, r io.Reader) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *DirStorage) Get(key string) (io.ReadCloser, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// path returns the file of a key, rejecting keys outside of the directory
+func (d *DirStorage) path(key string) (string, error) {
+	clean := path.Clean(filepath.ToSlash(key))
+	if path.IsAbs(clean) || filepath.IsAbs(key) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid archive key %q", key)
+	}
+	return filepath.Join(d.Dir, filepath.FromSlash(clean)), nil
+}
+
+// ExportArchive bundles all refs of a hosted repository and stores the
+// bundle under key.
+func (c *controls) ExportArchive(repo string, storage ArchiveStorage, key string) error {
+	return c.repoOps().exportArchive(repo, storage, key)
+}
+
+// RestoreArchive creates a hosted repository from a bundle stored under key
+// by ExportArchive. The repository must not exist yet.
+func (c *controls) RestoreArchive(repo string, storage ArchiveStorage, key string) error {
+	return c.repoOps().restoreArchive(repo, storage, key)
+}
+
+func (o repoOps) exportArchive(repo string, storage ArchiveStorage, key string) error {
+	dir, err := o.repoPath(repo)
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(o.config.GitPath, "bundle", "create", "-", "--all")
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git bundle create failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return storage.Put(key, &stdout)
+}
+
+func (o repoOps) restoreArchive(repo string, storage ArchiveStorage, key string) (err error) {
+	store := o.store()
+	if _, err := store.Open(repo); err != ErrRepoNotFound {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", repo)
+		}
+		return err
+	}
+
+	bundle, release, err := o.downloadArchive(storage, key)
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+
+	heads, err := o.git("", nil, "", "bundle", "list-heads", bundle)
+	if err != nil {
+		return err
+	}
+
+	dir, err := store.Create(repo)
+	if err != nil {
+		return err
+	}
+	if _, err := o.git(dir, nil, "", "fetch", "--quiet", bundle, "+refs/*:refs/*"); err != nil {
+		return err
+	}
+	if head := bundleHead(heads); head != "" {
+		if _, err := o.git(dir, nil, "", "symbolic-ref", "HEAD", head); err != nil {
+			return err
+		}
+	}
+	updateServerInfo(o.config, dir)
+
+	o.emit(Event{Type: PushEvent, Transport: LocalTransport, Repo: repo, Refs: pushedRefs(o.config, dir, map[string]string{})})
+	return nil
+}
+
+// downloadArchive copies an archive to a temporary file, since git only reads
+// bundles from files.
+func (o repoOps) downloadArchive(storage ArchiveStorage, key string) (string, func(*error), error) {
+	r, err := storage.Get(key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	f, release, err := o.createTemp("gitkit-bundle")
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		release(&err)
+		return "", nil, err
+	}
+	return f.Name(), release, nil
+}
+
+// bundleHead returns the branch HEAD pointed to when the bundle was created,
+// from the output of git bundle list-heads. Bundles only record the revision
+// of HEAD, so main and master win over other branches at the same revision.
+func bundleHead(heads string) string {
+	refs := map[string]string{}
+	for _, line := range strings.Split(heads, "\n") {
+		chunks := strings.Fields(line)
+		if len(chunks) == 2 {
+			refs[chunks[1]] = chunks[0]
+		}
+	}
+
+	head, ok := refs["HEAD"]
+	if !ok {
+		return ""
+	}
+
+	branches := []string{}
+	for ref, rev := range refs {
+		if rev == head && strings.HasPrefix(ref, "refs/heads/") {
+			branches = append(branches, ref)
+		}
+	}
+	sort.Strings(branches)
+
+	for _, preferred := range []string{"refs/heads/main", "refs/heads/master"} {
+		for _, branch := range branches {
+			if branch == preferred {
+				return branch
+			}
+		}
+	}
+	if len(branches) > 0 {
+		return branches[0]
+	}
+	return ""
+}
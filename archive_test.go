@@ -0,0 +1,116 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal object storage keeping objects in memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.EscapedPath()] = body
+	case "GET":
+		body, ok := f.objects[r.URL.EscapedPath()]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}
+}
+
+func TestArchives(t *testing.T) {
+	dir, err := os.MkdirTemp("", "archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	bucket := httptest.NewServer(s3)
+	defer bucket.Close()
+
+	storages := map[string]ArchiveStorage{
+		"dir": &DirStorage{Dir: filepath.Join(dir, "archives")},
+		"s3":  &S3Storage{Endpoint: bucket.URL, Bucket: "fixtures", Prefix: "ci/", AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	}
+
+	server := New(Config{Dir: dir})
+	for name, storage := range storages {
+		key := "my repo!.bundle"
+		assert.NoError(t, server.ExportArchive(repo, storage, key), name)
+
+		restored := "restored-" + name + ".git"
+		assert.NoError(t, server.RestoreArchive(restored, storage, key), name)
+		assert.Error(t, server.RestoreArchive(restored, storage, key), name)
+
+		before, err := listRefs("git", filepath.Join(dir, repo))
+		assert.NoError(t, err)
+		after, err := listRefs("git", filepath.Join(dir, restored))
+		assert.NoError(t, err)
+		assert.Equal(t, before, after, name)
+
+		head, err := gitOutput("git", filepath.Join(dir, restored), "symbolic-ref", "HEAD")
+		assert.NoError(t, err)
+		assert.Equal(t, "refs/heads/master", strings.TrimSpace(string(head)))
+
+		assert.Error(t, server.RestoreArchive("missing.git", storage, "missing.bundle"), name)
+	}
+
+	assert.Contains(t, s3.objects, "/fixtures/ci/my%20repo%21.bundle")
+}
+
+func TestDirStorageKeys(t *testing.T) {
+	dir := t.TempDir()
+	storage := &DirStorage{Dir: filepath.Join(dir, "archives")}
+
+	assert.NoError(t, storage.Put("ci/../repo.bundle", strings.NewReader("bundle")))
+	assert.FileExists(t, filepath.Join(dir, "archives", "repo.bundle"))
+
+	for _, key := range []string{"../escaped.bundle", "ci/../../escaped.bundle", "/tmp/escaped.bundle", ".", ""} {
+		assert.Error(t, storage.Put(key, strings.NewReader("bundle")), key)
+		_, err := storage.Get(key)
+		assert.Error(t, err, key)
+	}
+	assert.NoFileExists(t, filepath.Join(dir, "escaped.bundle"))
+}
+
+func TestBundleHead(t *testing.T) {
+	heads := "aaa HEAD\nbbb refs/heads/feature\naaa refs/heads/dev\naaa refs/heads/main\n"
+	assert.Equal(t, "refs/heads/main", bundleHead(heads))
+	assert.Equal(t, "refs/heads/dev", bundleHead("aaa HEAD\naaa refs/heads/dev\n"))
+	assert.Equal(t, "", bundleHead("aaa refs/heads/dev\n"))
+}
@@ -0,0 +1,97 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// authCache remembers AuthFunc decisions for a credential and repository
+// until they expire.
+type authCache struct {
+	mu      sync.Mutex
+	entries map[string]authDecision
+}
+
+type authDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// authCacheKey identifies the decisions for a credential and repository
+func authCacheKey(cred Credential, repo string) string {
+	id := cred.Authorization
+	if cred.Certificate != nil {
+		id = "certificate " + hex.EncodeToString(cred.Certificate.Raw)
+	}
+	sum := sha256.Sum256([]byte(id + "\x00" + repo))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *authCache) get(key string, now time.Time) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	decision, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+
+	if now.After(decision.expires) {
+		delete(c.entries, key)
+		return false, false
+	}
+	return decision.allow, true
+}
+
+func (c *authCache) put(key string, allow bool, now time.Time, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]authDecision{}
+	}
+
+	// Drop expired decisions while we're at it
+	for k, decision := range c.entries {
+		if decision.expires.Before(now) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = authDecision{allow: allow, expires: expires}
+}
+
+func (c *authCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// authorize runs the auth function, going through the decision cache when
+// Config.AuthCacheTTL is set. Errors are never cached, nor are Digest
+// credentials: their headers change with every request, and only the auth
+// function checks their response.
+func (s *Server) authorize(authFunc func(Credential, *Request) (bool, error), cred Credential, req *Request) (bool, error) {
+	ttl := s.config.AuthCacheTTL
+	if ttl <= 0 || cred.Digest != nil {
+		return authFunc(cred, req)
+	}
+
+	key := authCacheKey(cred, req.RepoName)
+	if allow, ok := s.authCache.get(key, s.clock.now()); ok {
+		return allow, nil
+	}
+
+	allow, err := authFunc(cred, req)
+	if err == nil {
+		now := s.clock.now()
+		s.authCache.put(key, allow, now, now.Add(ttl))
+	}
+	return allow, err
+}
+
+// FlushAuthCache forgets all cached authentication decisions
+func (s *Server) FlushAuthCache() {
+	s.authCache.flush()
+}
@@ -0,0 +1,104 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAuthCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "auth-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ttl := range []time.Duration{0, time.Hour} {
+		calls := 0
+		service := New(Config{Dir: dir, Auth: true, AuthCacheTTL: ttl})
+		service.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			calls++
+			return cred.Password == "secret", nil
+		}
+		server := httptest.NewServer(service)
+
+		get := func(password string) int {
+			req, _ := http.NewRequest("GET", server.URL+"/"+repo+"/info/refs?service=git-upload-pack", nil)
+			req.SetBasicAuth("alice", password)
+			resp, err := server.Client().Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, 200, get("secret"))
+		assert.Equal(t, 200, get("secret"))
+		assert.Equal(t, 401, get("wrong"))
+		assert.Equal(t, 401, get("wrong"))
+
+		if ttl == 0 {
+			assert.Equal(t, 4, calls)
+		} else {
+			assert.Equal(t, 2, calls)
+
+			service.FlushAuthCache()
+			assert.Equal(t, 200, get("secret"))
+			assert.Equal(t, 3, calls)
+		}
+
+		server.Close()
+	}
+}
+
+func TestServerAuthCacheDigest(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	service := New(Config{Dir: dir, Auth: true, AuthCacheTTL: time.Hour})
+	service.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		calls++
+		return cred.Digest["response"] == "right", nil
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	get := func(user string, nc int, response string) int {
+		req, _ := http.NewRequest("GET", server.URL+"/"+repo+"/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Authorization", fmt.Sprintf(`Digest username="%s", realm="gitkit", nonce="abc", uri="/", nc=%08x, cnonce="%d", qop=auth, response="%s"`, user, nc, nc, response))
+		resp, err := server.Client().Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Every Digest request is checked, a right response letting no other in
+	assert.Equal(t, 401, get("alice", 1, "wrong"))
+	assert.Equal(t, 200, get("alice", 2, "right"))
+	assert.Equal(t, 401, get("alice", 3, "other"))
+	assert.Equal(t, 200, get("alice", 4, "right"))
+	assert.Equal(t, 4, calls)
+}
+
+func TestAuthCachePrune(t *testing.T) {
+	now := time.Now()
+	cache := authCache{}
+	cache.put("expired", true, now, now.Add(time.Minute))
+	cache.put("current", true, now.Add(time.Hour), now.Add(2*time.Hour))
+	assert.Len(t, cache.entries, 1)
+	_, ok := cache.get("current", now.Add(time.Hour))
+	assert.True(t, ok)
+}
@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Operation is what a git command does to a repository
+type Operation string
+
+const (
+	ReadOperation  Operation = "read"  // upload-pack and upload-archive
+	WriteOperation Operation = "write" // receive-pack
+)
+
+// Identity is the authenticated client of an SSH connection
+type Identity struct {
+	User       string
+	KeyID      string // ID of the key or keyboard-interactive login, if any
+	KeyName    string
+	RemoteAddr string
+}
+
+// commandOperation returns the operation of a git command
+func commandOperation(command string) Operation {
+	if strings.HasSuffix(command, "receive-pack") {
+		return WriteOperation
+	}
+	return ReadOperation
+}
+
+// authorize checks that the client of the connection may run the command:
+// that its user is among SSH.AllowedUsers, and with SSH.AuthorizeFunc.
+func (s *SSH) authorize(conn *ssh.ServerConn, keyID string, gitcmd *GitCommand) error {
+	if !s.userAllowed(conn.User()) {
+		return userError(conn)
+	}
+	if s.AuthorizeFunc == nil {
+		return nil
+	}
+
+	identity := Identity{User: conn.User(), KeyID: keyID, RemoteAddr: conn.RemoteAddr().String()}
+	if conn.Permissions != nil {
+		identity.KeyName = conn.Permissions.Extensions["key-name"]
+	}
+	return s.AuthorizeFunc(identity, gitcmd.Repo, commandOperation(gitcmd.Command))
+}
@@ -0,0 +1,82 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizeFunc(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deploy, deployPub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, adminPub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{}
+	for id, content := range map[string]string{"deploy": deployPub, "admin": adminPub} {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[ssh.FingerprintSHA256(pub)] = id
+	}
+
+	identities := make(chan Identity, 10)
+	recorder := &EventRecorder{}
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	server.OnEvent = recorder.Record
+	server.PublicKeyLookupContextFunc = func(_ context.Context, lookup PublicKeyLookup) (*PublicKey, error) {
+		id, ok := keys[lookup.Fingerprint]
+		if !ok {
+			return nil, fmt.Errorf("unknown key")
+		}
+		return &PublicKey{Id: id, Name: id + "@example.com"}, nil
+	}
+	server.AuthorizeFunc = func(identity Identity, repo string, op Operation) error {
+		identities <- identity
+		if identity.KeyID == "deploy" && op == WriteOperation {
+			return fmt.Errorf("deploy keys are read-only")
+		}
+		return nil
+	}
+	url := SSHCloneURL("git", startSSH(t, server), repo)
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err := runGitWithKey(dir, deploy, "clone", url, clone)
+	assert.NoError(t, err, out)
+	identity := <-identities
+	assert.Equal(t, "deploy", identity.KeyID)
+	assert.Equal(t, "deploy@example.com", identity.KeyName)
+	assert.Equal(t, "git", identity.User)
+
+	commitFile(t, clone, "file")
+	out, err = runGitWithKey(clone, deploy, "push", "origin", "master")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "deploy keys are read-only")
+	<-identities
+	out, err = runGitWithKey(clone, admin, "push", "origin", "master")
+	assert.NoError(t, err, out)
+
+	denied := 0
+	for _, event := range recorder.Events() {
+		if event.Type == AuthFailureEvent {
+			denied++
+			assert.Equal(t, "deploy", event.KeyID)
+			assert.Equal(t, repo, event.Repo)
+		}
+	}
+	assert.Equal(t, 1, denied)
+}
@@ -0,0 +1,245 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKeysFile authenticates the public keys listed in an OpenSSH
+// authorized_keys file, reloading it whenever it changes. Use its
+// LookupPublicKeyContext method as SSH.PublicKeyLookupContextFunc, or its
+// LookupPublicKey method as SSH.PublicKeyLookupFunc.
+//
+// Keys are named after their comment. Their options are returned in
+// PublicKey.Options, e.g. for callers to read key identifiers from command=
+// options like git hosting shells do. Keys past their expiry-time option are
+// rejected, and cert-authority lines are ignored. Keys with a from= option
+// are only accepted from matching client addresses, which LookupPublicKey
+// does not know, so it rejects them. restrict and the no-* options are
+// accepted since gitkit offers no forwarding, terminals or user rc files;
+// keys with any other option are rejected rather than served unrestricted.
+type AuthorizedKeysFile struct {
+	Path string
+
+	// Now returns the time expiry-time options are checked against,
+	// time.Now if nil. Set it to SSH.Now for SSH.SetClockSkew to apply.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[string]authorizedKey // Keys by authorized_keys content
+}
+
+type authorizedKey struct {
+	PublicKey
+	expiry time.Time // Zero without expiry-time option
+	from   []string  // Patterns of the from= option
+	err    error     // Why the key is rejected, e.g. an unsupported option
+}
+
+// authorizedKeyOptions are the options accepted besides those parsed: they
+// only restrict features gitkit does not offer, or lift those restrictions.
+var authorizedKeyOptions = map[string]bool{
+	"command":             true,
+	"restrict":            true,
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-x11-forwarding":   true,
+	"agent-forwarding":    true,
+	"port-forwarding":     true,
+	"pty":                 true,
+	"user-rc":             true,
+	"x11-forwarding":      true,
+	"permitopen":          true,
+	"permitlisten":        true,
+}
+
+// NewAuthorizedKeysFile reads keys from the authorized_keys file at path
+func NewAuthorizedKeysFile(path string) *AuthorizedKeysFile {
+	return &AuthorizedKeysFile{Path: path}
+}
+
+// LookupPublicKey finds a public key in the file, see SSH.PublicKeyLookupFunc.
+// Keys with a from= option are rejected.
+func (f *AuthorizedKeysFile) LookupPublicKey(content string) (*PublicKey, error) {
+	return f.lookup(content, "")
+}
+
+// LookupPublicKeyContext finds a public key in the file, checking its from=
+// option against the remote address, see SSH.PublicKeyLookupContextFunc
+func (f *AuthorizedKeysFile) LookupPublicKeyContext(_ context.Context, lookup PublicKeyLookup) (*PublicKey, error) {
+	return f.lookup(lookup.AuthorizedKey, lookup.RemoteAddr)
+}
+
+func (f *AuthorizedKeysFile) lookup(content, remoteAddr string) (*PublicKey, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	content = marshalPublicKey(pub)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	key, ok := f.keys[content]
+	if !ok {
+		return nil, fmt.Errorf("unknown public key")
+	}
+	if key.err != nil {
+		return nil, key.err
+	}
+	now := time.Now
+	if f.Now != nil {
+		now = f.Now
+	}
+	if !key.expiry.IsZero() && now().After(key.expiry) {
+		return nil, fmt.Errorf("public key %s expired on %s", key.Fingerprint, key.expiry.Format(time.RFC3339))
+	}
+	if key.from != nil && !matchFrom(key.from, remoteAddr) {
+		if remoteAddr == "" {
+			return nil, fmt.Errorf("public key %s has a from= option, which needs the remote address of LookupPublicKeyContext", key.Fingerprint)
+		}
+		return nil, fmt.Errorf("public key %s is not allowed from %s", key.Fingerprint, remoteAddr)
+	}
+
+	found := key.PublicKey
+	found.Options = append([]string{}, key.Options...)
+	return &found, nil
+}
+
+// reload parses the file again if it changed since it was last read
+func (f *AuthorizedKeysFile) reload() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	if f.keys != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+
+	f.keys = keys
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return nil
+}
+
+func parseAuthorizedKeys(data []byte) (map[string]authorizedKey, error) {
+	keys := map[string]authorizedKey{}
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		pub, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		fingerprint := ssh.FingerprintSHA256(pub)
+		key := authorizedKey{PublicKey: PublicKey{
+			Id:          fingerprint,
+			Name:        comment,
+			Fingerprint: fingerprint,
+			Content:     marshalPublicKey(pub),
+			Options:     options,
+		}}
+
+		skip := false
+		for _, option := range options {
+			name, value := option, ""
+			if i := strings.Index(option, "="); i >= 0 {
+				name, value = option[:i], strings.Trim(option[i+1:], `"`)
+			}
+
+			switch name = strings.ToLower(name); name {
+			case "cert-authority":
+				skip = true
+			case "expiry-time":
+				if key.expiry, err = parseExpiryTime(value); err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+			case "from":
+				key.from = strings.Split(value, ",")
+			default:
+				if !authorizedKeyOptions[name] && key.err == nil {
+					key.err = fmt.Errorf("public key %s has unsupported option %s", fingerprint, name)
+				}
+			}
+		}
+		if !skip {
+			keys[key.Content] = key
+		}
+	}
+	return keys, nil
+}
+
+// parseExpiryTime parses the YYYYMMDD[HHMM[SS]] local times of expiry-time
+// options
+func parseExpiryTime(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			return time.ParseInLocation(layout, value, time.Local)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
+
+// matchFrom reports whether the host of remoteAddr matches the patterns of a
+// from= option: addresses with * and ? wildcards or CIDR ranges, negated by a
+// leading !. Host names are not resolved, so only address patterns match.
+func matchFrom(patterns []string, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			ok = network.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, ip.String())
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
@@ -0,0 +1,105 @@
+package gitkit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "authorized-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, alicePub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, bobPub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePub = strings.TrimSpace(alicePub)
+	bobPub = strings.TrimSpace(bobPub)
+
+	path := filepath.Join(dir, "authorized_keys")
+	write := func(lines ...string) {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# deploy keys", `no-pty,command="gitkit-shell key-1" `+alicePub+" alice@example.com")
+
+	keys := NewAuthorizedKeysFile(path)
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	server.PublicKeyLookupFunc = keys.LookupPublicKey
+	addr := startSSH(t, server)
+	url := SSHCloneURL("git", addr, repo)
+
+	key, err := keys.LookupPublicKey(alicePub)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", key.Name)
+	assert.Equal(t, []string{"no-pty", `command="gitkit-shell key-1"`}, key.Options)
+
+	out, err := runGitWithKey(dir, alice, "ls-remote", url)
+	assert.NoError(t, err, out)
+	out, err = runGitWithKey(dir, bob, "ls-remote", url)
+	assert.Error(t, err, out)
+
+	// Changes are picked up without restarting the server
+	write(bobPub+" bob", `expiry-time="20200101" `+alicePub+" alice@example.com")
+	out, err = runGitWithKey(dir, bob, "ls-remote", url)
+	assert.NoError(t, err, out)
+	_, err = keys.LookupPublicKey(alicePub)
+	assert.Error(t, err)
+	out, err = runGitWithKey(dir, alice, "ls-remote", url)
+	assert.Error(t, err, out)
+
+	write(`cert-authority ` + alicePub)
+	_, err = keys.LookupPublicKey(alicePub)
+	assert.Error(t, err)
+
+	// from= is checked against the client address, and expiry follows the
+	// server clock
+	server = NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	keys = NewAuthorizedKeysFile(path)
+	keys.Now = server.Now
+	server.PublicKeyLookupContextFunc = keys.LookupPublicKeyContext
+	url = SSHCloneURL("git", startSSH(t, server), repo)
+	write(`restrict,from="127.0.0.0/8,!10.*" `+alicePub, `from="10.*" `+bobPub)
+	out, err = runGitWithKey(dir, alice, "ls-remote", url)
+	assert.NoError(t, err, out)
+	out, err = runGitWithKey(dir, bob, "ls-remote", url)
+	assert.Error(t, err, out)
+	_, err = keys.LookupPublicKey(alicePub)
+	assert.Error(t, err)
+
+	write(`environment="GIT_DIR=/" ` + alicePub)
+	_, err = keys.LookupPublicKeyContext(context.Background(), PublicKeyLookup{AuthorizedKey: alicePub, RemoteAddr: "127.0.0.1:22"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported option environment")
+	}
+
+	write(`expiry-time="` + time.Now().Add(time.Hour).Format("200601021504") + `" ` + alicePub)
+	out, err = runGitWithKey(dir, alice, "ls-remote", url)
+	assert.NoError(t, err, out)
+	server.SetClockSkew(2 * time.Hour)
+	out, err = runGitWithKey(dir, alice, "ls-remote", url)
+	assert.Error(t, err, out)
+
+	write("not a key")
+	_, err = keys.LookupPublicKey(bobPub)
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package gitkit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// throttledConn limits the bytes per second read and written through a
+// connection, in each direction, like a slow link.
+type throttledConn struct {
+	net.Conn
+	read  pacer
+	write pacer
+}
+
+func throttle(conn net.Conn, rate int64) net.Conn {
+	return &throttledConn{Conn: conn, read: pacer{rate: rate}, write: pacer{rate: rate}}
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p[:c.read.chunk(len(p))])
+	c.read.wait(n)
+	return n, err
+}
+
+// Write sends p in chunks of a twentieth of a second of bandwidth, so that
+// data flows steadily rather than in bursts.
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := c.write.chunk(len(p) - written)
+		c.write.wait(n)
+		n, err := c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// pacer schedules transfers at a rate in bytes per second
+type pacer struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // When the next byte may be transferred
+}
+
+// chunk returns how many of n bytes to transfer at once
+func (p *pacer) chunk(n int) int {
+	max := int(p.rate / 20)
+	if max < 1 {
+		max = 1
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// wait blocks until n bytes may be transferred, and schedules the next
+// transfer after them.
+func (p *pacer) wait(n int) {
+	if n <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	start := p.next
+	p.next = p.next.Add(time.Duration(int64(n) * int64(time.Second) / p.rate))
+	p.mu.Unlock()
+
+	time.Sleep(time.Until(start))
+}
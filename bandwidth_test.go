@@ -0,0 +1,42 @@
+package gitkit
+
+import (
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHBandwidth(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Random content does not compress
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{Dir: dir}).Commit(repo, "master", Commit{Files: map[string]string{"random": string(content)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	clone := func(bandwidth int64) time.Duration {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), SSHBandwidth: bandwidth})
+		url := SSHCloneURL("git", startSSH(t, server), repo)
+
+		start := time.Now()
+		out, err := runGit(dir, "clone", url, filepath.Join(t.TempDir(), "clone"))
+		assert.NoError(t, err, out)
+		return time.Since(start)
+	}
+
+	unlimited := clone(0)
+	throttled := clone(32 * 1024)
+	assert.True(t, throttled > 2*time.Second, "64KiB cloned at 32KiB/s in %s", throttled)
+	assert.True(t, throttled > unlimited+time.Second, "throttled clone took %s, unlimited %s", throttled, unlimited)
+}
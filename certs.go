@@ -0,0 +1,251 @@
+package gitkit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// CertificateAuthority issues certificates for TLS servers and clients in
+// tests. Clients trust it with CertPool, or CertificatePEM written to the
+// file git reads from GIT_SSL_CAINFO.
+//
+// The authority is also an http.Handler answering OCSP requests and serving
+// its CRL, for clients checking revocation. Set OCSPServer and
+// CRLDistributionPoint to its URL for issued certificates to point to it.
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+	// OCSPServer is the OCSP responder URL of issued certificates
+	OCSPServer string
+	// CRLDistributionPoint is the CRL URL of issued certificates
+	CRLDistributionPoint string
+
+	key     *ecdsa.PrivateKey
+	mu      sync.Mutex
+	serial  int64
+	revoked map[string]time.Time // Revocation times by serial number
+	crls    int64
+}
+
+// CertificateOptions describe a certificate issued by a CertificateAuthority
+type CertificateOptions struct {
+	CommonName string
+	// Hosts are the DNS names and IP addresses the certificate is valid for
+	Hosts []string
+	// NotBefore defaults to an hour ago
+	NotBefore time.Time
+	// NotAfter defaults to a day after NotBefore
+	NotAfter time.Time
+	// Client issues a client certificate instead of a server one
+	Client bool
+}
+
+// NewCertificateAuthority creates a self-signed certificate authority
+func NewCertificateAuthority() (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gitkit test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{Certificate: cert, key: key, serial: 1}, nil
+}
+
+// Issue creates a certificate signed by the authority, with its Leaf set
+func (ca *CertificateAuthority) Issue(options CertificateOptions) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	notBefore := options.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now().Add(-time.Hour)
+	}
+	notAfter := options.NotAfter
+	if notAfter.IsZero() {
+		notAfter = notBefore.Add(24 * time.Hour)
+	}
+
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: options.CommonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if options.Client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	if ca.OCSPServer != "" {
+		template.OCSPServer = []string{ca.OCSPServer}
+	}
+	if ca.CRLDistributionPoint != "" {
+		template.CRLDistributionPoints = []string{ca.CRLDistributionPoint}
+	}
+	for _, host := range options.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// CertPool returns a pool trusting the authority
+func (ca *CertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// CertificatePEM returns the PEM encoded certificate of the authority
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// Revoke revokes the certificate, which is then reported as revoked in OCSP
+// responses and the CRL of the authority.
+func (ca *CertificateAuthority) Revoke(cert *x509.Certificate) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.revoked == nil {
+		ca.revoked = map[string]time.Time{}
+	}
+	ca.revoked[cert.SerialNumber.String()] = time.Now()
+}
+
+// revocation returns the revocation time of a certificate, zero if it is not
+// revoked.
+func (ca *CertificateAuthority) revocation(serial *big.Int) time.Time {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.revoked[serial.String()]
+}
+
+// OCSPResponse returns a signed OCSP response with the current status of the
+// certificate, valid for an hour.
+func (ca *CertificateAuthority) OCSPResponse(cert *x509.Certificate) ([]byte, error) {
+	return ca.ocspResponse(cert.SerialNumber)
+}
+
+func (ca *CertificateAuthority) ocspResponse(serial *big.Int) ([]byte, error) {
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serial,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if revokedAt := ca.revocation(serial); !revokedAt.IsZero() {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = revokedAt
+		template.RevocationReason = ocsp.KeyCompromise
+	}
+	return ocsp.CreateResponse(ca.Certificate, ca.Certificate, template, ca.key)
+}
+
+// CRL returns the DER encoded list of the certificates revoked by the
+// authority, valid for an hour.
+func (ca *CertificateAuthority) CRL() ([]byte, error) {
+	ca.mu.Lock()
+	ca.crls++
+	number := ca.crls
+	revoked := []pkix.RevokedCertificate{}
+	for serial, revokedAt := range ca.revoked {
+		serialNumber, _ := new(big.Int).SetString(serial, 10)
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serialNumber, RevocationTime: revokedAt})
+	}
+	ca.mu.Unlock()
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:              big.NewInt(number),
+		ThisUpdate:          now.Add(-time.Minute),
+		NextUpdate:          now.Add(time.Hour),
+		RevokedCertificates: revoked,
+	}
+	return x509.CreateRevocationList(rand.Reader, template, ca.Certificate, ca.key)
+}
+
+// ServeHTTP serves the CRL of the authority for GET requests, and answers
+// OCSP requests sent with POST.
+func (ca *CertificateAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		crl, err := ca.CRL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(crl)
+	case "POST":
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/ocsp-response")
+			w.Write(ocsp.MalformedRequestErrorResponse)
+			return
+		}
+		resp, err := ca.ocspResponse(req.SerialNumber)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
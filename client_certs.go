@@ -0,0 +1,49 @@
+package gitkit
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// clientCertificate returns the verified certificate of the TLS client of a
+// request, if any.
+func clientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return req.TLS.PeerCertificates[0]
+}
+
+// certificateNames returns the names a client certificate may be mapped to a
+// user with: its subject common name, then its DNS, email and URI SANs.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// certificatePrincipal returns the user a client certificate authenticates,
+// with ClientCertUserFunc, or else the first of its names that is a user of
+// Config.Users.
+func (s *Server) certificatePrincipal(cert *x509.Certificate) (string, error) {
+	if s.ClientCertUserFunc != nil {
+		return s.ClientCertUserFunc(cert)
+	}
+
+	if s.config.Users != nil {
+		for _, name := range certificateNames(cert) {
+			if _, ok := s.config.Users.User(name); ok {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no user for client certificate %s", cert.Subject)
+}
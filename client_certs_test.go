@@ -0,0 +1,92 @@
+package gitkit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(options CertificateOptions) tls.Certificate {
+		options.Client = true
+		cert, err := ca.Issue(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	alice := issue(CertificateOptions{CommonName: "alice"})
+	bob := issue(CertificateOptions{CommonName: "CI runner", Hosts: []string{"bob"}})
+	mallory := issue(CertificateOptions{CommonName: "mallory"})
+
+	users := NewUserStore()
+	assert.NoError(t, users.AddUser("alice", ""))
+	assert.NoError(t, users.AddUser("bob", "secret"))
+	service := New(Config{Dir: dir, Auth: true, Users: users, MutualTLS: true})
+	server := httptest.NewUnstartedServer(service)
+	if server.TLS, err = service.TLSConfig(ca, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(repo string, user string, certs ...tls.Certificate) int {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.CertPool(), Certificates: certs}}
+		req, err := http.NewRequest("GET", server.URL+"/"+repo+"/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 200, get(repo, "", alice))
+	assert.Equal(t, 200, get(repo, "", bob), "mapped with a SAN")
+	assert.Equal(t, 401, get(repo, "", mallory))
+	assert.Equal(t, 401, get(repo, ""))
+	assert.Equal(t, 200, get(repo, "bob"), "passwords are still accepted")
+
+	assert.NoError(t, users.SetEnabled("alice", false))
+	assert.Equal(t, 401, get(repo, "", alice))
+
+	// Certificates are authorized per repository like passwords
+	service.ClientCertUserFunc = func(cert *x509.Certificate) (string, error) {
+		if cert.Subject.CommonName == "mallory" {
+			return "", fmt.Errorf("revoked")
+		}
+		return cert.Subject.CommonName, nil
+	}
+	service.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		assert.NotNil(t, cred.Certificate)
+		return cred.Username == "alice" && req.RepoName == repo, nil
+	}
+	assert.Equal(t, 200, get(repo, "", alice))
+	assert.Equal(t, 401, get(other, "", alice))
+	assert.Equal(t, 401, get(repo, "", mallory))
+}
@@ -0,0 +1,112 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ClientGone reports a client that disappeared in the middle of an
+// operation, e.g. an impatient client aborting a clone.
+type ClientGone struct {
+	Transport  string
+	Repo       string
+	Command    string // git-upload-pack, git-receive-pack...
+	RemoteAddr string
+	// Sent and Received are the bytes of the transfer sent to and received
+	// from the client before it disappeared
+	Sent     int64
+	Received int64
+}
+
+// transfer counts the bytes exchanged with a client, recording whether
+// reading from or writing to it failed.
+type transfer struct {
+	sent     int64
+	received int64
+	failed   int32
+}
+
+func (t *transfer) reader(r io.Reader) io.Reader {
+	return &transferReader{Reader: r, transfer: t}
+}
+
+func (t *transfer) writer(w io.Writer) io.Writer {
+	return &transferWriter{Writer: w, transfer: t}
+}
+
+// gone tells whether the client disappeared, either failing a read or write,
+// or closing the request or connection of ctx.
+func (t *transfer) gone(ctx context.Context) bool {
+	return atomic.LoadInt32(&t.failed) != 0 || ctx.Err() != nil
+}
+
+func (t *transfer) report(transport string, repo string, command string, remoteAddr string) ClientGone {
+	return ClientGone{
+		Transport:  transport,
+		Repo:       repo,
+		Command:    command,
+		RemoteAddr: remoteAddr,
+		Sent:       atomic.LoadInt64(&t.sent),
+		Received:   atomic.LoadInt64(&t.received),
+	}
+}
+
+func (c ClientGone) String() string {
+	return fmt.Sprintf("%s: client %s gone during %s after sending %d bytes and receiving %d", c.Repo, c.RemoteAddr, c.Command, c.Sent, c.Received)
+}
+
+type transferReader struct {
+	io.Reader
+	transfer *transfer
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.transfer.received, int64(n))
+	if err != nil && err != io.EOF {
+		atomic.StoreInt32(&r.transfer.failed, 1)
+	}
+	return n, err
+}
+
+type transferWriter struct {
+	io.Writer
+	transfer *transfer
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(&w.transfer.sent, int64(n))
+	if err != nil {
+		atomic.StoreInt32(&w.transfer.failed, 1)
+	}
+	return n, err
+}
+
+// clientGone reports the client of a request if it disappeared during the
+// transfer.
+func (s *Server) clientGone(r *Request, rpc string, t *transfer) {
+	if !t.gone(r.Context()) {
+		return
+	}
+	gone := t.report(HTTPTransport, r.RepoName, rpc, r.RemoteAddr)
+	s.config.logInfo("client-gone", gone.String())
+	if s.OnClientGone != nil {
+		s.OnClientGone(gone)
+	}
+}
+
+// clientGone reports the client of a git command if it disappeared during
+// the transfer.
+func (s *SSH) clientGone(ctx context.Context, remoteAddr string, gitcmd *GitCommand, t *transfer) {
+	if !t.gone(ctx) {
+		return
+	}
+	gone := t.report(SSHTransport, gitcmd.Repo, gitcmd.Command, remoteAddr)
+	s.gitConfig.logInfo("client-gone", gone.String())
+	if s.OnClientGone != nil {
+		s.OnClientGone(gone)
+	}
+}
@@ -0,0 +1,120 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClientGoneHTTP(t *testing.T) {
+	dir, err := os.MkdirTemp("", "client-gone-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := New(Config{Dir: dir})
+	head, err := service.Commit(repo, "master", Commit{Files: map[string]string{"file": "content"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := make(chan ClientGone, 10)
+	service.OnClientGone = func(c ClientGone) { gone <- c }
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	url := HTTPCloneURL(ts.Listener.Addr().String(), repo)
+
+	out, err := runGit(dir, "clone", url, filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+	assert.Empty(t, gone)
+
+	// The client leaves while upload-pack waits for the rest of the negotiation
+	want := "0032want " + head + "\n"
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", url+"/git-upload-pack", strings.NewReader(want))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	time.AfterFunc(300*time.Millisecond, cancel)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	select {
+	case c := <-gone:
+		assert.Equal(t, HTTPTransport, c.Transport)
+		assert.Equal(t, repo, c.Repo)
+		assert.Equal(t, "git-upload-pack", c.Command)
+		assert.Equal(t, int64(len(want)), c.Received)
+	case <-time.After(10 * time.Second):
+		t.Fatal("client gone not reported")
+	}
+}
+
+func TestClientGoneSSH(t *testing.T) {
+	dir, err := os.MkdirTemp("", "client-gone-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	gone := make(chan ClientGone, 10)
+	server.OnClientGone = func(c ClientGone) { gone <- c }
+	addr := startSSH(t, server)
+
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+	assert.Empty(t, gone)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("git-upload-pack '" + repo + "'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdout.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case c := <-gone:
+		assert.Equal(t, SSHTransport, c.Transport)
+		assert.Equal(t, repo, c.Repo)
+		assert.Equal(t, "git-upload-pack", c.Command)
+		assert.NotZero(t, c.Sent)
+		assert.Zero(t, c.Received)
+	case <-time.After(10 * time.Second):
+		t.Fatal("client gone not reported")
+	}
+}
@@ -0,0 +1,39 @@
+package gitkit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clock is the server's notion of time for expiry checks, offset from the
+// real time by a configurable skew.
+type clock struct {
+	skew int64 // time.Duration, accessed atomically
+}
+
+func (c *clock) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&c.skew)))
+}
+
+func (c *clock) setSkew(skew time.Duration) {
+	atomic.StoreInt64(&c.skew, int64(skew))
+}
+
+func (c *clock) getSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.skew))
+}
+
+// Now returns the time the server uses for expiry checks: the current time
+// shifted by the clock skew. It can be set as the Time function of a
+// tls.Config, or used by auth functions validating tokens, so certificates
+// and tokens expire as the server sees it.
+func (c *controls) Now() time.Time {
+	return c.clock.now()
+}
+
+// SetClockSkew shifts the server's clock, replacing Config.ClockSkew. A
+// positive skew puts the server in the future, so credentials look expired
+// earlier than they are; a negative one makes them look not yet valid.
+func (c *controls) SetClockSkew(skew time.Duration) {
+	c.clock.setSkew(skew)
+}
@@ -0,0 +1,57 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockSkew(t *testing.T) {
+	dir, err := os.MkdirTemp("", "clock-skew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir, Auth: true, AuthCacheTTL: time.Minute, ClockSkew: -time.Hour})
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), service.Now(), time.Minute)
+
+	// A token valid for the next half hour
+	expires := time.Now().Add(30 * time.Minute)
+	service.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		return cred.Password == "token" && service.Now().Before(expires), nil
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	get := func() int {
+		req, _ := http.NewRequest("GET", server.URL+"/"+repo+"/info/refs?service=git-upload-pack", nil)
+		req.SetBasicAuth("alice", "token")
+		resp, err := server.Client().Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 200, get())
+
+	// The cached decision and the token both expire as the server sees it
+	service.SetClockSkew(time.Hour)
+	assert.Equal(t, 401, get())
+
+	service.SetClockSkew(0)
+	service.FlushAuthCache()
+	assert.Equal(t, 200, get())
+
+	ssh := NewSSH(Config{ClockSkew: time.Hour})
+	assert.WithinDuration(t, time.Now().Add(time.Hour), ssh.Now(), time.Minute)
+}
@@ -0,0 +1,329 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Cluster runs several HTTP and SSH servers over the same repositories, each
+// transport behind a round-robin TCP balancer, like load-balanced git
+// hosting. HTTP backends close connections after every response, so the
+// requests of a single git operation land on different backends, as they
+// may behind a balancer without sticky sessions.
+type Cluster struct {
+	// Servers are the HTTP backends, in balancing order
+	Servers []*Server
+	// SSHServers are the SSH backends, in balancing order. They share the
+	// host keys of Config.KeyDir.
+	SSHServers []*SSH
+
+	httpServers []*http.Server
+	httpLB      *balancer
+	sshLB       *balancer
+
+	shared   RepoStore
+	gitPath  string
+	mu       sync.RWMutex
+	replicas string          // Directory of the per-backend copies of diverged repositories
+	diverged map[string]bool // Diverged repositories by lockKey
+}
+
+// NewCluster starts size HTTP and SSH backends with the config, and their
+// balancers, on loopback ports. SSH backends are only started when
+// Config.KeyDir is set.
+func NewCluster(config Config, size int) (*Cluster, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	c := &Cluster{shared: config.repoStore(), gitPath: config.GitPath, diverged: map[string]bool{}}
+	if c.gitPath == "" {
+		c.gitPath = "git"
+	}
+	httpAddrs := []string{}
+	sshAddrs := []string{}
+
+	for i := 0; i < size; i++ {
+		config := config
+		config.Store = &replicaStore{RepoStore: c.shared, cluster: c, backend: i}
+
+		server := New(config)
+		if err := server.Setup(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		httpServer := &http.Server{Handler: server}
+		httpServer.SetKeepAlivesEnabled(false)
+		go httpServer.Serve(listener)
+
+		c.Servers = append(c.Servers, server)
+		c.httpServers = append(c.httpServers, httpServer)
+		httpAddrs = append(httpAddrs, listener.Addr().String())
+
+		if config.KeyDir == "" {
+			continue
+		}
+		sshServer := NewSSH(config)
+		if err := sshServer.Listen("127.0.0.1:0"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		go sshServer.Serve()
+
+		c.SSHServers = append(c.SSHServers, sshServer)
+		sshAddrs = append(sshAddrs, sshServer.Address())
+	}
+
+	var err error
+	if c.httpLB, err = newBalancer(httpAddrs); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(sshAddrs) > 0 {
+		if c.sshLB, err = newBalancer(sshAddrs); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// HTTPAddress returns the address of the HTTP balancer
+func (c *Cluster) HTTPAddress() string {
+	return c.httpLB.listener.Addr().String()
+}
+
+// SSHAddress returns the address of the SSH balancer, empty if the cluster
+// has no SSH backends.
+func (c *Cluster) SSHAddress() string {
+	if c.sshLB == nil {
+		return ""
+	}
+	return c.sshLB.listener.Addr().String()
+}
+
+// Close stops the balancers and all backends.
+func (c *Cluster) Close() error {
+	var firstErr error
+	for _, lb := range []*balancer{c.httpLB, c.sshLB} {
+		if lb != nil {
+			lb.close()
+		}
+	}
+	for _, server := range c.httpServers {
+		if err := server.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, server := range c.SSHServers {
+		if err := server.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if c.replicas != "" {
+		if err := os.RemoveAll(c.replicas); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Diverge gives every backend its own copy of the repository, like replicas
+// of a replicated git backend. Changes made through one backend, such as
+// pushes or Commit, are then only seen by that backend, until Converge is
+// called. Since consecutive HTTP requests are served by different backends,
+// fetches may get refs advertised by one backend and their objects
+// negotiated with another, reproducing eventual consistency bugs.
+func (c *Cluster) Diverge(repo string) error {
+	name := c.shared.Resolve(repo)
+	dir, err := c.shared.Open(name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replicas == "" {
+		if c.replicas, err = os.MkdirTemp("", "gitkit-replicas"); err != nil {
+			return err
+		}
+	}
+	for i := range c.Servers {
+		replica := c.replicaPath(i, name)
+		if err := os.RemoveAll(replica); err != nil {
+			return err
+		}
+		if out, err := exec.Command(c.gitPath, "clone", "--quiet", "--mirror", dir, replica).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to copy %s: %s", name, out)
+		}
+	}
+	c.diverged[lockKey(name)] = true
+	return nil
+}
+
+// Converge drops the copies of a repository made by Diverge, all backends
+// serving the shared repository again.
+func (c *Cluster) Converge(repo string) error {
+	name := c.shared.Resolve(repo)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.diverged[lockKey(name)] {
+		return nil
+	}
+	delete(c.diverged, lockKey(name))
+	for i := range c.Servers {
+		if err := os.RemoveAll(c.replicaPath(i, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) replicaPath(backend int, name string) string {
+	return filepath.Join(c.replicas, strconv.Itoa(backend), filepath.FromSlash(lockKey(name)))
+}
+
+// replicaStore serves the copy of diverged repositories of a backend, and
+// the shared repositories otherwise.
+type replicaStore struct {
+	RepoStore
+	cluster *Cluster
+	backend int
+}
+
+func (r *replicaStore) Open(name string) (string, error) {
+	c := r.cluster
+	name = c.shared.Resolve(name)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.diverged[lockKey(name)] {
+		return c.replicaPath(r.backend, name), nil
+	}
+	return r.RepoStore.Open(name)
+}
+
+// balancer proxies TCP connections to its backends in turn
+type balancer struct {
+	listener net.Listener
+	backends []string
+
+	mu    sync.Mutex
+	next  int
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newBalancer(backends []string) (*balancer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &balancer{listener: listener, backends: backends, conns: map[net.Conn]bool{}}
+	b.wg.Add(1)
+	go b.serve()
+	return b, nil
+}
+
+func (b *balancer) serve() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		backend := b.backends[b.next%len(b.backends)]
+		b.next++
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.proxy(conn, backend)
+		}()
+	}
+}
+
+func (b *balancer) proxy(conn net.Conn, backend string) {
+	upstream, err := net.Dial("tcp", backend)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if !b.track(conn, upstream) {
+		return
+	}
+	defer b.untrack(conn, upstream)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// track records open connections so that close can interrupt them, and
+// closes them if the balancer is already closed.
+func (b *balancer) track(conns ...net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conns == nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+	for _, conn := range conns {
+		b.conns[conn] = true
+	}
+	return true
+}
+
+func (b *balancer) untrack(conns ...net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+		delete(b.conns, conn)
+	}
+}
+
+func (b *balancer) close() {
+	b.listener.Close()
+
+	b.mu.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
@@ -0,0 +1,98 @@
+package gitkit
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, err := NewCluster(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	assert.Len(t, cluster.Servers, 2)
+	assert.Len(t, cluster.SSHServers, 2)
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err := runGit(dir, "clone", HTTPCloneURL(cluster.HTTPAddress(), repo), clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.NoError(t, err, out)
+
+	// Consecutive requests land on each backend in turn
+	cluster.Servers[0].InjectFault(repo, Fault{StatusCode: 502})
+	statuses := []int{}
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(HTTPCloneURL(cluster.HTTPAddress(), repo) + "/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	assert.ElementsMatch(t, []int{200, 200, 502, 502}, statuses)
+	assert.NotEqual(t, statuses[0], statuses[1])
+
+	cluster.SSHServers[1].InjectFault(repo, Fault{Message: "backend down"})
+	failures := 0
+	for i := 0; i < 2; i++ {
+		if out, err := runGit(dir, "ls-remote", SSHCloneURL("git", cluster.SSHAddress(), repo)); err != nil {
+			assert.Contains(t, out, "backend down")
+			failures++
+		}
+	}
+	assert.Equal(t, 1, failures)
+}
+
+func TestClusterDiverge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, err := NewCluster(Config{Dir: dir}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	assert.NoError(t, cluster.Diverge(repo))
+	rev, err := cluster.Servers[0].Commit(repo, "master", Commit{Files: map[string]string{"file": "content"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, cluster.Servers[1].repoOps().resolve(filepath.Join(dir, repo), rev+"^{commit}"))
+
+	// Refs are advertised by the first backend, the second one does not have
+	// the advertised commit
+	out, err := runGit(dir, "clone", HTTPCloneURL(cluster.HTTPAddress(), repo), filepath.Join(t.TempDir(), "clone"))
+	assert.Error(t, err)
+	assert.Contains(t, out, "not our ref")
+
+	assert.NoError(t, cluster.Converge(repo))
+	out, err = runGit(dir, "clone", HTTPCloneURL(cluster.HTTPAddress(), repo), filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+}
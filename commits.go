@@ -0,0 +1,145 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page sizes of paginated API endpoints, as on GitHub
+const (
+	defaultPerPage = 30
+	maxPerPage     = 100
+)
+
+// serveCommits lists the commits of a ref, newest first, or returns a single
+// commit with its changed files when the route names one.
+func (s *Server) serveCommits(w http.ResponseWriter, r *Request, route string) {
+	if route != "" {
+		s.getAPICommit(w, r, route)
+		return
+	}
+
+	query := r.URL.Query()
+	ref := query.Get("sha")
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	ops := s.repoOps()
+	rev := ops.resolve(r.RepoPath, ref+"^{commit}")
+	if rev == "" {
+		if query.Get("sha") == "" {
+			apiError(w, http.StatusConflict, "Git Repository is empty.")
+			return
+		}
+		apiError(w, http.StatusNotFound, "No commit found for SHA: "+ref)
+		return
+	}
+
+	paths := []string{}
+	if p := query.Get("path"); p != "" {
+		paths = append(paths, "--", p)
+	}
+
+	count, err := ops.git(r.RepoPath, nil, "", append([]string{"rev-list", "--count", rev}, paths...)...)
+	if err != nil {
+		s.apiFail(w, "commits", err)
+		return
+	}
+	total, _ := strconv.Atoi(count)
+
+	page, perPage := apiPage(r)
+	args := []string{fmt.Sprintf("--skip=%d", (page-1)*perPage), fmt.Sprintf("--max-count=%d", perPage), rev}
+	commits, err := s.apiCommits(r, append(args, paths...)...)
+	if err != nil {
+		s.apiFail(w, "commits", err)
+		return
+	}
+
+	setLinkHeader(w, r, page, perPage, total)
+	writeJSON(w, http.StatusOK, commits)
+}
+
+func (s *Server) getAPICommit(w http.ResponseWriter, r *Request, ref string) {
+	ops := s.repoOps()
+	rev := ops.resolve(r.RepoPath, ref+"^{commit}")
+	if rev == "" {
+		apiError(w, http.StatusNotFound, "No commit found for SHA: "+ref)
+		return
+	}
+
+	commits, err := s.apiCommits(r, "-1", rev)
+	if err != nil {
+		s.apiFail(w, "commits", err)
+		return
+	}
+	commit := commits[0]
+
+	// Root commits are compared with the empty tree
+	parent := ops.resolve(r.RepoPath, rev+"^")
+	if parent == "" {
+		if parent, err = ops.git(r.RepoPath, nil, "", "hash-object", "-t", "tree", "--stdin"); err != nil {
+			s.apiFail(w, "commits", err)
+			return
+		}
+	}
+	if commit.Files, err = s.fileDiffs(r, parent, rev); err != nil {
+		s.apiFail(w, "commits", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, commit)
+}
+
+// apiPage returns the requested page, starting at 1, and page size
+func apiPage(r *Request) (int, int) {
+	query := r.URL.Query()
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return page, perPage
+}
+
+// setLinkHeader sets the Link header pointing to the first, previous, next
+// and last pages, as GitHub does. Links are only set for pages that exist.
+func setLinkHeader(w http.ResponseWriter, r *Request, page int, perPage int, total int) {
+	last := (total + perPage - 1) / perPage
+	if last < 1 {
+		last = 1
+	}
+
+	link := func(page int, rel string) string {
+		u := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(perPage))
+		u.RawQuery = query.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+	}
+
+	links := []string{}
+	if page < last {
+		links = append(links, link(page+1, "next"), link(last, "last"))
+	}
+	if page > 1 {
+		links = append(links, link(1, "first"), link(page-1, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,262 @@
+package gitkit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Accept headers selecting the raw formats of the compare endpoint
+const (
+	diffMediaType  = "application/vnd.github.diff"
+	patchMediaType = "application/vnd.github.patch"
+)
+
+// APIComparison compares two refs in the REST API, with the fields of GitHub
+// comparisons. Changes are those of head since the merge base of both refs.
+type APIComparison struct {
+	Status       string        `json:"status"` // "identical", "ahead", "behind" or "diverged"
+	AheadBy      int           `json:"ahead_by"`
+	BehindBy     int           `json:"behind_by"`
+	TotalCommits int           `json:"total_commits"`
+	MergeBase    APICommit     `json:"merge_base_commit"`
+	Commits      []APICommit   `json:"commits"` // Oldest first
+	Files        []APIFileDiff `json:"files"`
+}
+
+// APICommit is a commit in the REST API, with the fields of GitHub commits
+type APICommit struct {
+	SHA    string          `json:"sha"`
+	URL    string          `json:"url"`
+	Commit APICommitDetail `json:"commit"`
+	// Files changed since the first parent, only set for single commits
+	Files []APIFileDiff `json:"files,omitempty"`
+}
+
+// APICommitDetail holds the git data of a commit
+type APICommitDetail struct {
+	Author    APISignature `json:"author"`
+	Committer APISignature `json:"committer"`
+	Message   string       `json:"message"`
+}
+
+// APISignature identifies the author or committer of a commit
+type APISignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+// APIFileDiff describes the changes of a file between two commits
+type APIFileDiff struct {
+	Filename         string `json:"filename"`
+	PreviousFilename string `json:"previous_filename,omitempty"` // For renamed files
+	Status           string `json:"status"`                      // "added", "removed", "modified" or "renamed"
+	Additions        int    `json:"additions"`
+	Deletions        int    `json:"deletions"`
+	Changes          int    `json:"changes"`
+	Patch            string `json:"patch,omitempty"` // Hunks of the unified diff, empty for binary files
+}
+
+// serveCompare compares two refs, the route being "<base>...<head>". The
+// Accept header selects a unified diff or patches instead of JSON.
+func (s *Server) serveCompare(w http.ResponseWriter, r *Request, route string) {
+	refs := strings.SplitN(route, "...", 2)
+	if len(refs) != 2 {
+		apiError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	ops := s.repoOps()
+	base := ops.resolve(r.RepoPath, refs[0]+"^{commit}")
+	head := ops.resolve(r.RepoPath, refs[1]+"^{commit}")
+	if base == "" || head == "" {
+		apiError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	mergeBase, err := ops.git(r.RepoPath, nil, "", "merge-base", base, head)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "No common ancestor between "+refs[0]+" and "+refs[1])
+		return
+	}
+
+	switch r.Header.Get("Accept") {
+	case diffMediaType:
+		s.writeGitOutput(w, r, "text/plain; charset=utf-8", "diff", "-M", mergeBase, head)
+		return
+	case patchMediaType:
+		s.writeGitOutput(w, r, "text/plain; charset=utf-8", "format-patch", "--stdout", base+".."+head)
+		return
+	}
+
+	comparison, err := s.compare(r, base, head, mergeBase)
+	if err != nil {
+		s.apiFail(w, "compare", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, comparison)
+}
+
+func (s *Server) compare(r *Request, base string, head string, mergeBase string) (*APIComparison, error) {
+	ops := s.repoOps()
+	comparison := &APIComparison{Files: []APIFileDiff{}}
+
+	counts, err := ops.git(r.RepoPath, nil, "", "rev-list", "--left-right", "--count", base+"..."+head)
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(counts); len(fields) == 2 {
+		comparison.BehindBy, _ = strconv.Atoi(fields[0])
+		comparison.AheadBy, _ = strconv.Atoi(fields[1])
+	}
+
+	switch {
+	case comparison.AheadBy == 0 && comparison.BehindBy == 0:
+		comparison.Status = "identical"
+	case comparison.BehindBy == 0:
+		comparison.Status = "ahead"
+	case comparison.AheadBy == 0:
+		comparison.Status = "behind"
+	default:
+		comparison.Status = "diverged"
+	}
+
+	mergeBaseCommits, err := s.apiCommits(r, "-1", mergeBase)
+	if err != nil {
+		return nil, err
+	}
+	comparison.MergeBase = mergeBaseCommits[0]
+
+	if comparison.Commits, err = s.apiCommits(r, "--reverse", base+".."+head); err != nil {
+		return nil, err
+	}
+	comparison.TotalCommits = len(comparison.Commits)
+
+	if comparison.Files, err = s.fileDiffs(r, mergeBase, head); err != nil {
+		return nil, err
+	}
+	return comparison, nil
+}
+
+// apiCommits lists commits with git log and the given arguments
+func (s *Server) apiCommits(r *Request, args ...string) ([]APICommit, error) {
+	args = append([]string{"log", "--format=%H%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%B%x1e"}, args...)
+	out, err := gitOutput(s.config.GitPath, r.RepoPath, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []APICommit{}
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.Split(strings.TrimLeft(record, "\n"), "\x00")
+		if len(fields) != 8 {
+			continue
+		}
+
+		authorDate, _ := time.Parse(time.RFC3339, fields[3])
+		committerDate, _ := time.Parse(time.RFC3339, fields[6])
+		commits = append(commits, APICommit{
+			SHA: fields[0],
+			URL: apiRepoURL(r) + "/commits/" + fields[0],
+			Commit: APICommitDetail{
+				Author:    APISignature{Name: fields[1], Email: fields[2], Date: authorDate.UTC()},
+				Committer: APISignature{Name: fields[4], Email: fields[5], Date: committerDate.UTC()},
+				Message:   strings.TrimRight(fields[7], "\n"),
+			},
+		})
+	}
+	return commits, nil
+}
+
+// fileDiffs lists the files changed between two commits
+func (s *Server) fileDiffs(r *Request, from string, to string) ([]APIFileDiff, error) {
+	out, err := gitOutput(s.config.GitPath, r.RepoPath, "diff", "-z", "--numstat", "-M", from, to)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := gitOutput(s.config.GitPath, r.RepoPath, "diff", "-z", "--name-status", "-M", from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both lists are in the same order: "<status>\0<path>\0" or, for renames,
+	// "R<score>\0<old>\0<new>\0".
+	kinds := []string{}
+	for fields := strings.Split(string(statuses), "\x00"); len(fields) > 1; {
+		if fields[0] == "" {
+			break
+		}
+		kind := fields[0][:1]
+		if (kind == "R" || kind == "C") && len(fields) < 3 {
+			break
+		}
+
+		kinds = append(kinds, kind)
+		if kind == "R" || kind == "C" {
+			fields = fields[3:]
+		} else {
+			fields = fields[2:]
+		}
+	}
+
+	files := []APIFileDiff{}
+	for fields := strings.Split(string(out), "\x00"); len(fields) > 1 && len(files) < len(kinds); {
+		stats := strings.SplitN(fields[0], "\t", 3)
+		if len(stats) != 3 {
+			break
+		}
+
+		file := APIFileDiff{Filename: stats[2]}
+		fields = fields[1:]
+		if file.Filename == "" && len(fields) >= 2 {
+			file.PreviousFilename, file.Filename = fields[0], fields[1]
+			fields = fields[2:]
+		}
+
+		// Binary files have "-" counts
+		file.Additions, _ = strconv.Atoi(stats[0])
+		file.Deletions, _ = strconv.Atoi(stats[1])
+		file.Changes = file.Additions + file.Deletions
+
+		switch kinds[len(files)] {
+		case "A":
+			file.Status = "added"
+		case "D":
+			file.Status = "removed"
+		case "R":
+			file.Status = "renamed"
+		default:
+			file.Status = "modified"
+		}
+
+		paths := []string{file.Filename}
+		if file.PreviousFilename != "" {
+			paths = append(paths, file.PreviousFilename)
+		}
+		patch, err := gitOutput(s.config.GitPath, r.RepoPath, append([]string{"diff", "-M", from, to, "--"}, paths...)...)
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.Index(string(patch), "\n@@"); i >= 0 {
+			file.Patch = strings.TrimRight(string(patch[i+1:]), "\n")
+		}
+
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// writeGitOutput answers with the output of a git command
+func (s *Server) writeGitOutput(w http.ResponseWriter, r *Request, contentType string, args ...string) {
+	out, err := gitOutput(s.config.GitPath, r.RepoPath, args...)
+	if err != nil {
+		s.apiFail(w, args[0], err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
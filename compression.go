@@ -0,0 +1,96 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressionSet holds the zlib compression levels per repository. The empty
+// repository name applies to all repositories.
+type compressionSet struct {
+	mu     sync.RWMutex
+	levels map[string]int
+}
+
+func (c *compressionSet) set(repo string, level *int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.levels == nil {
+		c.levels = map[string]int{}
+	}
+
+	if level == nil {
+		delete(c.levels, lockKey(repo))
+	} else {
+		c.levels[lockKey(repo)] = *level
+	}
+}
+
+func (c *compressionSet) get(repo string) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if level, ok := c.levels[lockKey(repo)]; ok {
+		return level, true
+	}
+	level, ok := c.levels[""]
+	return level, ok
+}
+
+// settings returns the core.compression and pack.compression settings of
+// the repository, empty when no level is set.
+func (c *compressionSet) settings(repo string) []string {
+	level, ok := c.get(repo)
+	if !ok {
+		return nil
+	}
+	return []string{"core.compression=" + strconv.Itoa(level), "pack.compression=" + strconv.Itoa(level)}
+}
+
+// configEnv returns the environment passing the settings to git commands,
+// like git -c does, keeping settings already in the environment. It is empty
+// without settings.
+func configEnv(settings ...string) []string {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	params := []string{}
+	if existing := os.Getenv("GIT_CONFIG_PARAMETERS"); existing != "" {
+		params = append(params, existing)
+	}
+	for _, setting := range settings {
+		params = append(params, "'"+strings.Replace(setting, "'", `'\''`, -1)+"'")
+	}
+	return []string{"GIT_CONFIG_PARAMETERS=" + strings.Join(params, " ")}
+}
+
+func checkCompression(level int) error {
+	if level < -1 || level > 9 {
+		return fmt.Errorf("invalid compression level %d, must be between -1 and 9", level)
+	}
+	return nil
+}
+
+// SetCompression sets the zlib compression level of the packs and objects git
+// writes while serving the repository, from 0 for no compression to 9, -1
+// being the zlib default. It trades the CPU used by the server against the
+// bandwidth of transfers. An empty repository name applies the level to every
+// repository.
+func (c *controls) SetCompression(repo string, level int) error {
+	if err := checkCompression(level); err != nil {
+		return err
+	}
+	c.compression.set(repo, &level)
+	return nil
+}
+
+// ClearCompression removes a level set with SetCompression, git using the
+// one of the repository config again.
+func (c *controls) ClearCompression(repo string) {
+	c.compression.set(repo, nil)
+}
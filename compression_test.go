@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingHandler counts the bytes of the responses of a handler
+type countingHandler struct {
+	http.Handler
+	mu    sync.Mutex
+	bytes int
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Handler.ServeHTTP(&countingWriter{ResponseWriter: w, handler: h}, r)
+}
+
+func (h *countingHandler) reset() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.bytes
+	h.bytes = 0
+	return n
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	handler *countingHandler
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.handler.mu.Lock()
+	w.handler.bytes += len(p)
+	w.handler.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *countingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	service := New(Config{Dir: dir, AutoCreate: true})
+	if _, err := service.config.repoStore().Create("repo.git"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Commit("repo.git", "master", Commit{Files: map[string]string{
+		"data.txt": strings.Repeat("compressible line of text\n", 20000),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &countingHandler{Handler: service}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	clone := func() int {
+		handler.reset()
+		out, err := runGit(dir, "clone", "--bare", ts.URL+"/repo.git", filepath.Join(t.TempDir(), "clone"))
+		assert.NoError(t, err, out)
+		return handler.reset()
+	}
+
+	assert.NoError(t, service.SetCompression("", 9))
+	compressed := clone()
+	assert.NoError(t, service.SetCompression("repo.git", 0))
+	uncompressed := clone()
+	assert.Greater(t, uncompressed, 500000)
+	assert.Less(t, compressed, uncompressed/10)
+
+	service.ClearCompression("repo.git")
+	assert.Less(t, clone(), uncompressed/10)
+
+	assert.Error(t, service.SetCompression("", 10))
+}
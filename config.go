@@ -1,9 +1,13 @@
 package gitkit
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Config struct {
@@ -16,6 +20,200 @@ type Config struct {
 	Hooks      *HookScripts // Scripts for hooks/* directory
 	Auth       bool         // Require authentication
 	ReadOnly   bool         // Simulates a user that has read-only access to the repository.
+	Users      *UserStore   // Users for HTTP and SSH authentication, unless custom auth functions are set
+	GitSuffix  SuffixPolicy // Whether repositories are addressable with and/or without the .git suffix
+	Store      RepoStore    // Where repositories are kept, defaults to an FSStore rooted at Dir
+
+	// Aliases route requested repository names to other repositories, the
+	// first matching alias applying, e.g. to serve renamed repositories.
+	Aliases []RepoAlias
+
+	// HostKeyTypes are the types of the SSH host keys offered to clients,
+	// among RSAHostKey, ECDSAHostKey and Ed25519HostKey. Missing keys are
+	// generated in KeyDir. Defaults to Ed25519HostKey only, fast to generate,
+	// or RSAHostKey when KeyDir holds the RSA key generated by earlier
+	// versions, unless HostKeyFiles are set.
+	HostKeyTypes []string
+	// CacheHostKeys reuses the host keys generated by other servers of the
+	// process, by type, instead of generating new ones, e.g. to speed up
+	// tests creating a server with a new KeyDir each. They are still written
+	// to KeyDir.
+	CacheHostKeys bool
+	// HostKeyFiles are private keys loaded as SSH host keys, like the
+	// HostKey options of sshd, in PEM or OpenSSH format. Like with sshd, a
+	// key replaces any earlier key of the same type.
+	HostKeyFiles []string
+	// HostCA signs a host certificate for every host key, presented along
+	// with the keys to clients trusting it with a @cert-authority
+	// known_hosts line.
+	HostCA *SSHCertificateAuthority
+	// HostCertPrincipals are the host names of the certificates signed by
+	// HostCA, defaults to localhost, 127.0.0.1 and ::1.
+	HostCertPrincipals []string
+	// HostCertificateFiles are OpenSSH host certificates presented along with
+	// the host key they certify, like the HostCertificate options of sshd.
+	HostCertificateFiles []string
+	// UserCAKeys are CA public keys in authorized_keys format trusted to sign
+	// OpenSSH user certificates, like the TrustedUserCAKeys option of sshd.
+	// Certificates are accepted in addition to the keys of
+	// PublicKeyLookupFunc.
+	UserCAKeys []string
+	// UserCertPrincipals are the principals accepted in user certificates,
+	// defaults to the user name of the connection.
+	UserCertPrincipals []string
+	// SSHCiphers, SSHKeyExchanges and SSHMACs are the algorithms the SSH
+	// server negotiates, in order of preference and named like with ssh -Q,
+	// to reproduce servers allowing only legacy or only modern algorithms.
+	// They default to the ones of golang.org/x/crypto/ssh.
+	SSHCiphers      []string
+	SSHKeyExchanges []string
+	SSHMACs         []string
+	// SSHMaxAuthTries closes SSH connections after this many failed
+	// authentication attempts, like the MaxAuthTries option of sshd, every
+	// key a client offers counting as an attempt. Clients are disconnected
+	// with "too many authentication failures". Defaults to 6, negative
+	// values allowing unlimited attempts.
+	SSHMaxAuthTries int
+	// SSHMaxConnections limits the SSH connections open at once, like a
+	// saturated server. Clients beyond it are disconnected with "too many
+	// connections" before the key exchange, or wait for a connection to
+	// close with SSHQueueConnections. Unlimited when zero.
+	SSHMaxConnections   int
+	SSHQueueConnections bool
+	// SSHBandwidth limits the bytes per second every SSH connection reads
+	// and writes, in each direction, to simulate slow links. Unlimited when
+	// zero.
+	SSHBandwidth int64
+	// SSHEnv are extra environment variables of the git commands run for SSH
+	// sessions, e.g. GIT_TRACE or variables read by hooks. See also
+	// SSH.SessionEnvFunc.
+	SSHEnv map[string]string
+	// SSHHomeDirs are the roots, relative to Dir, of the repository paths
+	// of SSH commands relative to the home directory of a user, by user, like
+	// OpenSSH-hosted git servers: "~alice/repo.git" is in the root of alice
+	// and "~/repo.git" in the one of the SSH user, or else in Dir. Unknown
+	// users are rejected. Unset, "~user" is an ordinary directory.
+	SSHHomeDirs map[string]string
+	// SSHTranscriptDir, if set, records every SSH git command to a new
+	// directory of it, numbered and named after the command, e.g.
+	// "0001-git-upload-pack": its stdin, stdout and stderr files, and the
+	// pkt-lines exchanged, decoded one per line in a pkt-lines file.
+	SSHTranscriptDir string
+
+	TempDir     string        // Directory for temporary files, defaults to the system one
+	TempCleanup CleanupPolicy // When temporary files are removed
+
+	// MemoryBudget bounds the bytes of request bodies the HTTP server holds
+	// in memory at once, across requests. When set, bodies are read ahead
+	// before running git, and the parts not fitting in the budget are
+	// handled according to MemoryOverflow.
+	MemoryBudget   int64
+	MemoryOverflow OverflowPolicy // Spill bodies beyond the budget to temporary files, or reject them
+
+	// StrictTeardown makes SSH.Stop fail with a *LeakError when goroutines,
+	// sessions, child git processes or temporary files remain.
+	StrictTeardown bool
+
+	// AuthCacheTTL caches HTTP auth decisions for this long, by credential
+	// and repository, disabled when zero. Digest credentials, whose response
+	// only the auth function verifies, are never cached.
+	AuthCacheTTL time.Duration
+	AuthNonces   bool // Require HTTP Digest auth with server-issued nonces, rejecting replays
+	// MutualTLS makes Server.TLSConfig ask clients for a certificate issued
+	// by its authority. With Auth, requests presenting one are authenticated
+	// as the user it is mapped to, see Server.ClientCertUserFunc, and
+	// authorized like requests with a password, with AuthFunc.
+	MutualTLS bool
+
+	// ClockSkew shifts the server's clock for expiry checks of nonces,
+	// cached auth decisions and anything validated against Now(), to
+	// reproduce servers whose clock is ahead (positive) or behind.
+	ClockSkew time.Duration
+
+	// Logger receives the log lines of the server, the standard logger of
+	// the log package by default, e.g. a logger per test to tell apart the
+	// servers of parallel tests.
+	Logger *log.Logger
+
+	// OnSecretLeak, if set, is called with the redacted line whenever a log
+	// line or event would have contained a credential. Tests can fail on
+	// leaks with SecretLeaks.Record.
+	OnSecretLeak func(string)
+
+	EventJournal string // Path to a JSONL file where server events are appended
+	ChangedFiles bool   // Compute the files changed by each pushed ref for push events
+
+	LockMessage string      // Error returned for locked repositories, defaults to "repository temporarily unavailable"
+	LockHints   *ErrorHints // Hints added to HTTP responses for locked repositories
+
+	DumbHTTP        bool // Serve the dumb HTTP protocol instead of smart HTTP
+	API             bool // Serve a GitHub-style REST API under /api/v3, for provider API clients
+	StaleServerInfo bool // Do not run update-server-info after ref changes when serving dumb HTTP
+	// LogGitStderr logs the stderr of the git commands serving HTTP requests,
+	// like git http-backend does, instead of relaying it verbatim in the
+	// response body among the packets of their stdout, like some providers
+	// do.
+	LogGitStderr bool
+
+	// ProtocolV2 honors HTTP clients asking for protocol v2 with the
+	// Git-Protocol header, servers answering with protocol v0 otherwise.
+	// Over SSH, the GIT_PROTOCOL variable of clients is always honored,
+	// unless SSHIgnoreGitProtocol is set.
+	ProtocolV2 bool
+	// SSHIgnoreGitProtocol refuses the GIT_PROTOCOL variable of SSH clients,
+	// like sshd without AcceptEnv GIT_PROTOCOL, serving them with protocol
+	// v0 to reproduce servers where protocol v2 silently falls back.
+	SSHIgnoreGitProtocol bool
+	// ForceProtocolVersion, "0", "1" or "2", serves every client with that
+	// protocol version whatever it asks for, e.g. to check that clients
+	// handle protocol v2 or the lack of it.
+	ForceProtocolVersion string
+	// Agent is the agent capability advertised by the server, e.g.
+	// "git/2.30.0" or "JGit/6.0", since some clients adapt to the server
+	// they talk to. Defaults to the one of the git binary.
+	Agent string
+	// HideObjectInfo hides the protocol v2 object-info command, which
+	// clients use to query object sizes without fetching them, like servers
+	// running git older than 2.30. It is left out of the capabilities, and
+	// rejected as an invalid command.
+	HideObjectInfo bool
+	// PartialClone serves partial clones, e.g. git clone --filter=blob:none,
+	// and the fetches of missing objects by id that their clients make on
+	// demand, acting as their promisor remote.
+	PartialClone bool
+	// FilterPolicy refuses the filters of HTTP clones or of later fetches
+	// with PartialClone, to reproduce inconsistent filter support.
+	FilterPolicy FilterPolicy
+	// EmptyRepoAdvertisement is how repositories without refs are
+	// advertised, with the unborn HEAD of protocol v2 by default.
+	EmptyRepoAdvertisement EmptyRepoAdvertisement
+	// DefaultBranch is the branch HEAD of the repositories created by the
+	// servers points to, e.g. with AutoCreate, which protocol v2 clients
+	// cloning them empty check out. Defaults to the init.defaultBranch of
+	// git.
+	DefaultBranch string
+	// DubiousOwnership makes git treat every served repository as owned by
+	// another user, failing with "detected dubious ownership" unless it is
+	// listed in safe.directory, like a server in a container serving a
+	// volume of the host.
+	DubiousOwnership bool
+	// TrustAllDirectories sets safe.directory to '*' for the served
+	// repositories, serving them whatever their owner.
+	TrustAllDirectories bool
+
+	// Rand is the source of randomness of generated host keys, SSH
+	// handshakes and HTTP Digest nonces, crypto/rand by default. Seed sets
+	// it to SeededRand(Seed) instead, and logs the seed, so that runs can be
+	// replayed. Go randomizes RSA and ECDSA keys whatever the source, so
+	// only Ed25519 host keys are reproducible.
+	Rand io.Reader
+	Seed int64
+
+	// Features enables experimental behaviors by name, among KnownFeatures.
+	// They can also be toggled at runtime with SetFeature.
+	Features map[Feature]bool
+
+	adopted *adoptedRepos // Repositories served with AdoptRepo
 }
 
 // HookScripts represents all repository server-size git hooks
@@ -54,19 +252,58 @@ func (c *HookScripts) setupInDir(path string) error {
 		}
 
 		if err := ioutil.WriteFile(fullPath, []byte(script), 0755); err != nil {
-			logError("hook-update", err)
-			return err
+			return fmt.Errorf("hook-update: %v", err)
 		}
 	}
 
 	return nil
 }
 
+// KeyPath returns the path of the first SSH host key generated in KeyDir
 func (c *Config) KeyPath() string {
-	return filepath.Join(c.KeyDir, "gitkit.rsa")
+	if types := c.hostKeyTypes(); len(types) > 0 {
+		return c.HostKeyPath(types[0])
+	}
+	return c.HostKeyPath(Ed25519HostKey)
+}
+
+// HostKeyPath returns the path of the SSH host key of the given type in KeyDir
+func (c *Config) HostKeyPath(keyType string) string {
+	return filepath.Join(c.KeyDir, "gitkit."+keyType)
+}
+
+func (c *Config) hostCertPrincipals() []string {
+	if len(c.HostCertPrincipals) == 0 {
+		return []string{"localhost", "127.0.0.1", "::1"}
+	}
+	return c.HostCertPrincipals
+}
+
+// agentEnv returns the environment setting the agent advertised by git
+func (c *Config) agentEnv() []string {
+	if c.Agent == "" {
+		return nil
+	}
+	return []string{"GIT_USER_AGENT=" + c.Agent}
+}
+
+func (c *Config) hostKeyTypes() []string {
+	if len(c.HostKeyTypes) == 0 && len(c.HostKeyFiles) == 0 {
+		// Keep serving the key known to clients of earlier versions
+		if c.KeyDir != "" && fileExists(c.HostKeyPath(RSAHostKey)) && !fileExists(c.HostKeyPath(Ed25519HostKey)) {
+			return []string{RSAHostKey}
+		}
+		return []string{Ed25519HostKey}
+	}
+	return c.HostKeyTypes
 }
 
 func (c *Config) Setup() error {
+	// Stores may keep repositories elsewhere
+	if c.Dir == "" && c.Store != nil {
+		return nil
+	}
+
 	if _, err := os.Stat(c.Dir); err != nil {
 		if err = os.Mkdir(c.Dir, 0755); err != nil {
 			return err
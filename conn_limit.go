@@ -0,0 +1,111 @@
+package gitkit
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrTooManyConnections is the message SSH clients are disconnected with
+// beyond Config.SSHMaxConnections
+var ErrTooManyConnections = errors.New("too many connections")
+
+// disconnectTooManyConnections is the SSH_DISCONNECT_TOO_MANY_CONNECTIONS
+// reason code of RFC 4253
+const disconnectTooManyConnections = 11
+
+// connLimit counts the SSH connections open at once against
+// Config.SSHMaxConnections.
+type connLimit struct {
+	mu    sync.Mutex
+	open  int
+	freed chan struct{} // Closed and renewed whenever a connection closes
+}
+
+// acquire takes a connection slot, waiting for one to be freed if queue is
+// set, until closed is closed. It returns the function freeing the slot, or
+// nil if no slot could be taken.
+func (l *connLimit) acquire(max int, queue bool, closed <-chan struct{}) func() {
+	for {
+		l.mu.Lock()
+		if l.open < max {
+			l.open++
+			l.mu.Unlock()
+			return l.release
+		}
+		if l.freed == nil {
+			l.freed = make(chan struct{})
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		if !queue {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+func (l *connLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.open--
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+}
+
+// disconnectMsg is the SSH_MSG_DISCONNECT message
+type disconnectMsg struct {
+	Reason   uint32 `sshtype:"1"`
+	Message  string
+	Language string
+}
+
+// refuseConnection disconnects a client right after the version exchange,
+// before the key exchange, with the reason of sshd refusing connections
+// beyond its limits, which clients report as "Received disconnect".
+func refuseConnection(conn net.Conn, serverVersion string, message string) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, serverVersion+"\r\n"); err != nil {
+		return err
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		return err
+	}
+
+	// Unencrypted binary packet of RFC 4253, padded to a multiple of 8
+	payload := ssh.Marshal(&disconnectMsg{Reason: disconnectTooManyConnections, Message: message})
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	length := 1 + len(payload) + padding
+	packet := []byte{byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length), byte(padding)}
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+
+	// Let the client read the message before the connection is reset for
+	// the key exchange data left unread
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+	return nil
+}
@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHMaxConnections(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	t.Run("refuse", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), SSHMaxConnections: 1})
+		addr := startSSH(t, server)
+		url := SSHCloneURL("git", addr, repo)
+
+		held, err := ssh.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := runGit(dir, "ls-remote", url)
+		assert.Error(t, err, out)
+		assert.Contains(t, out, "Received disconnect")
+		assert.Contains(t, out, "too many connections")
+		_, err = ssh.Dial("tcp", addr, clientConfig)
+		assert.Error(t, err)
+		if err != nil {
+			assert.Contains(t, err.Error(), "too many connections")
+		}
+
+		held.Close()
+		assert.Eventually(t, func() bool {
+			_, err := runGit(dir, "ls-remote", url)
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), SSHMaxConnections: 1, SSHQueueConnections: true})
+		addr := startSSH(t, server)
+
+		held, err := ssh.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listed := make(chan error, 1)
+		go func() {
+			out, err := runGit(dir, "ls-remote", SSHCloneURL("git", addr, repo))
+			if err != nil {
+				t.Log(out)
+			}
+			listed <- err
+		}()
+
+		select {
+		case err := <-listed:
+			t.Fatalf("connection served beyond the limit: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+		held.Close()
+		select {
+		case err := <-listed:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued connection not served")
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package gitkit
+
+// controls holds the state tests change while a server runs, e.g. injected
+// faults, locks and the clock, along with the methods changing it. Server
+// and SSH embed it, so these methods are the same on both.
+type controls struct {
+	config    *Config
+	emitLocal func(Event) // Emits the push events of server-side changes
+
+	locks         repoLocks
+	faults        faultSet
+	resources     resourceTracker
+	storageErrors storageErrors
+	rejections    rejectionSet
+	clock         clock
+	compression   compressionSet
+	packOptions   packOptionSet
+	features      featureSet
+}
+
+func (c *controls) repoOps() repoOps {
+	return repoOps{config: c.config, resources: &c.resources, storageErrors: &c.storageErrors, rejections: &c.rejections, emit: c.emitLocal}
+}
@@ -1,6 +1,7 @@
 package gitkit
 
 import (
+	"crypto/x509"
 	"net/http"
 )
 
@@ -8,6 +9,11 @@ type Credential struct {
 	Username      string
 	Password      string
 	Authorization string
+	// Digest holds the parameters of Digest authorization headers
+	Digest map[string]string
+	// Certificate is the verified TLS client certificate of the request,
+	// with Config.MutualTLS. Username is then the user it is mapped to.
+	Certificate *x509.Certificate
 }
 
 func getCredential(req *http.Request) Credential {
@@ -20,6 +26,12 @@ func getCredential(req *http.Request) Credential {
 	cred.Username = user
 	cred.Password = pass
 	cred.Authorization = auth
+	cred.Certificate = clientCertificate(req)
+
+	if digest := parseDigest(auth); digest != nil {
+		cred.Username = digest["username"]
+		cred.Digest = digest
+	}
 
 	return cred
 }
@@ -0,0 +1,159 @@
+package gitkit
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	digestRealm    = "gitkit"
+	digestNonceTTL = 10 * time.Minute
+)
+
+var errStaleNonce = fmt.Errorf("stale nonce")
+
+// nonceTracker issues Digest nonces and rejects requests replaying a nonce
+// count that was already used.
+type nonceTracker struct {
+	mu     sync.Mutex
+	nonces map[string]*nonceState
+}
+
+type nonceState struct {
+	issued time.Time
+	count  uint64
+}
+
+func (t *nonceTracker) issue(random io.Reader, now time.Time) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(random, buf); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(buf)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.nonces == nil {
+		t.nonces = map[string]*nonceState{}
+	}
+
+	// Drop expired nonces while we're at it
+	for n, state := range t.nonces {
+		if now.Sub(state.issued) > digestNonceTTL {
+			delete(t.nonces, n)
+		}
+	}
+
+	t.nonces[nonce] = &nonceState{issued: now}
+	return nonce, nil
+}
+
+// check validates the nonce and nonce count of a Digest credential
+func (t *nonceTracker) check(cred Credential, now time.Time) error {
+	if cred.Digest == nil {
+		return fmt.Errorf("digest authorization required")
+	}
+
+	count, err := strconv.ParseUint(cred.Digest["nc"], 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid nonce count: %q", cred.Digest["nc"])
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.nonces[cred.Digest["nonce"]]
+	if !ok || now.Sub(state.issued) > digestNonceTTL {
+		return errStaleNonce
+	}
+
+	if count <= state.count {
+		return fmt.Errorf("replayed nonce count %d", count)
+	}
+	state.count = count
+	return nil
+}
+
+// parseDigest parses the parameters of a Digest authorization header
+func parseDigest(auth string) map[string]string {
+	if !strings.HasPrefix(auth, "Digest ") {
+		return nil
+	}
+
+	params := map[string]string{}
+	rest := strings.TrimSpace(strings.TrimPrefix(auth, "Digest "))
+
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma != -1 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[key] = strings.TrimSpace(value)
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return params
+}
+
+// VerifyDigest checks whether a Digest credential was computed with the
+// given password, for requests made with method. It supports the MD5 and
+// SHA-256 algorithms, with or without qop=auth.
+func VerifyDigest(cred Credential, method string, password string) bool {
+	d := cred.Digest
+	if d == nil {
+		return false
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToUpper(d["algorithm"]) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return false
+	}
+
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := h(d["username"] + ":" + d["realm"] + ":" + password)
+	ha2 := h(method + ":" + d["uri"])
+
+	var expected string
+	if d["qop"] == "" {
+		expected = h(ha1 + ":" + d["nonce"] + ":" + ha2)
+	} else {
+		expected = h(strings.Join([]string{ha1, d["nonce"], d["nc"], d["cnonce"], d["qop"], ha2}, ":"))
+	}
+
+	return expected == d["response"]
+}
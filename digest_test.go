@@ -0,0 +1,97 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Example from RFC 2617, section 3.5
+const rfcDigest = `Digest username="Mufasa", realm="testrealm@host.com", ` +
+	`nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", qop=auth, ` +
+	`nc=00000001, cnonce="0a4f113b", response="6629fae49393a05397450978507c4ef1", ` +
+	`opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+
+func Test_parseDigest(t *testing.T) {
+	params := parseDigest(rfcDigest)
+	assert.Equal(t, map[string]string{
+		"username": "Mufasa",
+		"realm":    "testrealm@host.com",
+		"nonce":    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		"uri":      "/dir/index.html",
+		"qop":      "auth",
+		"nc":       "00000001",
+		"cnonce":   "0a4f113b",
+		"response": "6629fae49393a05397450978507c4ef1",
+		"opaque":   "5ccc069c403ebaf9f0171e9517f40e41",
+	}, params)
+
+	assert.Nil(t, parseDigest("Basic Zm9vOmJhcg=="))
+}
+
+func TestVerifyDigest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost/dir/index.html", nil)
+	req.Header.Set("Authorization", rfcDigest)
+	cred := getCredential(req)
+
+	assert.Equal(t, "Mufasa", cred.Username)
+	assert.True(t, VerifyDigest(cred, "GET", "Circle Of Life"))
+	assert.False(t, VerifyDigest(cred, "GET", "wrong"))
+	assert.False(t, VerifyDigest(cred, "POST", "Circle Of Life"))
+	assert.False(t, VerifyDigest(Credential{}, "GET", "Circle Of Life"))
+}
+
+func TestServerAuthNonces(t *testing.T) {
+	dir, err := os.MkdirTemp("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir, Auth: true, AuthNonces: true})
+	service.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		return cred.Username == "alice" && VerifyDigest(cred, req.Method, "secret"), nil
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/" + repo)
+	u.User = url.UserPassword("alice", "secret")
+	out, err := runGit(dir, "clone", u.String(), "clone")
+	assert.NoError(t, err, out)
+
+	u.User = url.UserPassword("alice", "wrong")
+	out, err = runGit(dir, "-c", "credential.helper=", "clone", u.String(), "wrong")
+	assert.Error(t, err, out)
+
+	// Nonces that were not issued by the server are rejected as stale
+	req, _ := http.NewRequest("GET", server.URL+"/"+repo+"/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Authorization", rfcDigest)
+	resp, err := server.Client().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "stale=true")
+
+	// Replaying a nonce count is rejected
+	nonce, err := service.nonces.issue(service.config.random(), time.Now())
+	assert.NoError(t, err)
+	cred := Credential{Digest: map[string]string{"nonce": nonce, "nc": "00000001"}}
+	assert.NoError(t, service.nonces.check(cred, time.Now()))
+	assert.Error(t, service.nonces.check(cred, time.Now()))
+	cred.Digest["nc"] = "00000002"
+	assert.NoError(t, service.nonces.check(cred, time.Now()))
+
+	// Nonces expire
+	cred.Digest["nc"] = "00000003"
+	assert.Equal(t, errStaleNonce, service.nonces.check(cred, time.Now().Add(digestNonceTTL+time.Minute)))
+}
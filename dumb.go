@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+)
+
+// Files served by the dumb HTTP protocol, relative to the repository
+var dumbFileRegex = regexp.MustCompile(`^(.*?)/(HEAD|info/refs|objects/info/[^/]+|objects/[0-9a-f]{2}/[0-9a-f]{38,62}|objects/pack/pack-[0-9a-f]{40,64}\.(?:pack|idx))$`)
+
+// findDumbService matches requests for static repository files
+func (s *Server) findDumbService(req *http.Request) (*service, string) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, ""
+	}
+
+	matches := dumbFileRegex.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		return nil, ""
+	}
+
+	return &service{method: req.Method, handler: s.getDumbFile}, matches[1]
+}
+
+func (s *Server) getDumbFile(_ string, w http.ResponseWriter, r *Request) {
+	file := dumbFileRegex.FindStringSubmatch(r.URL.Path)[2]
+	fullPath := path.Join(r.RepoPath, file)
+
+	// Repositories that never had their server info generated would
+	// otherwise look empty to dumb clients.
+	if file == "info/refs" && !fileExists(fullPath) {
+		if _, err := gitOutput(s.config.GitPath, r.RepoPath, "update-server-info"); err != nil {
+			s.config.logError("update-server-info", err)
+		}
+	}
+
+	if _, err := os.Stat(fullPath); err != nil {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	w.Header().Set("Content-Type", dumbContentType(file))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r.Request, fullPath)
+}
+
+func dumbContentType(file string) string {
+	switch path.Ext(file) {
+	case ".pack":
+		return "application/x-git-packed-objects"
+	case ".idx":
+		return "application/x-git-packed-objects-toc"
+	}
+
+	if path.Dir(path.Dir(file)) == "objects" && path.Base(path.Dir(file)) != "info" {
+		return "application/x-git-loose-object"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// updateServerInfo refreshes the auxiliary files used by the dumb protocol
+// after refs changed, unless they are configured to go stale.
+func updateServerInfo(config *Config, repoPath string) {
+	if !config.DumbHTTP || config.StaleServerInfo {
+		return
+	}
+
+	if _, err := gitOutput(config.GitPath, repoPath, "update-server-info"); err != nil {
+		config.logError("update-server-info", err)
+	}
+}
@@ -0,0 +1,80 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumbHTTP(t *testing.T) {
+	for _, stale := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stale=%v", stale), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "dumb")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			repo, err := createBareRepo(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			service := New(Config{Dir: dir, DumbHTTP: true, StaleServerInfo: stale})
+			server := httptest.NewServer(service)
+			defer server.Close()
+
+			clone := func(name string) string {
+				target := filepath.Join(dir, name)
+				out, err := exec.Command("git", "clone", server.URL+"/"+repo, target).CombinedOutput()
+				assert.NoError(t, err, string(out))
+
+				cmd := exec.Command("git", "rev-parse", "HEAD")
+				cmd.Dir = target
+				out, err = cmd.CombinedOutput()
+				assert.NoError(t, err, string(out))
+				return strings.TrimSpace(string(out))
+			}
+
+			// info/refs is generated on first access
+			initial := clone("first")
+
+			branch, err := exec.Command("git", "--git-dir", filepath.Join(dir, repo), "symbolic-ref", "--short", "HEAD").Output()
+			assert.NoError(t, err)
+
+			rev, err := service.Commit(repo, strings.TrimSpace(string(branch)), Commit{Files: map[string]string{"a": "b"}})
+			assert.NoError(t, err)
+
+			if stale {
+				assert.Equal(t, initial, clone("second"))
+			} else {
+				assert.Equal(t, rev, clone("second"))
+			}
+		})
+	}
+
+	dir, err := os.MkdirTemp("", "dumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(New(Config{Dir: dir, DumbHTTP: true}))
+	defer server.Close()
+
+	// Smart HTTP is not available
+	resp, err := server.Client().Post(server.URL+"/"+repo+"/git-upload-pack", "application/x-git-upload-pack-request", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+}
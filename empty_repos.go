@@ -0,0 +1,28 @@
+package gitkit
+
+// EmptyRepoAdvertisement is how empty repositories, without any ref, are
+// advertised to clients cloning or fetching them, since servers differ and
+// clients name the initial branch of empty clones after it.
+type EmptyRepoAdvertisement string
+
+const (
+	// EmptyRepoUnborn advertises empty repositories like git 2.31 and later
+	// (default): with a capabilities^{} line and no ref in protocol v0, and
+	// with the unborn HEAD and the branch it points to in protocol v2, which
+	// clients check out.
+	EmptyRepoUnborn EmptyRepoAdvertisement = ""
+	// EmptyRepoCapabilities advertises empty repositories with zero refs in
+	// every protocol version, like servers predating the unborn ls-refs
+	// extension, clients naming the initial branch after their own
+	// init.defaultBranch.
+	EmptyRepoCapabilities EmptyRepoAdvertisement = "capabilities"
+)
+
+// emptyRepoSettings returns the upload-pack settings advertising empty
+// repositories as Config.EmptyRepoAdvertisement asks for.
+func (c *Config) emptyRepoSettings() []string {
+	if c.EmptyRepoAdvertisement == EmptyRepoCapabilities {
+		return []string{"lsrefs.unborn=ignore"}
+	}
+	return []string{"lsrefs.unborn=advertise"}
+}
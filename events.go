@@ -0,0 +1,124 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FetchEvent       = "fetch"
+	PushEvent        = "push"
+	AuthSuccessEvent = "auth.success"
+	AuthFailureEvent = "auth.failure"
+)
+
+const (
+	HTTPTransport = "http"
+	SSHTransport  = "ssh"
+)
+
+// Event describes something a client did against the server
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Transport  string    `json:"transport"`
+	Repo       string    `json:"repo,omitempty"`
+	User       string    `json:"user,omitempty"`
+	KeyID      string    `json:"key_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Refs lists the refs updated by a push
+	Refs []RefChange `json:"refs,omitempty"`
+}
+
+// eventLog dispatches server events to the journal file and the
+// user-defined callback.
+type eventLog struct {
+	mu sync.Mutex
+}
+
+// emit records an event, masking credentials and the given secrets in its
+// error message.
+func (l *eventLog) emit(config *Config, fn func(Event), event Event, secrets ...string) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Error != "" {
+		event.Error = config.redact(event.Error, secrets...)
+	}
+
+	if config.EventJournal != "" {
+		if err := l.append(config.EventJournal, event); err != nil {
+			config.logError("event-journal", err)
+		}
+	}
+
+	if fn != nil {
+		fn(event)
+	}
+}
+
+// append writes the event as a single JSON line at the end of the journal
+func (l *eventLog) append(path string, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// ReadEventJournal reads back all events stored in a journal file
+func ReadEventJournal(path string) ([]Event, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		event := Event{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// serviceEvent returns the event type for a git service, in either its
+// dashed or spaced form.
+func serviceEvent(service string) string {
+	switch subCommand(strings.Replace(service, " ", "-", 1)) {
+	case "upload-pack":
+		return FetchEvent
+	case "receive-pack":
+		return PushEvent
+	}
+	return ""
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
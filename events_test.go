@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventJournal(t *testing.T) {
+	dir, err := os.MkdirTemp("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal := filepath.Join(dir, "events.jsonl")
+	received := []Event{}
+
+	service := New(Config{Dir: dir, EventJournal: journal, ChangedFiles: true})
+	service.OnEvent = func(e Event) {
+		received = append(received, e)
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	clone := filepath.Join(dir, "clone")
+	out, err := exec.Command("git", "clone", server.URL+"/"+repo, clone).CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	if err := os.WriteFile(filepath.Join(clone, "notes.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"add", "notes.txt"},
+		{"-c", "user.email=test@gitkit.com", "-c", "user.name=test-user", "commit", "-m", "notes"},
+		{"push", "origin", "HEAD"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = clone
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+
+	events, err := ReadEventJournal(journal)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, received, events)
+
+	assert.Equal(t, FetchEvent, events[0].Type)
+	assert.Equal(t, PushEvent, events[1].Type)
+	assert.Nil(t, events[0].Refs)
+	assert.Len(t, events[1].Refs, 1)
+	assert.Equal(t, "heads", events[1].Refs[0].RefType)
+	assert.Equal(t, []string{"notes.txt"}, events[1].Refs[0].Files)
+
+	for _, e := range events {
+		assert.Equal(t, HTTPTransport, e.Transport)
+		assert.Equal(t, repo, e.Repo)
+		assert.Empty(t, e.Error)
+		assert.False(t, e.Time.IsZero())
+	}
+}
@@ -0,0 +1,91 @@
+package gitkit
+
+import (
+	"sync"
+	"time"
+)
+
+// FaultPhase is a step of a FaultSchedule
+type FaultPhase struct {
+	// Duration of the phase. A zero or negative duration lasts until the
+	// schedule is stopped.
+	Duration time.Duration
+	// Fault injected during the phase, nil for a healthy server
+	Fault *Fault
+}
+
+// FaultSchedule injects faults on a timeline, e.g. healthy for 30s, then a
+// 10s outage, then degraded latency, to check how long-running clients
+// recover in soak tests.
+type FaultSchedule struct {
+	Phases []FaultPhase
+	// Repeat restarts from the first phase after the last one. Otherwise the
+	// server is healthy once the last phase is over.
+	Repeat bool
+	// OnPhase, if set, is called with the index of each phase as it starts,
+	// e.g. to mark outages on test dashboards.
+	OnPhase func(phase int)
+}
+
+// schedule runs the schedule for the repository in the background, until
+// the returned function is called or the last phase is over. Stopping the
+// schedule clears the fault.
+func (f *faultSet) schedule(repo string, schedule FaultSchedule) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer f.set(repo, nil)
+
+		for {
+			for i, phase := range schedule.Phases {
+				f.set(repo, phase.Fault)
+				if schedule.OnPhase != nil {
+					schedule.OnPhase(i)
+				}
+
+				if !waitPhase(phase.Duration, stop) {
+					return
+				}
+			}
+			if !schedule.Repeat || len(schedule.Phases) == 0 {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// ScheduleFaults injects the faults of the schedule for the repository, or
+// every repository with an empty name, replacing any fault injected with
+// InjectFault. Call the returned function to stop the schedule and clear the
+// fault.
+func (c *controls) ScheduleFaults(repo string, schedule FaultSchedule) (stop func()) {
+	return c.faults.schedule(repo, schedule)
+}
+
+// waitPhase waits for the duration, forever if zero or negative, and returns
+// false if stopped before.
+func waitPhase(d time.Duration, stop <-chan struct{}) bool {
+	if d <= 0 {
+		<-stop
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,220 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Fault makes the server reject requests for a repository with an error
+type Fault struct {
+	// StatusCode is the HTTP status code, defaults to 503
+	StatusCode int `json:"status_code,omitempty"`
+	// Message is sent in the HTTP response body, and as an ERR pkt-line over SSH
+	Message string `json:"message,omitempty"`
+	// MessageSize repeats the message up to this many bytes, possibly cutting
+	// the last character, to test how clients handle very long errors. Over
+	// SSH, the message is cut to fit in a pkt-line.
+	MessageSize int `json:"message_size,omitempty"`
+	// Latin1 encodes the message in ISO-8859-1 instead of UTF-8, like servers
+	// running with a legacy locale. Characters outside of Latin-1 become "?".
+	Latin1 bool `json:"latin1,omitempty"`
+	// Hints are provider-style hints added to HTTP responses
+	Hints *ErrorHints `json:"hints,omitempty"`
+	// Latency delays requests before failing them. A fault with only a
+	// latency lets requests through after the delay, simulating a degraded
+	// server. SSHFault delays the phases of SSH connections instead.
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// ErrorHints are the retry and rate limit hints git hosting providers add
+// to their error responses.
+type ErrorHints struct {
+	// RetryAfter sets the Retry-After header, in seconds
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+	// RateLimit enables the X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset headers
+	RateLimit          bool      `json:"rate_limit,omitempty"`
+	RateLimitLimit     int       `json:"rate_limit_limit,omitempty"`
+	RateLimitRemaining int       `json:"rate_limit_remaining,omitempty"`
+	RateLimitReset     time.Time `json:"rate_limit_reset,omitempty"`
+	// JSON sends the message as a GitLab-style {"message": "..."} body
+	JSON bool `json:"json,omitempty"`
+}
+
+// faultSet holds the faults injected per repository. The empty repository
+// name applies to all repositories.
+type faultSet struct {
+	mu     sync.RWMutex
+	faults map[string]Fault
+}
+
+func (f *faultSet) set(repo string, fault *Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.faults == nil {
+		f.faults = map[string]Fault{}
+	}
+
+	if fault == nil {
+		delete(f.faults, lockKey(repo))
+	} else {
+		f.faults[lockKey(repo)] = *fault
+	}
+}
+
+func (f *faultSet) get(repo string) *Fault {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if fault, ok := f.faults[lockKey(repo)]; ok {
+		return &fault
+	}
+	if fault, ok := f.faults[""]; ok {
+		return &fault
+	}
+	return nil
+}
+
+// all returns a copy of the faults by repository
+func (f *faultSet) all() map[string]Fault {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	faults := map[string]Fault{}
+	for repo, fault := range f.faults {
+		faults[repo] = fault
+	}
+	return faults
+}
+
+func (f Fault) statusCode() int {
+	if f.StatusCode == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return f.StatusCode
+}
+
+func (f Fault) message() string {
+	if f.Message == "" {
+		return http.StatusText(f.statusCode())
+	}
+	return f.Message
+}
+
+// delay waits for the latency of the fault, then reports whether the request
+// should fail.
+func (f Fault) delay() bool {
+	time.Sleep(f.Latency)
+	return f.Latency == 0 || f.StatusCode != 0 || f.Message != ""
+}
+
+// body returns the message as sent to clients, encoded and padded
+func (f Fault) body() string {
+	message := f.message()
+	if f.Latin1 {
+		message = latin1(message)
+	}
+	if f.MessageSize > len(message) {
+		message = strings.Repeat(message, f.MessageSize/len(message)+1)[:f.MessageSize]
+	}
+	return message
+}
+
+// latin1 encodes s in ISO-8859-1
+func latin1(s string) string {
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			r = '?'
+		}
+		encoded = append(encoded, byte(r))
+	}
+	return string(encoded)
+}
+
+// InjectFault makes all requests and commands for the repository fail with
+// the fault, until ClearFault is called. An empty repository name applies the fault to
+// every repository.
+func (c *controls) InjectFault(repo string, fault Fault) {
+	c.faults.set(repo, &fault)
+}
+
+// ClearFault removes a fault injected with InjectFault.
+func (c *controls) ClearFault(repo string) {
+	c.faults.set(repo, nil)
+}
+
+// writeFault sends the HTTP error response of a fault
+func writeFault(w http.ResponseWriter, fault *Fault) {
+	if fault.Latin1 {
+		w.Header().Set("Content-Type", "text/plain; charset=iso-8859-1")
+	}
+	writeError(w, fault.statusCode(), fault.body(), fault.Hints)
+}
+
+// writeError sends an HTTP error response along with the optional hints
+func writeError(w http.ResponseWriter, status int, message string, hints *ErrorHints) {
+	if hints == nil {
+		textError(w, status, message)
+		return
+	}
+
+	h := w.Header()
+	if hints.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(hints.RetryAfter.Round(time.Second)/time.Second)))
+	}
+	if hints.RateLimit {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(hints.RateLimitLimit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(hints.RateLimitRemaining))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(hints.RateLimitReset.Unix(), 10))
+	}
+
+	if !hints.JSON {
+		textError(w, status, message)
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{"message": message})
+	if err != nil {
+		textError(w, status, message)
+		return
+	}
+
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// textError is http.Error, keeping the content type if already set
+func textError(w http.ResponseWriter, status int, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, message)
+}
+
+// rejectCommand replies to an exec request with an ERR pkt-line, which git
+// clients display as "remote error: <message>". Messages too long for a
+// pkt-line are cut.
+func rejectCommand(ch ssh.Channel, req *ssh.Request, message string) {
+	if max := maxPktPayload - len("ERR \n"); len(message) > max {
+		message = message[:max]
+	}
+
+	req.Reply(true, nil)
+	packLine(ch, "ERR "+message+"\n")
+	ch.SendRequest("exit-status", false, []byte{0, 0, 0, 1})
+}
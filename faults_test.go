@@ -0,0 +1,213 @@
+package gitkit
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerFaultHints(t *testing.T) {
+	dir, err := os.MkdirTemp("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	reset := time.Unix(1700000000, 0)
+	service.InjectFault(repo, Fault{
+		StatusCode: 429,
+		Message:    "slow down",
+		Hints: &ErrorHints{
+			RetryAfter:         90 * time.Second,
+			RateLimit:          true,
+			RateLimitLimit:     60,
+			RateLimitRemaining: 0,
+			RateLimitReset:     reset,
+			JSON:               true,
+		},
+	})
+
+	resp, err := server.Client().Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "90", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "60", resp.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1700000000", resp.Header.Get("X-RateLimit-Reset"))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"message":"slow down"}`, strings.TrimSpace(string(body)))
+
+	service.ClearFault(repo)
+	service.InjectFault("", Fault{})
+	resp, err = server.Client().Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+
+	service.ClearFault("")
+	out, err := runGit(dir, "clone", server.URL+"/"+repo, "clone")
+	assert.NoError(t, err, out)
+}
+
+func TestSSHFault(t *testing.T) {
+	dir, err := os.MkdirTemp("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+
+	server.InjectFault("", Fault{Message: "try again later"})
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "remote error: try again later")
+}
+
+func TestLongFaultMessages(t *testing.T) {
+	dir, err := os.MkdirTemp("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	service.InjectFault(repo, Fault{Message: "dépôt ✋ ", MessageSize: 10000, Latin1: true})
+	resp, err := server.Client().Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=iso-8859-1", resp.Header.Get("Content-Type"))
+	assert.Len(t, body, 10001)
+	assert.True(t, strings.HasPrefix(string(body), "d\xe9p\xf4t ? d\xe9p\xf4t ? "))
+
+	ssh := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, ssh)
+
+	ssh.InjectFault("", Fault{Message: "x", MessageSize: 100000})
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "remote error: "+strings.Repeat("x", 1000))
+}
+
+func TestScheduleFaults(t *testing.T) {
+	dir, err := os.MkdirTemp("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	status := func() (int, time.Duration) {
+		start := time.Now()
+		resp, err := server.Client().Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, time.Since(start)
+	}
+
+	phases := make(chan int)
+	stop := service.ScheduleFaults(repo, FaultSchedule{
+		Phases: []FaultPhase{
+			{Duration: 50 * time.Millisecond},
+			{Duration: 50 * time.Millisecond, Fault: &Fault{StatusCode: 500}},
+			{Fault: &Fault{Latency: 200 * time.Millisecond}},
+		},
+		OnPhase: func(phase int) { phases <- phase },
+	})
+	defer stop()
+
+	assert.Equal(t, 0, <-phases)
+	code, _ := status()
+	assert.Equal(t, 200, code)
+
+	assert.Equal(t, 1, <-phases)
+	code, _ = status()
+	assert.Equal(t, 500, code)
+
+	assert.Equal(t, 2, <-phases)
+	code, elapsed := status()
+	assert.Equal(t, 200, code)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(200*time.Millisecond))
+
+	stop()
+	code, elapsed = status()
+	assert.Equal(t, 200, code)
+	assert.Less(t, int64(elapsed), int64(200*time.Millisecond))
+
+	// Repeating schedules loop until stopped
+	stop = service.ScheduleFaults("", FaultSchedule{
+		Phases: []FaultPhase{
+			{Duration: 10 * time.Millisecond, Fault: &Fault{}},
+			{Duration: 10 * time.Millisecond},
+		},
+		Repeat:  true,
+		OnPhase: func(phase int) { phases <- phase },
+	})
+	for _, phase := range []int{0, 1, 0, 1} {
+		assert.Equal(t, phase, <-phases)
+	}
+	go func() {
+		for range phases {
+		}
+	}()
+	stop()
+	close(phases)
+	code, _ = status()
+	assert.Equal(t, 200, code)
+
+	// Negative durations last until stopped instead of looping
+	started := 0
+	stop = service.ScheduleFaults("", FaultSchedule{
+		Phases:  []FaultPhase{{Duration: -time.Second}},
+		Repeat:  true,
+		OnPhase: func(int) { started++ },
+	})
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	assert.Equal(t, 1, started)
+}
@@ -0,0 +1,84 @@
+package gitkit
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Feature is the name of an experimental behavior, disabled unless
+// enabled in Config.Features or with SetFeature, so that consumers can opt in
+// to it gradually.
+type Feature string
+
+const (
+	// FeatureRequireProtocolV2 refuses HTTP fetches and clones not asking for
+	// protocol v2 with Config.ProtocolV2, like a server dropping protocol
+	// v0. Pushes, which have no protocol v2, are still served.
+	FeatureRequireProtocolV2 Feature = "require-protocol-v2"
+)
+
+// knownFeatures are the features the server implements
+var knownFeatures = map[Feature]bool{
+	FeatureRequireProtocolV2: true,
+}
+
+// KnownFeatures returns the names of the features the server implements
+func KnownFeatures() []Feature {
+	features := []Feature{}
+	for feature := range knownFeatures {
+		features = append(features, feature)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	return features
+}
+
+func checkFeature(feature Feature) error {
+	if !knownFeatures[feature] {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	return nil
+}
+
+// featureSet holds the features toggled at runtime, overriding the ones of
+// Config.Features.
+type featureSet struct {
+	mu      sync.RWMutex
+	toggled map[Feature]bool
+}
+
+func (f *featureSet) set(feature Feature, enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.toggled == nil {
+		f.toggled = map[Feature]bool{}
+	}
+	f.toggled[feature] = enabled
+}
+
+func (f *featureSet) enabled(config *Config, feature Feature) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if enabled, ok := f.toggled[feature]; ok {
+		return enabled
+	}
+	return config.Features[feature]
+}
+
+// FeatureEnabled tells whether the feature is enabled, with SetFeature or
+// else in Config.Features.
+func (c *controls) FeatureEnabled(feature Feature) bool {
+	return c.features.enabled(c.config, feature)
+}
+
+// SetFeature enables or disables the feature while the server runs,
+// overriding Config.Features. It fails for unknown features.
+func (c *controls) SetFeature(feature Feature, enabled bool) error {
+	if err := checkFeature(feature); err != nil {
+		return err
+	}
+	c.features.set(feature, enabled)
+	return nil
+}
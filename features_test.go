@@ -0,0 +1,50 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatures(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir, ProtocolV2: true, Features: map[Feature]bool{FeatureRequireProtocolV2: true}})
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	url := HTTPCloneURL(ts.Listener.Addr().String(), repo)
+
+	assert.True(t, service.FeatureEnabled(FeatureRequireProtocolV2))
+	out, err := runGit(dir, "-c", "protocol.version=0", "ls-remote", url)
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "protocol v2 required")
+	out, err = runGit(dir, "-c", "protocol.version=2", "ls-remote", url)
+	assert.NoError(t, err, out)
+
+	// Pushes have no protocol v2
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err = runGit(dir, "-c", "protocol.version=2", "clone", url, clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "file")
+	out, err = runGit(clone, "push", "origin", "master")
+	assert.NoError(t, err, out)
+
+	// Toggled at runtime
+	assert.NoError(t, service.SetFeature(FeatureRequireProtocolV2, false))
+	assert.False(t, service.FeatureEnabled(FeatureRequireProtocolV2))
+	out, err = runGit(dir, "-c", "protocol.version=0", "ls-remote", url)
+	assert.NoError(t, err, out)
+
+	assert.Error(t, service.SetFeature("process-pool", true))
+	assert.Contains(t, KnownFeatures(), FeatureRequireProtocolV2)
+	err = (&Config{Dir: dir, Features: map[Feature]bool{"process-pool": true}}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `Features: unknown feature "process-pool"`)
+	}
+}
@@ -0,0 +1,122 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// FilterPolicy restricts the upload-pack requests allowed to use object
+// filters with Config.PartialClone, to reproduce servers supporting filters
+// inconsistently, which forces clients into their fallback logic. Filters
+// are advertised either way.
+type FilterPolicy string
+
+const (
+	// FilterAlways accepts filters in all requests (default)
+	FilterAlways FilterPolicy = ""
+	// FilterClonesOnly accepts filters in clones, refusing them in later
+	// fetches, including the lazy fetches of missing objects
+	FilterClonesOnly FilterPolicy = "clones"
+	// FilterFetchesOnly refuses filters in clones, accepting them in later
+	// fetches
+	FilterFetchesOnly FilterPolicy = "fetches"
+)
+
+// fetchRequest sums up an upload-pack request body
+type fetchRequest struct {
+	wants    []string
+	haves    int
+	filtered bool
+}
+
+// parseFetchRequest reads the wants, haves and filter of a protocol v0 or v2
+// upload-pack request body.
+func parseFetchRequest(r io.Reader) (*fetchRequest, error) {
+	req := &fetchRequest{}
+	for {
+		line, err := readPktLine(r)
+		if err == io.EOF {
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Fields(strings.SplitN(string(line), "\x00", 2)[0])
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "want":
+			req.wants = append(req.wants, fields[1])
+		case "have":
+			req.haves++
+		case "filter":
+			req.filtered = true
+		}
+	}
+}
+
+// clone tells whether the request fetches refs from scratch, wanting only
+// ref tips without having any object, rather than updating a clone or
+// fetching missing objects.
+func (f *fetchRequest) clone(refs map[string]string) bool {
+	if f.haves > 0 {
+		return false
+	}
+	tips := map[string]bool{}
+	for _, rev := range refs {
+		tips[rev] = true
+	}
+	for _, want := range f.wants {
+		if !tips[want] {
+			return false
+		}
+	}
+	return true
+}
+
+// refuseFilter answers filtered upload-pack requests refused by
+// Config.FilterPolicy with an ERR pkt-line, and returns the body to pass to
+// git otherwise.
+func (s *Server) refuseFilter(w http.ResponseWriter, r *Request, body io.Reader) (io.Reader, bool) {
+	if !s.config.PartialClone || s.config.FilterPolicy == FilterAlways {
+		return body, true
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		s.fail500(w, "post-rpc", err)
+		return nil, false
+	}
+	req, err := parseFetchRequest(bytes.NewReader(data))
+	if err != nil {
+		s.fail500(w, "post-rpc", err)
+		return nil, false
+	}
+	if !req.filtered || len(req.wants) == 0 {
+		return bytes.NewReader(data), true
+	}
+
+	clone := req.clone(snapshotRefs(&s.config, r.RepoPath))
+	if clone == (s.config.FilterPolicy == FilterClonesOnly) {
+		return bytes.NewReader(data), true
+	}
+
+	message := "filtering not supported for fetches"
+	if clone {
+		message = "filtering not supported for clones"
+	}
+	s.config.logError("post-rpc", fmt.Errorf("%s: %s", r.RepoName, message))
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	packLine(w, "ERR "+message+"\n")
+
+	user, _, _ := r.BasicAuth()
+	s.emit(r, Event{Type: FetchEvent, User: user, Error: message})
+	return nil, false
+}
@@ -0,0 +1,291 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config fields depending on the machine running the server, which the
+// fixture leaves to the test recreating it.
+var fixtureSkippedFields = map[string]bool{
+	"Dir":                  true,
+	"KeyDir":               true,
+	"GitPath":              true,
+	"TempDir":              true,
+	"EventJournal":         true,
+	"HostKeyFiles":         true,
+	"HostCA":               true,
+	"HostCertificateFiles": true,
+	"Users":                true,
+	"Store":                true,
+	"ClockSkew":            true, // Exported with the current skew
+}
+
+// GoFixture returns Go statements recreating the server in a test: its
+// repositories with the files of every branch, its config, users and
+// injected faults. It captures a scenario tuned by hand, e.g. through the
+// REST API, to turn a bug reproduction into a regression test. The
+// statements expect a *testing.T named t and a directory named dir to hold
+// the repositories. History, tags and user passwords are not exported.
+func (s *Server) GoFixture() (string, error) {
+	state, err := s.State()
+	if err != nil {
+		return "", err
+	}
+	return goFixture("New", &s.config, state, s.repoOps())
+}
+
+// GoFixture returns Go statements recreating the server in a test, like
+// Server.GoFixture, host keys being generated in the keys subdirectory of
+// dir.
+func (s *SSH) GoFixture() (string, error) {
+	state, err := s.State()
+	if err != nil {
+		return "", err
+	}
+	return goFixture("NewSSH", s.gitConfig, state, s.repoOps())
+}
+
+func goFixture(constructor string, config *Config, state *State, ops repoOps) (string, error) {
+	b := &bytes.Buffer{}
+
+	if len(state.Repos) > 0 {
+		fmt.Fprintf(b, "for _, repo := range %s {\n", goLiteral(reflect.ValueOf(state.Repos)))
+		fmt.Fprintf(b, "if _, err := (&gitkit.FSStore{Dir: dir}).Create(repo); err != nil {\nt.Fatal(err)\n}\n}\n")
+	}
+
+	if config.Users != nil {
+		fmt.Fprintf(b, "\n// Passwords are not exported\nusers := gitkit.NewUserStore()\n")
+		for _, name := range config.Users.Users() {
+			user, _ := config.Users.User(name)
+			fmt.Fprintf(b, "if err := users.AddUser(%q, \"\"); err != nil {\nt.Fatal(err)\n}\n", name)
+			for _, key := range user.PublicKeys {
+				fmt.Fprintf(b, "if err := users.AddPublicKey(%q, %q); err != nil {\nt.Fatal(err)\n}\n", name, strings.TrimSpace(key))
+			}
+			if user.Disabled {
+				fmt.Fprintf(b, "if err := users.SetEnabled(%q, false); err != nil {\nt.Fatal(err)\n}\n", name)
+			}
+		}
+	}
+
+	fmt.Fprintf(b, "\nservice := gitkit.%s(gitkit.Config{\nDir: dir,\n", constructor)
+	if constructor == "NewSSH" {
+		fmt.Fprintf(b, "KeyDir: filepath.Join(dir, \"keys\"),\n")
+	}
+	if config.Users != nil {
+		fmt.Fprintf(b, "Users: users,\n")
+	}
+	b.WriteString(goFields(reflect.ValueOf(*config), fixtureSkippedFields))
+	fmt.Fprintf(b, "})\n")
+
+	for _, repo := range state.Repos {
+		if err := goBranches(b, repo, ops); err != nil {
+			return "", err
+		}
+	}
+
+	if len(state.Faults)+len(state.LockedRepos)+len(state.StorageErrors)+len(state.PushRejections) > 0 ||
+		state.TLSFault != nil || state.SSHFault != nil || state.ClockSkew != 0 {
+		b.WriteString("\n")
+	}
+	for _, repo := range sortedKeys(state.Faults) {
+		fmt.Fprintf(b, "service.InjectFault(%q, %s)\n", repo, goLiteral(reflect.ValueOf(state.Faults[repo])))
+	}
+	for _, repo := range state.LockedRepos {
+		fmt.Fprintf(b, "service.Lock(%q)\n", repo)
+	}
+	for _, repo := range sortedKeys(state.StorageErrors) {
+		fmt.Fprintf(b, "service.InjectStorageError(%q, errors.New(%q))\n", repo, state.StorageErrors[repo])
+	}
+	for _, repo := range sortedKeys(state.PushRejections) {
+		fmt.Fprintf(b, "service.RejectPushes(%q, %s)\n", repo, goLiteral(reflect.ValueOf(state.PushRejections[repo])))
+	}
+	if state.TLSFault != nil {
+		fmt.Fprintf(b, "service.InjectTLSFault(%s)\n", goLiteral(reflect.ValueOf(*state.TLSFault)))
+	}
+	if state.SSHFault != nil {
+		fmt.Fprintf(b, "if err := service.InjectSSHFault(%s); err != nil {\nt.Fatal(err)\n}\n", goLiteral(reflect.ValueOf(*state.SSHFault)))
+	}
+	if state.ClockSkew != 0 {
+		fmt.Fprintf(b, "service.SetClockSkew(%s)\n", goDuration(state.ClockSkew))
+	}
+
+	return formatStatements(b.String())
+}
+
+// goBranches writes the commits recreating the tip of every branch of a
+// repository.
+func goBranches(b *bytes.Buffer, repo string, ops repoOps) error {
+	dir, err := ops.repoPath(repo)
+	if err != nil {
+		return err
+	}
+	out, err := ops.git(dir, nil, "", "for-each-ref", "--format=%(refname:strip=2)", "refs/heads")
+	if err != nil {
+		return err
+	}
+
+	for _, branch := range strings.Fields(out) {
+		ref := "refs/heads/" + branch
+		info, err := gitExec(ops.config.GitPath, dir, nil, "", "log", "-1", "--format=%an%x00%ae%x00%at%x00%B", ref)
+		if err != nil {
+			return err
+		}
+		fields := strings.SplitN(string(info), "\x00", 4)
+		if len(fields) != 4 {
+			return fmt.Errorf("unexpected commit of %s in %s: %q", branch, repo, info)
+		}
+		date, _ := strconv.ParseInt(fields[2], 10, 64)
+
+		commit := Commit{
+			AuthorName:  fields[0],
+			AuthorEmail: fields[1],
+			Message:     strings.TrimRight(fields[3], "\n"),
+			Date:        time.Unix(date, 0).UTC(),
+			Files:       map[string]string{},
+		}
+
+		tree, err := gitExec(ops.config.GitPath, dir, nil, "", "ls-tree", "-r", "-z", "--full-tree", ref)
+		if err != nil {
+			return err
+		}
+		for _, entry := range strings.Split(string(tree), "\x00") {
+			tab := strings.Index(entry, "\t")
+			if tab < 0 {
+				continue
+			}
+			meta := strings.Fields(entry[:tab])
+			if len(meta) != 3 || meta[1] != "blob" {
+				continue
+			}
+			content, err := gitExec(ops.config.GitPath, dir, nil, "", "cat-file", "blob", meta[2])
+			if err != nil {
+				return err
+			}
+			commit.Files[entry[tab+1:]] = string(content)
+		}
+
+		fmt.Fprintf(b, "if _, err := service.Commit(%q, %q, %s); err != nil {\nt.Fatal(err)\n}\n", repo, branch, goLiteral(reflect.ValueOf(commit)))
+	}
+	return nil
+}
+
+// formatStatements gofmts Go statements
+func formatStatements(statements string) (string, error) {
+	const header = "package fixture\n\nfunc fixture() {\n"
+
+	src, err := format.Source([]byte(header + statements + "}\n"))
+	if err != nil {
+		return "", fmt.Errorf("invalid fixture: %v", err)
+	}
+
+	body := strings.TrimSuffix(strings.TrimPrefix(string(src), header), "}\n")
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, "\t")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// goFields returns the non-zero exported fields of a struct as Go key-value
+// pairs, one per line, leaving out the skipped fields and the ones that have
+// no literal such as funcs.
+func goFields(v reflect.Value, skipped map[string]bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+		if field.PkgPath != "" || skipped[field.Name] || value.IsZero() {
+			continue
+		}
+		if literal := goLiteral(value); literal != "" {
+			fmt.Fprintf(b, "%s: %s,\n", field.Name, literal)
+		}
+	}
+	return b.String()
+}
+
+// goLiteral returns a Go expression for a value, empty if it has none
+func goLiteral(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return goDuration(value)
+	case time.Time:
+		return fmt.Sprintf("time.Unix(%d, %d).UTC()", value.Unix(), value.Nanosecond())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		if literal := goLiteral(v.Elem()); literal != "" {
+			return "&" + literal
+		}
+	case reflect.Struct:
+		return fmt.Sprintf("gitkit.%s{\n%s}", v.Type().Name(), goFields(v, nil))
+	case reflect.Slice:
+		elems := []string{}
+		for i := 0; i < v.Len(); i++ {
+			elems = append(elems, goLiteral(v.Index(i)))
+		}
+		return fmt.Sprintf("%s{%s}", v.Type(), strings.Join(elems, ", "))
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return ""
+		}
+		keys := []string{}
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		entries := &strings.Builder{}
+		for _, key := range keys {
+			fmt.Fprintf(entries, "%q: %s,\n", key, goLiteral(v.MapIndex(reflect.ValueOf(key))))
+		}
+		return fmt.Sprintf("%s{\n%s}", v.Type(), entries)
+	}
+	return ""
+}
+
+// goDuration returns a Go expression for a duration, in the largest unit
+// dividing it
+func goDuration(d time.Duration) string {
+	for _, unit := range []struct {
+		duration time.Duration
+		name     string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+	} {
+		if d%unit.duration == 0 {
+			return fmt.Sprintf("%d * %s", d/unit.duration, unit.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", int64(d))
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,63 @@
+package gitkit
+
+import (
+	"errors"
+	"go/parser"
+	"go/token"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoFixture(t *testing.T) {
+	dir, err := os.MkdirTemp("", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	users := NewUserStore()
+	if err := users.AddUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	service := New(Config{Dir: dir, AutoCreate: true, Auth: true, Users: users, AuthCacheTTL: time.Minute})
+
+	if _, err := service.config.repoStore().Create("repo.git"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Commit("repo.git", "main", Commit{
+		Message: "Add files",
+		Files:   map[string]string{"docs/README.md": "# Hello\n", "data.bin": "\x00\x01"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	service.InjectFault("repo.git", Fault{StatusCode: 502, Latency: 2 * time.Second})
+	service.Lock("")
+	service.InjectStorageError("repo.git", errors.New("disk full"))
+	service.SetClockSkew(-time.Hour)
+
+	fixture, err := service.GoFixture()
+	assert.NoError(t, err)
+
+	_, err = parser.ParseFile(token.NewFileSet(), "", "package fixture\nfunc fixture() {\n"+fixture+"}\n", 0)
+	assert.NoError(t, err, fixture)
+	for _, statement := range []string{
+		`for _, repo := range []string{"repo.git"} {`,
+		`if err := users.AddUser("alice", ""); err != nil {`,
+		`service := gitkit.New(gitkit.Config{`,
+		`AuthCacheTTL: 1 * time.Minute,`,
+		`if _, err := service.Commit("repo.git", "main", gitkit.Commit{`,
+		`"docs/README.md": "# Hello\n",`,
+		`"data.bin":       "\x00\x01",`,
+		`Latency:    2 * time.Second,`,
+		`service.Lock("")`,
+		`service.InjectStorageError("repo.git", errors.New("disk full"))`,
+		`service.SetClockSkew(-1 * time.Hour)`,
+	} {
+		assert.Contains(t, fixture, statement)
+	}
+	assert.NotContains(t, fixture, "secret")
+	assert.NotContains(t, fixture, dir)
+}
@@ -2,11 +2,12 @@ package gitkit
 
 import (
 	"fmt"
+	"path"
 	"regexp"
 	"strings"
 )
 
-var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack) '(.*)'$`)
+var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack) '?([^']*)'?$`)
 
 type GitCommand struct {
 	Command  string
@@ -20,11 +21,67 @@ func ParseGitCommand(cmd string) (*GitCommand, error) {
 		return nil, fmt.Errorf("invalid git command")
 	}
 
+	repo, err := normalizeRepoPath(matches[0][2])
+	if err != nil {
+		return nil, err
+	}
+
 	result := &GitCommand{
 		Original: cmd,
 		Command:  matches[0][1],
-		Repo:     strings.Replace(matches[0][2], "/", "", 1),
+		Repo:     repo,
 	}
 
 	return result, nil
 }
+
+// normalizeRepoPath turns the path sent by clients into a repository name
+// relative to the server root. ssh:// URLs send "/repo.git" while scp-like
+// ones send "repo.git", and both may start with "~/", which is the server
+// root here.
+func normalizeRepoPath(repoPath string) (string, error) {
+	repoPath = strings.TrimPrefix(strings.TrimLeft(repoPath, "/"), "~/")
+	repoPath = path.Clean("/" + repoPath)
+	repoPath = strings.TrimPrefix(repoPath, "/")
+
+	if repoPath == "" || repoPath == "~" {
+		return "", fmt.Errorf("invalid repository path")
+	}
+	return repoPath, nil
+}
+
+// resolveHome resolves the repository of a command whose path is relative
+// to the home directory of a user, "~/" standing for the one of user, with
+// Config.SSHHomeDirs.
+func (c *Config) resolveHome(gitcmd *GitCommand, user string) (string, error) {
+	matches := gitCommandRegex.FindStringSubmatch(gitcmd.Original)
+	if len(c.SSHHomeDirs) == 0 || matches == nil {
+		return gitcmd.Repo, nil
+	}
+
+	repoPath := strings.TrimLeft(matches[2], "/")
+	if !strings.HasPrefix(repoPath, "~") {
+		return gitcmd.Repo, nil
+	}
+	home, rest := repoPath[1:], ""
+	if i := strings.Index(home, "/"); i >= 0 {
+		home, rest = home[:i], home[i+1:]
+	}
+
+	if home == "" {
+		home = user
+		if _, ok := c.SSHHomeDirs[home]; !ok {
+			return gitcmd.Repo, nil
+		}
+	}
+	root, ok := c.SSHHomeDirs[home]
+	if !ok {
+		return "", fmt.Errorf("%s: unknown user %s", repoPath, home)
+	}
+
+	repo, err := normalizeRepoPath(rest)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(root, repo), nil
+}
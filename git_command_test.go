@@ -1,6 +1,7 @@
 package gitkit
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,6 +17,12 @@ func TestParseGitCommand(t *testing.T) {
 		"git receive-pack 'hello.git'":       GitCommand{"git receive-pack", "hello.git", "git receive-pack 'hello.git'"},
 		"git-upload-archive 'hello.git'":     GitCommand{"git-upload-archive", "hello.git", "git-upload-archive 'hello.git'"},
 		"git upload-archive 'hello.git'":     GitCommand{"git upload-archive", "hello.git", "git upload-archive 'hello.git'"},
+		"git-upload-pack 'hello/world.git'":  GitCommand{"git-upload-pack", "hello/world.git", "git-upload-pack 'hello/world.git'"},
+		"git-upload-pack '~/hello.git'":      GitCommand{"git-upload-pack", "hello.git", "git-upload-pack '~/hello.git'"},
+		"git-upload-pack '/~/hello.git'":     GitCommand{"git-upload-pack", "hello.git", "git-upload-pack '/~/hello.git'"},
+		"git-upload-pack '//hello//world'":   GitCommand{"git-upload-pack", "hello/world", "git-upload-pack '//hello//world'"},
+		"git-upload-pack '/../hello.git'":    GitCommand{"git-upload-pack", "hello.git", "git-upload-pack '/../hello.git'"},
+		"git-upload-pack hello.git":          GitCommand{"git-upload-pack", "hello.git", "git-upload-pack hello.git"},
 	}
 
 	for s, expected := range examples {
@@ -29,4 +36,57 @@ func TestParseGitCommand(t *testing.T) {
 	cmd, err := ParseGitCommand("git do-stuff")
 	assert.Error(t, err)
 	assert.Nil(t, cmd)
+
+	cmd, err = ParseGitCommand("git-upload-pack '/'")
+	assert.Error(t, err)
+	assert.Nil(t, cmd)
+}
+
+func TestSSHHomeDirs(t *testing.T) {
+	config := &Config{SSHHomeDirs: map[string]string{"alice": "users/alice", "bob": "users/bob"}}
+
+	for command, expected := range map[string]string{
+		"git-upload-pack '~alice/hello.git'":        "users/alice/hello.git",
+		"git-upload-pack '/~bob/hello.git'":         "users/bob/hello.git",
+		"git-upload-pack '~/hello.git'":             "users/alice/hello.git",
+		"git-upload-pack '~alice/../bob/hello.git'": "users/alice/bob/hello.git",
+		"git-upload-pack 'hello.git'":               "hello.git",
+	} {
+		cmd, err := ParseGitCommand(command)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		repo, err := config.resolveHome(cmd, "alice")
+		assert.NoError(t, err, command)
+		assert.Equal(t, expected, repo, command)
+	}
+
+	// Users without a root use the server root for ~/
+	cmd, _ := ParseGitCommand("git-upload-pack '~/hello.git'")
+	repo, err := config.resolveHome(cmd, "git")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello.git", repo)
+
+	cmd, _ = ParseGitCommand("git-upload-pack '~carol/hello.git'")
+	_, err = config.resolveHome(cmd, "alice")
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	repo, err = createBareRepo(filepath.Join(dir, "users", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), SSHHomeDirs: config.SSHHomeDirs})
+	addr := startSSH(t, server)
+	out, err := runGit(dir, "ls-remote", SSHCloneURL("git", addr, "~alice/"+repo))
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "refs/heads/master")
+	out, err = runGit(dir, "ls-remote", SSHCloneURL("git", addr, "~carol/"+repo))
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "repository not found")
+
+	err = (&Config{Dir: dir, SSHHomeDirs: map[string]string{"alice": "/home/alice"}}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `SSHHomeDirs: root "/home/alice" of alice is not relative to Dir`)
+	}
 }
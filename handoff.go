@@ -0,0 +1,69 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// HandoffListener returns a new listener on the socket of a TCP or Unix
+// listener, so that a new server can take over the socket: once the new
+// listener is served, closing the old one only stops the old server from
+// accepting connections. Clients connecting meanwhile wait in the accept
+// queue instead of being refused, and connections already accepted are left
+// to the old server, like the rolling restart of a git server. Use it with
+// http.Server:
+//
+//	next, err := gitkit.HandoffListener(listener)
+//	go http.Serve(next, newService)
+//	oldServer.Shutdown(ctx) // closes listener, in-flight requests complete
+//
+// To hand the socket off to another process instead, pass the file of the
+// listener in exec.Cmd.ExtraFiles and open it there with net.FileListener.
+func HandoffListener(listener net.Listener) (net.Listener, error) {
+	filer, ok := listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("cannot hand off %T listeners", listener)
+	}
+
+	file, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// Handoff makes next serve the connections to the address of the server, to
+// apply config changes requiring a new instance without refusing clients.
+// next must not be listening yet, and must share the host keys of the server
+// for clients to keep trusting it. Serve of the server returns once next
+// accepts the connections, and Serve must then be called on next.
+// Connections already accepted by the server, such as in-flight clones, are
+// served until they complete.
+func (s *SSH) Handoff(next *SSH) error {
+	socket := s.currentSocket()
+	if socket == nil {
+		return ErrNoListener
+	}
+	if next.currentListener() != nil {
+		return ErrAlreadyStarted
+	}
+	if err := next.prepare(); err != nil {
+		return err
+	}
+
+	handed, err := HandoffListener(socket)
+	if err != nil {
+		return err
+	}
+	next.setListener(handed)
+	s.gitConfig.logf("ssh: handing off %s", handed.Addr())
+
+	if listener := s.unsetListener(); listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
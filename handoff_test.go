@@ -0,0 +1,132 @@
+package gitkit
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHHandoff(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ssh-handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")}
+
+	old := NewSSH(config)
+	recorder := &EventRecorder{}
+	old.OnEvent = recorder.Record
+	if err := old.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- old.Serve() }()
+	addr := old.Address()
+	url := SSHCloneURL("git", addr, repo)
+
+	// A clone in flight during the handoff completes on the old server
+	old.InjectFault(repo, Fault{Latency: time.Second})
+	cloned := make(chan error, 1)
+	go func() {
+		out, err := runGit(dir, "clone", url, filepath.Join(t.TempDir(), "in-flight"))
+		if err != nil {
+			t.Log(out)
+		}
+		cloned <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	next := NewSSH(config)
+	assert.NoError(t, old.Handoff(next))
+	assert.Equal(t, ErrNoListener, old.Handoff(next))
+	go next.Serve()
+	defer next.Stop()
+
+	select {
+	case err := <-served:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("old server still serving")
+	}
+	assert.Equal(t, addr, next.Address())
+
+	// New clients are served by the new server right away
+	out, err := runGit(dir, "ls-remote", url)
+	assert.NoError(t, err, out)
+
+	assert.NoError(t, <-cloned)
+	assert.NotEmpty(t, recorder.Events())
+}
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestSSHServeListener(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")}
+
+	t.Run("pre-bound port", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NewSSH(config)
+		served := make(chan error, 1)
+		go func() { served <- server.ServeListener(listener) }()
+		defer server.Stop()
+
+		select {
+		case <-server.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("server not listening")
+		}
+		assert.Equal(t, listener.Addr().String(), server.Address())
+		out, err := runGit(dir, "ls-remote", SSHCloneURL("git", listener.Addr().String(), repo))
+		assert.NoError(t, err, out)
+
+		assert.Equal(t, ErrAlreadyStarted, server.ServeListener(listener))
+		assert.NoError(t, server.Stop())
+		assert.Error(t, <-served)
+	})
+
+	t.Run("wrapped listener", func(t *testing.T) {
+		socket, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := &countingListener{Listener: socket}
+		server := NewSSH(config)
+		go server.ServeListener(listener)
+		defer server.Stop()
+
+		out, err := runGit(dir, "ls-remote", SSHCloneURL("git", socket.Addr().String(), repo))
+		assert.NoError(t, err, out)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&listener.accepted))
+	})
+}
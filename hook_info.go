@@ -27,36 +27,162 @@ type HookInfo struct {
 	Ref      string
 	RefType  string
 	RefName  string
+	// Files lists the paths changed by the update. Only set by the Receiver
+	// when ChangedFiles is enabled.
+	Files []string
 }
 
-// ReadHookInput reads the hook context
+// RefUpdate is a single ref update line of the pre-receive and post-receive
+// hook input, in the "<old-rev> <new-rev> <ref>" format.
+type RefUpdate struct {
+	OldRev  string `json:"old_rev"`
+	NewRev  string `json:"new_rev"`
+	Ref     string `json:"ref"`
+	RefType string `json:"ref_type,omitempty"`
+	RefName string `json:"ref_name"`
+}
+
+// ParseRefUpdates parses every ref update line of a hook input. Empty lines
+// are skipped.
+func ParseRefUpdates(input io.Reader) ([]RefUpdate, error) {
+	updates := []RefUpdate{}
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		update, err := ParseRefUpdate(line)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
+
+// ParseRefUpdate parses a single "<old-rev> <new-rev> <ref>" hook input line
+func ParseRefUpdate(line string) (RefUpdate, error) {
+	chunks := strings.SplitN(line, " ", 3)
+	if len(chunks) != 3 || !isSHA(chunks[0]) || !isSHA(chunks[1]) || chunks[2] == "" {
+		return RefUpdate{}, fmt.Errorf("Invalid hook input: %q", line)
+	}
+
+	update := RefUpdate{
+		OldRev: chunks[0],
+		NewRev: chunks[1],
+		Ref:    chunks[2],
+	}
+	update.RefType, update.RefName = splitRef(update.Ref)
+
+	return update, nil
+}
+
+// IsZeroSHA returns true if the revision is the all-zeroes object name git
+// uses for refs that do not exist, both for SHA-1 and SHA-256 repositories.
+func IsZeroSHA(rev string) bool {
+	return isSHA(rev) && strings.Trim(rev, "0") == ""
+}
+
+// isSHA checks whether s is a full SHA-1 or SHA-256 hex object name
+func isSHA(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitRef splits a full ref into its type and name:
+// refs/heads/feature/x -> "heads", "feature/x"
+// refs/stash -> "", "stash"
+// HEAD -> "", "HEAD"
+func splitRef(ref string) (string, string) {
+	if !strings.HasPrefix(ref, "refs/") {
+		return "", ref
+	}
+
+	ref = strings.TrimPrefix(ref, "refs/")
+	i := strings.Index(ref, "/")
+	if i == -1 {
+		return "", ref
+	}
+
+	return ref[:i], ref[i+1:]
+}
+
+// ReadHookInput reads the hook context of the first updated ref
 func ReadHookInput(input io.Reader) (*HookInfo, error) {
-	reader := bufio.NewReader(input)
+	hooks, err := ReadHookInputs(input)
+	if err != nil {
+		return nil, err
+	}
 
-	line, _, err := reader.ReadLine()
+	return hooks[0], nil
+}
+
+// ReadHookInputs reads the hook context of every updated ref
+func ReadHookInputs(input io.Reader) ([]*HookInfo, error) {
+	updates, err := ParseRefUpdates(input)
 	if err != nil {
 		return nil, err
 	}
 
-	chunks := strings.Split(string(line), " ")
-	if len(chunks) != 3 {
+	if len(updates) == 0 {
 		return nil, fmt.Errorf("Invalid hook input")
 	}
-	refchunks := strings.Split(chunks[2], "/")
 
 	dir, _ := os.Getwd()
+	hooks := make([]*HookInfo, 0, len(updates))
+	for _, update := range updates {
+		hooks = append(hooks, newHookInfo(update, dir))
+	}
+
+	return hooks, nil
+}
+
+func newHookInfo(update RefUpdate, dir string) *HookInfo {
 	info := HookInfo{
 		RepoName: filepath.Base(dir),
 		RepoPath: dir,
-		OldRev:   chunks[0],
-		NewRev:   chunks[1],
-		Ref:      chunks[2],
-		RefType:  refchunks[1],
-		RefName:  refchunks[2],
+		OldRev:   update.OldRev,
+		NewRev:   update.NewRev,
+		Ref:      update.Ref,
+		RefType:  update.RefType,
+		RefName:  update.RefName,
 	}
 	info.Action = parseHookAction(info)
 
-	return &info, nil
+	return &info
+}
+
+// RefUpdate returns the ref update the hook was invoked for
+func (h *HookInfo) RefUpdate() RefUpdate {
+	return RefUpdate{
+		OldRev:  h.OldRev,
+		NewRev:  h.NewRev,
+		Ref:     h.Ref,
+		RefType: h.RefType,
+		RefName: h.RefName,
+	}
+}
+
+// Kind returns the kind of ref update, see ClassifyRefUpdate
+func (h *HookInfo) Kind() (string, error) {
+	return ClassifyRefUpdate(h.RepoPath, h.RefUpdate())
 }
 
 func parseHookAction(h HookInfo) string {
@@ -67,9 +193,9 @@ func parseHookAction(h HookInfo) string {
 		context = "tag"
 	}
 
-	if h.OldRev == ZeroSHA && h.NewRev != ZeroSHA {
+	if IsZeroSHA(h.OldRev) && !IsZeroSHA(h.NewRev) {
 		action = "create"
-	} else if h.OldRev != ZeroSHA && h.NewRev == ZeroSHA {
+	} else if !IsZeroSHA(h.OldRev) && IsZeroSHA(h.NewRev) {
 		action = "delete"
 	}
 
@@ -52,3 +52,74 @@ func Test_HookAction(t *testing.T) {
 		assert.Equal(t, expected, parseHookAction(hook))
 	}
 }
+
+func Test_ParseRefUpdates(t *testing.T) {
+	input := "0000000000000000000000000000000000000000 e285100b636ac67fa28d85685072158edaa01685 refs/heads/feature/new-ui\r\n" +
+		"\n" +
+		"a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 0000000000000000000000000000000000000000 refs/tags/v1.0.0+build.1\n" +
+		"e285100b636ac67fa28d85685072158edaa01685 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/pull/1/head\n" +
+		"e285100b636ac67fa28d85685072158edaa01685 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/stash"
+
+	updates, err := ParseRefUpdates(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Equal(t, []RefUpdate{
+		{
+			OldRev:  ZeroSHA,
+			NewRev:  "e285100b636ac67fa28d85685072158edaa01685",
+			Ref:     "refs/heads/feature/new-ui",
+			RefType: "heads",
+			RefName: "feature/new-ui",
+		},
+		{
+			OldRev:  "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2",
+			NewRev:  ZeroSHA,
+			Ref:     "refs/tags/v1.0.0+build.1",
+			RefType: "tags",
+			RefName: "v1.0.0+build.1",
+		},
+		{
+			OldRev:  "e285100b636ac67fa28d85685072158edaa01685",
+			NewRev:  "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2",
+			Ref:     "refs/pull/1/head",
+			RefType: "pull",
+			RefName: "1/head",
+		},
+		{
+			OldRev:  "e285100b636ac67fa28d85685072158edaa01685",
+			NewRev:  "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2",
+			Ref:     "refs/stash",
+			RefName: "stash",
+		},
+	}, updates)
+
+	invalid := []string{
+		"e285100b636ac67fa28d85685072158edaa01685 refs/heads/master",
+		"e285100b a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/heads/master",
+		"e285100b636ac67fa28d85685072158edaa01685 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 ",
+	}
+	for _, line := range invalid {
+		_, err := ParseRefUpdates(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func Test_ReadHookInputs(t *testing.T) {
+	input := "0000000000000000000000000000000000000000 e285100b636ac67fa28d85685072158edaa01685 refs/heads/main\n" +
+		"a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 0000000000000000000000000000000000000000 refs/tags/v1\n"
+
+	hooks, err := ReadHookInputs(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 2)
+	assert.Equal(t, BranchCreateAction, hooks[0].Action)
+	assert.Equal(t, TagDeleteAction, hooks[1].Action)
+
+	_, err = ReadHookInputs(strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func Test_IsZeroSHA(t *testing.T) {
+	assert.True(t, IsZeroSHA(ZeroSHA))
+	assert.True(t, IsZeroSHA(strings.Repeat("0", 64)))
+	assert.False(t, IsZeroSHA("e285100b636ac67fa28d85685072158edaa01685"))
+	assert.False(t, IsZeroSHA("0000"))
+}
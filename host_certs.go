@@ -0,0 +1,183 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHCertificateAuthority signs OpenSSH certificates in tests, e.g. the host
+// certificates of Config.HostCA.
+type SSHCertificateAuthority struct {
+	signer ssh.Signer
+	mu     sync.Mutex
+	serial uint64
+}
+
+// NewSSHCertificateAuthority creates a certificate authority with a new
+// Ed25519 key
+func NewSSHCertificateAuthority() (*SSHCertificateAuthority, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHCertificateAuthority{signer: signer}, nil
+}
+
+// PublicKey returns the key certificates are signed with
+func (ca *SSHCertificateAuthority) PublicKey() ssh.PublicKey {
+	return ca.signer.PublicKey()
+}
+
+// SignHostKey issues a host certificate for the key, valid for the host
+// names from an hour ago on.
+func (ca *SSHCertificateAuthority) SignHostKey(key ssh.PublicKey, principals ...string) (*ssh.Certificate, error) {
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        ssh.HostCert,
+		KeyId:           fmt.Sprintf("gitkit host %d", serial),
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// KnownHostsLine returns the @cert-authority known_hosts line trusting the
+// authority for the hosts, addresses with a port being normalized like ssh
+// does.
+func (ca *SSHCertificateAuthority) KnownHostsLine(hosts ...string) string {
+	return certAuthorityLine(hosts, ca.PublicKey())
+}
+
+func certAuthorityLine(hosts []string, key ssh.PublicKey) string {
+	normalized := []string{}
+	for _, host := range hosts {
+		normalized = append(normalized, knownhosts.Normalize(host))
+	}
+	return "@cert-authority " + knownhosts.Line(normalized, key)
+}
+
+// loadHostCertificate reads an OpenSSH host certificate file
+func loadHostCertificate(path string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host certificate %s: %v", path, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", path)
+	}
+	return cert, nil
+}
+
+// addHostCertificates presents certificates for the host keys: the ones
+// signed by Config.HostCA, then the ones of Config.HostCertificateFiles, each
+// replacing any earlier certificate of the same type.
+func (s *SSH) addHostCertificates(config *ssh.ServerConfig) error {
+	s.hostCerts = nil
+
+	if ca := s.gitConfig.HostCA; ca != nil {
+		for _, signer := range s.hostSigners {
+			cert, err := ca.SignHostKey(signer.PublicKey(), s.gitConfig.hostCertPrincipals()...)
+			if err != nil {
+				return err
+			}
+			if err := s.addHostCertificate(config, cert, signer); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, path := range s.gitConfig.HostCertificateFiles {
+		cert, err := loadHostCertificate(path)
+		if err != nil {
+			return err
+		}
+
+		var signer ssh.Signer
+		for _, hostSigner := range s.hostSigners {
+			if bytes.Equal(hostSigner.PublicKey().Marshal(), cert.Key.Marshal()) {
+				signer = hostSigner
+			}
+		}
+		if signer == nil {
+			return fmt.Errorf("no host key matches the certificate %s", path)
+		}
+		if err := s.addHostCertificate(config, cert, signer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SSH) addHostCertificate(config *ssh.ServerConfig, cert *ssh.Certificate, signer ssh.Signer) error {
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return err
+	}
+	s.offerHostKey(config, certSigner)
+
+	for i, hostCert := range s.hostCerts {
+		if hostCert.Type() == cert.Type() {
+			s.hostCerts[i] = cert
+			return nil
+		}
+	}
+	s.hostCerts = append(s.hostCerts, cert)
+	return nil
+}
+
+// HostCertificates returns the host certificates presented by the server,
+// once it listens.
+func (s *SSH) HostCertificates() []*ssh.Certificate {
+	s.hostMu.RLock()
+	defer s.hostMu.RUnlock()
+	return append([]*ssh.Certificate{}, s.hostCerts...)
+}
+
+// CertAuthorityKnownHosts returns the @cert-authority known_hosts lines of
+// the authorities of the host certificates, for clients to verify them
+// instead of the host keys.
+func (s *SSH) CertAuthorityKnownHosts() string {
+	s.hostMu.RLock()
+	defer s.hostMu.RUnlock()
+
+	var lines strings.Builder
+	seen := map[string]bool{}
+	for _, cert := range s.hostCerts {
+		key := string(cert.SignatureKey.Marshal())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		lines.WriteString(certAuthorityLine([]string{s.Address()}, cert.SignatureKey) + "\n")
+	}
+	return lines.String()
+}
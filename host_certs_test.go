@@ -0,0 +1,134 @@
+package gitkit
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// lsRemoteWithKnownHosts lists the refs of an ssh url, verifying the server
+// against the known_hosts file only.
+func lsRemoteWithKnownHosts(knownHosts string, url string) (string, error) {
+	cmd := exec.Command("git", "ls-remote", url)
+	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o UserKnownHostsFile="+knownHosts+
+		" -o GlobalKnownHostsFile=/dev/null -o StrictHostKeyChecking=yes -o BatchMode=yes")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestHostCA(t *testing.T) {
+	dir, err := os.MkdirTemp("", "host-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewSSHCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:          dir,
+		KeyDir:       filepath.Join(dir, "keys"),
+		HostKeyTypes: []string{RSAHostKey, Ed25519HostKey},
+		HostCA:       ca,
+	})
+	addr := startSSH(t, server)
+	assert.Len(t, server.HostCertificates(), 2)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(ca.KnownHostsLine(addr)+"\n"), 0644))
+	assert.Equal(t, ca.KnownHostsLine(addr)+"\n", server.CertAuthorityKnownHosts())
+
+	out, err := lsRemoteWithKnownHosts(knownHosts, SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+
+	// Servers without certificates are not trusted by the CA line
+	plain := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	plainAddr := startSSH(t, plain)
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(ca.KnownHostsLine(plainAddr)+"\n"), 0644))
+	out, err = lsRemoteWithKnownHosts(knownHosts, SSHCloneURL("git", plainAddr, repo))
+	assert.Error(t, err, out)
+
+	// Certificates are only valid for their principals
+	other := NewSSH(Config{
+		Dir:                dir,
+		KeyDir:             filepath.Join(dir, "keys"),
+		HostCA:             ca,
+		HostCertPrincipals: []string{"git.example.com"},
+	})
+	otherAddr := startSSH(t, other)
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(ca.KnownHostsLine(otherAddr)+"\n"), 0644))
+	out, err = lsRemoteWithKnownHosts(knownHosts, SSHCloneURL("git", otherAddr, repo))
+	assert.Error(t, err, out)
+}
+
+func TestHostCertificateFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "host-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewSSHCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, block, err := generateHostKey(rand.Reader, ECDSAHostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "host_key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.SignHostKey(pub, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := keyFile + "-cert.pub"
+	if err := os.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, HostKeyFiles: []string{keyFile}, HostCertificateFiles: []string{certFile}})
+	addr := startSSH(t, server)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(server.CertAuthorityKnownHosts()), 0644))
+	out, err := lsRemoteWithKnownHosts(knownHosts, SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+
+	// Certificates of keys the server does not have are refused
+	_, block, err = generateHostKey(rand.Reader, ECDSAHostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := filepath.Join(dir, "other_key")
+	if err := os.WriteFile(otherKey, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mismatch := NewSSH(Config{Dir: dir, HostKeyFiles: []string{otherKey}, HostCertificateFiles: []string{certFile}})
+	assert.Error(t, mismatch.Listen("127.0.0.1:0"))
+}
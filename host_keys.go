@@ -0,0 +1,284 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Types of SSH host keys, see Config.HostKeyTypes
+const (
+	RSAHostKey     = "rsa"
+	ECDSAHostKey   = "ecdsa"
+	Ed25519HostKey = "ed25519"
+)
+
+// generateHostKey creates a private key of the given type, along with its
+// PEM encoding, from the randomness of random.
+func generateHostKey(random io.Reader, keyType string) (crypto.Signer, *pem.Block, error) {
+	switch keyType {
+	case RSAHostKey:
+		key, err := rsa.GenerateKey(random, 2048)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case ECDSAHostKey:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), random)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	case Ed25519HostKey:
+		_, key, err := ed25519.GenerateKey(random)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported host key type %q", keyType)
+}
+
+// cachedHostKey is a host key generated for Config.CacheHostKeys
+type cachedHostKey struct {
+	mu     sync.Mutex
+	signer crypto.Signer
+	pem    *pem.Block
+}
+
+// hostKeyCache holds the host keys generated in the process by type, shared
+// by the servers with Config.CacheHostKeys.
+var hostKeyCache = struct {
+	mu   sync.Mutex
+	keys map[string]*cachedHostKey
+}{keys: map[string]*cachedHostKey{}}
+
+// generateCachedHostKey returns the cached host key of the given type,
+// generating it once.
+func generateCachedHostKey(random io.Reader, keyType string) (crypto.Signer, *pem.Block, error) {
+	hostKeyCache.mu.Lock()
+	cached, ok := hostKeyCache.keys[keyType]
+	if !ok {
+		cached = &cachedHostKey{}
+		hostKeyCache.keys[keyType] = cached
+	}
+	hostKeyCache.mu.Unlock()
+
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	if cached.signer == nil {
+		signer, block, err := generateHostKey(random, keyType)
+		if err != nil {
+			return nil, nil, err
+		}
+		cached.signer, cached.pem = signer, block
+	}
+	return cached.signer, cached.pem, nil
+}
+
+// loadHostKey reads a private host key file
+func loadHostKey(path string) (ssh.Signer, error) {
+	privateBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key %s: %v", path, err)
+	}
+	return private, nil
+}
+
+// rotatingSigner is a host key of the ssh config which can be swapped while
+// serving, since keys cannot be removed from the config. An impostor key,
+// set by SSHFault.WrongHostKey, is presented instead of the key while set.
+type rotatingSigner struct {
+	mu     sync.RWMutex
+	signer ssh.Signer
+	wrong  ssh.Signer
+}
+
+func (r *rotatingSigner) get() ssh.Signer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.wrong != nil {
+		return r.wrong
+	}
+	return r.signer
+}
+
+func (r *rotatingSigner) real() ssh.Signer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.signer
+}
+
+func (r *rotatingSigner) impostor() ssh.Signer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.wrong
+}
+
+func (r *rotatingSigner) set(signer ssh.Signer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.signer = signer
+}
+
+func (r *rotatingSigner) setImpostor(signer ssh.Signer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wrong = signer
+}
+
+func (r *rotatingSigner) PublicKey() ssh.PublicKey {
+	return r.get().PublicKey()
+}
+
+func (r *rotatingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return r.get().Sign(rand, data)
+}
+
+func (r *rotatingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer := r.get()
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+		return algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return signer.Sign(rand, data)
+}
+
+// offerHostKey offers a host key or certificate to clients, replacing any
+// one of the same type, including on a running server.
+func (s *SSH) offerHostKey(config *ssh.ServerConfig, key ssh.Signer) {
+	if s.hostSlots == nil {
+		s.hostSlots = map[string]*rotatingSigner{}
+	}
+	if slot, ok := s.hostSlots[key.PublicKey().Type()]; ok {
+		slot.set(key)
+		return
+	}
+	slot := &rotatingSigner{signer: key}
+	s.hostSlots[key.PublicKey().Type()] = slot
+	config.AddHostKey(slot)
+}
+
+// addHostKey offers the key to clients, replacing any key of the same type
+func (s *SSH) addHostKey(config *ssh.ServerConfig, key ssh.Signer) {
+	s.offerHostKey(config, key)
+
+	pub := key.PublicKey()
+	for i, hostKey := range s.hostKeys {
+		if hostKey.Type() == pub.Type() {
+			s.hostKeys[i] = pub
+			s.hostSigners[i] = key
+			return
+		}
+	}
+	s.hostKeys = append(s.hostKeys, pub)
+	s.hostSigners = append(s.hostSigners, key)
+}
+
+// RotateHostKey replaces the host key of the given type, see
+// Config.HostKeyTypes, with a new one on the running server, to test that
+// clients trusting the old key fail with a host key mismatch. Connections
+// already established keep going. Keys generated in KeyDir are replaced
+// there too, and host certificates signed by Config.HostCA are issued again.
+// Keys certified by Config.HostCertificateFiles cannot be rotated.
+func (s *SSH) RotateHostKey(keyType string) (ssh.PublicKey, error) {
+	private, privatePEM, err := generateHostKey(s.gitConfig.random(), keyType)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(private)
+	if err != nil {
+		return nil, err
+	}
+
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+
+	if s.hostSlots == nil {
+		return nil, ErrNoListener
+	}
+	var old ssh.PublicKey
+	for _, key := range s.hostKeys {
+		if key.Type() == signer.PublicKey().Type() {
+			old = key
+		}
+	}
+	if old == nil {
+		return nil, fmt.Errorf("the server has no %s host key", keyType)
+	}
+	if s.gitConfig.HostCA == nil {
+		for _, cert := range s.hostCerts {
+			if bytes.Equal(cert.Key.Marshal(), old.Marshal()) {
+				return nil, fmt.Errorf("the %s host key is certified by a certificate file", keyType)
+			}
+		}
+	}
+
+	for _, generated := range s.gitConfig.hostKeyTypes() {
+		if generated != keyType {
+			continue
+		}
+		if err := ioutil.WriteFile(s.gitConfig.HostKeyPath(keyType), pem.EncodeToMemory(privatePEM), 0600); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(s.gitConfig.HostKeyPath(keyType)+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	s.addHostKey(s.sshConfig, signer)
+	if err := s.addHostCertificates(s.sshConfig); err != nil {
+		return nil, err
+	}
+	if err := s.applySSHFault(); err != nil {
+		return nil, err
+	}
+	s.gitConfig.logf("ssh: rotated %s host key to %s", keyType, ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer.PublicKey(), nil
+}
+
+// HostKeys returns the public host keys offered by the server, once it
+// listens.
+func (s *SSH) HostKeys() []ssh.PublicKey {
+	s.hostMu.RLock()
+	defer s.hostMu.RUnlock()
+	return append([]ssh.PublicKey{}, s.hostKeys...)
+}
+
+// KnownHosts returns the known_hosts lines of the host keys of the server,
+// for clients to verify them with StrictHostKeyChecking.
+func (s *SSH) KnownHosts() string {
+	s.hostMu.RLock()
+	defer s.hostMu.RUnlock()
+
+	var lines strings.Builder
+	for _, key := range s.hostKeys {
+		lines.WriteString(knownhosts.Line([]string{knownhosts.Normalize(s.Address())}, key) + "\n")
+	}
+	return lines.String()
+}
@@ -0,0 +1,195 @@
+package gitkit
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyTypes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "host-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:          dir,
+		KeyDir:       filepath.Join(dir, "keys"),
+		HostKeyTypes: []string{RSAHostKey, ECDSAHostKey, Ed25519HostKey},
+	})
+	addr := startSSH(t, server)
+
+	for keyType, algorithm := range map[string]string{
+		RSAHostKey:     "rsa-sha2-256",
+		ECDSAHostKey:   "ecdsa-sha2-nistp256",
+		Ed25519HostKey: "ssh-ed25519",
+	} {
+		assert.FileExists(t, server.gitConfig.HostKeyPath(keyType))
+		assert.FileExists(t, server.gitConfig.HostKeyPath(keyType)+".pub")
+
+		out, err := runGitWithSSHOptions(dir, "-o HostKeyAlgorithms="+algorithm, "ls-remote", SSHCloneURL("git", addr, repo))
+		assert.NoError(t, err, out)
+	}
+
+	state, err := server.State()
+	assert.NoError(t, err)
+	assert.Len(t, state.HostKeys, 3)
+
+	// Only an Ed25519 key is offered by default
+	ed25519Only := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "default-keys")})
+	addr = startSSH(t, ed25519Only)
+	out, err := runGitWithSSHOptions(dir, "-o HostKeyAlgorithms=rsa-sha2-256", "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.Error(t, err, out)
+	assert.NoFileExists(t, ed25519Only.gitConfig.HostKeyPath(RSAHostKey))
+
+	// The RSA key generated by earlier versions is kept
+	rsaKeys := filepath.Join(dir, "rsa-keys")
+	assert.NoError(t, NewSSH(Config{Dir: dir, KeyDir: rsaKeys, HostKeyTypes: []string{RSAHostKey}}).prepare())
+	rsaOnly := NewSSH(Config{Dir: dir, KeyDir: rsaKeys})
+	addr = startSSH(t, rsaOnly)
+	out, err = runGitWithSSHOptions(dir, "-o HostKeyAlgorithms=rsa-sha2-256", "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+	assert.NoFileExists(t, rsaOnly.gitConfig.HostKeyPath(Ed25519HostKey))
+
+	unsupported := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "dsa-keys"), HostKeyTypes: []string{"dsa"}})
+	assert.Error(t, unsupported.Listen("127.0.0.1:0"))
+}
+
+func TestCacheHostKeys(t *testing.T) {
+	hostKeys := func(config Config) []ssh.PublicKey {
+		config.Dir = t.TempDir()
+		config.KeyDir = t.TempDir()
+		server := NewSSH(config)
+		if err := server.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		assert.FileExists(t, server.gitConfig.HostKeyPath(RSAHostKey))
+		return server.HostKeys()
+	}
+	types := []string{RSAHostKey, Ed25519HostKey}
+
+	cached := hostKeys(Config{HostKeyTypes: types, CacheHostKeys: true})
+	assert.Len(t, cached, 2)
+	assert.Equal(t, cached, hostKeys(Config{HostKeyTypes: types, CacheHostKeys: true}))
+	assert.NotEqual(t, cached, hostKeys(Config{HostKeyTypes: types}))
+}
+
+func TestHostKeyFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "host-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{}
+	for _, keyType := range []string{ECDSAHostKey, Ed25519HostKey, ECDSAHostKey} {
+		_, block, err := generateHostKey(rand.Reader, keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, fmt.Sprintf("host_key_%d", len(files)))
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	server := NewSSH(Config{Dir: dir, HostKeyFiles: files})
+	addr := startSSH(t, server)
+
+	// The second ECDSA key replaces the first one, no RSA key is generated
+	keys := server.HostKeys()
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "ecdsa-sha2-nistp256", keys[0].Type())
+		assert.Equal(t, "ssh-ed25519", keys[1].Type())
+	}
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(server.KnownHosts()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lsRemote := func(algorithms string) (string, error) {
+		cmd := exec.Command("git", "ls-remote", SSHCloneURL("git", addr, repo))
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o UserKnownHostsFile="+knownHosts+
+			" -o StrictHostKeyChecking=yes -o BatchMode=yes -o HostKeyAlgorithms="+algorithms)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	for _, algorithm := range []string{"ecdsa-sha2-nistp256", "ssh-ed25519"} {
+		out, err := lsRemote(algorithm)
+		assert.NoError(t, err, out)
+	}
+	out, err := lsRemote("rsa-sha2-256")
+	assert.Error(t, err, out)
+}
+
+func TestRotateHostKey(t *testing.T) {
+	dir, err := os.MkdirTemp("", "host-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:          dir,
+		KeyDir:       filepath.Join(dir, "keys"),
+		HostKeyTypes: []string{RSAHostKey, Ed25519HostKey},
+	})
+	_, err = server.RotateHostKey(Ed25519HostKey)
+	assert.Equal(t, ErrNoListener, err)
+
+	url := SSHCloneURL("git", startSSH(t, server), repo)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(server.KnownHosts()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := lsRemoteWithKnownHosts(knownHosts, url)
+	assert.NoError(t, err, out)
+
+	key, err := server.RotateHostKey(Ed25519HostKey)
+	assert.NoError(t, err)
+	assert.Contains(t, server.HostKeys(), key)
+	assert.Len(t, server.HostKeys(), 2)
+	pub, err := os.ReadFile(server.gitConfig.HostKeyPath(Ed25519HostKey) + ".pub")
+	assert.NoError(t, err)
+	assert.Equal(t, string(ssh.MarshalAuthorizedKey(key)), string(pub))
+
+	// Clients trusting the old key fail, until they learn the new one
+	out, err = lsRemoteWithKnownHosts(knownHosts, url)
+	assert.Error(t, err)
+	assert.Contains(t, out, "REMOTE HOST IDENTIFICATION HAS CHANGED")
+
+	if err := os.WriteFile(knownHosts, []byte(server.KnownHosts()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = lsRemoteWithKnownHosts(knownHosts, url)
+	assert.NoError(t, err, out)
+
+	_, err = server.RotateHostKey(ECDSAHostKey)
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package gitkit
+
+import (
+	"fmt"
+)
+
+// HostnameCase is a host name under which a server presents a certificate
+// failing hostname verification, see Server.HostnameCases.
+type HostnameCase struct {
+	Name string // e.g. "mismatched-host"
+	Host string // Host name to dial instead of the address of the server
+	URL  string // HTTPS clone URL of the repository under Host
+	// Resolve resolves Host to the server with git's http.curloptResolve
+	// option, e.g. git -c http.curloptResolve=<Resolve> clone <URL>, like a
+	// DNS record. Other clients have to dial the server address for Host.
+	Resolve string
+	// Hosts are the DNS names and IP addresses the certificate is valid for
+	Hosts []string
+}
+
+// hostnameDomain is the reserved domain of the host names of HostnameCases
+const hostnameDomain = "gitkit.test"
+
+// HostnameCases serves, with SNI certificates issued by the authority of
+// TLSConfig, host names under which the server at addr presents
+// certificates failing hostname verification in every way clients report:
+//
+//   - mismatched-host: valid for another host name
+//   - ip-sans-only: valid for the IP address of the server alone
+//   - common-name-only: naming the host in its subject only, without SANs,
+//     which Go clients reject while OpenSSL, and thus git, may accept
+//   - wildcard-depth: valid for a wildcard one label short of the host
+//
+// It returns the clone URLs of the repository for each case, along with how
+// to resolve their host name to the server.
+func (s *Server) HostnameCases(ca *CertificateAuthority, addr string, repo string) ([]HostnameCase, error) {
+	ip, port := splitHostPort(addr)
+	resolvePort := port
+	if resolvePort == "" {
+		resolvePort = "443"
+	}
+	cases := []struct {
+		name    string
+		host    string
+		options CertificateOptions
+	}{
+		{"mismatched-host", "mismatch." + hostnameDomain, CertificateOptions{Hosts: []string{"other." + hostnameDomain}}},
+		{"ip-sans-only", "ip-only." + hostnameDomain, CertificateOptions{Hosts: []string{ip}}},
+		{"common-name-only", "cn-only." + hostnameDomain, CertificateOptions{CommonName: "cn-only." + hostnameDomain}},
+		{"wildcard-depth", "deep.wildcard." + hostnameDomain, CertificateOptions{Hosts: []string{"*." + hostnameDomain}}},
+	}
+
+	result := []HostnameCase{}
+	for _, c := range cases {
+		cert, err := ca.Issue(c.options)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.name, err)
+		}
+		s.SetSNICertificate(c.host, cert)
+
+		hostAddr := c.host
+		if port != "" {
+			hostAddr = c.host + ":" + port
+		}
+		result = append(result, HostnameCase{
+			Name:    c.name,
+			Host:    c.host,
+			URL:     HTTPSCloneURL(hostAddr, repo),
+			Resolve: fmt.Sprintf("%s:%s:%s", c.host, resolvePort, ip),
+			Hosts:   append([]string{}, c.options.Hosts...),
+		})
+	}
+	return result, nil
+}
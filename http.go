@@ -1,7 +1,9 @@
 package gitkit
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,6 +11,8 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 type service struct {
@@ -19,9 +23,40 @@ type service struct {
 }
 
 type Server struct {
-	config   Config
-	services []service
-	AuthFunc func(Credential, *Request) (bool, error)
+	controls
+	config    Config
+	services  []service
+	events    eventLog
+	authCache authCache
+	nonces    nonceTracker
+	releases  releaseSet
+	tlsFaults tlsFaultSet
+	tlsCerts  tlsCertificates
+	memory    memoryBudget
+	generator repoGenerator
+	AuthFunc  func(Credential, *Request) (bool, error)
+	// ClientCertUserFunc, if set, maps the TLS client certificates of
+	// requests to the user passed to AuthFunc, with Config.MutualTLS,
+	// instead of the first of their subject common name and SANs that is a
+	// user of Config.Users.
+	ClientCertUserFunc func(cert *x509.Certificate) (string, error)
+	// Interceptor, if set, is called for every authenticated git request,
+	// to change or answer it.
+	Interceptor Interceptor
+	// OnRepoMissing, if set, is called when a client asks for a repository
+	// that does not exist, once created empty, to generate its content, e.g.
+	// with Commit, from its name. Returning an error deletes it, answering
+	// as if it did not exist, unless the error is ErrRepoNotFound and
+	// Config.AutoCreate is set, which keeps it empty.
+	OnRepoMissing func(repo string) error
+	// OnEvent, if set, is called for every event emitted by the server.
+	OnEvent func(Event)
+	// OnCancel, if set, is called when a git process is killed because its
+	// request ended first, with the time it took to exit.
+	OnCancel func(Cancellation)
+	// OnClientGone, if set, is called when a client disappears in the middle
+	// of a git operation.
+	OnClientGone func(ClientGone)
 }
 
 type Request struct {
@@ -32,6 +67,13 @@ type Request struct {
 
 func New(cfg Config) *Server {
 	s := Server{config: cfg}
+	s.controls.config = &s.config
+	s.emitLocal = func(e Event) {
+		s.events.emit(&s.config, s.OnEvent, e)
+	}
+	s.config.adopted = &adoptedRepos{}
+	s.clock.setSkew(cfg.ClockSkew)
+	s.config.seedRand()
 	s.services = []service{
 		service{"GET", "/info/refs", s.getInfoRefs, ""},
 		service{"POST", "/git-upload-pack", s.postRPC, "git-upload-pack"},
@@ -48,6 +90,10 @@ func New(cfg Config) *Server {
 
 // findService returns a matching git subservice and parsed repository name
 func (s *Server) findService(req *http.Request) (*service, string) {
+	if s.config.DumbHTTP {
+		return s.findDumbService(req)
+	}
+
 	for _, svc := range s.services {
 		if svc.method == req.Method && strings.HasSuffix(req.URL.Path, svc.suffix) {
 			path := strings.Replace(req.URL.Path, svc.suffix, "", 1)
@@ -58,7 +104,13 @@ func (s *Server) findService(req *http.Request) (*service, string) {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logInfo("request", r.Method+" "+r.Host+r.URL.String())
+	s.config.logInfo("request", r.Method+" "+r.Host+r.URL.String())
+	defer s.resources.session()()
+
+	if s.config.API && strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		s.serveAPI(w, r)
+		return
+	}
 
 	// Find the git subservice to handle the request
 	svc, repoUrlPath := s.findService(r)
@@ -70,7 +122,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Determine namespace and repo name from request path
 	repoNamespace, repoName := getNamespaceAndRepo(repoUrlPath)
 	if repoName == "" {
-		logError("auth", fmt.Errorf("no repo name provided"))
+		s.config.logError("auth", fmt.Errorf("no repo name provided"))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -81,47 +133,156 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		RepoPath: path.Join(s.config.Dir, repoNamespace, repoName),
 	}
 
-	if s.config.Auth {
-		if s.AuthFunc == nil {
-			logError("auth", fmt.Errorf("no auth backend provided"))
-			w.WriteHeader(http.StatusUnauthorized)
+	if alias, target := s.config.resolveAlias(req.RepoName); alias != nil {
+		if alias.Redirect {
+			s.config.logInfo("repo-alias", fmt.Sprintf("%s: redirecting to %s", req.RepoName, target))
+			redirectRepo(w, r, repoUrlPath, target)
 			return
 		}
+		s.config.logInfo("repo-alias", fmt.Sprintf("%s: serving %s", req.RepoName, target))
+		req.RepoName = target
+		req.RepoPath = path.Join(s.config.Dir, target)
+	}
 
-		cred := getCredential(r)
-		if cred.Authorization == "" {
-			logError("auth", fmt.Errorf("no Authorization header found"))
-			w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
-			w.WriteHeader(http.StatusUnauthorized)
+	resolved, ok := s.config.resolveRepoName(req.RepoName)
+	if !ok {
+		s.config.logError("repo-suffix", fmt.Errorf("%s does not match the .git suffix policy", req.RepoName))
+		http.NotFound(w, r)
+		return
+	}
+	if resolved != req.RepoName {
+		if s.config.GitSuffix == SuffixRedirect {
+			redirectRepo(w, r, repoUrlPath, resolved)
 			return
 		}
+		req.RepoName = resolved
+		req.RepoPath = path.Join(s.config.Dir, resolved)
+	}
+
+	if !s.authenticate(w, req) {
+		return
+	}
+
+	if !s.intercept(w, svc, req) {
+		return
+	}
+
+	if s.locks.locked(req.RepoName) {
+		s.config.logError("repo-lock", fmt.Errorf("%s is locked", req.RepoName))
+		writeError(w, http.StatusServiceUnavailable, lockMessage(&s.config), s.config.LockHints)
+		return
+	}
+
+	if fault := s.faults.get(req.RepoName); fault != nil && fault.delay() {
+		s.config.logError("fault", fmt.Errorf("%s: %s", req.RepoName, fault.message()))
+		writeFault(w, fault)
+		return
+	}
+
+	repoPath, err := s.generator.open(s.repoOps(), req.RepoName, s.OnRepoMissing)
+	if err != nil && err != ErrRepoNotFound {
+		s.config.logError("repo-init", err)
+	}
+
+	if err != nil {
+		s.config.logError("repo-init", fmt.Errorf("%s does not exist", req.RepoName))
+		http.NotFound(w, r)
+		return
+	}
+	req.RepoPath = repoPath
+
+	if strings.HasPrefix(repoPath, memoryPrefix) {
+		s.serveMemory(svc, w, req)
+		return
+	}
+
+	svc.handler(svc.rpc, w, req)
+}
+
+// authenticate checks the credentials of a request when Config.Auth is set,
+// answering unauthenticated requests. It returns whether to serve the request.
+func (s *Server) authenticate(w http.ResponseWriter, req *Request) bool {
+	if !s.config.Auth {
+		return true
+	}
+
+	authFunc := s.AuthFunc
+	if authFunc == nil && s.config.Users != nil {
+		authFunc = s.config.Users.AuthFunc
+	}
+
+	if authFunc == nil {
+		s.config.logError("auth", fmt.Errorf("no auth backend provided"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	cred := getCredential(req.Request)
+	if cred.Certificate != nil {
+		principal, err := s.certificatePrincipal(cred.Certificate)
+		if err != nil {
+			s.config.logError("auth", err)
+			s.emit(req, Event{Type: AuthFailureEvent, Error: err.Error()})
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		cred = Credential{Username: principal, Certificate: cred.Certificate}
+	}
 
-		allow, err := s.AuthFunc(cred, req)
-		if !allow || err != nil {
-			if err != nil {
-				logError("auth", err)
-			}
+	if cred.Authorization == "" && cred.Certificate == nil {
+		s.config.logError("auth", fmt.Errorf("no Authorization header found"))
+		s.authChallenge(w, false)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
 
-			logError("auth", fmt.Errorf("rejected user %s", cred.Username))
+	if s.config.AuthNonces && cred.Certificate == nil {
+		if err := s.nonces.check(cred, s.clock.now()); err != nil {
+			s.config.logError("auth", err)
+			s.emit(req, Event{Type: AuthFailureEvent, User: cred.Username, Error: err.Error()})
+			s.authChallenge(w, err == errStaleNonce)
 			w.WriteHeader(http.StatusUnauthorized)
-			return
+			return false
 		}
 	}
 
-	if !repoExists(req.RepoPath) && s.config.AutoCreate == true {
-		err := initRepo(req.RepoName, &s.config)
+	allow, err := s.authorize(authFunc, cred, req)
+	if !allow || err != nil {
 		if err != nil {
-			logError("repo-init", err)
+			s.config.logError("auth", err, cred.Password, cred.Authorization)
+		}
+
+		s.config.logError("auth", fmt.Errorf("rejected user %s", cred.Username))
+		s.emit(req, Event{Type: AuthFailureEvent, User: cred.Username, Error: errorString(err)}, cred.Password, cred.Authorization)
+		if s.config.AuthNonces {
+			s.authChallenge(w, false)
 		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
 	}
+	s.emit(req, Event{Type: AuthSuccessEvent, User: cred.Username})
+	return true
+}
 
-	if !repoExists(req.RepoPath) {
-		logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
-		http.NotFound(w, r)
+// authChallenge sets the WWW-Authenticate header of a 401 response. With
+// nonces enabled, it issues a fresh Digest nonce.
+func (s *Server) authChallenge(w http.ResponseWriter, stale bool) {
+	if !s.config.AuthNonces {
+		w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
 		return
 	}
 
-	svc.handler(svc.rpc, w, req)
+	nonce, err := s.nonces.issue(s.config.random(), s.clock.now())
+	if err != nil {
+		s.config.logError("auth", err)
+		return
+	}
+
+	challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, digestRealm, nonce)
+	if stale {
+		challenge += ", stale=true"
+	}
+	w.Header()["WWW-Authenticate"] = []string{challenge}
 }
 
 func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
@@ -133,52 +294,106 @@ func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 		return
 	}
 
+	if !s.requireProtocolV2(w, r, rpc, "advertisement") {
+		return
+	}
+
 	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
+	cmd.Env = append(cmd.Env, serviceEnv(&s.config, &s.compression, &s.packOptions, r.RepoName)...)
+	cmd.Env = append(cmd.Env, s.protocolEnv(r)...)
+	cmd.Env = append(cmd.Env, s.config.agentEnv()...)
+	defer s.gitStderr(context, r, cmd)()
 	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
-	defer cleanUpProcess(cmd)
+	defer s.resources.process(cmd)()
+	defer s.watchProcess(r, rpc, cmd).done()
+
+	t := &transfer{}
+	defer s.clientGone(r, rpc, t)
+	out := t.writer(w)
 
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
 	w.Header().Add("Cache-Control", "no-cache")
 	w.WriteHeader(200)
 
-	if err := packLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
-		logError(context, err)
+	if err := packLine(out, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
+		s.config.logError(context, err)
 		return
 	}
 
-	if err := packFlush(w); err != nil {
-		logError(context, err)
+	if err := packFlush(out); err != nil {
+		s.config.logError(context, err)
 		return
 	}
 
-	if _, err := io.Copy(w, pipe); err != nil {
-		logError(context, err)
+	var err error
+	if s.protocolV2(r) {
+		err = filterCapabilities(out, pipe, s.hiddenCapabilities())
+	} else {
+		_, err = io.Copy(out, pipe)
+	}
+	if err != nil {
+		s.config.logError(context, err)
 		return
 	}
 
 	if err := cmd.Wait(); err != nil {
-		logError(context, err)
+		s.config.logError(context, err)
 		return
 	}
 }
 
 func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 	context := "post-rpc"
-	body := r.Body
+	t := &transfer{}
+	defer s.clientGone(r, rpc, t)
+	body := t.reader(r.Body)
 
 	if r.Header.Get("Content-Encoding") == "gzip" {
 		var err error
-		body, err = gzip.NewReader(r.Body)
+		body, err = gzip.NewReader(body)
 		if err != nil {
-			fail500(w, context, err)
+			s.fail500(w, context, err)
+			return
+		}
+	}
+
+	buffered, ok := s.readBody(w, r, body)
+	if !ok {
+		return
+	}
+	defer buffered.Close()
+	body = buffered
+
+	if !s.requireProtocolV2(w, r, rpc, "result") {
+		return
+	}
+
+	if rpc == "git-upload-pack" && s.protocolV2(r) {
+		if body, ok = s.rejectHiddenCommand(w, r, body); !ok {
+			return
+		}
+	}
+
+	if rpc == "git-upload-pack" {
+		if body, ok = s.refuseFilter(w, r, body); !ok {
+			return
+		}
+	}
+
+	if rpc == "git-receive-pack" {
+		if report := s.repoOps().pushReport(r.RepoName); report != nil {
+			s.rejectPush(w, r, body, *report)
 			return
 		}
 	}
 
 	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
+	cmd.Env = append(cmd.Env, serviceEnv(&s.config, &s.compression, &s.packOptions, r.RepoName)...)
+	cmd.Env = append(cmd.Env, s.protocolEnv(r)...)
+	cmd.Env = append(cmd.Env, s.config.agentEnv()...)
 
 	// Simulates servers that short-circuit the connection
 	// when the user does not have permissions to finish
@@ -189,21 +404,28 @@ func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 		return
 	}
 
+	var refs map[string]string
+	if rpc == "git-receive-pack" {
+		refs = snapshotRefs(&s.config, r.RepoPath)
+	}
+
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
 	defer stdin.Close()
+	defer s.gitStderr(context, r, cmd)()
 
 	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
-	defer cleanUpProcess(cmd)
+	defer s.resources.process(cmd)()
+	defer s.watchProcess(r, rpc, cmd).done()
 
 	if _, err := io.Copy(stdin, body); err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
 
@@ -211,32 +433,63 @@ func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 	w.Header().Add("Cache-Control", "no-cache")
 	w.WriteHeader(200)
 
-	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
-		logError(context, err)
+	if _, err := io.Copy(t.writer(newWriteFlusher(w)), pipe); err != nil {
+		s.config.logError(context, err)
 		return
 	}
-	if err := cmd.Wait(); err != nil {
-		logError(context, err)
-		return
+	err = cmd.Wait()
+	if err != nil {
+		s.config.logError(context, err)
+	} else if rpc == "git-receive-pack" {
+		updateServerInfo(&s.config, r.RepoPath)
 	}
-}
 
-func (s *Server) Setup() error {
-	return s.config.Setup()
+	if event := serviceEvent(rpc); event != "" {
+		user, _, _ := r.BasicAuth()
+		s.emit(r, Event{Type: event, User: user, Error: errorString(err), Refs: pushedRefs(&s.config, r.RepoPath, refs)})
+	}
 }
 
-func initRepo(name string, config *Config) error {
-	fullPath := path.Join(config.Dir, name)
+// rejectPush answers a push with the report instead of running receive-pack
+func (s *Server) rejectPush(w http.ResponseWriter, r *Request, body io.Reader, report pushReport) {
+	w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(200)
 
-	if err := exec.Command(config.GitPath, "init", "--bare", fullPath).Run(); err != nil {
-		return err
+	if err := rejectPush(body, newWriteFlusher(w), report); err != nil {
+		s.config.logError("post-rpc", err)
 	}
 
-	if config.AutoHooks && config.Hooks != nil {
-		return config.Hooks.setupInDir(fullPath)
-	}
+	user, _, _ := r.BasicAuth()
+	s.emit(r, Event{Type: PushEvent, User: user, Error: report.event})
+}
 
-	return nil
+// emit sends an event for the request to the journal and OnEvent callback
+func (s *Server) emit(r *Request, event Event, secrets ...string) {
+	event.Transport = HTTPTransport
+	event.Repo = r.RepoName
+	event.RemoteAddr = r.RemoteAddr
+	s.events.emit(&s.config, s.OnEvent, event, secrets...)
+}
+
+// watchProcess kills a git command of the request once the request is done,
+// e.g. when the client disconnects.
+func (s *Server) watchProcess(r *Request, rpc string, cmd *exec.Cmd) *processWatch {
+	return watchProcess(r.Context(), cmd, func(cleanup time.Duration) {
+		s.config.logInfo("cancel", fmt.Sprintf("%s: %s canceled, exited after %s", r.RepoName, rpc, cleanup))
+		if s.OnCancel != nil {
+			s.OnCancel(Cancellation{Transport: HTTPTransport, Repo: r.RepoName, Command: rpc, RemoteAddr: r.RemoteAddr, Cleanup: cleanup})
+		}
+	})
+}
+
+func (s *Server) fail500(w http.ResponseWriter, context string, err error) {
+	http.Error(w, "Internal server error", 500)
+	s.config.logError(context, err)
+}
+
+func (s *Server) Setup() error {
+	return s.config.Setup()
 }
 
 func repoExists(p string) bool {
@@ -247,9 +500,47 @@ func repoExists(p string) bool {
 func gitCommand(name string, args ...string) (*exec.Cmd, io.Reader) {
 	cmd := exec.Command(name, args...)
 	cmd.Env = os.Environ()
+	setProcessGroup(cmd)
 
 	r, _ := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
 
 	return cmd, r
 }
+
+// gitStderr logs the stderr of a git command with Config.LogGitStderr,
+// instead of relaying it in the response body along with its stdout. It
+// returns the function logging it, once the handler is done: the command may
+// still be running on early returns, so stderr is written under a lock.
+func (s *Server) gitStderr(context string, r *Request, cmd *exec.Cmd) func() {
+	if !s.config.LogGitStderr {
+		return func() {}
+	}
+
+	stderr := &lockedBuffer{}
+	cmd.Stderr = stderr
+	return func() {
+		if out := stderr.String(); out != "" {
+			s.config.logError(context, fmt.Errorf("%s: %s", r.RepoName, strings.TrimSpace(out)))
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to read while it is written to, e.g.
+// by a running command
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
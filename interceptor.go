@@ -0,0 +1,156 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GitRequest describes a git request about to be served, over HTTP or SSH,
+// once authenticated.
+type GitRequest struct {
+	Transport  string // HTTPTransport or SSHTransport
+	Repo       string
+	Service    string // git-upload-pack or git-receive-pack
+	User       string
+	Credential *Credential // Credential of HTTP requests, nil over SSH
+	KeyID      string      // ID of the key of SSH clients
+	// ProtocolVersion is the git protocol version asked for by the client,
+	// 0 unless it asked for another one.
+	ProtocolVersion int
+	RemoteAddr      string
+}
+
+// GitResponse answers a git request instead of the server
+type GitResponse struct {
+	// Status is the HTTP status code of the response. Unset, HTTP clients
+	// are sent an ERR packet with the message, which git prints.
+	Status  int
+	Message string
+}
+
+// Interceptor is called for every git request before serving it. It may
+// change the Repo and ProtocolVersion of the request, or return a response
+// answering it instead, e.g. to reject it.
+type Interceptor interface {
+	Intercept(*GitRequest) *GitResponse
+}
+
+// InterceptorFunc is a function used as an Interceptor
+type InterceptorFunc func(*GitRequest) *GitResponse
+
+func (f InterceptorFunc) Intercept(req *GitRequest) *GitResponse {
+	return f(req)
+}
+
+// protocolVersion returns the version of a Git-Protocol header or
+// GIT_PROTOCOL variable, e.g. 2 for "version=2", or 0.
+func protocolVersion(protocol string) int {
+	for _, param := range strings.Split(protocol, ":") {
+		if strings.HasPrefix(param, "version=") {
+			version, _ := strconv.Atoi(strings.TrimPrefix(param, "version="))
+			return version
+		}
+	}
+	return 0
+}
+
+// intercept passes the request to the Interceptor, applying its changes,
+// and answers the request if it returns a response. It tells whether to go
+// on serving the request.
+func (s *Server) intercept(w http.ResponseWriter, svc *service, req *Request) bool {
+	if s.Interceptor == nil {
+		return true
+	}
+
+	rpc := svc.rpc
+	kind := "result"
+	if rpc == "" {
+		rpc, kind = req.URL.Query().Get("service"), "advertisement"
+	}
+	cred := getCredential(req.Request)
+	gitReq := &GitRequest{
+		Transport:       HTTPTransport,
+		Repo:            req.RepoName,
+		Service:         rpc,
+		User:            cred.Username,
+		Credential:      &cred,
+		ProtocolVersion: protocolVersion(req.Header.Get("Git-Protocol")),
+		RemoteAddr:      req.RemoteAddr,
+	}
+	version := gitReq.ProtocolVersion
+
+	if resp := s.Interceptor.Intercept(gitReq); resp != nil {
+		s.config.logError("intercept", fmt.Errorf("%s: %s", req.RepoName, resp.Message))
+		if resp.Status != 0 {
+			writeError(w, resp.Status, resp.Message, nil)
+			return false
+		}
+		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-%s", rpc, kind))
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		if kind == "advertisement" {
+			packLine(w, fmt.Sprintf("# service=%s\n", rpc))
+			packFlush(w)
+		}
+		packLine(w, "ERR "+resp.Message+"\n")
+		return false
+	}
+
+	if gitReq.Repo != req.RepoName {
+		s.config.logInfo("intercept", fmt.Sprintf("%s: serving %s", req.RepoName, gitReq.Repo))
+		req.RepoName = gitReq.Repo
+		req.RepoPath = path.Join(s.config.Dir, gitReq.Repo)
+	}
+	if gitReq.ProtocolVersion != version {
+		if gitReq.ProtocolVersion == 0 {
+			req.Header.Del("Git-Protocol")
+		} else {
+			req.Header.Set("Git-Protocol", fmt.Sprintf("version=%d", gitReq.ProtocolVersion))
+		}
+	}
+	return true
+}
+
+// intercept passes the command to the Interceptor, applying its changes,
+// and rejects the command if it returns a response. It tells whether to go
+// on running the command.
+func (s *SSH) intercept(ch ssh.Channel, req *ssh.Request, conn *ssh.ServerConn, keyID string, gitcmd *GitCommand, protocol *string) bool {
+	if s.Interceptor == nil {
+		return true
+	}
+
+	gitReq := &GitRequest{
+		Transport:  SSHTransport,
+		Repo:       gitcmd.Repo,
+		Service:    gitcmd.Command,
+		User:       conn.User(),
+		KeyID:      keyID,
+		RemoteAddr: conn.RemoteAddr().String(),
+
+		ProtocolVersion: protocolVersion(*protocol),
+	}
+	version := gitReq.ProtocolVersion
+
+	if resp := s.Interceptor.Intercept(gitReq); resp != nil {
+		s.gitConfig.logError("intercept", fmt.Errorf("%s: %s", gitcmd.Repo, resp.Message))
+		rejectCommand(ch, req, resp.Message)
+		return false
+	}
+
+	if gitReq.Repo != gitcmd.Repo {
+		s.gitConfig.logInfo("intercept", fmt.Sprintf("%s: serving %s", gitcmd.Repo, gitReq.Repo))
+		gitcmd.Repo = gitReq.Repo
+	}
+	if gitReq.ProtocolVersion != version {
+		*protocol = ""
+		if gitReq.ProtocolVersion != 0 {
+			*protocol = fmt.Sprintf("version=%d", gitReq.ProtocolVersion)
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterceptor(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu := sync.Mutex{}
+	requests := []GitRequest{}
+	interceptor := InterceptorFunc(func(req *GitRequest) *GitResponse {
+		mu.Lock()
+		requests = append(requests, *req)
+		mu.Unlock()
+
+		switch req.Repo {
+		case "private.git":
+			return &GitResponse{Message: "access denied"}
+		case "limited.git":
+			return &GitResponse{Status: http.StatusTooManyRequests, Message: "slow down"}
+		case "moved.git":
+			req.Repo = repo
+		}
+		if req.Transport == HTTPTransport {
+			req.ProtocolVersion = 0
+		}
+		return nil
+	})
+
+	service := New(Config{Dir: dir, ProtocolV2: true})
+	service.Interceptor = interceptor
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	out, err := runGit(dir, "ls-remote", HTTPCloneURL(addr, "private.git"))
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "access denied")
+	out, err = runGit(dir, "ls-remote", HTTPCloneURL(addr, "limited.git"))
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "429")
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err = runGit(dir, "-c", "protocol.version=2", "clone", HTTPCloneURL(addr, "moved.git"), clone)
+	assert.NoError(t, err, out)
+	out, err = runGit(clone, "config", "--get", "remote.origin.url")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "moved.git")
+
+	mu.Lock()
+	assert.Equal(t, HTTPTransport, requests[0].Transport)
+	assert.Equal(t, "private.git", requests[0].Repo)
+	assert.Equal(t, "git-upload-pack", requests[0].Service)
+	assert.NotNil(t, requests[0].Credential)
+	assert.Equal(t, "moved.git", requests[2].Repo)
+	assert.Equal(t, 2, requests[2].ProtocolVersion)
+	requests = nil
+	mu.Unlock()
+
+	sshServer := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	sshServer.Interceptor = interceptor
+	sshAddr := startSSH(t, sshServer)
+
+	out, err = runGit(dir, "ls-remote", SSHCloneURL("git", sshAddr, "private.git"))
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "access denied")
+	out, err = runGit(dir, "ls-remote", SSHCloneURL("git", sshAddr, "moved.git"))
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "refs/heads/master")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, SSHTransport, requests[0].Transport)
+	assert.Equal(t, "git", requests[0].User)
+	assert.Equal(t, 2, requests[0].ProtocolVersion)
+	assert.Equal(t, "git-upload-pack", requests[0].Service)
+	assert.Nil(t, requests[0].Credential)
+}
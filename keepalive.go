@@ -0,0 +1,60 @@
+package gitkit
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepAlive sends keepalive requests to the client every
+// SSH.ClientAliveInterval until done is closed, closing the connection once
+// SSH.ClientAliveCountMax intervals passed without an answer. Clients answer
+// keepalive@openssh.com with a failure, which is enough to tell they are
+// alive.
+func (s *SSH) keepAlive(conn *ssh.ServerConn, done <-chan struct{}) {
+	max := s.ClientAliveCountMax
+	if max <= 0 {
+		max = 3
+	}
+
+	ticker := time.NewTicker(s.ClientAliveInterval)
+	defer ticker.Stop()
+
+	// Only one request is in flight at once, since the client answers them
+	// in order
+	answered := make(chan error, 1)
+	waiting := false
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if waiting {
+			select {
+			case err := <-answered:
+				if err != nil {
+					return
+				}
+				waiting = false
+				missed = 0
+			default:
+				missed++
+				if missed >= max {
+					s.gitConfig.logf("ssh: closing %s, %d keepalive requests unanswered", conn.RemoteAddr(), missed)
+					conn.Close()
+					return
+				}
+				continue
+			}
+		}
+
+		waiting = true
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+	}
+}
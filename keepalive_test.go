@@ -0,0 +1,91 @@
+package gitkit
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// freezingConn stops reading from the connection while frozen, like a peer
+// that died without closing it.
+type freezingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	thawed *sync.Cond
+	frozen bool
+}
+
+func (c *freezingConn) freeze(frozen bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frozen = frozen
+	c.thawed.Broadcast()
+}
+
+func (c *freezingConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	for c.frozen {
+		c.thawed.Wait()
+	}
+	c.mu.Unlock()
+	return c.Conn.Read(p)
+}
+
+func TestSSHClientAlive(t *testing.T) {
+	dir := t.TempDir()
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	server.ClientAliveInterval = 100 * time.Millisecond
+	server.ClientAliveCountMax = 2
+	addr := startSSH(t, server)
+
+	dial := func() (*ssh.Client, *freezingConn) {
+		tcp, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &freezingConn{Conn: tcp}
+		conn.thawed = sync.NewCond(&conn.mu)
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssh.NewClient(c, chans, reqs), conn
+	}
+	closed := func(client *ssh.Client) chan struct{} {
+		closed := make(chan struct{})
+		go func() {
+			client.Wait()
+			close(closed)
+		}()
+		return closed
+	}
+
+	alive, _ := dial()
+	defer alive.Close()
+	aliveClosed := closed(alive)
+
+	dead, conn := dial()
+	defer dead.Close()
+	deadClosed := closed(dead)
+	conn.freeze(true)
+	time.Sleep(time.Second)
+	conn.freeze(false)
+
+	select {
+	case <-deadClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unresponsive client not disconnected")
+	}
+	select {
+	case <-aliveClosed:
+		t.Fatal("responsive client disconnected")
+	default:
+	}
+	_, err := alive.NewSession()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,93 @@
+package gitkit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PublicKeyLookup describes a public key offered by an SSH client
+type PublicKeyLookup struct {
+	User          string
+	Key           ssh.PublicKey
+	AuthorizedKey string // Key in authorized_keys format, as passed to PublicKeyLookupFunc
+	Fingerprint   string // SHA256 fingerprint, as printed by ssh-keygen -l
+	RemoteAddr    string
+}
+
+// lookupFunc returns the function authenticating public keys:
+// PublicKeyLookupContextFunc, PublicKeyLookupFunc or else the one of
+// Config.Users, or nil.
+func (s *SSH) lookupFunc() func(context.Context, PublicKeyLookup) (*PublicKey, error) {
+	if s.PublicKeyLookupContextFunc != nil {
+		return s.PublicKeyLookupContextFunc
+	}
+
+	lookupFunc := s.PublicKeyLookupFunc
+	if lookupFunc == nil && s.gitConfig.Users != nil {
+		lookupFunc = s.gitConfig.Users.LookupPublicKey
+	}
+	if lookupFunc == nil {
+		return nil
+	}
+	return func(_ context.Context, lookup PublicKeyLookup) (*PublicKey, error) {
+		return lookupFunc(lookup.AuthorizedKey)
+	}
+}
+
+// newPublicKeyLookup describes the key offered on the connection
+func newPublicKeyLookup(conn ssh.ConnMetadata, key ssh.PublicKey) PublicKeyLookup {
+	return PublicKeyLookup{
+		User:          conn.User(),
+		Key:           key,
+		AuthorizedKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint:   ssh.FingerprintSHA256(key),
+		RemoteAddr:    conn.RemoteAddr().String(),
+	}
+}
+
+// handshakeSet holds the contexts of the connections being authenticated by
+// remote address, canceled once their handshake ends.
+type handshakeSet struct {
+	mu       sync.Mutex
+	contexts map[string]context.Context
+}
+
+// start sets the context of the handshake of a connection, which times out
+// after timeout if set, returning the function ending it.
+func (h *handshakeSet) start(addr string, timeout time.Duration) func() {
+	ctx, cancel := context.Background(), context.CancelFunc(nil)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.contexts == nil {
+		h.contexts = map[string]context.Context{}
+	}
+	h.contexts[addr] = ctx
+
+	return func() {
+		cancel()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.contexts, addr)
+	}
+}
+
+// context returns the context of the handshake of a connection
+func (h *handshakeSet) context(addr string) context.Context {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ctx, ok := h.contexts[addr]; ok {
+		return ctx
+	}
+	return context.Background()
+}
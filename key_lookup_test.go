@@ -0,0 +1,74 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPublicKeyLookupContextFunc(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, alicePub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(alicePub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu := sync.Mutex{}
+	lookups := []PublicKeyLookup{}
+	deadlines := []bool{}
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	server.HandshakeTimeout = time.Minute
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return nil, fmt.Errorf("not used")
+	}
+	server.PublicKeyLookupContextFunc = func(ctx context.Context, lookup PublicKeyLookup) (*PublicKey, error) {
+		_, ok := ctx.Deadline()
+		mu.Lock()
+		lookups = append(lookups, lookup)
+		deadlines = append(deadlines, ok)
+		mu.Unlock()
+
+		if lookup.Fingerprint != ssh.FingerprintSHA256(pub) {
+			return nil, fmt.Errorf("unknown key")
+		}
+		return &PublicKey{Id: "alice", Name: "alice"}, nil
+	}
+	assert.NoError(t, server.Validate())
+	addr := startSSH(t, server)
+	url := SSHCloneURL("git", addr, repo)
+
+	out, err := runGitWithKey(dir, alice, "ls-remote", url)
+	assert.NoError(t, err, out)
+	out, err = runGitWithKey(dir, bob, "ls-remote", url)
+	assert.Error(t, err, out)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.NotEmpty(t, lookups) {
+		assert.Equal(t, "git", lookups[0].User)
+		assert.Equal(t, strings.TrimSpace(alicePub), lookups[0].AuthorizedKey)
+		assert.Equal(t, pub.Marshal(), lookups[0].Key.Marshal())
+		assert.Contains(t, lookups[0].RemoteAddr, "127.0.0.1:")
+		assert.True(t, deadlines[0], "lookups time out with the handshake")
+	}
+}
@@ -0,0 +1,59 @@
+package gitkit
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyboardInteractive accepts the clients for which SSH.KeyboardInteractiveFunc
+// succeeds, reporting the returned ID like key IDs.
+func (s *SSH) keyboardInteractive(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	time.Sleep(s.sshFault().AuthLatency)
+	if err := s.checkUser(conn); err != nil {
+		return nil, err
+	}
+	id, err := s.KeyboardInteractiveFunc(conn.User(), challenge)
+	if err != nil {
+		s.emit(conn, Event{Type: AuthFailureEvent, Error: err.Error()})
+		return nil, err
+	}
+
+	s.emit(conn, Event{Type: AuthSuccessEvent, KeyID: id})
+	return &ssh.Permissions{Extensions: map[string]string{"key-id": id}}, nil
+}
+
+// KeyboardInteractive asks the client for the password of a user over
+// keyboard-interactive auth, see SSH.KeyboardInteractiveFunc. SSH clients
+// connect as the git user, so the user name is asked first unless the
+// client connects as a user of the store. The ID is the user name.
+func (u *UserStore) KeyboardInteractive(user string, challenge ssh.KeyboardInteractiveChallenge) (string, error) {
+	if _, ok := u.User(user); !ok {
+		answers, err := challenge("", "", []string{"Username: "}, []bool{true})
+		if err != nil {
+			return "", err
+		}
+		if len(answers) != 1 {
+			return "", fmt.Errorf("expected 1 answer, got %d", len(answers))
+		}
+		user = answers[0]
+	}
+
+	answers, err := challenge(user, "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return "", err
+	}
+	if len(answers) != 1 {
+		return "", fmt.Errorf("expected 1 answer, got %d", len(answers))
+	}
+
+	ok, err := u.Authenticate(user, answers[0])
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("invalid password for user %s", user)
+	}
+	return user, nil
+}
@@ -0,0 +1,79 @@
+package gitkit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyboardInteractive(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keyboard-interactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewUserStore()
+	assert.NoError(t, users.AddUser("alice", "secret"))
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	server.KeyboardInteractiveFunc = users.KeyboardInteractive
+	recorder := &EventRecorder{}
+	server.OnEvent = recorder.Record
+	addr := startSSH(t, server)
+
+	dial := func(user string, answers ...string) error {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+				if len(answers) < len(questions) {
+					return nil, errors.New("no more answers")
+				}
+				asked := answers[:len(questions)]
+				answers = answers[len(questions):]
+				return asked, nil
+			})},
+		})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		return session.Close()
+	}
+
+	assert.NoError(t, dial("alice", "secret"))
+	assert.NoError(t, dial("git", "alice", "secret"))
+	assert.Error(t, dial("alice", "wrong"))
+	assert.Error(t, dial("git", "bob", "secret"))
+
+	events := recorder.Events()
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, AuthSuccessEvent, events[0].Type)
+		assert.Equal(t, "alice", events[0].KeyID)
+		assert.Equal(t, AuthSuccessEvent, events[1].Type)
+		assert.Equal(t, "invalid password for user alice", events[2].Error)
+		assert.Equal(t, "user bob does not exist", events[3].Error)
+	}
+
+	// Public keys are rejected without a key lookup func
+	key, _, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runGitWithKey(dir, key, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.Error(t, err, out)
+}
@@ -0,0 +1,175 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leakGracePeriod is how long a strict teardown waits for resources to be
+// released before reporting them as leaked.
+const leakGracePeriod = 2 * time.Second
+
+// LeakError lists the resources still held by a server after it was stopped
+type LeakError struct {
+	Leaks []string
+}
+
+func (e *LeakError) Error() string {
+	return fmt.Sprintf("leaked resources after shutdown: %s", strings.Join(e.Leaks, ", "))
+}
+
+// resourceTracker keeps count of the goroutines, sessions, child processes
+// and temporary files a server holds while serving.
+type resourceTracker struct {
+	mu         sync.Mutex
+	goroutines int
+	sessions   int
+	processes  map[*exec.Cmd]bool
+	tempFiles  map[string]bool
+	keptFiles  map[string]bool
+	created    int
+}
+
+// goroutine records a running goroutine until the returned function is called
+func (r *resourceTracker) goroutine() func() {
+	return r.count(&r.goroutines)
+}
+
+// session records an open session until the returned function is called
+func (r *resourceTracker) session() func() {
+	return r.count(&r.sessions)
+}
+
+func (r *resourceTracker) count(counter *int) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*counter++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			*counter--
+		})
+	}
+}
+
+// process records a started child process until the returned function is
+// called.
+func (r *resourceTracker) process(cmd *exec.Cmd) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.processes == nil {
+		r.processes = map[*exec.Cmd]bool{}
+	}
+	r.processes[cmd] = true
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.processes, cmd)
+	}
+}
+
+// tempFile records a temporary file or directory. The returned function
+// releases it once the operation using it is done, removing it unless the
+// cleanup policy keeps it given the outcome of the operation.
+func (r *resourceTracker) tempFile(path string, policy CleanupPolicy) func(err *error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tempFiles == nil {
+		r.tempFiles = map[string]bool{}
+		r.keptFiles = map[string]bool{}
+	}
+	r.tempFiles[path] = true
+	r.created++
+
+	return func(err *error) {
+		failed := err != nil && *err != nil
+		keep := policy == CleanupNever || (policy == CleanupOnSuccess && failed)
+		if !keep {
+			os.RemoveAll(path)
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.tempFiles, path)
+		if keep {
+			r.keptFiles[path] = true
+		}
+	}
+}
+
+// leaks describes the resources currently held
+func (r *resourceTracker) leaks() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	leaks := []string{}
+	if r.goroutines > 0 {
+		leaks = append(leaks, fmt.Sprintf("%d goroutines", r.goroutines))
+	}
+	if r.sessions > 0 {
+		leaks = append(leaks, fmt.Sprintf("%d sessions", r.sessions))
+	}
+
+	processes := []string{}
+	for cmd := range r.processes {
+		processes = append(processes, fmt.Sprintf("process %q", strings.Join(cmd.Args, " ")))
+	}
+	sort.Strings(processes)
+	leaks = append(leaks, processes...)
+
+	files := []string{}
+	for path := range r.tempFiles {
+		files = append(files, "temp file "+path)
+	}
+	sort.Strings(files)
+	return append(leaks, files...)
+}
+
+// check waits up to the grace period for all resources to be released,
+// returning a *LeakError listing those still held.
+func (r *resourceTracker) check(grace time.Duration) error {
+	deadline := time.Now().Add(grace)
+	for {
+		leaks := r.leaks()
+		if len(leaks) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &LeakError{Leaks: leaks}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// CheckLeaks waits for in-flight requests and connections to finish, then
+// returns a *LeakError if goroutines, sessions, child git processes or
+// temporary files remain. SSH.Stop calls it when Config.StrictTeardown is set.
+func (c *controls) CheckLeaks() error {
+	return c.resources.check(leakGracePeriod)
+}
+
+// TestingT is the subset of *testing.T used by test helpers
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// AssertNoLeaks fails the test if any of the servers still holds resources
+// once its clients are done, see CheckLeaks.
+func AssertNoLeaks(t TestingT, servers ...interface{ CheckLeaks() error }) {
+	t.Helper()
+	for _, server := range servers {
+		if err := server.CheckLeaks(); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+}
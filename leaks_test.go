@@ -0,0 +1,100 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeT struct {
+	errors []string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func TestResourceTracker(t *testing.T) {
+	tracker := &resourceTracker{}
+	assert.NoError(t, tracker.check(0))
+
+	dir, err := os.MkdirTemp("", "tracked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeDir := tracker.tempFile(dir, CleanupAlways)
+	goroutineDone := tracker.goroutine()
+	processDone := tracker.process(exec.Command("git", "upload-pack", "repo.git"))
+
+	err = tracker.check(0)
+	assert.IsType(t, &LeakError{}, err)
+	assert.Equal(t, []string{"1 goroutines", `process "git upload-pack repo.git"`, "temp file " + dir}, err.(*LeakError).Leaks)
+
+	goroutineDone()
+	goroutineDone()
+	processDone()
+	removeDir(nil)
+	assert.NoError(t, tracker.check(0))
+	assert.False(t, fileExists(dir))
+}
+
+func TestStrictTeardown(t *testing.T) {
+	dir, err := os.MkdirTemp("", "strict-teardown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), StrictTeardown: true}
+
+	service := New(config)
+	httpServer := httptest.NewServer(service)
+	defer httpServer.Close()
+
+	server := NewSSH(config)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	out, err := runGit(dir, "clone", HTTPCloneURL(httpServer.Listener.Addr().String(), repo), "http")
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "clone", server.CloneURL("git", repo), "ssh")
+	assert.NoError(t, err, out)
+	_, err = service.Commit(repo, "master", Commit{Files: map[string]string{"file": "content"}})
+	assert.NoError(t, err)
+
+	ft := &fakeT{}
+	AssertNoLeaks(ft, service, server)
+	assert.Empty(t, ft.errors)
+
+	// A client that never closes its session is reported
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Stop()
+	assert.IsType(t, &LeakError{}, err)
+	assert.Contains(t, err.Error(), "1 sessions")
+}
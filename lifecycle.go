@@ -0,0 +1,76 @@
+package gitkit
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnInfo describes an SSH connection to the lifecycle callbacks of SSH,
+// along with the git command at hand for OnExec.
+type ConnInfo struct {
+	RemoteAddr  string
+	User        string
+	KeyID       string
+	Fingerprint string        // SHA256 fingerprint of the key of the client, if any
+	Command     string        // Git command, for OnExec
+	Repo        string        // Repository of the command, for OnExec
+	Duration    time.Duration // Of the command for OnExec, of the connection for OnDisconnect
+	Error       string        // Why the handshake or the command failed, if it did
+}
+
+// newConnInfo describes an authenticated connection
+func newConnInfo(conn *ssh.ServerConn) ConnInfo {
+	info := ConnInfo{RemoteAddr: conn.RemoteAddr().String(), User: conn.User()}
+	if conn.Permissions != nil {
+		info.KeyID = conn.Permissions.Extensions["key-id"]
+		info.Fingerprint = conn.Permissions.Extensions["key-fingerprint"]
+	}
+	return info
+}
+
+// connected reports a new connection to SSH.OnConnect, returning its
+// description to complete once authenticated.
+func (s *SSH) connected(conn net.Conn) *ConnInfo {
+	info := &ConnInfo{RemoteAddr: conn.RemoteAddr().String()}
+	if s.OnConnect != nil {
+		s.OnConnect(*info)
+	}
+	return info
+}
+
+// authenticated reports the end of the handshake of a connection to
+// SSH.OnAuth, successful unless err is set.
+func (s *SSH) authenticated(info *ConnInfo, conn *ssh.ServerConn, err error) {
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		*info = newConnInfo(conn)
+	}
+	if s.OnAuth != nil {
+		s.OnAuth(*info)
+	}
+	info.Error = ""
+}
+
+// executed reports a git command that exited to SSH.OnExec
+func (s *SSH) executed(conn *ssh.ServerConn, gitcmd *GitCommand, started time.Time, err error) {
+	if s.OnExec == nil {
+		return
+	}
+	info := newConnInfo(conn)
+	info.Command = gitcmd.Command
+	info.Repo = gitcmd.Repo
+	info.Duration = time.Since(started)
+	info.Error = errorString(err)
+	s.OnExec(info)
+}
+
+// disconnected reports a closed connection to SSH.OnDisconnect
+func (s *SSH) disconnected(info *ConnInfo, started time.Time) {
+	if s.OnDisconnect != nil {
+		info.Duration = time.Since(started)
+		s.OnDisconnect(*info)
+	}
+}
@@ -0,0 +1,84 @@
+package gitkit
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, pub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu := sync.Mutex{}
+	calls := []string{}
+	infos := map[string]ConnInfo{}
+	disconnected := make(chan struct{}, 1)
+	record := func(name string) func(ConnInfo) {
+		return func(info ConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, name)
+			infos[name] = info
+			if name == "disconnect" {
+				disconnected <- struct{}{}
+			}
+		}
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "key-1"}, nil
+	}
+	server.OnConnect = record("connect")
+	server.OnAuth = record("auth")
+	server.OnExec = record("exec")
+	server.OnDisconnect = record("disconnect")
+	addr := startSSH(t, server)
+
+	out, err := runGitWithKey(dir, key, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnection not reported")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"connect", "auth", "exec", "disconnect"}, calls)
+	assert.Contains(t, infos["connect"].RemoteAddr, "127.0.0.1:")
+	assert.Equal(t, "key-1", infos["auth"].KeyID)
+	assert.Equal(t, ssh.FingerprintSHA256(parsed), infos["auth"].Fingerprint)
+	assert.Empty(t, infos["auth"].Error)
+	assert.Equal(t, "git-upload-pack", infos["exec"].Command)
+	assert.Equal(t, repo, infos["exec"].Repo)
+	assert.NotZero(t, infos["exec"].Duration)
+	assert.Equal(t, "git", infos["disconnect"].User)
+	assert.GreaterOrEqual(t, int64(infos["disconnect"].Duration), int64(infos["exec"].Duration))
+
+	// Failed handshakes are reported too
+	calls = nil
+	mu.Unlock()
+	_, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	assert.Error(t, err)
+	<-disconnected
+	mu.Lock()
+	assert.Equal(t, []string{"connect", "auth", "disconnect"}, calls)
+	assert.NotEmpty(t, infos["auth"].Error)
+}
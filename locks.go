@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultLockMessage = "repository temporarily unavailable"
+
+// repoLocks tracks repositories that are locked for maintenance
+type repoLocks struct {
+	mu    sync.RWMutex
+	repos map[string]bool
+}
+
+func (l *repoLocks) set(repo string, locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.repos == nil {
+		l.repos = map[string]bool{}
+	}
+
+	if locked {
+		l.repos[lockKey(repo)] = true
+	} else {
+		delete(l.repos, lockKey(repo))
+	}
+}
+
+func (l *repoLocks) locked(repo string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.repos[lockKey(repo)]
+}
+
+// all returns the sorted names of the locked repositories
+func (l *repoLocks) all() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	repos := []string{}
+	for repo := range l.repos {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func lockKey(repo string) string {
+	return strings.Trim(path.Clean("/"+repo), "/")
+}
+
+func lockMessage(config *Config) string {
+	if config.LockMessage != "" {
+		return config.LockMessage
+	}
+	return defaultLockMessage
+}
+
+// Lock makes all requests and commands for the repository fail as if it was
+// under maintenance, until Unlock is called.
+func (c *controls) Lock(repo string) {
+	c.locks.set(repo, true)
+}
+
+// Unlock makes a locked repository available again.
+func (c *controls) Unlock(repo string) {
+	c.locks.set(repo, false)
+}
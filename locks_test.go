@@ -0,0 +1,66 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir, LockMessage: "migration in progress"})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	service.Lock("/" + repo)
+	out, err := runGit(dir, "clone", server.URL+"/"+repo, "locked")
+	assert.Error(t, err)
+	assert.Contains(t, out, "503")
+	assert.NoDirExists(t, filepath.Join(dir, "locked"))
+
+	resp, err := server.Client().Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+
+	service.Unlock(repo)
+	out, err = runGit(dir, "clone", server.URL+"/"+repo, "unlocked")
+	assert.NoError(t, err, out)
+}
+
+func TestSSHLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+
+	server.Lock(repo)
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), "locked")
+	assert.Error(t, err)
+	assert.Contains(t, out, "remote error: repository temporarily unavailable")
+
+	server.Unlock(repo)
+	out, err = runGit(dir, "clone", SSHCloneURL("git", addr, repo), "unlocked")
+	assert.NoError(t, err, out)
+}
@@ -0,0 +1,136 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// LoopbackServer serves a handler on several loopback addresses at once. It
+// is meant for tests that need to exercise client URL parsing against a live
+// server: IPv4 and IPv6 literals, "localhost", non-default ports and trailing
+// slashes all resolve to the same handler.
+type LoopbackServer struct {
+	server    *http.Server
+	listeners []net.Listener
+	ports     []int
+	ipv6      bool
+}
+
+// NewLoopbackServer starts serving handler on the given number of ephemeral
+// ports. Each port is bound on 127.0.0.1 and, when the host supports it, on
+// [::1] as well, so "localhost" works no matter how it resolves.
+func NewLoopbackServer(handler http.Handler, ports int) (*LoopbackServer, error) {
+	if ports < 1 {
+		ports = 1
+	}
+
+	l := &LoopbackServer{
+		server: &http.Server{Handler: handler},
+		ipv6:   true,
+	}
+
+	for i := 0; i < ports; i++ {
+		if err := l.bind(); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	for _, ln := range l.listeners {
+		go l.server.Serve(ln)
+	}
+
+	return l, nil
+}
+
+// bind listens on a new port, pairing the IPv4 and IPv6 loopback addresses.
+func (l *LoopbackServer) bind() error {
+	// Another process might grab the IPv6 side of a freshly assigned port,
+	// so retry a few times before giving up on pairing.
+	for attempt := 0; attempt < 10; attempt++ {
+		v4, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		port := v4.Addr().(*net.TCPAddr).Port
+
+		if !l.ipv6 {
+			l.add(port, v4)
+			return nil
+		}
+
+		v6, err := net.Listen("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+		if err == nil {
+			l.add(port, v4, v6)
+			return nil
+		}
+		v4.Close()
+
+		// Hosts without IPv6 loopback only get IPv4 addresses
+		if !canListenIPv6() {
+			l.ipv6 = false
+		}
+	}
+
+	return fmt.Errorf("unable to bind a loopback port on both IPv4 and IPv6")
+}
+
+func (l *LoopbackServer) add(port int, listeners ...net.Listener) {
+	l.ports = append(l.ports, port)
+	l.listeners = append(l.listeners, listeners...)
+}
+
+func canListenIPv6() bool {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// Addrs returns all the addresses the server is listening on.
+func (l *LoopbackServer) Addrs() []string {
+	addrs := make([]string, 0, len(l.listeners))
+	for _, ln := range l.listeners {
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return addrs
+}
+
+// Hosts returns every host:port combination that reaches the server,
+// including "localhost".
+func (l *LoopbackServer) Hosts() []string {
+	hosts := []string{}
+	for _, port := range l.ports {
+		p := strconv.Itoa(port)
+		hosts = append(hosts, net.JoinHostPort("127.0.0.1", p))
+		if l.ipv6 {
+			hosts = append(hosts, net.JoinHostPort("::1", p))
+		}
+		hosts = append(hosts, net.JoinHostPort("localhost", p))
+	}
+	return hosts
+}
+
+// URLs returns the clone URLs of the given repository for every host, each
+// with and without a trailing slash.
+func (l *LoopbackServer) URLs(repo string) []string {
+	urls := []string{}
+	for _, host := range l.Hosts() {
+		base := HTTPCloneURL(host, repo)
+		urls = append(urls, base, base+"/")
+	}
+	return urls
+}
+
+// Close stops the server and closes all of its listeners.
+func (l *LoopbackServer) Close() error {
+	err := l.server.Close()
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoopbackServer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewLoopbackServer(New(Config{Dir: dir}), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	urls := server.URLs(repo)
+	assert.GreaterOrEqual(t, len(urls), 2*2*2)
+
+	for i, url := range urls {
+		target := filepath.Join(dir, "clones", fmt.Sprintf("clone-%d", i))
+		out, err := exec.Command("git", "clone", url, target).CombinedOutput()
+		assert.NoError(t, err, "cloning %s: %s", url, out)
+		assert.FileExists(t, filepath.Join(target, "homework"))
+	}
+}
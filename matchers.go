@@ -0,0 +1,245 @@
+package gitkit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/onsi/gomega/types"
+)
+
+// EventRecorder collects the events of one or more servers, for assertions
+// once clients are done:
+//
+//	recorder := &gitkit.EventRecorder{}
+//	server.OnEvent = recorder.Record
+type EventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Record stores an event, it can be used as the OnEvent callback
+func (r *EventRecorder) Record(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns a copy of the recorded events
+func (r *EventRecorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event{}, r.events...)
+}
+
+// Reset forgets all recorded events
+func (r *EventRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
+
+// PushOptions selects push events. Empty fields match anything.
+type PushOptions struct {
+	Repo      string
+	User      string
+	Transport string
+	Ref       string // A ref updated by the push
+	NewRev    string // The revision Ref was updated to
+	Kind      string // How Ref was updated, e.g. CreateUpdate or DeleteUpdate
+	Failed    bool   // Match failed pushes instead of successful ones
+}
+
+// CheckRef returns an error unless the repository has ref at rev, or has the
+// ref at all if rev is empty. The repository is a git directory path or a
+// *Snapshot.
+func CheckRef(repo interface{}, ref string, rev string) error {
+	refs, err := refsOf(repo)
+	if err != nil {
+		return err
+	}
+
+	actual, ok := refs[ref]
+	if !ok {
+		return fmt.Errorf("ref %s does not exist", ref)
+	}
+	if rev != "" && actual != rev {
+		return fmt.Errorf("ref %s is at %s, not %s", ref, actual, rev)
+	}
+	return nil
+}
+
+// CheckPush returns an error unless one of the events is a push matching the
+// options. Events are given as a []Event or an *EventRecorder.
+func CheckPush(events interface{}, opts PushOptions) error {
+	var list []Event
+	switch e := events.(type) {
+	case []Event:
+		list = e
+	case *EventRecorder:
+		list = e.Events()
+	default:
+		return fmt.Errorf("expected []Event or *EventRecorder, got %T", events)
+	}
+
+	pushes := 0
+	for _, event := range list {
+		if event.Type != PushEvent {
+			continue
+		}
+		pushes++
+		if matchPush(event, opts) {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the %d push events matches %+v", pushes, opts)
+}
+
+func matchPush(event Event, opts PushOptions) bool {
+	if opts.Failed != (event.Error != "") {
+		return false
+	}
+	if opts.Repo != "" && strings.Trim(opts.Repo, "/") != event.Repo {
+		return false
+	}
+	if opts.User != "" && opts.User != event.User {
+		return false
+	}
+	if opts.Transport != "" && opts.Transport != event.Transport {
+		return false
+	}
+	if opts.Ref == "" {
+		return opts.NewRev == "" && opts.Kind == ""
+	}
+
+	for _, change := range event.Refs {
+		if change.Ref != opts.Ref {
+			continue
+		}
+		if opts.NewRev != "" && change.NewRev != opts.NewRev {
+			continue
+		}
+		if opts.Kind != "" && opts.Kind != refChangeKind(change) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// refChangeKind returns how a ref was updated, classifying changes of
+// events that were not, e.g. decoded from older webhooks, without access to
+// the repository: their updates of existing refs are fast-forwards.
+func refChangeKind(change RefChange) string {
+	if change.Kind != "" {
+		return change.Kind
+	}
+
+	switch {
+	case IsZeroSHA(change.OldRev):
+		return CreateUpdate
+	case IsZeroSHA(change.NewRev):
+		return DeleteUpdate
+	}
+	return FastForwardUpdate
+}
+
+// CheckClone returns an error unless the client repository at clone has the
+// branches of the hosted repository at repo as remote-tracking branches (or
+// as branches, for bare and mirror clones) at the same revisions.
+func CheckClone(clone string, repo string) error {
+	hosted, err := listRefs("git", repo)
+	if err != nil {
+		return err
+	}
+	cloned, err := listRefs("git", clone)
+	if err != nil {
+		return err
+	}
+
+	for ref, rev := range hosted {
+		if !strings.HasPrefix(ref, "refs/heads/") {
+			continue
+		}
+
+		tracking := "refs/remotes/origin/" + strings.TrimPrefix(ref, "refs/heads/")
+		actual, ok := cloned[tracking]
+		if !ok {
+			actual, ok = cloned[ref]
+		}
+		if !ok {
+			return fmt.Errorf("clone is missing %s", ref)
+		}
+		if actual != rev {
+			return fmt.Errorf("clone has %s at %s, not %s", ref, actual, rev)
+		}
+	}
+	return nil
+}
+
+func refsOf(repo interface{}) (map[string]string, error) {
+	switch r := repo.(type) {
+	case string:
+		return listRefs("git", r)
+	case *Snapshot:
+		return r.Refs, nil
+	}
+	return nil, fmt.Errorf("expected a repository path or *Snapshot, got %T", repo)
+}
+
+// HaveRef succeeds if a repository, given as a git directory path or a
+// *Snapshot, has ref at rev. An empty rev only checks the ref exists.
+func HaveRef(ref string, rev string) types.GomegaMatcher {
+	return &checkMatcher{
+		description: fmt.Sprintf("to have ref %s %s", ref, rev),
+		check: func(actual interface{}) error {
+			return CheckRef(actual, ref, rev)
+		},
+	}
+}
+
+// HaveReceivedPush succeeds if the events, given as a []Event or an
+// *EventRecorder, contain a push matching the options.
+func HaveReceivedPush(opts PushOptions) types.GomegaMatcher {
+	return &checkMatcher{
+		description: fmt.Sprintf("to have received a push matching %+v", opts),
+		check: func(actual interface{}) error {
+			return CheckPush(actual, opts)
+		},
+	}
+}
+
+// HaveCloneOf succeeds if the client repository path it is given is an up to
+// date clone of the hosted repository at repo.
+func HaveCloneOf(repo string) types.GomegaMatcher {
+	return &checkMatcher{
+		description: fmt.Sprintf("to be a clone of %s", repo),
+		check: func(actual interface{}) error {
+			clone, ok := actual.(string)
+			if !ok {
+				return fmt.Errorf("expected a repository path, got %T", actual)
+			}
+			return CheckClone(clone, repo)
+		},
+	}
+}
+
+// checkMatcher turns a check function into a Gomega matcher
+type checkMatcher struct {
+	description string
+	check       func(actual interface{}) error
+	failure     error
+}
+
+func (m *checkMatcher) Match(actual interface{}) (bool, error) {
+	m.failure = m.check(actual)
+	return m.failure == nil, nil
+}
+
+func (m *checkMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected\n\t%v\n%s, but %v", actual, m.description, m.failure)
+}
+
+func (m *checkMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected\n\t%v\nnot %s", actual, m.description)
+}
@@ -0,0 +1,76 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchers(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "matchers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosted := filepath.Join(dir, repo)
+
+	recorder := &EventRecorder{}
+	service := New(Config{Dir: dir})
+	service.OnEvent = recorder.Record
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	clone := filepath.Join(dir, "clone")
+	out, err := runGit(dir, "clone", HTTPCloneURL(server.Listener.Addr().String(), repo), clone)
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	g.Expect(clone).To(HaveCloneOf(hosted))
+
+	rev, err := service.Commit(repo, "master", Commit{Files: map[string]string{"upstream": "moved"}})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(hosted).To(HaveRef("refs/heads/master", rev))
+	g.Expect(clone).ToNot(HaveCloneOf(hosted))
+
+	out, err = runGit(clone, "push", "origin", "HEAD:refs/heads/feature")
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	head, err := gitOutput("git", clone, "rev-parse", "HEAD")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(recorder).To(HaveReceivedPush(PushOptions{Repo: repo, Transport: HTTPTransport}))
+	g.Expect(recorder).To(HaveReceivedPush(PushOptions{Ref: "refs/heads/feature", NewRev: strings.TrimSpace(string(head)), Kind: CreateUpdate}))
+	g.Expect(recorder).To(HaveReceivedPush(PushOptions{Ref: "refs/heads/master", Transport: LocalTransport}))
+	g.Expect(recorder).ToNot(HaveReceivedPush(PushOptions{Ref: "refs/heads/feature", Kind: DeleteUpdate}))
+	g.Expect(recorder.Events()).ToNot(HaveReceivedPush(PushOptions{Failed: true}))
+
+	snapshot, err := service.Snapshot(repo)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(snapshot).To(HaveRef("refs/heads/feature", ""))
+	g.Expect(snapshot).ToNot(HaveRef("refs/heads/missing", ""))
+
+	// The same checks are available for testify users
+	assert.NoError(t, CheckRef(hosted, "refs/heads/master", rev))
+	assert.EqualError(t, CheckRef(hosted, "refs/heads/missing", ""), "ref refs/heads/missing does not exist")
+	assert.NoError(t, CheckPush(recorder, PushOptions{User: ""}))
+	assert.Error(t, CheckPush(recorder, PushOptions{Repo: "other.git"}))
+
+	// Updates of existing refs are classified when pushed
+	assert.NoError(t, CheckPush(recorder, PushOptions{Ref: "refs/heads/master", Kind: FastForwardUpdate}))
+	assert.Error(t, CheckPush(recorder, PushOptions{Ref: "refs/heads/master", Kind: ForceUpdate}))
+	out, err = runGit(clone, "push", "--force", "origin", "HEAD:refs/heads/master")
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	g.Expect(recorder).To(HaveReceivedPush(PushOptions{Ref: "refs/heads/master", Transport: HTTPTransport, Kind: ForceUpdate}))
+
+	recorder.Reset()
+	assert.Empty(t, recorder.Events())
+}
@@ -0,0 +1,191 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// OverflowPolicy controls what happens to request bodies exceeding the
+// memory budget of Config.MemoryBudget
+type OverflowPolicy string
+
+const (
+	// OverflowSpill writes the rest of the body to a temporary file (default)
+	OverflowSpill OverflowPolicy = ""
+	// OverflowReject fails the request with 413 Request Entity Too Large
+	OverflowReject OverflowPolicy = "reject"
+)
+
+// bufferChunk is the size of the chunks request bodies are buffered in
+const bufferChunk = 32 * 1024
+
+var errMemoryBudget = errors.New("memory budget exceeded")
+
+// MemoryStats reports the memory used to buffer HTTP request bodies
+type MemoryStats struct {
+	Buffered int64 // Bytes currently buffered in memory
+	Peak     int64 // Most bytes buffered in memory at once
+	Spilled  int64 // Bytes written to temporary files since the server started
+	Rejected int   // Requests rejected for exceeding the budget
+}
+
+// memoryBudget accounts the bytes buffered in memory across requests
+type memoryBudget struct {
+	mu    sync.Mutex
+	stats MemoryStats
+}
+
+// reserve accounts n more bytes, unless it would exceed the limit
+func (m *memoryBudget) reserve(limit int64, n int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stats.Buffered+n > limit {
+		return false
+	}
+	m.stats.Buffered += n
+	if m.stats.Buffered > m.stats.Peak {
+		m.stats.Peak = m.stats.Buffered
+	}
+	return true
+}
+
+func (m *memoryBudget) release(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Buffered -= n
+}
+
+func (m *memoryBudget) spilled(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Spilled += n
+}
+
+func (m *memoryBudget) rejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Rejected++
+}
+
+func (m *memoryBudget) get() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// bufferedBody is a request body read ahead, in memory up to the budget and
+// in a temporary file beyond it.
+type bufferedBody struct {
+	io.Reader
+	memory  int64 // Bytes accounted in the budget
+	spilled int64
+	file    *os.File
+	budget  *memoryBudget
+	release func(*error)
+}
+
+// Close releases the memory and temporary file of the body
+func (b *bufferedBody) Close() error {
+	b.budget.release(b.memory)
+	b.memory = 0
+	if b.file != nil {
+		b.file.Close()
+		b.release(nil)
+		b.file = nil
+	}
+	return nil
+}
+
+// bufferBody reads a request body ahead within the memory budget, spilling
+// to a temporary file or failing with errMemoryBudget beyond it.
+func (s *Server) bufferBody(body io.Reader) (*bufferedBody, error) {
+	buffered := &bufferedBody{budget: &s.memory}
+	memory := &bytes.Buffer{}
+	chunk := make([]byte, bufferChunk)
+
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if n > 0 {
+			if err := buffered.write(s, memory, chunk[:n]); err != nil {
+				buffered.Close()
+				return nil, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			buffered.Close()
+			return nil, err
+		}
+	}
+
+	buffered.Reader = memory
+	if buffered.file != nil {
+		if _, err := buffered.file.Seek(0, io.SeekStart); err != nil {
+			buffered.Close()
+			return nil, err
+		}
+		buffered.Reader = io.MultiReader(memory, buffered.file)
+		s.memory.spilled(buffered.spilled)
+	}
+	return buffered, nil
+}
+
+func (b *bufferedBody) write(s *Server, memory *bytes.Buffer, data []byte) error {
+	if b.file == nil && b.budget.reserve(s.config.MemoryBudget, int64(len(data))) {
+		b.memory += int64(len(data))
+		memory.Write(data)
+		return nil
+	}
+
+	if s.config.MemoryOverflow == OverflowReject {
+		return errMemoryBudget
+	}
+	if b.file == nil {
+		file, release, err := s.repoOps().createTemp("gitkit-body-*")
+		if err != nil {
+			return err
+		}
+		b.file, b.release = file, release
+	}
+	if _, err := b.file.Write(data); err != nil {
+		return err
+	}
+	b.spilled += int64(len(data))
+	return nil
+}
+
+// readBody returns the body of an RPC request, buffered if Config.MemoryBudget
+// is set, and answers the requests whose body cannot be buffered.
+func (s *Server) readBody(w http.ResponseWriter, r *Request, body io.Reader) (io.ReadCloser, bool) {
+	if s.config.MemoryBudget <= 0 {
+		return io.NopCloser(body), true
+	}
+
+	buffered, err := s.bufferBody(body)
+	if err == errMemoryBudget {
+		s.memory.rejected()
+		s.config.logError("memory", fmt.Errorf("%s: request body exceeds the memory budget of %d bytes", r.RepoName, s.config.MemoryBudget))
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		s.fail500(w, "memory", err)
+		return nil, false
+	}
+	s.config.logInfo("memory", fmt.Sprintf("%s: buffered %d bytes in memory, %d on disk", r.RepoName, buffered.memory, buffered.spilled))
+	return buffered, true
+}
+
+// MemoryStats reports the memory used to buffer request bodies within
+// Config.MemoryBudget
+func (s *Server) MemoryStats() MemoryStats {
+	return s.memory.get()
+}
@@ -0,0 +1,474 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitserver "github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh"
+)
+
+// memoryPrefix starts the git directories handed out by MemoryStore, which
+// are not paths.
+const memoryPrefix = "memory://"
+
+// MemoryStore keeps repositories in memory with go-git storers, for tests
+// running without temporary directories or the git binary. Servers with a
+// MemoryStore as Config.Store speak the git protocol with the go-git server
+// transport instead of running git upload-pack and receive-pack.
+//
+// The go-git server transport limits what clients get: protocol v0 only, no
+// side-band, no shallow or partial clones and no multi-ack negotiation, so
+// common commits are never acknowledged and fetches send every object the
+// client does not already have. Features running git on repositories, e.g.
+// hooks, commits or the changed files of push events, need a store on disk,
+// as do clusters.
+type MemoryStore struct {
+	// DefaultBranch is the branch HEAD of created repositories points to,
+	// defaulting to master.
+	DefaultBranch string
+
+	mu    sync.Mutex
+	repos map[string]*memoryRepo
+}
+
+// memoryRepo is a repository of a MemoryStore
+type memoryRepo struct {
+	mu      sync.RWMutex // Held for writing while pushing
+	storage *memory.Storage
+}
+
+func (m *MemoryStore) Open(name string) (string, error) {
+	if m.repo(name) == nil {
+		return "", ErrRepoNotFound
+	}
+	return memoryPrefix + name, nil
+}
+
+func (m *MemoryStore) Create(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.repos[name]; ok {
+		return memoryPrefix + name, nil
+	}
+
+	branch := m.DefaultBranch
+	if branch == "" {
+		branch = "master"
+	}
+	storage := memory.NewStorage()
+	head := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch))
+	if err := storage.SetReference(head); err != nil {
+		return "", err
+	}
+
+	if m.repos == nil {
+		m.repos = map[string]*memoryRepo{}
+	}
+	m.repos[name] = &memoryRepo{storage: storage}
+	return memoryPrefix + name, nil
+}
+
+func (m *MemoryStore) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.repos[name]; !ok {
+		return ErrRepoNotFound
+	}
+	delete(m.repos, name)
+	return nil
+}
+
+func (m *MemoryStore) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := []string{}
+	for name := range m.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryStore) Resolve(name string) string {
+	if m.repo(name) != nil {
+		return name
+	}
+
+	alt := name + ".git"
+	if strings.HasSuffix(name, ".git") {
+		alt = strings.TrimSuffix(name, ".git")
+	}
+	if alt != "" && m.repo(alt) != nil {
+		return alt
+	}
+	return name
+}
+
+// Storer returns the go-git storer of a repository, e.g. to open it with
+// git.Open and commit to it. It must not be changed while being served.
+func (m *MemoryStore) Storer(name string) (storage.Storer, error) {
+	repo := m.repo(name)
+	if repo == nil {
+		return nil, ErrRepoNotFound
+	}
+	return repo.storage, nil
+}
+
+// Load loads the repository named by the path of an endpoint, making the
+// store the transport.Loader of go-git servers.
+func (m *MemoryStore) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	repo := m.repo(strings.TrimPrefix(ep.Path, "/"))
+	if repo == nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	return repo.storage, nil
+}
+
+func (m *MemoryStore) repo(name string) *memoryRepo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.repos[name]
+}
+
+// memoryService returns the service of an in-memory repository, given the
+// git directory the store returned, or nil for repositories on disk.
+func (c *Config) memoryService(dir string, rpc string) *memoryService {
+	store, ok := c.Store.(*MemoryStore)
+	if !ok || !strings.HasPrefix(dir, memoryPrefix) {
+		return nil
+	}
+
+	name := strings.TrimPrefix(dir, memoryPrefix)
+	repo := store.repo(name)
+	if repo == nil {
+		return nil
+	}
+	return &memoryService{store: store, repo: repo, name: name, rpc: rpc}
+}
+
+// memoryService serves upload-pack or receive-pack for an in-memory
+// repository, through the go-git server transport.
+type memoryService struct {
+	store *MemoryStore
+	repo  *memoryRepo
+	name  string
+	rpc   string
+}
+
+func (m *memoryService) endpoint() *transport.Endpoint {
+	return &transport.Endpoint{Protocol: "file", Path: path.Join("/", m.name)}
+}
+
+// serve advertises the refs of the repository and answers the request of
+// the client, returning the refs updated by pushes.
+func (m *memoryService) serve(ctx context.Context, r io.Reader, w io.Writer) ([]RefChange, error) {
+	if m.rpc == "git-receive-pack" {
+		m.repo.mu.Lock()
+		defer m.repo.mu.Unlock()
+	} else {
+		m.repo.mu.RLock()
+		defer m.repo.mu.RUnlock()
+	}
+
+	if err := m.advertise(w); err != nil {
+		return nil, err
+	}
+	if m.rpc == "git-receive-pack" {
+		return m.receivePack(ctx, r, w)
+	}
+	return nil, m.uploadPack(ctx, r, w, false)
+}
+
+// advertise writes the refs and capabilities of the repository
+func (m *memoryService) advertise(w io.Writer) error {
+	var session interface {
+		AdvertisedReferences() (*packp.AdvRefs, error)
+	}
+	var err error
+
+	srv := gitserver.NewServer(m.store)
+	if m.rpc == "git-receive-pack" {
+		session, err = srv.NewReceivePackSession(m.endpoint(), nil)
+	} else {
+		session, err = srv.NewUploadPackSession(m.endpoint(), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	refs, err := session.AdvertisedReferences()
+	if err != nil {
+		return err
+	}
+	return refs.Encode(w)
+}
+
+// uploadPack reads the wants and haves of a fetch and sends the pack once
+// the client is done. Rounds of negotiation are answered with a NAK, which
+// ends stateless requests.
+func (m *memoryService) uploadPack(ctx context.Context, r io.Reader, w io.Writer, stateless bool) error {
+	req := packp.NewUploadPackRequest()
+	if err := req.UploadRequest.Decode(r); err != nil {
+		// Clients having every ref only send a flush
+		if len(req.Wants) == 0 {
+			return nil
+		}
+		return memoryError(w, err)
+	}
+
+	scanner := pktline.NewScanner(r)
+negotiation:
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+		switch {
+		case len(line) == 0:
+			if err := packLine(w, "NAK\n"); err != nil {
+				return err
+			}
+			if stateless {
+				return nil
+			}
+		case bytes.HasPrefix(line, []byte("have ")):
+			have := plumbing.NewHash(string(line[len("have "):]))
+			// Objects of the client missing here cannot be left out
+			if m.repo.storage.HasEncodedObject(have) == nil {
+				req.Haves = append(req.Haves, have)
+			}
+		case string(line) == "done":
+			break negotiation
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	session, err := gitserver.NewServer(m.store).NewUploadPackSession(m.endpoint(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := session.UploadPack(ctx, req)
+	if err != nil {
+		return memoryError(w, err)
+	}
+	return resp.Encode(w)
+}
+
+// receivePack applies the ref updates and pack of a push, and reports their
+// status to the client.
+func (m *memoryService) receivePack(ctx context.Context, r io.Reader, w io.Writer) ([]RefChange, error) {
+	// Not closed by go-git once the pack is read, unlike SSH channels, so
+	// that the status can still be reported
+	body := bufio.NewReader(r)
+
+	// Clients with nothing to push only send a flush
+	if start, err := body.Peek(4); err == io.EOF || string(start) == "0000" {
+		return nil, nil
+	}
+
+	req := packp.NewReferenceUpdateRequest()
+	if err := req.Decode(body); err != nil {
+		return nil, err
+	}
+
+	// Clients only deleting refs send no pack
+	req.Packfile = nil
+	for _, cmd := range req.Commands {
+		if cmd.Action() != packp.Delete {
+			req.Packfile = io.NopCloser(body)
+			break
+		}
+	}
+
+	before := m.refs()
+	session, err := gitserver.NewServer(m.store).NewReceivePackSession(m.endpoint(), nil)
+	if err != nil {
+		return nil, err
+	}
+	status, err := session.ReceivePack(ctx, req)
+	if status != nil {
+		if err := status.Encode(w); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := []RefChange{}
+	for _, update := range diffRefs(before, m.refs()) {
+		changes = append(changes, RefChange{RefUpdate: update, Kind: m.updateKind(update)})
+	}
+	return changes, err
+}
+
+// updateKind classifies a ref update like ClassifyRefUpdate, with go-git
+func (m *memoryService) updateKind(update RefUpdate) string {
+	switch {
+	case IsZeroSHA(update.OldRev):
+		return CreateUpdate
+	case IsZeroSHA(update.NewRev):
+		return DeleteUpdate
+	}
+
+	old, err := object.GetCommit(m.repo.storage, plumbing.NewHash(update.OldRev))
+	if err != nil {
+		return ""
+	}
+	rev, err := object.GetCommit(m.repo.storage, plumbing.NewHash(update.NewRev))
+	if err != nil {
+		return ""
+	}
+	if ok, err := old.IsAncestor(rev); err != nil || !ok {
+		return ForceUpdate
+	}
+	return FastForwardUpdate
+}
+
+// refs lists the refs of the repository by name
+func (m *memoryService) refs() map[string]string {
+	refs := map[string]string{}
+
+	iter, err := m.repo.storage.IterReferences()
+	if err != nil {
+		return refs
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	return refs
+}
+
+// memoryError reports an error to the client, in place of the response
+func memoryError(w io.Writer, err error) error {
+	packLine(w, fmt.Sprintf("ERR %s\n", err))
+	return err
+}
+
+// serveMemory answers the requests for in-memory repositories, each smart
+// HTTP request replaying a part of the exchange of serve.
+func (s *Server) serveMemory(svc *service, w http.ResponseWriter, r *Request) {
+	context := "memory-store"
+	advertise := svc.rpc == ""
+
+	rpc := svc.rpc
+	if advertise {
+		rpc = r.URL.Query().Get("service")
+	}
+	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	m := s.config.memoryService(r.RepoPath, rpc)
+	if m == nil {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	t := &transfer{}
+	defer s.clientGone(r, rpc, t)
+
+	if advertise {
+		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+
+		m.repo.mu.RLock()
+		defer m.repo.mu.RUnlock()
+
+		out := t.writer(w)
+		if err := packLine(out, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
+			s.config.logError(context, err)
+			return
+		}
+		if err := packFlush(out); err != nil {
+			s.config.logError(context, err)
+			return
+		}
+		if err := m.advertise(out); err != nil {
+			s.config.logError(context, err)
+		}
+		return
+	}
+
+	body := t.reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var err error
+		body, err = gzip.NewReader(body)
+		if err != nil {
+			s.fail500(w, context, err)
+			return
+		}
+	}
+
+	// Simulates servers that short-circuit the connection, like postRPC
+	if rpc == "git-receive-pack" && s.config.ReadOnly {
+		return
+	}
+
+	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	var refs []RefChange
+	var err error
+	out := t.writer(newWriteFlusher(w))
+	if rpc == "git-receive-pack" {
+		m.repo.mu.Lock()
+		refs, err = m.receivePack(r.Context(), body, out)
+		m.repo.mu.Unlock()
+	} else {
+		m.repo.mu.RLock()
+		err = m.uploadPack(r.Context(), body, out, true)
+		m.repo.mu.RUnlock()
+	}
+	if err != nil {
+		s.config.logError(context, fmt.Errorf("%s: %v", r.RepoName, err))
+	}
+
+	if event := serviceEvent(rpc); event != "" {
+		user, _, _ := r.BasicAuth()
+		s.emit(r, Event{Type: event, User: user, Error: errorString(err), Refs: refs})
+	}
+}
+
+// serveMemory runs a git command on an in-memory repository
+func (s *SSH) serveMemory(ctx context.Context, ch ssh.Channel, req *ssh.Request, conn *ssh.ServerConn, keyID string, gitcmd *GitCommand, m *memoryService) {
+	req.Reply(true, nil)
+
+	started := time.Now()
+	t := &transfer{}
+	refs, err := m.serve(ctx, t.reader(ch), t.writer(ch))
+	s.executed(conn, gitcmd, started, err)
+	s.clientGone(ctx, conn.RemoteAddr().String(), gitcmd, t)
+	if event := serviceEvent(gitcmd.Command); event != "" {
+		s.emit(conn, Event{Type: event, Repo: gitcmd.Repo, KeyID: keyID, Error: errorString(err), Refs: refs})
+	}
+	if err != nil {
+		s.gitConfig.logf("ssh: command failed: %v", err)
+		return
+	}
+
+	ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+}
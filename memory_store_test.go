@@ -0,0 +1,104 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := &MemoryStore{DefaultBranch: "master"}
+	config := Config{Store: store, AutoCreate: true, KeyDir: filepath.Join(t.TempDir(), "keys")}
+
+	httpServer := New(config)
+	recorder := &EventRecorder{}
+	httpServer.OnEvent = recorder.Record
+	ts := httptest.NewServer(httpServer)
+	defer ts.Close()
+	sshServer := NewSSH(config)
+	sshServer.OnEvent = recorder.Record
+	addr := startSSH(t, sshServer)
+
+	urls := map[string]string{
+		"http.git": HTTPCloneURL(ts.Listener.Addr().String(), "http.git"),
+		"ssh.git":  SSHCloneURL("git", addr, "ssh.git"),
+	}
+	for name, url := range urls {
+		work, err := createRepo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(work)
+
+		out, err := runGit(work, "push", url, "master", "master:feature")
+		assert.NoError(t, err, out)
+
+		clone := filepath.Join(t.TempDir(), "clone")
+		out, err = runGit(t.TempDir(), "clone", url, clone)
+		assert.NoError(t, err, out)
+		assert.FileExists(t, filepath.Join(clone, "homework"), name)
+
+		out, err = runGit(work, "-c", "user.email=test@ssh.com", "-c", "user.name=test-user", "commit", "--allow-empty", "-m", "second")
+		assert.NoError(t, err, out)
+		out, err = runGit(work, "push", url, "master", ":feature")
+		assert.NoError(t, err, out)
+
+		out, err = runGit(clone, "pull", "--prune")
+		assert.NoError(t, err, out)
+		local, _ := runGit(clone, "rev-parse", "HEAD")
+		head, _ := runGit(work, "rev-parse", "HEAD")
+		assert.Equal(t, strings.TrimSpace(head), strings.TrimSpace(local), name)
+
+		storage, err := store.Storer(name)
+		assert.NoError(t, err)
+		repo, err := git.Open(storage, nil)
+		assert.NoError(t, err)
+		ref, err := repo.Head()
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, strings.TrimSpace(head), ref.Hash().String(), name)
+		}
+		_, err = repo.Reference(plumbing.NewBranchReferenceName("feature"), false)
+		assert.Equal(t, plumbing.ErrReferenceNotFound, err, name)
+
+		out, err = runGit(clone, "fetch")
+		assert.NoError(t, err, out)
+	}
+
+	names, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http.git", "ssh.git"}, names)
+
+	pushes := 0
+	for _, event := range recorder.Events() {
+		if event.Type == PushEvent && event.Error == "" && len(event.Refs) == 2 {
+			pushes++
+		}
+	}
+	assert.Equal(t, 4, pushes)
+	assert.NoError(t, CheckPush(recorder, PushOptions{Ref: "refs/heads/master", Kind: FastForwardUpdate}))
+}
+
+func TestMemoryStoreShallow(t *testing.T) {
+	store := &MemoryStore{}
+	ts := httptest.NewServer(New(Config{Store: store, AutoCreate: true}))
+	defer ts.Close()
+	url := HTTPCloneURL(ts.Listener.Addr().String(), "repo.git")
+
+	work, err := createRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+	out, err := runGit(work, "push", url, "master")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(t.TempDir(), "clone", "--depth=1", url, "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "does not support shallow")
+}
@@ -0,0 +1,70 @@
+package gitkit
+
+import (
+	cryptorand "crypto/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	dir, err := os.MkdirTemp("", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Random data does not compress, so pushes send about its size
+	data := make([]byte, 300*1024)
+	if _, err := cryptorand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(service *Server, repo string) (string, error) {
+		ts := httptest.NewServer(service)
+		defer ts.Close()
+
+		clone := filepath.Join(t.TempDir(), "clone")
+		if out, err := runGit(dir, "init", clone); err != nil {
+			t.Fatal(err, out)
+		}
+		if err := os.WriteFile(filepath.Join(clone, "data.bin"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, clone, "notes.txt")
+		if out, err := runGit(clone, "add", "data.bin"); err != nil {
+			t.Fatal(err, out)
+		}
+		if out, err := runGit(clone, "-c", "user.email=test@gitkit.com", "-c", "user.name=test-user", "commit", "-m", "data"); err != nil {
+			t.Fatal(err, out)
+		}
+		return runGit(clone, "push", ts.URL+"/"+repo, "HEAD:master")
+	}
+
+	spill := New(Config{Dir: dir, AutoCreate: true, MemoryBudget: 64 * 1024, TempDir: filepath.Join(dir, "tmp")})
+	out, err := push(spill, "spill.git")
+	assert.NoError(t, err, out)
+	stats := spill.MemoryStats()
+	assert.Zero(t, stats.Buffered)
+	assert.LessOrEqual(t, stats.Peak, int64(64*1024))
+	assert.Greater(t, stats.Spilled, int64(200*1024))
+	assert.Zero(t, spill.TempStats().Active)
+	assert.Equal(t, 1, spill.TempStats().Created)
+
+	reject := New(Config{Dir: dir, AutoCreate: true, MemoryBudget: 64 * 1024, MemoryOverflow: OverflowReject})
+	out, err = push(reject, "reject.git")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "413")
+	assert.Equal(t, 1, reject.MemoryStats().Rejected)
+	assert.Zero(t, reject.MemoryStats().Buffered)
+
+	// Small requests fit in the budget
+	ts := httptest.NewServer(reject)
+	defer ts.Close()
+	out, err = runGit(dir, "clone", ts.URL+"/spill.git", filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+	assert.Equal(t, 1, reject.MemoryStats().Rejected)
+}
@@ -0,0 +1,23 @@
+package gitkit
+
+// ownershipSettings returns the settings trusting every repository with
+// Config.TrustAllDirectories, like containers setting safe.directory to '*'.
+// git only reads safe.directory from protected configs, which include the
+// ones of the command line.
+func (c *Config) ownershipSettings() []string {
+	if !c.TrustAllDirectories {
+		return nil
+	}
+	return []string{"safe.directory=*"}
+}
+
+// ownershipEnv returns the environment making git treat repositories as owned
+// by another user with Config.DubiousOwnership, as in containers where
+// volumes keep the owner of the host. It relies on the switch of git's test
+// suite, which still honors safe.directory.
+func (c *Config) ownershipEnv() []string {
+	if !c.DubiousOwnership {
+		return nil
+	}
+	return []string{"GIT_TEST_ASSUME_DIFFERENT_OWNER=1"}
+}
@@ -0,0 +1,94 @@
+package gitkit
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwnership(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := func(t *testing.T, config Config) map[string]string {
+		config.Dir = dir
+		config.KeyDir = filepath.Join(dir, "keys")
+		ts := httptest.NewServer(New(config))
+		t.Cleanup(ts.Close)
+		return map[string]string{
+			"http": HTTPCloneURL(ts.Listener.Addr().String(), repo),
+			"ssh":  SSHCloneURL("git", startSSH(t, NewSSH(config)), repo),
+		}
+	}
+
+	t.Run("dubious", func(t *testing.T) {
+		for transport, url := range urls(t, Config{DubiousOwnership: true}) {
+			out, err := runGit(dir, "ls-remote", url)
+			assert.Error(t, err, transport)
+			if transport == "ssh" {
+				assert.Contains(t, out, "detected dubious ownership")
+			}
+		}
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		for transport, url := range urls(t, Config{DubiousOwnership: true, TrustAllDirectories: true}) {
+			out, err := runGit(dir, "ls-remote", url)
+			assert.NoError(t, err, transport, out)
+		}
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		mirror := filepath.Join(dir, repo)
+		err := New(Config{Dir: t.TempDir(), DubiousOwnership: true}).AdoptRepo("mirror.git", mirror)
+		assert.Error(t, err)
+		if err != nil {
+			assert.Contains(t, err.Error(), "safe.directory")
+		}
+		assert.NoError(t, New(Config{Dir: t.TempDir(), DubiousOwnership: true, TrustAllDirectories: true}).AdoptRepo("mirror.git", mirror))
+	})
+}
+
+func TestLogGitStderr(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		config  Config
+		relayed bool
+		logged  bool
+	}{
+		{"verbatim", Config{Dir: dir, DubiousOwnership: true}, true, false},
+		{"logged", Config{Dir: dir, DubiousOwnership: true, LogGitStderr: true}, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			tc.config.Logger = log.New(logs, "", 0)
+			ts := httptest.NewServer(New(tc.config))
+			defer ts.Close()
+
+			resp, err := http.Get(HTTPCloneURL(ts.Listener.Addr().String(), repo) + "/info/refs?service=git-upload-pack")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.relayed, strings.Contains(string(body), "dubious ownership"), string(body))
+			assert.Equal(t, tc.logged, strings.Contains(logs.String(), "dubious ownership"), logs.String())
+		})
+	}
+}
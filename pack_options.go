@@ -0,0 +1,136 @@
+package gitkit
+
+import (
+	"strconv"
+	"sync"
+)
+
+// PackOptions tune how git packs the objects of a repository, to compare
+// client fetch times under different server pack strategies. Zero fields
+// keep the defaults of git.
+type PackOptions struct {
+	// Islands are the pack.island regular expressions grouping refs into
+	// delta islands, so that Repack never stores objects as deltas against
+	// objects of another island, like forks sharing a repository
+	Islands []string
+	// IslandCore is the island Repack packs first, pack.islandCore
+	IslandCore string
+	// DisableBitmaps stops using reachability bitmaps to count the objects
+	// to send, and writing them in Repack
+	DisableBitmaps bool
+	// DisablePackReuse stops sending parts of existing packs verbatim,
+	// pack.allowPackReuse
+	DisablePackReuse bool
+	// Window and Depth are the delta search window and maximum delta chain
+	// length, pack.window and pack.depth
+	Window int
+	Depth  int
+	// Threads limits the threads searching for deltas, pack.threads
+	Threads int
+}
+
+func (o PackOptions) settings() []string {
+	settings := []string{}
+	for _, island := range o.Islands {
+		settings = append(settings, "pack.island="+island)
+	}
+	if o.IslandCore != "" {
+		settings = append(settings, "pack.islandCore="+o.IslandCore)
+	}
+	if o.DisableBitmaps {
+		settings = append(settings, "pack.useBitmaps=false")
+	}
+	if o.DisablePackReuse {
+		settings = append(settings, "pack.allowPackReuse=false")
+	}
+	if o.Window > 0 {
+		settings = append(settings, "pack.window="+strconv.Itoa(o.Window))
+	}
+	if o.Depth > 0 {
+		settings = append(settings, "pack.depth="+strconv.Itoa(o.Depth))
+	}
+	if o.Threads > 0 {
+		settings = append(settings, "pack.threads="+strconv.Itoa(o.Threads))
+	}
+	return settings
+}
+
+// packOptionSet holds the pack options per repository. The empty repository
+// name applies to all repositories.
+type packOptionSet struct {
+	mu      sync.RWMutex
+	options map[string]PackOptions
+}
+
+func (p *packOptionSet) set(repo string, options *PackOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.options == nil {
+		p.options = map[string]PackOptions{}
+	}
+
+	if options == nil {
+		delete(p.options, lockKey(repo))
+	} else {
+		p.options[lockKey(repo)] = *options
+	}
+}
+
+func (p *packOptionSet) get(repo string) PackOptions {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if options, ok := p.options[lockKey(repo)]; ok {
+		return options
+	}
+	return p.options[""]
+}
+
+// serviceEnv returns the environment of the git commands serving the
+// repository, passing them its compression level, pack options, and the
+// partial clone, empty repository and ownership settings of the config.
+func serviceEnv(config *Config, compression *compressionSet, packOptions *packOptionSet, repo string) []string {
+	settings := append(compression.settings(repo), packOptions.get(repo).settings()...)
+	settings = append(settings, config.partialCloneSettings()...)
+	settings = append(settings, config.emptyRepoSettings()...)
+	settings = append(settings, config.ownershipSettings()...)
+	return append(configEnv(settings...), config.ownershipEnv()...)
+}
+
+func (o repoOps) repack(repo string, options PackOptions, compression []string) error {
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"repack", "-a", "-d", "-f", "-q", "--write-bitmap-index"}
+	if options.DisableBitmaps {
+		args[len(args)-1] = "--no-write-bitmap-index"
+	}
+	if len(options.Islands) > 0 {
+		args = append(args, "--delta-islands")
+	}
+	_, err = o.git(dir, configEnv(append(compression, options.settings()...)...), "", args...)
+	return err
+}
+
+// SetPackOptions tunes how objects of the repository are packed when served
+// and by Repack, until ClearPackOptions is called. An empty repository name
+// applies the options to every repository.
+func (c *controls) SetPackOptions(repo string, options PackOptions) {
+	c.packOptions.set(repo, &options)
+}
+
+// ClearPackOptions removes options set with SetPackOptions.
+func (c *controls) ClearPackOptions(repo string) {
+	c.packOptions.set(repo, nil)
+}
+
+// Repack packs all objects of a hosted repository into a single pack,
+// computing deltas again with the pack options and compression level of the
+// repository, and writing a reachability bitmap unless disabled. It
+// precomputes the packs of a server strategy, which fetches then reuse.
+func (c *controls) Repack(repo string) error {
+	return c.repoOps().repack(repo, c.packOptions.get(repo), c.compression.settings(repo))
+}
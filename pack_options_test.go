@@ -0,0 +1,67 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pack-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	service := New(Config{Dir: dir})
+	repoDir, err := service.config.repoStore().Create("repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for _, branch := range []string{"main", "fork"} {
+			if _, err := service.Commit("repo.git", branch, Commit{Files: map[string]string{
+				"file.txt": fmt.Sprintf("%s %d\n", branch, i),
+			}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	packs := func(pattern string) []string {
+		files, err := filepath.Glob(filepath.Join(repoDir, "objects", "pack", pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	service.SetPackOptions("repo.git", PackOptions{
+		Islands:    []string{"refs/heads/(main|fork)"},
+		IslandCore: "main",
+		Window:     50,
+		Depth:      10,
+		Threads:    1,
+	})
+	assert.NoError(t, service.Repack("repo.git"))
+	assert.Len(t, packs("*.pack"), 1)
+	assert.Len(t, packs("*.bitmap"), 1)
+
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	out, err := runGit(dir, "clone", ts.URL+"/repo.git", filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+
+	service.SetPackOptions("", PackOptions{DisableBitmaps: true, DisablePackReuse: true})
+	service.ClearPackOptions("repo.git")
+	assert.NoError(t, service.Repack("repo.git"))
+	assert.Len(t, packs("*.pack"), 1)
+	assert.Empty(t, packs("*.bitmap"))
+
+	out, err = runGit(dir, "clone", ts.URL+"/repo.git", filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+}
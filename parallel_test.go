@@ -0,0 +1,77 @@
+package gitkit
+
+import (
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParallelServers runs many servers at once, each in a parallel test,
+// to check that they share no state.
+func TestParallelServers(t *testing.T) {
+	const servers = 16
+
+	for i := 0; i < servers; i++ {
+		i := i
+		t.Run(fmt.Sprintf("server-%d", i), func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			repo := fmt.Sprintf("parallel-%d.git", i)
+			logs := &lockedBuffer{}
+			config := Config{
+				Dir:           dir,
+				KeyDir:        filepath.Join(dir, "keys"),
+				AutoCreate:    true,
+				CacheHostKeys: true,
+				Logger:        log.New(logs, "", 0),
+			}
+			recorder := &EventRecorder{}
+
+			service := New(config)
+			service.OnEvent = recorder.Record
+			ts := httptest.NewServer(service)
+			defer ts.Close()
+
+			sshServer := NewSSH(config)
+			sshServer.OnEvent = recorder.Record
+			// Simultaneous connections from other tests do not count
+			sshServer.DisableSimultaneousConns = true
+			addr := startSSH(t, sshServer)
+
+			work := filepath.Join(t.TempDir(), "work")
+			out, err := runGit(dir, "clone", HTTPCloneURL(ts.Listener.Addr().String(), repo), work)
+			if err != nil {
+				t.Fatal(err, out)
+			}
+			commitFile(t, work, repo)
+			out, err = runGit(work, "push", "origin", "HEAD:master")
+			assert.NoError(t, err, out)
+
+			clone := filepath.Join(t.TempDir(), "clone")
+			out, err = runGit(dir, "clone", SSHCloneURL("git", addr, repo), clone)
+			assert.NoError(t, err, out)
+			content, err := os.ReadFile(filepath.Join(clone, repo))
+			assert.NoError(t, err)
+			assert.Equal(t, repo, string(content))
+
+			for _, event := range recorder.Events() {
+				if event.Repo != "" {
+					assert.Equal(t, repo, event.Repo)
+				}
+			}
+			for j := 0; j < servers; j++ {
+				if j != i {
+					assert.NotContains(t, logs.String(), fmt.Sprintf("parallel-%d.git", j))
+				}
+			}
+			assert.True(t, strings.Contains(logs.String(), repo), "logs of the server: %s", logs)
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package gitkit
+
+// partialCloneSettings returns the upload-pack settings serving partial
+// clones when Config.PartialClone is set: object filters, and wants of any
+// object, since the lazy fetches of promisor clients ask for blobs by id
+// rather than for refs.
+func (c *Config) partialCloneSettings() []string {
+	if !c.PartialClone {
+		return nil
+	}
+	return []string{"uploadpack.allowFilter=true", "uploadpack.allowAnySHA1InWant=true"}
+}
@@ -0,0 +1,148 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// missingObjects returns the objects a clone refers to but does not have
+func missingObjects(t *testing.T, clone string) []string {
+	out, err := runGit(clone, "rev-list", "--objects", "--all", "--missing=print")
+	if err != nil {
+		t.Fatal(err, out)
+	}
+	missing := []string{}
+	for _, line := range strings.Fields(out) {
+		if strings.HasPrefix(line, "?") {
+			missing = append(missing, line[1:])
+		}
+	}
+	return missing
+}
+
+func TestPartialClone(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		partialClone bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), PartialClone: tc.partialClone}
+			httpService := New(config)
+			recorder := &EventRecorder{}
+			httpService.OnEvent = recorder.Record
+			ts := httptest.NewServer(httpService)
+			defer ts.Close()
+
+			sshService := NewSSH(config)
+			sshService.OnEvent = recorder.Record
+			sshAddr := startSSH(t, sshService)
+
+			if _, err := httpService.Commit(repo, "master", Commit{Files: map[string]string{"file": "old content"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := httpService.Commit(repo, "master", Commit{Files: map[string]string{"file": "new content"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, url := range []string{HTTPCloneURL(ts.Listener.Addr().String(), repo), SSHCloneURL("git", sshAddr, repo)} {
+				recorder.Reset()
+				clone := filepath.Join(t.TempDir(), "clone")
+				out, err := runGit(dir, "clone", "--filter=blob:none", url, clone)
+				assert.NoError(t, err, out)
+
+				if !tc.partialClone {
+					assert.Contains(t, out, "filtering not recognized by server", url)
+					assert.Empty(t, missingObjects(t, clone), url)
+					continue
+				}
+
+				// The blobs of the checkout are fetched on demand right
+				// after the clone, the ones of history when read
+				assert.Len(t, missingObjects(t, clone), 1, url)
+				out, err = runGit(clone, "show", "HEAD~1:file")
+				assert.NoError(t, err, out)
+				assert.Equal(t, "old content", out, url)
+				assert.Empty(t, missingObjects(t, clone), url)
+
+				fetches := 0
+				for _, event := range recorder.Events() {
+					if event.Type == FetchEvent {
+						fetches++
+					}
+				}
+				assert.Equal(t, 3, fetches, url)
+			}
+		})
+	}
+}
+
+func TestFilterPolicy(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		policy FilterPolicy
+		clone  bool
+		fetch  bool
+	}{
+		{FilterAlways, true, true},
+		{FilterClonesOnly, true, false},
+		{FilterFetchesOnly, false, true},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			service := New(Config{Dir: dir, PartialClone: true, FilterPolicy: tc.policy})
+			recorder := &EventRecorder{}
+			service.OnEvent = recorder.Record
+			ts := httptest.NewServer(service)
+			defer ts.Close()
+			url := HTTPCloneURL(ts.Listener.Addr().String(), repo)
+
+			if _, err := service.Commit(repo, "master", Commit{Files: map[string]string{"file": "old content"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := service.Commit(repo, "master", Commit{Files: map[string]string{"file": "new content"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			clone := filepath.Join(t.TempDir(), "clone")
+			out, err := runGit(dir, "clone", "--no-checkout", "--filter=blob:none", url, clone)
+			if !tc.clone {
+				assert.Error(t, err, out)
+				assert.Contains(t, out, "remote error: filtering not supported for clones")
+				events := recorder.Events()
+				assert.Equal(t, FetchEvent, events[len(events)-1].Type)
+				assert.Equal(t, "filtering not supported for clones", events[len(events)-1].Error)
+				return
+			}
+			assert.NoError(t, err, out)
+
+			// Fetching missing objects is refused like fetching new commits
+			out, err = runGit(clone, "show", "HEAD~1:file")
+			assert.Equal(t, tc.fetch, err == nil, out)
+			if _, err := service.Commit(repo, "master", Commit{Files: map[string]string{"file": "newer content"}}); err != nil {
+				t.Fatal(err)
+			}
+			out, err = runGit(clone, "fetch", "origin")
+			assert.Equal(t, tc.fetch, err == nil, out)
+			if !tc.fetch {
+				assert.Contains(t, out, "remote error: filtering not supported for fetches")
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package gitkit
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Cancellation reports a git process killed because the request or session
+// running it ended first, e.g. when a client aborts a clone.
+type Cancellation struct {
+	Transport  string
+	Repo       string
+	Command    string // git-upload-pack, git-receive-pack...
+	RemoteAddr string
+	// Cleanup is the time between the cancellation and the exit of the
+	// process
+	Cleanup time.Duration
+}
+
+// processWatch kills the process group of a git command as soon as its
+// context is done, so that git does not keep running for clients which are
+// gone.
+type processWatch struct {
+	cmd        *exec.Cmd
+	stop       chan struct{}
+	report     func(time.Duration)
+	mu         sync.Mutex
+	canceledAt time.Time
+}
+
+// watchProcess watches a started command until done is called. report, if
+// not nil, is called with the cleanup time of canceled commands.
+func watchProcess(ctx context.Context, cmd *exec.Cmd, report func(time.Duration)) *processWatch {
+	w := &processWatch{cmd: cmd, stop: make(chan struct{}), report: report}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.mu.Lock()
+			w.canceledAt = time.Now()
+			w.mu.Unlock()
+			killProcessGroup(cmd)
+		case <-w.stop:
+		}
+	}()
+	return w
+}
+
+// done stops watching the command, killing and waiting for it if it has
+// not been waited for yet.
+func (w *processWatch) done() {
+	close(w.stop)
+	if w.cmd.ProcessState == nil {
+		killProcessGroup(w.cmd)
+		w.cmd.Wait()
+	}
+
+	w.mu.Lock()
+	canceledAt := w.canceledAt
+	w.mu.Unlock()
+	if !canceledAt.IsZero() && w.report != nil {
+		w.report(time.Since(canceledAt))
+	}
+}
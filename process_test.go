@@ -0,0 +1,115 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCancelHTTP(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cancel-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := New(Config{Dir: dir})
+	head, err := service.Commit(repo, "master", Commit{Files: map[string]string{"file": "content"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceled := make(chan Cancellation, 1)
+	service.OnCancel = func(c Cancellation) { canceled <- c }
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+
+	// upload-pack waits for the rest of the negotiation forever
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", HTTPCloneURL(ts.Listener.Addr().String(), repo)+"/git-upload-pack",
+		strings.NewReader("0032want "+head+"\n"))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	select {
+	case c := <-canceled:
+		assert.Equal(t, HTTPTransport, c.Transport)
+		assert.Equal(t, repo, c.Repo)
+		assert.Equal(t, "git-upload-pack", c.Command)
+		assert.Less(t, int64(c.Cleanup), int64(5*time.Second))
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload-pack was not canceled")
+	}
+	assert.NoError(t, service.CheckLeaks())
+}
+
+func TestCancelSSH(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cancel-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	canceled := make(chan Cancellation, 1)
+	server.OnCancel = func(c Cancellation) { canceled <- c }
+	addr := startSSH(t, server)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// upload-pack advertises refs, then waits for the wants of the client
+	if err := session.Start("git-upload-pack '" + repo + "'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdout.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case c := <-canceled:
+		assert.Equal(t, SSHTransport, c.Transport)
+		assert.Equal(t, repo, c.Repo)
+		assert.Equal(t, "git-upload-pack", c.Command)
+		assert.Less(t, int64(c.Cleanup), int64(5*time.Second))
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload-pack was not canceled")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package gitkit
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs the command in its own process group, so that the
+// git processes it spawns are killed with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil && cmd.Process.Pid > 0 {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,176 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// gitProtocol returns the GIT_PROTOCOL value of git serving an HTTP client
+// that asked for the requested one: the requested one with ProtocolV2,
+// unless ForceProtocolVersion is set.
+func (c *Config) gitProtocol(requested string) string {
+	if c.ForceProtocolVersion != "" {
+		return "version=" + c.ForceProtocolVersion
+	}
+	if c.ProtocolV2 {
+		return requested
+	}
+	return ""
+}
+
+// protocolEnv passes the protocol version requested by the client with the
+// Git-Protocol header to git, like git http-backend does, with
+// Config.ProtocolV2.
+func (s *Server) protocolEnv(r *Request) []string {
+	if protocol := s.config.gitProtocol(r.Header.Get("Git-Protocol")); protocol != "" {
+		return []string{"GIT_PROTOCOL=" + protocol}
+	}
+	return nil
+}
+
+// protocolV2 tells whether the request is served with protocol v2
+func (s *Server) protocolV2(r *Request) bool {
+	return protocolVersion(s.config.gitProtocol(r.Header.Get("Git-Protocol"))) == 2
+}
+
+// gitProtocol returns the GIT_PROTOCOL value of git serving an SSH client
+// that asked for the requested one: the requested one, unless
+// ForceProtocolVersion is set. The requested one is empty when refused with
+// Config.SSHIgnoreGitProtocol.
+func (s *SSH) gitProtocol(requested string) string {
+	if s.gitConfig.ForceProtocolVersion != "" {
+		return "version=" + s.gitConfig.ForceProtocolVersion
+	}
+	return requested
+}
+
+// protocolEnv passes the protocol version requested by the client with the
+// GIT_PROTOCOL variable to git, like sshd accepting it does.
+func (s *SSH) protocolEnv(requested string) []string {
+	if protocol := s.gitProtocol(requested); protocol != "" {
+		return []string{"GIT_PROTOCOL=" + protocol}
+	}
+	return nil
+}
+
+// parseEnvRequest returns the variable of the payload of an env request
+func parseEnvRequest(payload []byte) (string, string, error) {
+	env := struct {
+		Name  string
+		Value string
+	}{}
+	if err := ssh.Unmarshal(payload, &env); err != nil {
+		return "", "", err
+	}
+	return env.Name, env.Value, nil
+}
+
+// requireProtocolV2 refuses fetches not asking for protocol v2 with
+// FeatureRequireProtocolV2, answering with an ERR packet of the response
+// kind, "advertisement" or "result", and tells whether to go on.
+func (s *Server) requireProtocolV2(w http.ResponseWriter, r *Request, rpc string, kind string) bool {
+	if rpc != "git-upload-pack" || !s.config.ProtocolV2 || !s.FeatureEnabled(FeatureRequireProtocolV2) || s.protocolV2(r) {
+		return true
+	}
+
+	s.config.logError("protocol", fmt.Errorf("%s: protocol v2 required", r.RepoName))
+	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-%s", rpc, kind))
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	if kind == "advertisement" {
+		packLine(w, fmt.Sprintf("# service=%s\n", rpc))
+		packFlush(w)
+	}
+	packLine(w, "ERR protocol v2 required\n")
+	return false
+}
+
+// hiddenCapabilities returns the protocol v2 capabilities and commands the
+// server hides from clients.
+func (s *Server) hiddenCapabilities() map[string]bool {
+	hidden := map[string]bool{}
+	if s.config.HideObjectInfo {
+		hidden["object-info"] = true
+	}
+	return hidden
+}
+
+// filterCapabilities copies a protocol v2 capability advertisement, leaving
+// out the hidden capabilities.
+func filterCapabilities(w io.Writer, r io.Reader, hidden map[string]bool) error {
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var length int
+		if _, err := fmt.Sscanf(string(header), "%04x", &length); err != nil {
+			return fmt.Errorf("invalid pkt-line length %q", header)
+		}
+		payload := []byte{}
+		if length > 4 {
+			payload = make([]byte, length-4)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+		}
+
+		if hidden[capabilityName(payload)] {
+			continue
+		}
+		if _, err := w.Write(append(header, payload...)); err != nil {
+			return err
+		}
+	}
+}
+
+// capabilityName returns the name of a capability line, e.g. "fetch" for
+// "fetch=shallow\n"
+func capabilityName(line []byte) string {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if i := bytes.IndexByte(line, '='); i >= 0 {
+		line = line[:i]
+	}
+	return string(line)
+}
+
+// rejectHiddenCommand answers protocol v2 requests running a hidden command
+// like git does for unknown commands, and returns the body to pass to git
+// otherwise.
+func (s *Server) rejectHiddenCommand(w http.ResponseWriter, r *Request, body io.Reader) (io.Reader, bool) {
+	hidden := s.hiddenCapabilities()
+	if len(hidden) == 0 {
+		return body, true
+	}
+
+	line, err := readPktLine(body)
+	if err != nil {
+		s.fail500(w, "post-rpc", err)
+		return nil, false
+	}
+	command := strings.TrimPrefix(strings.TrimSuffix(string(line), "\n"), "command=")
+	if !hidden[command] {
+		first := &bytes.Buffer{}
+		if line == nil {
+			packFlush(first)
+		} else {
+			packLine(first, string(line))
+		}
+		return io.MultiReader(first, body), true
+	}
+
+	s.config.logError("post-rpc", fmt.Errorf("%s: %s is hidden", r.RepoName, command))
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	packLine(w, fmt.Sprintf("ERR invalid command '%s'\n", command))
+	return nil, false
+}
@@ -0,0 +1,270 @@
+package gitkit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// protocolV2Request sends a request to the server asking for protocol v2,
+// returning the response body.
+func protocolV2Request(t *testing.T, method string, url string, body io.Reader) string {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestObjectInfo(t *testing.T) {
+	dir, err := os.MkdirTemp("", "object-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		config     Config
+		v2         bool
+		objectInfo bool
+	}{
+		{"v0", Config{Dir: dir}, false, false},
+		{"v2", Config{Dir: dir, ProtocolV2: true}, true, true},
+		{"hidden object-info", Config{Dir: dir, ProtocolV2: true, HideObjectInfo: true}, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := New(tc.config)
+			head, err := service.Commit(repo, "master", Commit{Files: map[string]string{"file": "content"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts := httptest.NewServer(service)
+			defer ts.Close()
+			url := HTTPCloneURL(ts.Listener.Addr().String(), repo)
+
+			advertisement := protocolV2Request(t, "GET", url+"/info/refs?service=git-upload-pack", nil)
+			assert.Equal(t, tc.v2, bytes.Contains([]byte(advertisement), []byte("version 2\n")), advertisement)
+			assert.Equal(t, tc.objectInfo, bytes.Contains([]byte(advertisement), []byte("object-info\n")), advertisement)
+
+			out, err := runGit(dir, "-c", "protocol.version=2", "clone", url, filepath.Join(t.TempDir(), "clone"))
+			assert.NoError(t, err, out)
+
+			if !tc.v2 {
+				return
+			}
+			blob, err := gitOutput("git", filepath.Join(dir, repo), "rev-parse", head+":file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := &bytes.Buffer{}
+			packLine(body, "command=object-info\n")
+			body.WriteString("0001")
+			packLine(body, "size\n")
+			packLine(body, "oid "+string(bytes.TrimSpace(blob))+"\n")
+			packFlush(body)
+
+			info := protocolV2Request(t, "POST", url+"/git-upload-pack", body)
+			if tc.objectInfo {
+				assert.Contains(t, info, string(bytes.TrimSpace(blob))+" 7")
+			} else {
+				assert.Contains(t, info, "ERR invalid command 'object-info'")
+			}
+		})
+	}
+}
+
+func TestAgent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Agent: "JGit/6.0", ProtocolV2: true}
+
+	ts := httptest.NewServer(New(config))
+	defer ts.Close()
+	url := HTTPCloneURL(ts.Listener.Addr().String(), repo)
+	for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+		resp, err := http.Get(url + "/info/refs?service=" + service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		advertisement, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Contains(t, string(advertisement), "agent=JGit/6.0", service)
+	}
+	assert.Contains(t, protocolV2Request(t, "GET", url+"/info/refs?service=git-upload-pack", nil), "agent=JGit/6.0\n")
+
+	server := NewSSH(config)
+	addr := startSSH(t, server)
+	out, err := runGit(dir, "-c", "protocol.version=0", "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("git-receive-pack '" + repo + "'"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := readPktLine(stdout)
+	assert.NoError(t, err)
+	assert.Contains(t, string(line), "agent=JGit/6.0")
+}
+
+func TestSSHProtocolV2(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   Config
+		protocol string
+		v2       bool
+	}{
+		{"v2", Config{}, "version=2", true},
+		{"v2 not asked for", Config{}, "", false},
+		{"ignored", Config{SSHIgnoreGitProtocol: true}, "version=2", false},
+		{"forced v2", Config{ForceProtocolVersion: "2"}, "", true},
+		{"forced v0", Config{ForceProtocolVersion: "0"}, "version=2", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Dir = dir
+			tc.config.KeyDir = filepath.Join(dir, "keys")
+			addr := startSSH(t, NewSSH(tc.config))
+
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			if tc.protocol != "" {
+				err := session.Setenv("GIT_PROTOCOL", tc.protocol)
+				assert.Equal(t, tc.config.SSHIgnoreGitProtocol, err != nil, err)
+			}
+			assert.Error(t, session.Setenv("LANG", "C"), "only GIT_PROTOCOL is accepted")
+			stdout, err := session.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := session.Start("git-upload-pack '" + repo + "'"); err != nil {
+				t.Fatal(err)
+			}
+			line, err := readPktLine(stdout)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.v2, string(line) == "version 2\n", string(line))
+		})
+	}
+
+	addr := startSSH(t, NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")}))
+	out, err := runGit(dir, "-c", "protocol.version=2", "clone", SSHCloneURL("git", addr, repo), filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+
+	err = (&Config{Dir: dir, ForceProtocolVersion: "3"}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `ForceProtocolVersion: unknown protocol version "3"`)
+	}
+}
+
+func TestEmptyRepoAdvertisement(t *testing.T) {
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "--bare", "--initial-branch=trunk", filepath.Join(dir, "empty.git")).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+
+	for _, advertisement := range []EmptyRepoAdvertisement{EmptyRepoUnborn, EmptyRepoCapabilities} {
+		config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), ProtocolV2: true, EmptyRepoAdvertisement: advertisement}
+		ts := httptest.NewServer(New(config))
+		sshAddr := startSSH(t, NewSSH(config))
+
+		want := "refs/heads/trunk"
+		if advertisement == EmptyRepoCapabilities {
+			want = "refs/heads/other"
+		}
+		for _, url := range []string{HTTPCloneURL(ts.Listener.Addr().String(), "empty.git"), SSHCloneURL("git", sshAddr, "empty.git")} {
+			clone := filepath.Join(t.TempDir(), "clone")
+			out, err := runGit(dir, "-c", "init.defaultBranch=other", "-c", "protocol.version=2", "clone", url, clone)
+			assert.NoError(t, err, out)
+			assert.Contains(t, out, "empty repository")
+			out, err = runGit(clone, "symbolic-ref", "HEAD")
+			assert.NoError(t, err, out)
+			assert.Equal(t, want, strings.TrimSpace(out), url)
+
+			out, err = runGit(dir, "-c", "protocol.version=0", "ls-remote", url)
+			assert.NoError(t, err, out)
+			assert.Empty(t, strings.TrimSpace(out))
+		}
+		ts.Close()
+	}
+}
+
+func TestUnbornDefaultBranch(t *testing.T) {
+	dir := t.TempDir()
+	service := New(Config{Dir: dir, AutoCreate: true, ProtocolV2: true, DefaultBranch: "trunk"})
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	url := HTTPCloneURL(ts.Listener.Addr().String(), "created.git")
+
+	for version, want := range map[string]string{"2": "refs/heads/trunk", "0": "refs/heads/other"} {
+		clone := filepath.Join(t.TempDir(), "clone")
+		out, err := runGit(dir, "-c", "init.defaultBranch=other", "-c", "protocol.version="+version, "clone", url, clone)
+		assert.NoError(t, err, out)
+		out, err = runGit(clone, "symbolic-ref", "HEAD")
+		assert.NoError(t, err, out)
+		assert.Equal(t, want, strings.TrimSpace(out), version)
+	}
+
+	out, err := runGit(filepath.Join(dir, "created.git"), "symbolic-ref", "HEAD")
+	assert.NoError(t, err, out)
+	assert.Equal(t, "refs/heads/trunk", strings.TrimSpace(out))
+}
@@ -0,0 +1,82 @@
+package gitkit
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// serveRaw streams the file at a ref of the repository, the route being
+// "<ref>/<path>". Refs may contain slashes, the longest existing ref wins.
+func (s *Server) serveRaw(w http.ResponseWriter, r *Request, route string) {
+	parts := strings.Split(route, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		rev := s.repoOps().resolve(r.RepoPath, strings.Join(parts[:i], "/")+"^{commit}")
+		if rev == "" {
+			continue
+		}
+
+		file := strings.Join(parts[i:], "/")
+		kind, err := gitOutput(s.config.GitPath, r.RepoPath, "cat-file", "-t", rev+":"+file)
+		if err != nil || strings.TrimSpace(string(kind)) != "blob" {
+			break
+		}
+		s.writeBlob(w, r, rev+":"+file, path.Base(file))
+		return
+	}
+
+	apiError(w, http.StatusNotFound, "Not Found")
+}
+
+// writeBlob streams a blob, detecting its content type from the file name
+// or, failing that, from its first bytes.
+func (s *Server) writeBlob(w http.ResponseWriter, r *Request, object string, name string) {
+	size, err := gitOutput(s.config.GitPath, r.RepoPath, "cat-file", "-s", object)
+	if err != nil {
+		s.apiFail(w, "raw", err)
+		return
+	}
+
+	cmd := exec.Command(s.config.GitPath, "cat-file", "blob", object)
+	cmd.Dir = r.RepoPath
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.apiFail(w, "raw", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.apiFail(w, "raw", err)
+		return
+	}
+	defer s.resources.process(cmd)()
+	defer cleanUpProcess(cmd)
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(stdout, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		s.apiFail(w, "raw", err)
+		return
+	}
+	head = head[:n]
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strings.TrimSpace(string(size)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	w.Write(head)
+	if _, err := io.Copy(w, stdout); err != nil {
+		s.config.logError("raw", err)
+	}
+}
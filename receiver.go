@@ -13,10 +13,23 @@ import (
 
 const ZeroSHA = "0000000000000000000000000000000000000000"
 
+// Kinds of ref updates
+const (
+	CreateUpdate      = "create"
+	FastForwardUpdate = "update"
+	ForceUpdate       = "force-update"
+	DeleteUpdate      = "delete"
+)
+
 type Receiver struct {
-	Debug       bool
-	MasterOnly  bool
-	TmpDir      string
+	Debug      bool
+	MasterOnly bool
+	// ChangedFiles, if true, fills HookInfo.Files before calling HandlerFunc
+	ChangedFiles bool
+	TmpDir       string
+	// Cleanup controls when checkouts in TmpDir are removed. Debug keeps
+	// them all.
+	Cleanup     CleanupPolicy
 	HandlerFunc func(*HookInfo, string) error
 }
 
@@ -29,32 +42,96 @@ func ReadCommitMessage(sha string) (string, error) {
 }
 
 func IsForcePush(hook *HookInfo) (bool, error) {
-	// New branch or tag OR deleted branch or tag
-	if hook.OldRev == ZeroSHA || hook.NewRev == ZeroSHA {
-		return false, nil
+	kind, err := ClassifyRefUpdate("", hook.RefUpdate())
+	if err != nil {
+		return false, err
 	}
 
-	out, err := exec.Command("git", "merge-base", hook.OldRev, hook.NewRev).CombinedOutput()
-	if err != nil {
-		return false, fmt.Errorf("git merge base failed: %s", out)
+	return kind == ForceUpdate, nil
+}
+
+// ClassifyRefUpdate returns the kind of a ref update. Updates of existing refs
+// are checked with git merge-base in the repository at dir to tell
+// fast-forwards from forced updates. An empty dir uses the current working
+// directory, which is the repository itself when running inside git hooks.
+func ClassifyRefUpdate(dir string, update RefUpdate) (string, error) {
+	switch {
+	case IsZeroSHA(update.OldRev) && IsZeroSHA(update.NewRev):
+		return "", fmt.Errorf("invalid ref update: both revisions are zero")
+	case IsZeroSHA(update.OldRev):
+		return CreateUpdate, nil
+	case IsZeroSHA(update.NewRev):
+		return DeleteUpdate, nil
+	case update.OldRev == update.NewRev:
+		return FastForwardUpdate, nil
 	}
 
-	base := strings.TrimSpace(string(out))
+	ok, err := isAncestor(dir, update.OldRev, update.NewRev)
+	if err != nil {
+		return "", err
+	}
 
 	// Non fast-forwarded, meaning force
-	return base != hook.OldRev, nil
+	if !ok {
+		return ForceUpdate, nil
+	}
+	return FastForwardUpdate, nil
+}
+
+func isAncestor(dir string, ancestor string, rev string) (bool, error) {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, rev)
+	cmd.Dir = dir
+
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+
+	// Exit code 1 means ancestor is not reachable from rev, including for
+	// unrelated histories.
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && len(out) == 0 {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("git merge base failed: %s", out)
 }
 
 func (r *Receiver) Handle(reader io.Reader) error {
-	hook, err := ReadHookInput(reader)
+	hooks, err := ReadHookInputs(reader)
 	if err != nil {
 		return err
 	}
 
+	for _, hook := range hooks {
+		if err := r.handleHook(hook); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Receiver) handleHook(hook *HookInfo) (err error) {
 	if r.MasterOnly && hook.Ref != "refs/heads/master" {
 		return fmt.Errorf("cant push to non-master branch")
 	}
 
+	if r.ChangedFiles {
+		files, err := ChangedFiles(hook.RepoPath, hook.RefUpdate())
+		if err != nil {
+			return err
+		}
+		hook.Files = files
+	}
+
+	// There's nothing to check out for deleted refs
+	if IsZeroSHA(hook.NewRev) {
+		if r.HandlerFunc != nil {
+			return r.HandlerFunc(hook, "")
+		}
+		return nil
+	}
+
 	id, err := uuid.NewV4()
 	if err != nil {
 		return fmt.Errorf("error generating new uuid: %v", err)
@@ -66,9 +143,12 @@ func (r *Receiver) Handle(reader io.Reader) error {
 	}
 
 	// Cleanup temp directory unless we're in debug mode
-	if !r.Debug {
-		defer os.RemoveAll(tmpDir)
-	}
+	defer func() {
+		keep := r.Debug || r.Cleanup == CleanupNever || (r.Cleanup == CleanupOnSuccess && err != nil)
+		if !keep {
+			os.RemoveAll(tmpDir)
+		}
+	}()
 
 	archiveCmd := fmt.Sprintf("git archive '%s' | tar -x -C '%s'", hook.NewRev, tmpDir)
 	buff, err := exec.Command("bash", "-c", archiveCmd).CombinedOutput()
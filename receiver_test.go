@@ -0,0 +1,77 @@
+package gitkit
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyRefUpdate(t *testing.T) {
+	repo, err := createRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+
+	git := func(args ...string) string {
+		args = append([]string{"-c", "user.email=test@gitkit.com", "-c", "user.name=test-user"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	base := git("rev-parse", "HEAD")
+	git("commit", "--allow-empty", "-m", "second")
+	next := git("rev-parse", "HEAD")
+	git("checkout", "--orphan", "unrelated")
+	git("commit", "--allow-empty", "-m", "unrelated")
+	unrelated := git("rev-parse", "HEAD")
+
+	examples := map[string]RefUpdate{
+		CreateUpdate:      {OldRev: ZeroSHA, NewRev: base},
+		DeleteUpdate:      {OldRev: base, NewRev: ZeroSHA},
+		FastForwardUpdate: {OldRev: base, NewRev: next},
+		ForceUpdate:       {OldRev: next, NewRev: base},
+	}
+
+	for expected, update := range examples {
+		kind, err := ClassifyRefUpdate(repo, update)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, kind)
+	}
+
+	kind, err := ClassifyRefUpdate(repo, RefUpdate{OldRev: base, NewRev: unrelated})
+	assert.NoError(t, err)
+	assert.Equal(t, ForceUpdate, kind)
+
+	_, err = ClassifyRefUpdate(repo, RefUpdate{OldRev: ZeroSHA, NewRev: ZeroSHA})
+	assert.Error(t, err)
+
+	hook := &HookInfo{RepoPath: repo, OldRev: next, NewRev: base}
+	kind, err = hook.Kind()
+	assert.NoError(t, err)
+	assert.Equal(t, ForceUpdate, kind)
+}
+
+func TestReceiverHandleDelete(t *testing.T) {
+	handled := []string{}
+	receiver := Receiver{
+		HandlerFunc: func(hook *HookInfo, tmpPath string) error {
+			handled = append(handled, hook.Action)
+			assert.Empty(t, tmpPath)
+			return nil
+		},
+	}
+
+	input := "e285100b636ac67fa28d85685072158edaa01685 0000000000000000000000000000000000000000 refs/heads/a\n" +
+		"e285100b636ac67fa28d85685072158edaa01685 0000000000000000000000000000000000000000 refs/tags/b\n"
+	assert.NoError(t, receiver.Handle(strings.NewReader(input)))
+	assert.Equal(t, []string{BranchDeleteAction, TagDeleteAction}, handled)
+}
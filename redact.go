@@ -0,0 +1,141 @@
+package gitkit
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+var redactRules = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization header values
+	{regexp.MustCompile(`(?i)\b((?:proxy-)?authorization:\s*(?:basic|bearer|token)\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+	// Digest authorization responses
+	{regexp.MustCompile(`\b(response|cnonce)=("[^"]*"|[^,\s]+)`), `${1}="` + redacted + `"`},
+	// Passwords embedded in URLs
+	{regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*):[^/\s@]+@`), "${1}:" + redacted + "@"},
+	// Secrets in query strings and environment variables
+	{regexp.MustCompile(`(?i)\b([a-z0-9_]*(?:token|password|passwd|secret)[a-z0-9_]*=)[^&\s'"]+`), "${1}" + redacted},
+}
+
+// credentialRule matches authorization schemes followed by a value outside
+// of headers, e.g. in curl traces, which is only masked if it looks like a
+// credential, leaving prose such as "Basic authentication" alone.
+var credentialRule = regexp.MustCompile(`\b(Basic|Bearer|Token|token)(\s+)([A-Za-z0-9._~+/=-]{8,})`)
+
+// tokenLike tells whether a value looks like a token or base64 credential
+// rather than a word: it has digits or symbols, or a lowercase letter
+// followed by an uppercase one.
+func tokenLike(value string) bool {
+	if strings.ContainsAny(value, "0123456789+/=_") {
+		return true
+	}
+	for i := 1; i < len(value); i++ {
+		if value[i-1] >= 'a' && value[i-1] <= 'z' && value[i] >= 'A' && value[i] <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact masks credentials in s: Authorization header values, Digest
+// responses, passwords in URLs and token-like query parameters or
+// environment variables.
+func Redact(s string) string {
+	out, _ := redact(s)
+	return out
+}
+
+// redact masks credentials in s along with the given literal secrets, and
+// reports whether anything had to be masked.
+func redact(s string, secrets ...string) (string, bool) {
+	out := s
+
+	for _, secret := range secrets {
+		if secret != "" {
+			out = strings.Replace(out, secret, redacted, -1)
+		}
+	}
+
+	for _, rule := range redactRules {
+		out = rule.re.ReplaceAllString(out, rule.repl)
+	}
+	out = credentialRule.ReplaceAllStringFunc(out, func(match string) string {
+		parts := credentialRule.FindStringSubmatch(match)
+		if !tokenLike(parts[3]) {
+			return match
+		}
+		return parts[1] + parts[2] + redacted
+	})
+
+	return out, out != s
+}
+
+// redact masks credentials before they are logged or recorded. Config's
+// OnSecretLeak is called whenever a secret would have been emitted.
+func (c *Config) redact(s string, secrets ...string) string {
+	out, leaked := redact(s, secrets...)
+	if leaked && c.OnSecretLeak != nil {
+		c.OnSecretLeak(out)
+	}
+	return out
+}
+
+// SecretLeaks collects the lines passed to Config.OnSecretLeak, failing
+// tests that leaked credentials once done:
+//
+//	leaks := &gitkit.SecretLeaks{}
+//	config.OnSecretLeak = leaks.Record
+//	defer func() { assert.NoError(t, leaks.Err()) }()
+type SecretLeaks struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// Record stores a redacted line, it can be used as the OnSecretLeak callback
+func (l *SecretLeaks) Record(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+}
+
+// Err returns an error listing the recorded lines, or nil if none leaked
+func (l *SecretLeaks) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.lines) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d secret leaks: %s", len(l.lines), strings.Join(l.lines, "; "))
+}
+
+// logger returns Config.Logger, or the standard logger
+func (c *Config) logger() *log.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return log.Default()
+}
+
+func (c *Config) logf(format string, args ...interface{}) {
+	c.logger().Print(c.redact(fmt.Sprintf(format, args...)))
+}
+
+func (c *Config) logln(args ...interface{}) {
+	c.logger().Print(c.redact(fmt.Sprintln(args...)))
+}
+
+func (c *Config) logError(context string, err error, secrets ...string) {
+	c.logger().Print(c.redact(fmt.Sprintf("%s: %v\n", context, err), secrets...))
+}
+
+func (c *Config) logInfo(context string, message string) {
+	c.logger().Print(c.redact(fmt.Sprintf("%s: %s\n", context, message)))
+}
@@ -0,0 +1,154 @@
+package gitkit
+
+import (
+	"sort"
+	"strings"
+)
+
+// RefChange is a ref updated by a push, along with the files it changed
+// when Config.ChangedFiles is enabled.
+type RefChange struct {
+	RefUpdate
+	Kind  string   `json:"kind,omitempty"` // How the ref was updated, e.g. ForceUpdate
+	Files []string `json:"files,omitempty"`
+}
+
+// ChangedFiles returns the paths changed by a ref update in the repository at
+// dir. Created refs list every file of the new tree, deleted refs return no
+// files.
+func ChangedFiles(dir string, update RefUpdate) ([]string, error) {
+	return changedFiles("git", dir, update)
+}
+
+func changedFiles(gitPath string, dir string, update RefUpdate) ([]string, error) {
+	var args []string
+
+	switch {
+	case IsZeroSHA(update.NewRev):
+		return nil, nil
+	case IsZeroSHA(update.OldRev):
+		args = []string{"ls-tree", "-r", "-z", "--name-only", update.NewRev}
+	default:
+		args = []string{"diff", "--no-renames", "-z", "--name-only", update.OldRev, update.NewRev}
+	}
+
+	out, err := gitOutput(gitPath, dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// listRefs returns all refs of the repository at dir mapped to their revision
+func listRefs(gitPath string, dir string) (map[string]string, error) {
+	out, err := gitOutput(gitPath, dir, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		chunks := strings.SplitN(line, " ", 2)
+		if len(chunks) == 2 {
+			refs[chunks[1]] = chunks[0]
+		}
+	}
+	return refs, nil
+}
+
+// diffRefs returns the ref updates that turn the before snapshot into the
+// after one, sorted by ref name.
+func diffRefs(before map[string]string, after map[string]string) []RefUpdate {
+	updates := []RefUpdate{}
+
+	for ref, newRev := range after {
+		oldRev, ok := before[ref]
+		if !ok {
+			oldRev = zeroSHAFor(newRev)
+		}
+		if oldRev != newRev {
+			updates = append(updates, newRefUpdate(oldRev, newRev, ref))
+		}
+	}
+
+	for ref, oldRev := range before {
+		if _, ok := after[ref]; !ok {
+			updates = append(updates, newRefUpdate(oldRev, zeroSHAFor(oldRev), ref))
+		}
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Ref < updates[j].Ref
+	})
+	return updates
+}
+
+func newRefUpdate(oldRev string, newRev string, ref string) RefUpdate {
+	update := RefUpdate{OldRev: oldRev, NewRev: newRev, Ref: ref}
+	update.RefType, update.RefName = splitRef(ref)
+	return update
+}
+
+// zeroSHAFor returns the zero object name matching the hash length of rev
+func zeroSHAFor(rev string) string {
+	return strings.Repeat("0", len(rev))
+}
+
+// pushedRefs compares the refs of a repository against a snapshot taken
+// before a push, computing changed files if enabled in the config.
+func pushedRefs(config *Config, repoPath string, before map[string]string) []RefChange {
+	if before == nil {
+		return nil
+	}
+
+	after, err := listRefs(config.GitPath, repoPath)
+	if err != nil {
+		config.logError("push-refs", err)
+		return nil
+	}
+
+	changes := []RefChange{}
+	for _, update := range diffRefs(before, after) {
+		changes = append(changes, refChange(config, repoPath, update))
+	}
+	return changes
+}
+
+// refChange classifies a ref update of the repository at dir, computing the
+// files it changed if enabled in the config.
+func refChange(config *Config, dir string, update RefUpdate) RefChange {
+	change := RefChange{RefUpdate: update}
+
+	var err error
+	if change.Kind, err = ClassifyRefUpdate(dir, update); err != nil {
+		config.logError("push-refs", err)
+	}
+	if config.ChangedFiles {
+		if change.Files, err = changedFiles(config.GitPath, dir, update); err != nil {
+			config.logError("push-refs", err)
+		}
+	}
+	return change
+}
+
+// snapshotRefs lists the refs of a repository before a push. A nil result
+// disables ref tracking for the push.
+func snapshotRefs(config *Config, repoPath string) map[string]string {
+	refs, err := listRefs(config.GitPath, repoPath)
+	if err != nil {
+		config.logError("push-refs", err)
+		return nil
+	}
+	return refs
+}
+
+func gitOutput(gitPath string, dir string, args ...string) ([]byte, error) {
+	return gitExec(gitPath, dir, nil, "", args...)
+}
@@ -0,0 +1,309 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const defaultRejectionReason = "pre-receive hook declined"
+
+// Largest payload of a side-band pkt-line, after the band byte
+const maxBandPayload = maxPktPayload - 1
+
+// PushRejection describes how RejectPushes rejects pushes, the way a
+// pre-receive hook enforcing a policy does.
+type PushRejection struct {
+	// Message is shown by clients line by line, each prefixed with
+	// "remote: ". It can span multiple lines and contain any unicode text.
+	Message string `json:"message,omitempty"`
+	// Reason is reported for every ref in report-status, and shown by clients
+	// next to the rejected refs. Defaults to "pre-receive hook declined".
+	Reason string `json:"reason,omitempty"`
+}
+
+func (r PushRejection) reason() string {
+	if r.Reason == "" {
+		return defaultRejectionReason
+	}
+	return strings.Replace(r.Reason, "\n", " ", -1)
+}
+
+// rejectionSet holds the push rejections per repository. The empty repository
+// name applies to all repositories.
+type rejectionSet struct {
+	mu         sync.RWMutex
+	rejections map[string]PushRejection
+}
+
+func (r *rejectionSet) set(repo string, rejection *PushRejection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rejections == nil {
+		r.rejections = map[string]PushRejection{}
+	}
+
+	if rejection == nil {
+		delete(r.rejections, lockKey(repo))
+	} else {
+		r.rejections[lockKey(repo)] = *rejection
+	}
+}
+
+func (r *rejectionSet) get(repo string) *PushRejection {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if rejection, ok := r.rejections[lockKey(repo)]; ok {
+		return &rejection
+	}
+	if rejection, ok := r.rejections[""]; ok {
+		return &rejection
+	}
+	return nil
+}
+
+// all returns a copy of the rejections by repository
+func (r *rejectionSet) all() map[string]PushRejection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rejections := map[string]PushRejection{}
+	for repo, rejection := range r.rejections {
+		rejections[repo] = rejection
+	}
+	return rejections
+}
+
+// RejectPushes rejects all pushes to the repository as a pre-receive hook
+// would, until ClearPushRejection is called. An empty repository name applies
+// to every repository.
+func (c *controls) RejectPushes(repo string, rejection PushRejection) {
+	c.rejections.set(repo, &rejection)
+}
+
+// ClearPushRejection removes a rejection set with RejectPushes
+func (c *controls) ClearPushRejection(repo string) {
+	c.rejections.set(repo, nil)
+}
+
+// RemoteMessage returns the messages a server sent to a git client, given the
+// client output: the "remote: " lines without their prefix, and without the
+// padding git appends to clear the rest of the line.
+func RemoteMessage(output string) string {
+	message := ""
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "remote: ") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "remote: ")
+		if strings.HasSuffix(line, "\x1b[K") {
+			line = strings.TrimSuffix(line, "\x1b[K")
+		} else {
+			line = strings.TrimSuffix(line, "        ")
+		}
+		message += line + "\n"
+	}
+	return message
+}
+
+// pushReport is the answer to a push rejected without running receive-pack
+type pushReport struct {
+	unpack  string // Unpack status, "ok" or the unpacker error
+	reason  string // Reported for every ref
+	message string // Sent on the progress side-band
+	event   string // Error of the push event
+}
+
+// pushReport returns how a push to the repository is rejected, if it is
+func (o repoOps) pushReport(repo string) *pushReport {
+	if err := o.storageErrors.get(repo); err != nil {
+		return &pushReport{
+			unpack:  "index-pack abnormal exit",
+			reason:  "unpacker error",
+			message: storageErrorMessage(err) + "\nfatal: failed to write object\n",
+			event:   storageErrorMessage(err),
+		}
+	}
+
+	if rejection := o.rejections.get(repo); rejection != nil {
+		message := rejection.Message
+		if message != "" && !strings.HasSuffix(message, "\n") {
+			message += "\n"
+		}
+		return &pushReport{unpack: "ok", reason: rejection.reason(), message: message, event: rejection.reason()}
+	}
+	return nil
+}
+
+// rejectPush reads the commands and pack of a push from r and answers on w
+// with the report instead of updating refs. Objects are discarded.
+func rejectPush(r io.Reader, w io.Writer, report pushReport) error {
+	br := bufio.NewReader(r)
+
+	refs, caps, needsPack, err := readPushCommands(br)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	if needsPack {
+		if err := discardPack(br); err != nil {
+			return err
+		}
+	}
+
+	var status bytes.Buffer
+	packLine(&status, "unpack "+report.unpack+"\n")
+	for _, ref := range refs {
+		packLine(&status, "ng "+ref+" "+report.reason+"\n")
+	}
+	packFlush(&status)
+
+	if !strings.Contains(caps, "side-band") {
+		_, err := w.Write(status.Bytes())
+		return err
+	}
+
+	if err := writeBand(w, 2, []byte(report.message)); err != nil {
+		return err
+	}
+	if err := writeBand(w, 1, status.Bytes()); err != nil {
+		return err
+	}
+	return packFlush(w)
+}
+
+// writeBand sends data on a side-band, split in as many pkt-lines as needed
+func writeBand(w io.Writer, band byte, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxBandPayload {
+			n = maxBandPayload
+		}
+		if err := packLine(w, string([]byte{band})+string(data[:n])); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// readPushCommands reads the ref update commands sent by a pushing client,
+// returning the updated refs, the capabilities and whether a pack follows.
+func readPushCommands(r *bufio.Reader) ([]string, string, bool, error) {
+	refs := []string{}
+	caps := ""
+	needsPack := false
+
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if line == nil {
+			return refs, caps, needsPack, nil
+		}
+
+		command := string(line)
+		if i := strings.IndexByte(command, 0); i >= 0 {
+			caps = command[i+1:]
+			command = command[:i]
+		}
+
+		fields := strings.Fields(command)
+		if len(fields) != 3 {
+			continue
+		}
+		refs = append(refs, fields[2])
+		if !IsZeroSHA(fields[1]) {
+			needsPack = true
+		}
+	}
+}
+
+// readPktLine returns the payload of a pkt-line, or nil for a flush packet
+func readPktLine(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var length int
+	if _, err := fmt.Sscanf(string(header), "%04x", &length); err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	if length < 4 {
+		return nil, nil
+	}
+
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// discardPack reads a packfile without storing it. Objects are zlib streams,
+// read through r one byte at a time so nothing past the pack is consumed.
+func discardPack(r *bufio.Reader) error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "PACK" {
+		return fmt.Errorf("invalid pack header")
+	}
+
+	count := binary.BigEndian.Uint32(header[8:])
+	for i := uint32(0); i < count; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		kind := (c >> 4) & 7
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+
+		switch kind {
+		case 6: // OFS_DELTA, followed by the offset of its base
+			for {
+				if c, err = r.ReadByte(); err != nil {
+					return err
+				}
+				if c&0x80 == 0 {
+					break
+				}
+			}
+		case 7: // REF_DELTA, followed by the name of its base
+			if _, err := io.CopyN(ioutil.Discard, r, 20); err != nil {
+				return err
+			}
+		}
+
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			return err
+		}
+		zr.Close()
+	}
+
+	// Trailing checksum
+	_, err := io.CopyN(ioutil.Discard, r, 20)
+	return err
+}
@@ -0,0 +1,90 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const policyMessage = "error: GH006: Protected branch update failed for refs/heads/master.\n" +
+	"error: ✋ Changes must be made through a pull request.\n" +
+	"\n" +
+	"Politique de dépôt : 変更はプルリクエストで行ってください 🚫\n"
+
+func TestHTTPRejectPushes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rejections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	clone := filepath.Join(dir, "clone")
+	out, err := runGit(dir, "clone", server.URL+"/"+repo, clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+
+	before, err := listRefs("git", filepath.Join(dir, repo))
+	assert.NoError(t, err)
+
+	service.RejectPushes(repo, PushRejection{Message: policyMessage, Reason: "protected branch hook declined"})
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.Error(t, err)
+	assert.Equal(t, policyMessage, RemoteMessage(out))
+	assert.Contains(t, out, "! [remote rejected] HEAD -> master (protected branch hook declined)")
+
+	after, err := listRefs("git", filepath.Join(dir, repo))
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	service.ClearPushRejection(repo)
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.NoError(t, err, out)
+}
+
+func TestSSHRejectPushes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rejections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+
+	clone := filepath.Join(dir, "clone")
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+
+	server.RejectPushes("", PushRejection{Message: policyMessage})
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.Error(t, err)
+	assert.Equal(t, policyMessage, RemoteMessage(out))
+	assert.Contains(t, out, "! [remote rejected] HEAD -> master (pre-receive hook declined)")
+}
+
+func TestRemoteMessage(t *testing.T) {
+	output := "Enumerating objects: 3, done.\n" +
+		"remote: first line        \n" +
+		"remote: \n" +
+		"remote: colored\x1b[K\n" +
+		"To http://localhost/repo.git\n"
+	assert.Equal(t, "first line\n\ncolored\n", RemoteMessage(output))
+}
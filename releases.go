@@ -0,0 +1,253 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Release is a provider-style release attached to a tag of a hosted
+// repository, served by the REST API.
+type Release struct {
+	Tag        string
+	Name       string
+	Body       string
+	Draft      bool
+	Prerelease bool
+	Assets     []ReleaseAsset
+}
+
+// ReleaseAsset is a file attached to a release
+type ReleaseAsset struct {
+	Name        string
+	ContentType string // Defaults to "application/octet-stream"
+	Data        []byte
+}
+
+// APIRelease is a release in the REST API, with the fields of GitHub
+// release objects.
+type APIRelease struct {
+	ID              int64      `json:"id"`
+	TagName         string     `json:"tag_name"`
+	TargetCommitish string     `json:"target_commitish"`
+	Name            string     `json:"name"`
+	Body            string     `json:"body"`
+	Draft           bool       `json:"draft"`
+	Prerelease      bool       `json:"prerelease"`
+	CreatedAt       time.Time  `json:"created_at"`
+	Assets          []APIAsset `json:"assets"`
+}
+
+// APIAsset is a release asset in the REST API
+type APIAsset struct {
+	ID                 int64  `json:"id"`
+	Name               string `json:"name"`
+	ContentType        string `json:"content_type"`
+	Size               int    `json:"size"`
+	URL                string `json:"url"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+type storedRelease struct {
+	Release
+	id       int64
+	assetIDs []int64
+	target   string
+	created  time.Time
+}
+
+// releaseSet holds the releases of hosted repositories, newest last
+type releaseSet struct {
+	mu       sync.RWMutex
+	lastID   int64
+	releases map[string][]*storedRelease
+}
+
+func (r *releaseSet) add(repo string, release Release, target string, created time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.releases == nil {
+		r.releases = map[string][]*storedRelease{}
+	}
+
+	key := lockKey(repo)
+	r.removeLocked(key, release.Tag)
+
+	r.lastID++
+	stored := &storedRelease{Release: release, id: r.lastID, target: target, created: created}
+	for range release.Assets {
+		r.lastID++
+		stored.assetIDs = append(stored.assetIDs, r.lastID)
+	}
+	r.releases[key] = append(r.releases[key], stored)
+}
+
+func (r *releaseSet) remove(repo string, tag string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.removeLocked(lockKey(repo), tag)
+}
+
+func (r *releaseSet) removeLocked(key string, tag string) bool {
+	for i, release := range r.releases[key] {
+		if release.Tag == tag {
+			r.releases[key] = append(r.releases[key][:i], r.releases[key][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the releases of a repository, newest first
+func (r *releaseSet) list(repo string) []*storedRelease {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored := r.releases[lockKey(repo)]
+	releases := make([]*storedRelease, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		releases = append(releases, stored[i])
+	}
+	return releases
+}
+
+// AddRelease attaches a release, with its assets, to an existing tag of a
+// hosted repository. It replaces any release of the same tag.
+func (s *Server) AddRelease(repo string, release Release) error {
+	dir, err := s.repoOps().repoPath(repo)
+	if err != nil {
+		return err
+	}
+
+	target := s.repoOps().resolve(dir, "refs/tags/"+release.Tag+"^{commit}")
+	if target == "" {
+		return fmt.Errorf("%s: tag %q does not exist", repo, release.Tag)
+	}
+
+	s.releases.add(repo, release, target, s.clock.now())
+	return nil
+}
+
+// RemoveRelease removes the release of a tag added with AddRelease
+func (s *Server) RemoveRelease(repo string, tag string) error {
+	if !s.releases.remove(repo, tag) {
+		return fmt.Errorf("%s: no release for tag %q", repo, tag)
+	}
+	return nil
+}
+
+// serveReleases serves the releases endpoints of a repository:
+//
+//	releases
+//	releases/latest
+//	releases/tags/<tag>
+//	releases/assets/<id>
+//	releases/download/<tag>/<name>
+func (s *Server) serveReleases(w http.ResponseWriter, r *Request, route string) {
+	releases := s.releases.list(r.RepoName)
+	parts := strings.SplitN(route, "/", 3)
+
+	switch {
+	case len(parts) == 1:
+		list := []APIRelease{}
+		for _, release := range releases {
+			list = append(list, apiRelease(r, release))
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+
+	case len(parts) == 2 && parts[1] == "latest":
+		for _, release := range releases {
+			if !release.Draft && !release.Prerelease {
+				writeJSON(w, http.StatusOK, apiRelease(r, release))
+				return
+			}
+		}
+
+	case len(parts) == 3 && parts[1] == "tags":
+		for _, release := range releases {
+			if release.Tag == parts[2] {
+				writeJSON(w, http.StatusOK, apiRelease(r, release))
+				return
+			}
+		}
+
+	case len(parts) == 3 && parts[1] == "assets":
+		id, _ := strconv.ParseInt(parts[2], 10, 64)
+		for _, release := range releases {
+			for i, assetID := range release.assetIDs {
+				if assetID != id {
+					continue
+				}
+				if r.Header.Get("Accept") == "application/octet-stream" {
+					writeAsset(w, release.Assets[i])
+				} else {
+					writeJSON(w, http.StatusOK, apiAsset(r, release, i))
+				}
+				return
+			}
+		}
+
+	case len(parts) == 3 && parts[1] == "download":
+		for _, release := range releases {
+			for _, asset := range release.Assets {
+				if release.Tag+"/"+asset.Name == parts[2] {
+					writeAsset(w, asset)
+					return
+				}
+			}
+		}
+	}
+
+	apiError(w, http.StatusNotFound, "Not Found")
+}
+
+func apiRelease(r *Request, release *storedRelease) APIRelease {
+	api := APIRelease{
+		ID:              release.id,
+		TagName:         release.Tag,
+		TargetCommitish: release.target,
+		Name:            release.Name,
+		Body:            release.Body,
+		Draft:           release.Draft,
+		Prerelease:      release.Prerelease,
+		CreatedAt:       release.created.UTC().Truncate(time.Second),
+		Assets:          []APIAsset{},
+	}
+	for i := range release.Assets {
+		api.Assets = append(api.Assets, apiAsset(r, release, i))
+	}
+	return api
+}
+
+func apiAsset(r *Request, release *storedRelease, i int) APIAsset {
+	asset := release.Assets[i]
+	base := apiRepoURL(r)
+	return APIAsset{
+		ID:                 release.assetIDs[i],
+		Name:               asset.Name,
+		ContentType:        assetContentType(asset),
+		Size:               len(asset.Data),
+		URL:                fmt.Sprintf("%s/releases/assets/%d", base, release.assetIDs[i]),
+		BrowserDownloadURL: fmt.Sprintf("%s/releases/download/%s/%s", base, release.Tag, asset.Name),
+	}
+}
+
+func assetContentType(asset ReleaseAsset) string {
+	if asset.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return asset.ContentType
+}
+
+func writeAsset(w http.ResponseWriter, asset ReleaseAsset) {
+	w.Header().Set("Content-Type", assetContentType(asset))
+	w.Header().Set("Content-Length", strconv.Itoa(len(asset.Data)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", asset.Name))
+	w.WriteHeader(http.StatusOK)
+	w.Write(asset.Data)
+}
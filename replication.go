@@ -0,0 +1,281 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication serves repositories from a primary and a lagging read replica,
+// like git hosting with asynchronous replication. Pushes land on the primary,
+// fetches and clones are served by the replica, which applies the refs of
+// each push once the lag has passed. Clients fetching right after pushing get
+// the refs from before the push, to test read-after-write handling.
+type Replication struct {
+	// Primary serves pushes and the REST API
+	Primary *Server
+	// Replica serves fetches and clones
+	Replica *Server
+	// OnEvent, if set, is called for every event emitted by the servers
+	OnEvent func(Event)
+
+	primary RepoStore
+	replica *FSStore
+	dir     string // Directory of the replica repositories
+	gitPath string
+
+	mu      sync.Mutex
+	lag     time.Duration
+	seq     int64
+	applied map[string]int64 // Sequence of the last applied update by lockKey
+	timers  map[*time.Timer]bool
+
+	capture sync.Mutex // Orders snapshots of the primary
+	apply   sync.Mutex // Serializes updates of the replica
+}
+
+// NewReplication creates a primary serving the repositories of the config, and
+// a replica holding a copy of them, updated lag after every push. The primary
+// and replica can also be served separately, e.g. to put the replica behind a
+// Cluster.
+func NewReplication(config Config, lag time.Duration) (*Replication, error) {
+	dir, err := os.MkdirTemp("", "gitkit-replica")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replication{
+		primary: config.repoStore(),
+		dir:     dir,
+		gitPath: config.GitPath,
+		lag:     lag,
+		applied: map[string]int64{},
+		timers:  map[*time.Timer]bool{},
+	}
+	if r.gitPath == "" {
+		r.gitPath = "git"
+	}
+	r.replica = &FSStore{Dir: dir, GitPath: r.gitPath}
+
+	r.Primary = New(config)
+	r.Primary.OnEvent = r.emit
+	if err := r.Primary.Setup(); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	replica := config
+	replica.Store = r.replica
+	replica.AutoCreate = false
+	r.Replica = New(replica)
+	r.Replica.OnEvent = r.emit
+
+	repos, err := r.primary.List()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	for _, repo := range repos {
+		if err := r.Sync(repo); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// ServeHTTP serves pushes and API requests with the primary, and other
+// requests with the replica.
+func (r *Replication) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/git-receive-pack") ||
+		req.URL.Query().Get("service") == "git-receive-pack" ||
+		strings.HasPrefix(req.URL.Path, apiPrefix+"/") {
+		r.Primary.ServeHTTP(w, req)
+		return
+	}
+	r.Replica.ServeHTTP(w, req)
+}
+
+// SetLag sets the delay before pushes are applied to the replica. Pushes
+// already waiting keep their delay.
+func (r *Replication) SetLag(lag time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lag = lag
+}
+
+// Sync copies the current refs of a primary repository to the replica right
+// away, like a replication catching up.
+func (r *Replication) Sync(repo string) error {
+	name := r.primary.Resolve(repo)
+	seq, refs, err := r.snapshot(name)
+	if err != nil {
+		return err
+	}
+	return r.update(name, seq, refs)
+}
+
+// Close stops pending replication and removes the replica repositories.
+func (r *Replication) Close() error {
+	r.mu.Lock()
+	for timer := range r.timers {
+		timer.Stop()
+	}
+	r.timers = nil
+	r.mu.Unlock()
+
+	r.apply.Lock()
+	defer r.apply.Unlock()
+	return os.RemoveAll(r.dir)
+}
+
+// emit schedules the replication of successful pushes to the primary, and
+// forwards the events to OnEvent.
+func (r *Replication) emit(event Event) {
+	if event.Type == PushEvent && event.Error == "" {
+		r.schedule(event.Repo)
+	}
+	if r.OnEvent != nil {
+		r.OnEvent(event)
+	}
+}
+
+// schedule records the refs of a primary repository and applies them to the
+// replica after the lag.
+func (r *Replication) schedule(name string) {
+	seq, refs, err := r.snapshot(name)
+	if err != nil {
+		r.Primary.config.logError("replication", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timers == nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(r.lag, func() {
+		r.mu.Lock()
+		closed := r.timers == nil
+		delete(r.timers, timer)
+		r.mu.Unlock()
+
+		if closed {
+			return
+		}
+		if err := r.update(name, seq, refs); err != nil {
+			r.Primary.config.logError("replication", err)
+		}
+	})
+	r.timers[timer] = true
+}
+
+// snapshot returns the refs of a primary repository, nil if it does not
+// exist, along with a sequence number ordering snapshots.
+func (r *Replication) snapshot(name string) (int64, map[string]string, error) {
+	r.capture.Lock()
+	defer r.capture.Unlock()
+
+	r.mu.Lock()
+	r.seq++
+	seq := r.seq
+	r.mu.Unlock()
+
+	dir, err := r.primary.Open(name)
+	if err == ErrRepoNotFound {
+		return seq, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	out, err := exec.Command(r.gitPath, "-C", dir, "for-each-ref", "--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list refs of %s: %v", name, err)
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return seq, refs, nil
+}
+
+// update sets the refs of a replica repository to a snapshot of the primary,
+// fetching the missing objects. Updates older than the last applied one are
+// dropped, so that replicas never go back in time.
+func (r *Replication) update(name string, seq int64, refs map[string]string) error {
+	r.apply.Lock()
+	defer r.apply.Unlock()
+
+	r.mu.Lock()
+	if r.applied[lockKey(name)] > seq {
+		r.mu.Unlock()
+		return nil
+	}
+	r.applied[lockKey(name)] = seq
+	r.mu.Unlock()
+
+	if refs == nil {
+		if err := r.replica.Delete(name); err != nil && err != ErrRepoNotFound {
+			return err
+		}
+		return nil
+	}
+
+	dir, err := r.replica.Open(name)
+	if err == ErrRepoNotFound {
+		dir, err = r.replica.Create(name)
+	}
+	if err != nil {
+		return err
+	}
+	primary, err := r.primary.Open(name)
+	if err != nil {
+		return err
+	}
+
+	revs := []string{}
+	for _, rev := range refs {
+		revs = append(revs, rev)
+	}
+	if len(revs) > 0 {
+		args := append([]string{"-C", dir, "fetch", "--quiet", "--no-tags",
+			"--upload-pack=" + r.gitPath + " -c uploadpack.allowAnySHA1InWant=true upload-pack", primary}, revs...)
+		if out, err := exec.Command(r.gitPath, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to replicate %s: %s", name, out)
+		}
+	}
+
+	current, err := exec.Command(r.gitPath, "-C", dir, "for-each-ref", "--format=%(refname)").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list refs of %s: %v", name, err)
+	}
+	updates := &strings.Builder{}
+	for _, ref := range strings.Fields(string(current)) {
+		if _, ok := refs[ref]; !ok {
+			fmt.Fprintf(updates, "delete %s\n", ref)
+		}
+	}
+	for ref, rev := range refs {
+		fmt.Fprintf(updates, "update %s %s\n", ref, rev)
+	}
+
+	cmd := exec.Command(r.gitPath, "-C", dir, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(updates.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to update refs of %s: %s", name, out)
+	}
+
+	if head, err := exec.Command(r.gitPath, "-C", primary, "symbolic-ref", "HEAD").Output(); err == nil {
+		exec.Command(r.gitPath, "-C", dir, "symbolic-ref", "HEAD", strings.TrimSpace(string(head))).Run()
+	}
+	return nil
+}
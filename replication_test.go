@@ -0,0 +1,75 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplication(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replication, err := NewReplication(Config{Dir: dir, AutoCreate: true}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replication.Close()
+
+	ts := httptest.NewServer(replication)
+	defer ts.Close()
+	url := ts.URL + "/" + repo
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err := runGit(dir, "clone", url, clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.NoError(t, err, out)
+	pushed, err := runGit(clone, "rev-parse", "HEAD")
+	assert.NoError(t, err, pushed)
+
+	// Reads after the push still see the previous master
+	out, err = runGit(dir, "ls-remote", url, "refs/heads/master")
+	assert.NoError(t, err, out)
+	assert.NotContains(t, out, strings.TrimSpace(pushed))
+
+	assert.NoError(t, replication.Sync(repo))
+	out, err = runGit(dir, "ls-remote", url, "refs/heads/master")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, strings.TrimSpace(pushed))
+
+	// Repositories created by a push only appear on the replica later
+	replication.SetLag(100 * time.Millisecond)
+	out, err = runGit(clone, "push", ts.URL+"/new.git", "HEAD:main")
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "ls-remote", ts.URL+"/new.git")
+	assert.Error(t, err, out)
+	assert.Eventually(t, func() bool {
+		out, err := runGit(dir, "ls-remote", ts.URL+"/new.git", "refs/heads/main")
+		return err == nil && strings.Contains(out, strings.TrimSpace(pushed))
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Server-side commits are replicated as well
+	rev, err := replication.Primary.Commit(repo, "feature", Commit{Files: map[string]string{"a.txt": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		out, err := runGit(dir, "ls-remote", url, "refs/heads/feature")
+		return err == nil && strings.Contains(out, rev)
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,50 @@
+package gitkit
+
+import (
+	"fmt"
+	"sync"
+)
+
+// repoGenerator serializes the generation of missing repositories, so that
+// concurrent clients never see a repository half generated.
+type repoGenerator struct {
+	mu sync.Mutex
+}
+
+// open returns the git directory of a requested repository. Missing
+// repositories are created empty and passed to onMissing if set, and
+// otherwise created empty with Config.AutoCreate.
+func (g *repoGenerator) open(ops repoOps, repo string, onMissing func(string) error) (string, error) {
+	store := ops.store()
+	if onMissing == nil {
+		dir, err := store.Open(repo)
+		if err == ErrRepoNotFound && ops.config.AutoCreate {
+			return store.Create(repo)
+		}
+		return dir, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	dir, err := store.Open(repo)
+	if err != ErrRepoNotFound {
+		return dir, err
+	}
+	if dir, err = store.Create(repo); err != nil {
+		return "", err
+	}
+
+	err = onMissing(repo)
+	if err == ErrRepoNotFound && ops.config.AutoCreate {
+		return dir, nil
+	}
+	if err != nil {
+		if err := store.Delete(repo); err != nil {
+			ops.config.logError("repo-init", fmt.Errorf("%s: %v", repo, err))
+		}
+		return "", err
+	}
+	ops.config.logInfo("repo-init", fmt.Sprintf("%s: generated", repo))
+	return dir, nil
+}
@@ -0,0 +1,88 @@
+package gitkit
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// generateFixture fills repositories named fixture-<content> with a file
+// holding the content
+func generateFixture(ops interface {
+	Commit(string, string, Commit) (string, error)
+}, calls *int32) func(string) error {
+	return func(repo string) error {
+		atomic.AddInt32(calls, 1)
+		name := strings.TrimSuffix(repo, ".git")
+		if name == "broken" {
+			return errors.New("cannot generate broken")
+		}
+		if !strings.HasPrefix(name, "fixture-") {
+			return ErrRepoNotFound
+		}
+		_, err := ops.Commit(repo, "master", Commit{Files: map[string]string{"content": strings.TrimPrefix(name, "fixture-")}})
+		return err
+	}
+}
+
+func TestOnRepoMissing(t *testing.T) {
+	dir := t.TempDir()
+
+	var calls int32
+	service := New(Config{Dir: dir})
+	service.OnRepoMissing = generateFixture(service, &calls)
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	for i := 0; i < 2; i++ {
+		clone := filepath.Join(t.TempDir(), "clone")
+		out, err := runGit(dir, "clone", HTTPCloneURL(addr, "fixture-one.git"), clone)
+		if !assert.NoError(t, err, out) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(clone, "content"))
+		assert.NoError(t, err)
+		assert.Equal(t, "one", string(content))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "existing repositories are not generated again")
+
+	for _, repo := range []string{"other.git", "broken.git"} {
+		out, err := runGit(dir, "ls-remote", HTTPCloneURL(addr, repo))
+		assert.Error(t, err, out)
+		_, err = os.Stat(filepath.Join(dir, repo))
+		assert.True(t, os.IsNotExist(err), repo)
+	}
+
+	// Declined repositories are created empty with AutoCreate
+	service.config.AutoCreate = true
+	out, err := runGit(dir, "ls-remote", HTTPCloneURL(addr, "other.git"))
+	assert.NoError(t, err, out)
+	assert.Empty(t, out)
+	out, err = runGit(dir, "ls-remote", HTTPCloneURL(addr, "broken.git"))
+	assert.Error(t, err, out)
+
+	t.Run("ssh", func(t *testing.T) {
+		var calls int32
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+		server.OnRepoMissing = generateFixture(server, &calls)
+		addr := startSSH(t, server)
+
+		clone := filepath.Join(t.TempDir(), "clone")
+		out, err := runGit(dir, "clone", SSHCloneURL("git", addr, "fixture-two.git"), clone)
+		assert.NoError(t, err, out)
+		content, err := os.ReadFile(filepath.Join(clone, "content"))
+		assert.NoError(t, err)
+		assert.Equal(t, "two", string(content))
+
+		out, err = runGit(dir, "ls-remote", SSHCloneURL("git", addr, "missing.git"))
+		assert.Error(t, err, out)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+}
@@ -0,0 +1,501 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LocalTransport = "local"
+
+// Commit describes a commit created on the server side, without any client
+// involved.
+type Commit struct {
+	AuthorName  string
+	AuthorEmail string
+	Message     string
+	Date        time.Time
+	// Files maps paths to their new content
+	Files map[string]string
+	// Remove lists paths deleted by the commit
+	Remove []string
+}
+
+// repoOps implements server-side changes to hosted repositories. These are
+// reported as push events with the local transport.
+type repoOps struct {
+	config        *Config
+	emit          func(Event)
+	resources     *resourceTracker
+	storageErrors *storageErrors
+	rejections    *rejectionSet
+}
+
+// Commit creates a commit on top of branch (creating the branch if needed)
+// in a hosted repository and returns its revision. This simulates an upstream
+// moving forward without a client push.
+func (c *controls) Commit(repo string, branch string, commit Commit) (string, error) {
+	return c.repoOps().commit(repo, branch, commit)
+}
+
+// RewindBranch moves branch back by the given number of commits and returns
+// the new revision.
+func (c *controls) RewindBranch(repo string, branch string, commits int) (string, error) {
+	return c.repoOps().rewind(repo, branch, commits)
+}
+
+// DeleteRef removes a ref, e.g. refs/heads/feature, from a hosted repository.
+func (c *controls) DeleteRef(repo string, ref string) error {
+	return c.repoOps().deleteRef(repo, ref)
+}
+
+// AmendCommit replaces the tip of branch with a new commit that has the same
+// parents, the tree of the old tip plus the given changes, and the given
+// message and author.
+func (c *controls) AmendCommit(repo string, branch string, commit Commit) (string, error) {
+	return c.repoOps().amend(repo, branch, commit)
+}
+
+// RewriteHistory recreates the last given number of commits of branch with new
+// object names, as a rebase would, and force-updates the branch.
+func (c *controls) RewriteHistory(repo string, branch string, commits int) (string, error) {
+	return c.repoOps().rewrite(repo, branch, commits)
+}
+
+// PruneObjects expires reflogs and removes all unreachable objects from a
+// hosted repository.
+func (c *controls) PruneObjects(repo string) error {
+	return c.repoOps().prune(repo)
+}
+
+// CloneShallow creates a hosted repository that is itself shallow, holding
+// only the last depth commits of source. Clients fetching from it receive the
+// shallow boundary in the ref advertisement.
+func (c *controls) CloneShallow(repo string, source string, depth int) error {
+	return c.repoOps().cloneShallow(repo, source, depth)
+}
+
+// ShallowCommits returns the shallow boundary commits of a hosted repository,
+// or nothing if the repository has its full history.
+func (c *controls) ShallowCommits(repo string) ([]string, error) {
+	return c.repoOps().shallowCommits(repo)
+}
+
+func (o repoOps) commit(repo string, branch string, commit Commit) (string, error) {
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return "", err
+	}
+
+	ref := "refs/heads/" + branch
+	parent := o.resolve(dir, ref)
+
+	parents := []string{}
+	if parent != "" {
+		parents = append(parents, parent)
+	}
+
+	rev, err := o.writeCommit(dir, commit, parent, parents...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := o.updateRef(repo, dir, ref, parent, rev); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+func (o repoOps) rewind(repo string, branch string, commits int) (string, error) {
+	if commits < 1 {
+		return "", fmt.Errorf("invalid number of commits: %d", commits)
+	}
+
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return "", err
+	}
+
+	ref := "refs/heads/" + branch
+	old := o.resolve(dir, ref)
+	if old == "" {
+		return "", fmt.Errorf("branch %s does not exist in %s", branch, repo)
+	}
+
+	rev, err := o.git(dir, nil, "", "rev-parse", "--verify", fmt.Sprintf("%s~%d^{commit}", old, commits))
+	if err != nil {
+		return "", err
+	}
+
+	if err := o.updateRef(repo, dir, ref, old, rev); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+func (o repoOps) deleteRef(repo string, ref string) error {
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return err
+	}
+
+	old := o.resolve(dir, ref)
+	if old == "" {
+		return fmt.Errorf("ref %s does not exist in %s", ref, repo)
+	}
+
+	return o.updateRef(repo, dir, ref, old, "")
+}
+
+func (o repoOps) amend(repo string, branch string, commit Commit) (string, error) {
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return "", err
+	}
+
+	ref := "refs/heads/" + branch
+	old := o.resolve(dir, ref)
+	if old == "" {
+		return "", fmt.Errorf("branch %s does not exist in %s", branch, repo)
+	}
+
+	parents, err := o.parents(dir, old)
+	if err != nil {
+		return "", err
+	}
+
+	rev, err := o.writeCommit(dir, commit, old, parents...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := o.updateRef(repo, dir, ref, old, rev); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+func (o repoOps) rewrite(repo string, branch string, commits int) (string, error) {
+	if commits < 1 {
+		return "", fmt.Errorf("invalid number of commits: %d", commits)
+	}
+
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return "", err
+	}
+
+	ref := "refs/heads/" + branch
+	old := o.resolve(dir, ref)
+	if old == "" {
+		return "", fmt.Errorf("branch %s does not exist in %s", branch, repo)
+	}
+
+	out, err := o.git(dir, nil, "", "rev-list", "--first-parent", fmt.Sprintf("--max-count=%d", commits), old)
+	if err != nil {
+		return "", err
+	}
+
+	// Newest commit first
+	revs := strings.Fields(out)
+	if len(revs) < commits {
+		return "", fmt.Errorf("branch %s has less than %d commits", branch, commits)
+	}
+
+	parents, err := o.parents(dir, revs[len(revs)-1])
+	if err != nil {
+		return "", err
+	}
+
+	rev := ""
+	for i := len(revs) - 1; i >= 0; i-- {
+		if rev, err = o.recreate(dir, revs[i], parents); err != nil {
+			return "", err
+		}
+		parents = []string{rev}
+	}
+
+	if err := o.updateRef(repo, dir, ref, old, rev); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+// recreate writes a copy of commit rev on top of the given parents. The
+// committer date is moved forward by a second so the copy always gets a new
+// object name, even when parents did not change.
+func (o repoOps) recreate(dir string, rev string, parents []string) (string, error) {
+	out, err := o.git(dir, nil, "", "log", "-1", "--format=%T%n%an%n%ae%n%ad%n%cn%n%ce%n%ct%n%B", "--date=raw", rev)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.SplitN(out, "\n", 8)
+	if len(fields) < 7 {
+		return "", fmt.Errorf("unable to read commit %s", rev)
+	}
+	fields = append(fields, "")
+
+	committed, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	env := []string{
+		"GIT_AUTHOR_NAME=" + fields[1],
+		"GIT_AUTHOR_EMAIL=" + fields[2],
+		"GIT_AUTHOR_DATE=" + fields[3],
+		"GIT_COMMITTER_NAME=" + fields[4],
+		"GIT_COMMITTER_EMAIL=" + fields[5],
+		fmt.Sprintf("GIT_COMMITTER_DATE=%d +0000", committed+1),
+	}
+
+	args := []string{"commit-tree", fields[0]}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+	return o.git(dir, env, fields[7], args...)
+}
+
+func (o repoOps) prune(repo string) error {
+	dir, err := o.writablePath(repo)
+	if err != nil {
+		return err
+	}
+
+	if _, err := o.git(dir, nil, "", "reflog", "expire", "--expire=now", "--all"); err != nil {
+		return err
+	}
+	_, err = o.git(dir, nil, "", "gc", "--quiet", "--prune=now")
+	return err
+}
+
+func (o repoOps) cloneShallow(repo string, source string, depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("invalid depth: %d", depth)
+	}
+
+	store := o.store()
+	if _, err := store.Open(repo); err != ErrRepoNotFound {
+		return fmt.Errorf("%s already exists", repo)
+	}
+
+	// git ignores --depth for local clones unless given a file:// URL
+	if !strings.Contains(source, "://") && fileExists(source) {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			return err
+		}
+		source = "file://" + filepath.ToSlash(abs)
+	}
+
+	// The store creates the repository, fetched into like clone --bare
+	// --no-single-branch would
+	dir, err := store.Create(repo)
+	if err != nil {
+		return err
+	}
+	if err := o.fetchShallow(dir, source, depth); err != nil {
+		if err := store.Delete(repo); err != nil {
+			o.config.logError("clone-shallow", fmt.Errorf("%s: %v", repo, err))
+		}
+		return err
+	}
+	return nil
+}
+
+// fetchShallow fetches the branches and tags of source into the empty
+// repository at dir, pointing its HEAD to the one of source.
+func (o repoOps) fetchShallow(dir string, source string, depth int) error {
+	_, err := o.git(dir, nil, "", "fetch", "--quiet", "--depth", strconv.Itoa(depth), source, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	if err != nil {
+		return err
+	}
+
+	out, err := o.git(dir, nil, "", "ls-remote", "--symref", source, "HEAD")
+	if err != nil {
+		return err
+	}
+	if head := strings.Fields(out); len(head) > 1 && head[0] == "ref:" {
+		_, err = o.git(dir, nil, "", "symbolic-ref", "HEAD", head[1])
+	}
+	return err
+}
+
+func (o repoOps) shallowCommits(repo string) ([]string, error) {
+	dir, err := o.repoPath(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "shallow"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// parents returns the parent revisions of a commit
+func (o repoOps) parents(dir string, rev string) ([]string, error) {
+	out, err := o.git(dir, nil, "", "log", "-1", "--format=%P", rev)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// writeCommit builds the tree of a commit in a temporary index, starting from
+// the tree of base when set, and writes the commit object.
+func (o repoOps) writeCommit(dir string, commit Commit, base string, parents ...string) (rev string, err error) {
+	tmpDir, release, err := o.mkdirTemp("gitkit-index")
+	if err != nil {
+		return "", err
+	}
+	defer release(&err)
+
+	// Bare repositories have no work tree, but removing paths from the index
+	// requires one. An empty directory is enough.
+	env := []string{
+		"GIT_INDEX_FILE=" + filepath.Join(tmpDir, "index"),
+		"GIT_WORK_TREE=" + tmpDir,
+	}
+	if base != "" {
+		if _, err := o.git(dir, env, "", "read-tree", base); err != nil {
+			return "", err
+		}
+	}
+
+	paths := make([]string, 0, len(commit.Files))
+	for path := range commit.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		blob, err := o.git(dir, nil, commit.Files[path], "hash-object", "-w", "--stdin")
+		if err != nil {
+			return "", err
+		}
+		if _, err := o.git(dir, env, "", "update-index", "--add", "--cacheinfo", "100644,"+blob+","+path); err != nil {
+			return "", err
+		}
+	}
+
+	for _, path := range commit.Remove {
+		if _, err := o.git(dir, env, "", "update-index", "--force-remove", path); err != nil {
+			return "", err
+		}
+	}
+
+	tree, err := o.git(dir, env, "", "write-tree")
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"commit-tree", tree}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+	message := commit.Message
+	if message == "" {
+		message = "Update files"
+	}
+	return o.git(dir, commitEnv(commit), message, args...)
+}
+
+// updateRef atomically moves ref from old to rev and emits a push event. An
+// empty old revision creates the ref, an empty rev deletes it.
+func (o repoOps) updateRef(repo string, dir string, ref string, old string, rev string) error {
+	var err error
+	if rev == "" {
+		_, err = o.git(dir, nil, "", "update-ref", "-d", ref, old)
+	} else {
+		_, err = o.git(dir, nil, "", "update-ref", ref, rev, old)
+	}
+	if err != nil {
+		return err
+	}
+	updateServerInfo(o.config, dir)
+
+	hash := old + rev
+	if old == "" {
+		old = zeroSHAFor(hash)
+	}
+	if rev == "" {
+		rev = zeroSHAFor(hash)
+	}
+
+	change := refChange(o.config, dir, newRefUpdate(old, rev, ref))
+	o.emit(Event{Type: PushEvent, Transport: LocalTransport, Repo: repo, Refs: []RefChange{change}})
+	return nil
+}
+
+// resolve returns the revision of ref, or an empty string if it does not exist
+func (o repoOps) resolve(dir string, ref string) string {
+	rev, err := o.git(dir, nil, "", "rev-parse", "--verify", "--quiet", ref)
+	if err != nil {
+		return ""
+	}
+	return rev
+}
+
+func (o repoOps) repoPath(repo string) (string, error) {
+	dir, err := o.store().Open(repo)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", repo, err)
+	}
+	return dir, nil
+}
+
+// writablePath returns the git directory of a repository about to be
+// changed, failing with the injected storage error if any.
+func (o repoOps) writablePath(repo string) (string, error) {
+	if err := o.storageErrors.get(repo); err != nil {
+		return "", err
+	}
+	return o.repoPath(repo)
+}
+
+// store returns the repository store, failing writes with injected storage
+// errors.
+func (o repoOps) store() RepoStore {
+	return &faultyStore{RepoStore: o.config.repoStore(), errs: o.storageErrors}
+}
+
+// git runs a git command in dir and returns its trimmed output
+func (o repoOps) git(dir string, env []string, stdin string, args ...string) (string, error) {
+	out, err := gitExec(o.config.GitPath, dir, env, stdin, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func commitEnv(commit Commit) []string {
+	name, email := commit.AuthorName, commit.AuthorEmail
+	if name == "" {
+		name = "gitkit"
+	}
+	if email == "" {
+		email = "gitkit@localhost"
+	}
+
+	date := commit.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	stamp := fmt.Sprintf("%d %s", date.Unix(), date.Format("-0700"))
+
+	return []string{
+		"GIT_AUTHOR_NAME=" + name,
+		"GIT_AUTHOR_EMAIL=" + email,
+		"GIT_AUTHOR_DATE=" + stamp,
+		"GIT_COMMITTER_NAME=" + name,
+		"GIT_COMMITTER_EMAIL=" + email,
+		"GIT_COMMITTER_DATE=" + stamp,
+	}
+}
@@ -0,0 +1,176 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerCommitAndRewind(t *testing.T) {
+	dir, err := os.MkdirTemp("", "repo-ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []Event{}
+	server := New(Config{Dir: dir, ChangedFiles: true})
+	server.OnEvent = func(e Event) {
+		events = append(events, e)
+	}
+
+	show := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"--git-dir", filepath.Join(dir, repo)}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	branch := strings.TrimPrefix(show("symbolic-ref", "HEAD"), "refs/heads/")
+	base := show("rev-parse", "HEAD")
+
+	rev, err := server.Commit(repo, branch, Commit{
+		AuthorName:  "Upstream",
+		AuthorEmail: "upstream@example.com",
+		Message:     "Move forward",
+		Date:        time.Unix(1600000000, 0).UTC(),
+		Files:       map[string]string{"docs/readme.md": "hello"},
+		Remove:      []string{"homework"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rev, show("rev-parse", "HEAD"))
+	assert.Equal(t, base, show("rev-parse", "HEAD~1"))
+	assert.Equal(t, "hello", show("show", "HEAD:docs/readme.md"))
+	assert.Equal(t, "Upstream <upstream@example.com> 1600000000 Move forward", show("log", "-1", "--format=%an <%ae> %at %s"))
+	assert.Equal(t, "docs/readme.md", show("ls-tree", "-r", "--name-only", "HEAD"))
+
+	rewound, err := server.RewindBranch(repo, branch, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, base, rewound)
+	assert.Equal(t, base, show("rev-parse", "HEAD"))
+
+	_, err = server.RewindBranch(repo, "missing", 1)
+	assert.Error(t, err)
+	_, err = server.Commit("missing.git", branch, Commit{})
+	assert.Error(t, err)
+
+	assert.Len(t, events, 2)
+	for _, e := range events {
+		assert.Equal(t, PushEvent, e.Type)
+		assert.Equal(t, LocalTransport, e.Transport)
+		assert.Equal(t, repo, e.Repo)
+		assert.Len(t, e.Refs, 1)
+		assert.ElementsMatch(t, []string{"docs/readme.md", "homework"}, e.Refs[0].Files)
+	}
+	assert.Equal(t, rev, events[0].Refs[0].NewRev)
+	assert.Equal(t, rev, events[1].Refs[0].OldRev)
+}
+
+func TestServerRewriteHistory(t *testing.T) {
+	dir, err := os.MkdirTemp("", "repo-ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(Config{Dir: dir})
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"--git-dir", filepath.Join(dir, repo)}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	branch := strings.TrimPrefix(git("symbolic-ref", "HEAD"), "refs/heads/")
+	base := git("rev-parse", "HEAD")
+
+	first, err := server.Commit(repo, branch, Commit{Message: "first", Files: map[string]string{"a": "1"}})
+	assert.NoError(t, err)
+	second, err := server.Commit(repo, branch, Commit{Message: "second", Files: map[string]string{"b": "2"}})
+	assert.NoError(t, err)
+
+	amended, err := server.AmendCommit(repo, branch, Commit{Message: "second, amended", Files: map[string]string{"c": "3"}})
+	assert.NoError(t, err)
+	assert.NotEqual(t, second, amended)
+	assert.Equal(t, first, git("rev-parse", branch+"~1"))
+	assert.Equal(t, "second, amended", git("log", "-1", "--format=%s", branch))
+	assert.Equal(t, "a\nb\nc\nhomework", git("ls-tree", "-r", "--name-only", branch))
+
+	rewritten, err := server.RewriteHistory(repo, branch, 2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, amended, rewritten)
+	assert.Equal(t, base, git("rev-parse", branch+"~2"))
+	assert.NotEqual(t, first, git("rev-parse", branch+"~1"))
+	assert.Equal(t, git("rev-parse", amended+"^{tree}"), git("rev-parse", rewritten+"^{tree}"))
+	assert.Equal(t, "second, amended\nfirst", git("log", "-2", "--format=%s", branch))
+
+	_, err = server.RewriteHistory(repo, branch, 10)
+	assert.Error(t, err)
+
+	git("branch", "feature", amended)
+	assert.NoError(t, server.DeleteRef(repo, "refs/heads/feature"))
+	assert.Error(t, server.DeleteRef(repo, "refs/heads/feature"))
+
+	assert.NoError(t, server.PruneObjects(repo))
+	cmd := exec.Command("git", "--git-dir", filepath.Join(dir, repo), "cat-file", "-e", amended)
+	assert.Error(t, cmd.Run(), "amended commit should be pruned")
+}
+
+func TestServerCloneShallow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "repo-ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, err := createRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	out, err := runGit(source, "-c", "user.email=test@gitkit.com", "-c", "user.name=test-user", "commit", "--allow-empty", "-m", "second")
+	assert.NoError(t, err, out)
+
+	service := New(Config{Dir: dir})
+	assert.NoError(t, service.CloneShallow("shallow.git", source, 1))
+	assert.Error(t, service.CloneShallow("shallow.git", source, 1))
+
+	shallow, err := service.ShallowCommits("shallow.git")
+	assert.NoError(t, err)
+	assert.Len(t, shallow, 1)
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	out, err = runGit(dir, "clone", server.URL+"/shallow.git", "clone")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(filepath.Join(dir, "clone"), "rev-parse", "--is-shallow-repository")
+	assert.NoError(t, err, out)
+	assert.Equal(t, "true", strings.TrimSpace(out))
+
+	out, err = runGit(filepath.Join(dir, "clone"), "rev-list", "--count", "HEAD")
+	assert.NoError(t, err, out)
+	assert.Equal(t, "1", strings.TrimSpace(out))
+
+	// Repositories are created by the store
+	stored := t.TempDir()
+	service = New(Config{Store: &FSStore{Dir: stored}})
+	assert.NoError(t, service.CloneShallow("shallow.git", source, 1))
+	assert.True(t, isRepo(filepath.Join(stored, "shallow.git")))
+}
@@ -0,0 +1,47 @@
+package gitkit
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"sync"
+)
+
+// seededRand is a deterministic source of randomness safe for concurrent use
+type seededRand struct {
+	mu   sync.Mutex
+	rand *mathrand.Rand
+}
+
+// SeededRand returns a deterministic source of randomness for Config.Rand
+// and the Rand of certificate authorities, producing the same bytes for the
+// same seed, so that a failure found with a logged seed can be replayed.
+// It is not suitable for anything but tests.
+func SeededRand(seed int64) io.Reader {
+	return &seededRand{rand: mathrand.New(mathrand.NewSource(seed))}
+}
+
+func (r *seededRand) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Read(p)
+}
+
+// random returns the source of randomness of the server, crypto/rand unless
+// Config.Rand is set.
+func (c *Config) random() io.Reader {
+	if c.Rand != nil {
+		return c.Rand
+	}
+	return rand.Reader
+}
+
+// seedRand sets Rand from Config.Seed, logging the seed to replay runs.
+func (c *Config) seedRand() {
+	if c.Rand != nil || c.Seed == 0 {
+		return
+	}
+	c.Rand = SeededRand(c.Seed)
+	c.logInfo("rand", fmt.Sprintf("seed %d", c.Seed))
+}
@@ -0,0 +1,46 @@
+package gitkit
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeededRand(t *testing.T) {
+	read := func(r io.Reader) []byte {
+		buf := make([]byte, 32)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	assert.Equal(t, read(SeededRand(42)), read(SeededRand(42)))
+	assert.NotEqual(t, read(SeededRand(42)), read(SeededRand(43)))
+
+	hostKey := func(seed int64) string {
+		dir := t.TempDir()
+		repo, err := createBareRepo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NewSSH(Config{Dir: dir, KeyDir: t.TempDir(), HostKeyTypes: []string{Ed25519HostKey}, Seed: seed})
+		out, err := runGit(dir, "ls-remote", SSHCloneURL("git", startSSH(t, server), repo))
+		assert.NoError(t, err, out)
+		return string(server.HostKeys()[0].Marshal())
+	}
+	assert.Equal(t, hostKey(42), hostKey(42))
+	assert.NotEqual(t, hostKey(42), hostKey(43))
+
+	nonce := func(config Config) string {
+		service := New(config)
+		nonce, err := service.nonces.issue(service.config.random(), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nonce
+	}
+	assert.Equal(t, nonce(Config{Seed: 42}), nonce(Config{Rand: SeededRand(42)}))
+	assert.NotEqual(t, nonce(Config{}), nonce(Config{}))
+}
@@ -0,0 +1,143 @@
+package gitkit
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// connTracker keeps the open connections of a server with the number of
+// sessions running on each, to close them once idle when shutting down.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]int
+	draining bool
+	drained  chan struct{} // Closed once draining without connections left
+}
+
+// open accepts connections again after a shutdown
+func (c *connTracker) open() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = false
+	c.drained = nil
+}
+
+// add records an accepted connection. It closes it and returns false when
+// shutting down.
+func (c *connTracker) add(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		conn.Close()
+		return false
+	}
+	if c.conns == nil {
+		c.conns = map[net.Conn]int{}
+	}
+	c.conns[conn] = 0
+	return true
+}
+
+// remove forgets a connection once closed
+func (c *connTracker) remove(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.conns, conn)
+	c.checkDrained()
+}
+
+// session records a session running on a connection until the returned
+// function is called, which closes the connection if the server is shutting
+// down and it has no other session.
+func (c *connTracker) session(conn net.Conn) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.conns[conn]; ok {
+		c.conns[conn]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if _, ok := c.conns[conn]; !ok {
+				return
+			}
+			c.conns[conn]--
+			if c.draining && c.conns[conn] == 0 {
+				conn.Close()
+			}
+		})
+	}
+}
+
+// drain closes idle connections and returns a channel closed once all
+// connections are closed.
+func (c *connTracker) drain() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	for conn, sessions := range c.conns {
+		if sessions == 0 {
+			conn.Close()
+		}
+	}
+	c.checkDrained()
+	return c.drained
+}
+
+// checkDrained closes the drained channel once no connection is left. The
+// lock must be held.
+func (c *connTracker) checkDrained() {
+	if !c.draining || len(c.conns) > 0 {
+		return
+	}
+	select {
+	case <-c.drained:
+	default:
+		close(c.drained)
+	}
+}
+
+func (c *connTracker) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown stops the server gracefully, unlike Stop: it stops accepting
+// connections and closes idle ones, then waits for the git sessions in
+// flight to complete, closing their connections once done. When ctx is done
+// first, the remaining connections are closed and the error of ctx is
+// returned. With Config.StrictTeardown, it also reports leaked resources.
+func (s *SSH) Shutdown(ctx context.Context) error {
+	listener := s.unsetListener()
+	if listener == nil {
+		return nil
+	}
+	if err := listener.Close(); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.conns.drain():
+	case <-ctx.Done():
+		s.conns.closeAll()
+		return ctx.Err()
+	}
+
+	if s.gitConfig.StrictTeardown {
+		return s.CheckLeaks()
+	}
+	return nil
+}
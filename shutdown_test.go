@@ -0,0 +1,158 @@
+package gitkit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHShutdown(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clone starts a clone slowed down by a fault, returning its result
+	clone := func(server *SSH, url string) <-chan error {
+		server.InjectFault(repo, Fault{Latency: time.Second})
+		cloned := make(chan error, 1)
+		go func() {
+			out, err := runGit(dir, "clone", url, filepath.Join(t.TempDir(), "clone"))
+			if err != nil {
+				t.Log(out)
+			}
+			cloned <- err
+		}()
+		time.Sleep(300 * time.Millisecond)
+		return cloned
+	}
+
+	t.Run("drains sessions in flight", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+		addr := startSSH(t, server)
+		url := SSHCloneURL("git", addr, repo)
+
+		// Idle connections do not hold the shutdown
+		idle, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idle.Close()
+		idleClosed := make(chan error, 1)
+		go func() { idleClosed <- idle.Wait() }()
+
+		cloned := clone(server, url)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		assert.NoError(t, server.Shutdown(ctx))
+		assert.True(t, time.Since(start) > 500*time.Millisecond, "shutdown did not wait for the clone")
+
+		assert.NoError(t, <-cloned)
+		select {
+		case <-idleClosed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle connection still open")
+		}
+
+		out, err := runGit(dir, "ls-remote", url)
+		assert.Error(t, err, out)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+		addr := startSSH(t, server)
+
+		cloned := clone(server, SSHCloneURL("git", addr, repo))
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+		assert.Error(t, <-cloned)
+	})
+}
+
+func TestSSHListenAndServeContext(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServeContext(ctx, "127.0.0.1:0") }()
+
+	select {
+	case <-server.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server not listening")
+	}
+	addr := server.Addr().String()
+	out, err := runGit(dir, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still serving")
+	}
+	assert.Error(t, client.Wait(), "connections are closed")
+	out, err = runGit(dir, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.Error(t, err, out)
+}
+
+func TestSSHListenAndServeContextGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	server.ShutdownGracePeriod = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServeContext(ctx, "127.0.0.1:0") }()
+
+	select {
+	case <-server.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server not listening")
+	}
+
+	server.InjectFault(repo, Fault{Latency: time.Second})
+	cloned := make(chan error, 1)
+	go func() {
+		out, err := runGit(dir, "clone", SSHCloneURL("git", server.Addr().String(), repo), filepath.Join(t.TempDir(), "clone"))
+		if err != nil {
+			t.Log(out)
+		}
+		cloned <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-cloned, "the clone in flight completes")
+	select {
+	case err := <-served:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still serving")
+	}
+}
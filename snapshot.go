@@ -0,0 +1,114 @@
+package gitkit
+
+import (
+	"strings"
+)
+
+// Snapshot is the state of a hosted repository at some point in time: its
+// refs and the objects reachable from them.
+type Snapshot struct {
+	Refs map[string]string // Ref names mapped to their revision
+	// Commits lists the reachable commits, newest first
+	Commits []string
+	// Objects holds every reachable object: commits, trees, blobs and tags
+	Objects map[string]bool
+}
+
+// SnapshotDiff describes what changed between two snapshots
+type SnapshotDiff struct {
+	Created []RefUpdate
+	Deleted []RefUpdate
+	Moved   []RefUpdate
+	// NewCommits lists the commits reachable only in the newer snapshot,
+	// newest first
+	NewCommits []string
+	// RemovedCommits lists the commits no longer reachable, newest first
+	RemovedCommits []string
+	// NewObjects is the number of objects reachable only in the newer
+	// snapshot
+	NewObjects int
+}
+
+// Empty reports whether the snapshots were identical
+func (d SnapshotDiff) Empty() bool {
+	return len(d.Created) == 0 && len(d.Deleted) == 0 && len(d.Moved) == 0 &&
+		len(d.NewCommits) == 0 && len(d.RemovedCommits) == 0 && d.NewObjects == 0
+}
+
+// Snapshot records the refs and reachable objects of a hosted repository,
+// to be compared with a later snapshot using DiffSnapshots.
+func (c *controls) Snapshot(repo string) (*Snapshot, error) {
+	return c.repoOps().snapshot(repo)
+}
+
+// DiffSnapshots compares an older snapshot of a repository with a newer one
+func DiffSnapshots(before *Snapshot, after *Snapshot) SnapshotDiff {
+	diff := SnapshotDiff{}
+
+	for _, update := range diffRefs(before.Refs, after.Refs) {
+		switch {
+		case IsZeroSHA(update.OldRev):
+			diff.Created = append(diff.Created, update)
+		case IsZeroSHA(update.NewRev):
+			diff.Deleted = append(diff.Deleted, update)
+		default:
+			diff.Moved = append(diff.Moved, update)
+		}
+	}
+
+	diff.NewCommits = commitsMissingFrom(after.Commits, before.Objects)
+	diff.RemovedCommits = commitsMissingFrom(before.Commits, after.Objects)
+
+	for object := range after.Objects {
+		if !before.Objects[object] {
+			diff.NewObjects++
+		}
+	}
+	return diff
+}
+
+func commitsMissingFrom(commits []string, objects map[string]bool) []string {
+	missing := []string{}
+	for _, commit := range commits {
+		if !objects[commit] {
+			missing = append(missing, commit)
+		}
+	}
+	return missing
+}
+
+func (o repoOps) snapshot(repo string) (*Snapshot, error) {
+	dir, err := o.repoPath(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := listRefs(o.config.GitPath, dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{Refs: refs, Commits: []string{}, Objects: map[string]bool{}}
+
+	// Empty repositories have nothing reachable, and rev-list would fail
+	if len(refs) == 0 {
+		return snapshot, nil
+	}
+
+	commits, err := o.git(dir, nil, "", "rev-list", "--all")
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Commits = strings.Fields(commits)
+
+	objects, err := o.git(dir, nil, "", "rev-list", "--objects", "--all")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(objects, "\n") {
+		// Trees and blobs are followed by their path
+		if fields := strings.Fields(line); len(fields) > 0 {
+			snapshot.Objects[fields[0]] = true
+		}
+	}
+	return snapshot, nil
+}
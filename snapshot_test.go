@@ -0,0 +1,63 @@
+package gitkit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(Config{Dir: dir})
+	before, err := server.Snapshot(repo)
+	assert.NoError(t, err)
+	assert.True(t, DiffSnapshots(before, before).Empty())
+
+	feature, err := server.Commit(repo, "feature", Commit{Files: map[string]string{"new.txt": "new"}})
+	assert.NoError(t, err)
+	master, err := server.Commit(repo, "master", Commit{Files: map[string]string{"more.txt": "more"}})
+	assert.NoError(t, err)
+
+	after, err := server.Snapshot(repo)
+	assert.NoError(t, err)
+
+	diff := DiffSnapshots(before, after)
+	assert.Len(t, diff.Created, 1)
+	assert.Equal(t, "refs/heads/feature", diff.Created[0].Ref)
+	assert.Equal(t, feature, diff.Created[0].NewRev)
+	assert.Len(t, diff.Moved, 1)
+	assert.Equal(t, "refs/heads/master", diff.Moved[0].Ref)
+	assert.Equal(t, before.Refs["refs/heads/master"], diff.Moved[0].OldRev)
+	assert.Equal(t, master, diff.Moved[0].NewRev)
+	assert.Empty(t, diff.Deleted)
+	assert.ElementsMatch(t, []string{feature, master}, diff.NewCommits)
+	assert.Empty(t, diff.RemovedCommits)
+	// Two commits, two trees and two blobs
+	assert.Equal(t, 6, diff.NewObjects)
+
+	assert.NoError(t, server.DeleteRef(repo, "refs/heads/feature"))
+	_, err = server.RewindBranch(repo, "master", 1)
+	assert.NoError(t, err)
+
+	final, err := server.Snapshot(repo)
+	assert.NoError(t, err)
+
+	diff = DiffSnapshots(after, final)
+	assert.Len(t, diff.Deleted, 1)
+	assert.Equal(t, "refs/heads/feature", diff.Deleted[0].Ref)
+	assert.Len(t, diff.Moved, 1)
+	assert.Empty(t, diff.NewCommits)
+	assert.ElementsMatch(t, []string{feature, master}, diff.RemovedCommits)
+	assert.True(t, DiffSnapshots(before, final).Empty())
+}
@@ -2,20 +2,16 @@ package gitkit
 
 import (
 	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
+	"context"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +22,9 @@ import (
 var (
 	ErrAlreadyStarted = errors.New("server has already been started")
 	ErrNoListener     = errors.New("cannot call Serve() before Listen()")
+	// ErrTooManyAuthTries is reported in auth failure events of connections
+	// closed after Config.SSHMaxAuthTries failed attempts
+	ErrTooManyAuthTries = errors.New("too many authentication failures")
 )
 
 type PublicKey struct {
@@ -33,24 +32,132 @@ type PublicKey struct {
 	Name        string
 	Fingerprint string
 	Content     string
+	// Options are the authorized_keys options of the key, such as no-pty
+	// or command="...", as listed in the file
+	Options []string
 }
 
 type SSH struct {
-	listener net.Listener
+	listenerMu sync.RWMutex // Guards listener and socket
+	listener   net.Listener
+	socket     net.Listener // Listener wrapped by listener
 
 	sshConfig *ssh.ServerConfig
 	gitConfig *Config
 	// Timeout, if set will close the connection after the given duration
 	Timeout *time.Duration
+	// HandshakeTimeout, if set, closes connections that have not completed
+	// the SSH handshake and authentication within the duration.
+	HandshakeTimeout time.Duration
+	// IdleTimeout, if set, closes connections once no data was sent or
+	// received through them for the duration.
+	IdleTimeout time.Duration
+	// MaxSessionDuration, if set, closes sessions after the duration,
+	// killing their git command, while leaving their connection open.
+	MaxSessionDuration time.Duration
+	// ClientAliveInterval, if set, sends a keepalive request to clients at
+	// the interval, like the ClientAliveInterval option of sshd, closing
+	// connections once ClientAliveCountMax requests in a row are left
+	// unanswered, 3 by default.
+	ClientAliveInterval time.Duration
+	ClientAliveCountMax int
+	// ShutdownGracePeriod is how long ListenAndServeContext lets the git
+	// sessions in flight complete once its context is done, like Shutdown.
+	// Their connections are closed right away when unset.
+	ShutdownGracePeriod time.Duration
 	// DisableConnReuse, if true will disable a reuse of ssh connection in a later session.
 	DisableConnReuse bool
 	// DisableSimultaneousConns, if true will disable simultaneous conns from the same host.
 	DisableSimultaneousConns bool
 	PublicKeyLookupFunc      func(string) (*PublicKey, error)
+	// PublicKeyLookupContextFunc, if set, is used instead of
+	// PublicKeyLookupFunc, receiving the offered key along with its
+	// fingerprint and client. Its context ends with the handshake, timing out
+	// after HandshakeTimeout.
+	PublicKeyLookupContextFunc func(ctx context.Context, lookup PublicKeyLookup) (*PublicKey, error)
+	// AllowedUsers, if set, are the only users accepted, typically "git",
+	// others being rejected as UserRejection asks for.
+	AllowedUsers  []string
+	UserRejection UserRejection
+	// AuthorizeFunc, if set, is called once a client is authenticated for
+	// every git command it runs, before running it, e.g. to model read-only
+	// deploy keys. Its error rejects the command, and is sent to the client.
+	AuthorizeFunc func(identity Identity, repo string, op Operation) error
+	// KeyboardInteractiveFunc, if set, accepts keyboard-interactive auth
+	// alongside public keys when Config.Auth is enabled. It asks the client
+	// questions with challenge, and returns an ID reported like key IDs, or
+	// an error rejecting the client.
+	KeyboardInteractiveFunc func(user string, challenge ssh.KeyboardInteractiveChallenge) (string, error)
+	// SessionEnvFunc, if set, returns extra environment variables of the git
+	// command run for a session, overriding the ones of Config.SSHEnv.
+	SessionEnvFunc func(conn ssh.ConnMetadata, cmd *GitCommand) map[string]string
+	// OnRepoMissing, if set, is called when a client asks for a repository
+	// that does not exist, once created empty, to generate its content, e.g.
+	// with Commit, from its name. Returning an error deletes it, answering
+	// as if it did not exist, unless the error is ErrRepoNotFound and
+	// Config.AutoCreate is set, which keeps it empty.
+	OnRepoMissing func(repo string) error
+	// RejectMessages are the messages sent to clients making requests the
+	// server does not serve, by channel or request type, e.g. direct-tcpip
+	// for port forwarding, shell or pty-req, overriding the default ones.
+	// Empty messages refuse session requests silently.
+	RejectMessages map[string]string
+	// GreetingFunc, if set, returns the message printed to clients opening
+	// an interactive session, e.g. with ssh -T, instead of a git-shell-like
+	// greeting. The user is the name of its key when known.
+	GreetingFunc func(conn ssh.ConnMetadata, user string) string
+	// Interceptor, if set, is called for every git command of an
+	// authenticated client, to change or reject it.
+	Interceptor Interceptor
+	// OnRejectedRequest, if set, is called for every channel or session
+	// request, other than exec and env, that the server rejects.
+	OnRejectedRequest func(RejectedRequest)
+	// OnConnect, OnAuth, OnExec and OnDisconnect, if set, are called when a
+	// client connects, once its handshake ended, successful or not, once
+	// each of its git commands exited and once it disconnected, to check
+	// what clients did without parsing logs.
+	OnConnect    func(ConnInfo)
+	OnAuth       func(ConnInfo)
+	OnExec       func(ConnInfo)
+	OnDisconnect func(ConnInfo)
+	// OnEvent, if set, is called for every event emitted by the server.
+	OnEvent func(Event)
+	// OnCancel, if set, is called when a git process is killed because its
+	// connection was closed first, with the time it took to exit.
+	OnCancel func(Cancellation)
+	// OnClientGone, if set, is called when a client disappears in the middle
+	// of a git command.
+	OnClientGone func(ClientGone)
+
+	controls
+	events      eventLog
+	tarpit      tarpit
+	sshFaults   sshFaultSet
+	accepts     AcceptGate
+	conns       connTracker
+	connLimit   connLimit
+	generator   repoGenerator
+	connHosts   hostSet
+	handshakes  handshakeSet
+	transcripts int32 // Transcripts started, numbering their directories
+	hostMu      sync.RWMutex
+	hostKeys    []ssh.PublicKey
+	hostSigners []ssh.Signer
+	hostCerts   []*ssh.Certificate
+	hostSlots   map[string]*rotatingSigner // Host keys of sshConfig by type
+	readyMu     sync.Mutex
+	ready       chan struct{} // Closed once listening
 }
 
 func NewSSH(config Config) *SSH {
 	s := &SSH{gitConfig: &config}
+	s.controls.config = s.gitConfig
+	s.emitLocal = func(e Event) {
+		s.events.emit(s.gitConfig, s.OnEvent, e)
+	}
+	s.gitConfig.adopted = &adoptedRepos{}
+	s.clock.setSkew(config.ClockSkew)
+	s.gitConfig.seedRand()
 
 	// Use PATH if full path is not specified
 	if s.gitConfig.GitPath == "" {
@@ -94,72 +201,85 @@ func execCommand(cmdname string, args ...string) (string, string, error) {
 	return string(bufOut), string(bufErr), err
 }
 
-func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn *ssh.ServerConn) {
+func (s *SSH) handleConnection(ctx context.Context, conn net.Conn, keyID string, chans <-chan ssh.NewChannel, sConn *ssh.ServerConn) {
 	for newChan := range chans {
 		if newChan.ChannelType() != "session" {
-			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			s.rejectChannel(sConn, newChan)
 			continue
 		}
 
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
-			log.Printf("error accepting channel: %v", err)
+			s.gitConfig.logf("error accepting channel: %v", err)
 			continue
 		}
 
-		go func(in <-chan *ssh.Request) {
+		done := s.resources.session()
+		sessionDone := s.conns.session(conn)
+		go func(ctx context.Context, in <-chan *ssh.Request) {
+			defer done()
+			defer sessionDone()
 			defer ch.Close()
 
+			if s.MaxSessionDuration > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, s.MaxSessionDuration)
+				defer cancel()
+				go func() {
+					<-ctx.Done()
+					if ctx.Err() == context.DeadlineExceeded {
+						s.gitConfig.logf("ssh: closing session of %s after %s", sConn.RemoteAddr(), s.MaxSessionDuration)
+						ch.Close()
+					}
+				}()
+			}
+
 			defer func() {
 				if s.DisableConnReuse {
 					err := sConn.Close()
 					if err != nil {
-						log.Println("err while closing:", err)
+						s.gitConfig.logln("err while closing:", err)
 					}
 				}
 				if s.DisableSimultaneousConns {
 					host, _ := getHost(sConn.RemoteAddr().String())
-					mux.Lock()
-					defer mux.Unlock()
-					log.Println("disable simultaneous conns")
-					for i, connHost := range connHosts {
-						if host == connHost {
-							connHosts[i] = connHosts[len(connHosts)-1]
-							connHosts = connHosts[:len(connHosts)-1]
-						}
-					}
+					s.gitConfig.logln("disable simultaneous conns")
+					s.connHosts.remove(host)
 				}
 			}()
 
+			protocol := "" // GIT_PROTOCOL sent by the client
 			for req := range in {
 				payload := cleanCommand(string(req.Payload))
 
 				switch req.Type {
 				case "env":
-					log.Printf("ssh: incoming env request: %s\n", payload)
-
-					args := strings.Split(strings.Replace(payload, "\x00", "", -1), "\v")
-					if len(args) != 2 {
-						log.Printf("env: invalid env arguments: '%#v'", args)
+					name, value, err := parseEnvRequest(req.Payload)
+					if err != nil {
+						s.gitConfig.logf("env: invalid env request: %v", err)
+						req.Reply(false, nil)
 						continue
 					}
+					s.gitConfig.logf("ssh: incoming env request: %s=%s\n", name, value)
 
-					args[0] = strings.TrimLeft(args[0], "\x04")
-					if len(args[0]) == 0 {
-						log.Printf("env: invalid key from payload: %s", payload)
+					// Like sshd with AcceptEnv GIT_PROTOCOL, the only
+					// variable git clients send.
+					if name != "GIT_PROTOCOL" {
+						req.Reply(false, nil)
 						continue
 					}
-
-					_, _, err := execCommandBytes("env", args[0]+"="+args[1])
-					if err != nil {
-						log.Printf("env: %v", err)
-						return
+					if s.gitConfig.SSHIgnoreGitProtocol {
+						s.gitConfig.logf("ssh: ignoring GIT_PROTOCOL %s with SSHIgnoreGitProtocol", value)
+						req.Reply(false, nil)
+						continue
 					}
+					protocol = value
+					req.Reply(true, nil)
 				case "exec":
-					log.Printf("ssh: incoming exec request: %s\n", payload)
+					s.gitConfig.logf("ssh: incoming exec request: %s\n", payload)
 
 					cmdName := strings.TrimLeft(payload, "'()")
-					log.Printf("ssh: payload '%v'", cmdName)
+					s.gitConfig.logf("ssh: payload '%v'", cmdName)
 
 					if strings.HasPrefix(cmdName, "\x00") {
 						cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
@@ -167,17 +287,60 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn
 
 					gitcmd, err := ParseGitCommand(cmdName)
 					if err != nil {
-						log.Println("ssh: error parsing command:", err)
+						s.gitConfig.logln("ssh: error parsing command:", err)
 						ch.Write([]byte("Invalid command.\r\n"))
 						return
 					}
 
-					if !repoExists(filepath.Join(s.gitConfig.Dir, gitcmd.Repo)) && s.gitConfig.AutoCreate == true {
-						err := initRepo(gitcmd.Repo, s.gitConfig)
-						if err != nil {
-							logError("repo-init", err)
-							return
-						}
+					home, err := s.gitConfig.resolveHome(gitcmd, sConn.User())
+					if err != nil {
+						s.gitConfig.logError("repo-home", err)
+						rejectCommand(ch, req, "repository not found")
+						return
+					}
+					gitcmd.Repo = home
+
+					if alias, target := s.gitConfig.resolveAlias(gitcmd.Repo); alias != nil {
+						s.gitConfig.logInfo("repo-alias", fmt.Sprintf("%s: serving %s", gitcmd.Repo, target))
+						gitcmd.Repo = target
+					}
+
+					repo, ok := s.gitConfig.resolveRepoName(gitcmd.Repo)
+					if !ok {
+						s.gitConfig.logError("repo-suffix", fmt.Errorf("%s does not match the .git suffix policy", gitcmd.Repo))
+						rejectCommand(ch, req, "repository not found")
+						return
+					}
+					gitcmd.Repo = repo
+
+					if !s.intercept(ch, req, sConn, keyID, gitcmd, &protocol) {
+						return
+					}
+
+					if err := s.authorize(sConn, keyID, gitcmd); err != nil {
+						s.gitConfig.logError("authorize", fmt.Errorf("%s: %s denied: %v", gitcmd.Repo, gitcmd.Command, err))
+						s.emit(sConn, Event{Type: AuthFailureEvent, Repo: gitcmd.Repo, KeyID: keyID, Error: err.Error()})
+						rejectCommand(ch, req, err.Error())
+						return
+					}
+
+					if s.locks.locked(gitcmd.Repo) {
+						s.gitConfig.logError("repo-lock", fmt.Errorf("%s is locked", gitcmd.Repo))
+						rejectCommand(ch, req, lockMessage(s.gitConfig))
+						return
+					}
+
+					if fault := s.faults.get(gitcmd.Repo); fault != nil && fault.delay() {
+						s.gitConfig.logError("fault", fmt.Errorf("%s: %s", gitcmd.Repo, fault.message()))
+						rejectCommand(ch, req, fault.body())
+						return
+					}
+
+					repoPath, err := s.generator.open(s.repoOps(), gitcmd.Repo, s.OnRepoMissing)
+					if err != nil {
+						s.gitConfig.logError("repo-init", fmt.Errorf("%s: %v", gitcmd.Repo, err))
+						rejectCommand(ch, req, ErrRepoNotFound.Error())
+						return
 					}
 
 					// Simulates servers that short-circuit the connection
@@ -190,93 +353,219 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn
 						break
 					}
 
-					cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
-					cmd.Dir = s.gitConfig.Dir
+					if serviceEvent(gitcmd.Command) == PushEvent {
+						if report := s.repoOps().pushReport(gitcmd.Repo); report != nil {
+							s.rejectPush(ch, req, sConn, gitcmd.Repo, repoPath, *report)
+							return
+						}
+					}
+
+					if m := s.gitConfig.memoryService(repoPath, gitcmd.Command); m != nil {
+						s.serveMemory(ctx, ch, req, sConn, keyID, gitcmd, m)
+						return
+					}
+
+					var refs map[string]string
+					if serviceEvent(gitcmd.Command) == PushEvent {
+						refs = snapshotRefs(s.gitConfig, repoPath)
+					}
+
+					cmd := exec.Command(gitcmd.Command, repoPath)
 					cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
+					cmd.Env = append(cmd.Env, serviceEnv(s.gitConfig, &s.compression, &s.packOptions, gitcmd.Repo)...)
+					cmd.Env = append(cmd.Env, s.protocolEnv(protocol)...)
+					cmd.Env = append(cmd.Env, s.gitConfig.agentEnv()...)
+					cmd.Env = append(cmd.Env, s.sessionEnv(sConn, gitcmd)...)
 					// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
+					setProcessGroup(cmd)
 
 					stdout, err := cmd.StdoutPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stdout pipe: %v", err)
+						s.gitConfig.logf("ssh: cant open stdout pipe: %v", err)
 						return
 					}
 
 					stderr, err := cmd.StderrPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stderr pipe: %v", err)
+						s.gitConfig.logf("ssh: cant open stderr pipe: %v", err)
 						return
 					}
 
 					input, err := cmd.StdinPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stdin pipe: %v", err)
+						s.gitConfig.logf("ssh: cant open stdin pipe: %v", err)
 						return
 					}
 
+					started := time.Now()
 					if err = cmd.Start(); err != nil {
-						log.Printf("ssh: start error: %v", err)
+						s.gitConfig.logf("ssh: start error: %v", err)
 						return
 					}
+					processDone := s.resources.process(cmd)
+					watch := s.watchProcess(ctx, sConn, gitcmd, cmd)
 
 					req.Reply(true, nil)
-					go io.Copy(input, ch)
-					io.Copy(ch, stdout)
-					io.Copy(ch.Stderr(), stderr)
-
-					if err = cmd.Wait(); err != nil {
-						log.Printf("ssh: command failed: %v", err)
+					t := &transfer{}
+					rec := s.transcript(gitcmd)
+					v2 := protocolVersion(s.gitProtocol(protocol)) == 2
+					go func() {
+						io.Copy(input, rec.stdin(t.reader(ch)))
+						// Protocol v2 serves commands until its input
+						// ends, like with sshd. Other commands are left to
+						// be killed with their connection.
+						if v2 {
+							input.Close()
+						}
+					}()
+					fault := s.sshFault()
+					drop := func() {
+						s.gitConfig.logError("fault", fmt.Errorf("%s: dropping %s after %d bytes", gitcmd.Repo, sConn.RemoteAddr(), fault.DropAfterBytes))
+						sConn.Close()
+					}
+					io.Copy(rec.stdout(t.writer(fault.dropWriter(fault.dataWriter(ch), drop))), stdout)
+					io.Copy(rec.stderr(t.writer(fault.dataWriter(ch.Stderr()))), stderr)
+
+					err = cmd.Wait()
+					rec.close()
+					watch.done()
+					processDone()
+					s.executed(sConn, gitcmd, started, err)
+					s.clientGone(ctx, sConn.RemoteAddr().String(), gitcmd, t)
+					if err == nil && serviceEvent(gitcmd.Command) == PushEvent {
+						updateServerInfo(s.gitConfig, repoPath)
+					}
+					if event := serviceEvent(gitcmd.Command); event != "" {
+						s.emit(sConn, Event{Type: event, Repo: gitcmd.Repo, KeyID: keyID, Error: errorString(err), Refs: pushedRefs(s.gitConfig, repoPath, refs)})
+					}
+					if err != nil {
+						s.gitConfig.logf("ssh: command failed: %v", err)
 						return
 					}
 
 					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
 					return
 				default:
-					ch.Write([]byte("Unsupported request type.\r\n"))
-					log.Println("ssh: unsupported req type:", req.Type)
-					return
+					if !s.rejectRequest(sConn, ch, req) {
+						return
+					}
 				}
 				if s.DisableConnReuse {
-					log.Println("dispose connection")
+					s.gitConfig.logln("dispose connection")
 					break
 				}
 			}
-		}(reqs)
+		}(ctx, reqs)
+	}
+}
+
+// rejectPush answers a push with the report instead of running receive-pack
+func (s *SSH) rejectPush(ch ssh.Channel, req *ssh.Request, conn ssh.ConnMetadata, repo string, repoPath string, report pushReport) {
+	advertisement, err := gitExec(s.gitConfig.GitPath, "", s.gitConfig.agentEnv(), "", "receive-pack", "--advertise-refs", repoPath)
+	if err != nil {
+		s.gitConfig.logError("receive-pack", err)
+		rejectCommand(ch, req, ErrRepoNotFound.Error())
+		return
+	}
+
+	req.Reply(true, nil)
+	if _, err := ch.Write(advertisement); err != nil {
+		s.gitConfig.logError("receive-pack", err)
+		return
+	}
+	if err := rejectPush(ch, ch, report); err != nil {
+		s.gitConfig.logError("receive-pack", err)
 	}
+
+	s.emit(conn, Event{Type: PushEvent, Repo: repo, Error: report.event})
+	ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
 }
 
-func (s *SSH) createServerKey() error {
+// sessionEnv returns the extra environment variables of the git command of a
+// session, from Config.SSHEnv and SessionEnvFunc.
+func (s *SSH) sessionEnv(conn ssh.ConnMetadata, gitcmd *GitCommand) []string {
+	env := []string{}
+	for _, name := range sortedKeys(s.gitConfig.SSHEnv) {
+		env = append(env, name+"="+s.gitConfig.SSHEnv[name])
+	}
+	if s.SessionEnvFunc != nil {
+		vars := s.SessionEnvFunc(conn, gitcmd)
+		for _, name := range sortedKeys(vars) {
+			env = append(env, name+"="+vars[name])
+		}
+	}
+	return env
+}
+
+// watchProcess kills a git command of the connection once it is closed, e.g.
+// when the client disconnects.
+func (s *SSH) watchProcess(ctx context.Context, conn ssh.ConnMetadata, gitcmd *GitCommand, cmd *exec.Cmd) *processWatch {
+	return watchProcess(ctx, cmd, func(cleanup time.Duration) {
+		s.gitConfig.logInfo("cancel", fmt.Sprintf("%s: %s canceled, exited after %s", gitcmd.Repo, gitcmd.Command, cleanup))
+		if s.OnCancel != nil {
+			s.OnCancel(Cancellation{Transport: SSHTransport, Repo: gitcmd.Repo, Command: gitcmd.Command, RemoteAddr: conn.RemoteAddr().String(), Cleanup: cleanup})
+		}
+	})
+}
+
+// emit sends an event for the connection to the journal and OnEvent callback
+func (s *SSH) emit(conn ssh.ConnMetadata, event Event) {
+	event.Transport = SSHTransport
+	event.User = conn.User()
+	event.RemoteAddr = conn.RemoteAddr().String()
+	s.events.emit(s.gitConfig, s.OnEvent, event)
+}
+
+// createServerKeys generates the missing host keys of the given types in
+// KeyDir, in parallel since RSA keys are slow to generate.
+func (s *SSH) createServerKeys(keyTypes []string) error {
+	if len(keyTypes) == 0 {
+		return nil
+	}
 	if err := os.MkdirAll(s.gitConfig.KeyDir, os.ModePerm); err != nil {
 		return err
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
+	errs := make([]error, len(keyTypes))
+	var wg sync.WaitGroup
+	for i, keyType := range keyTypes {
+		wg.Add(1)
+		go func(i int, keyType string) {
+			defer wg.Done()
+			errs[i] = s.createServerKey(keyType)
+		}(i, keyType)
 	}
+	wg.Wait()
 
-	privateKeyFile, err := os.Create(s.gitConfig.KeyPath())
-	if err != nil {
-		return err
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if err := os.Chmod(s.gitConfig.KeyPath(), 0600); err != nil {
-		return err
+func (s *SSH) createServerKey(keyType string) error {
+	generate := generateHostKey
+	if s.gitConfig.CacheHostKeys {
+		generate = generateCachedHostKey
 	}
-	defer privateKeyFile.Close()
+
+	privateKey, privateKeyPEM, err := generate(s.gitConfig.random(), keyType)
 	if err != nil {
 		return err
 	}
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
+
+	keyPath := s.gitConfig.HostKeyPath(keyType)
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(privateKeyPEM), 0600); err != nil {
 		return err
 	}
 
-	pubKeyPath := s.gitConfig.KeyPath() + ".pub"
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	pub, err := ssh.NewPublicKey(privateKey.Public())
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
+	return ioutil.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(pub), 0644)
 }
 
 func (s *SSH) setup() error {
@@ -287,78 +576,246 @@ func (s *SSH) setup() error {
 		config = &ssh.ServerConfig{}
 	}
 	config.ServerVersion = fmt.Sprintf("SSH-2.0-gitkit %s", Version)
+	if s.gitConfig.Rand != nil {
+		config.Rand = s.gitConfig.Rand
+	}
+
+	if len(s.gitConfig.SSHCiphers) > 0 {
+		config.Ciphers = s.gitConfig.SSHCiphers
+	}
+	if len(s.gitConfig.SSHKeyExchanges) > 0 {
+		config.KeyExchanges = s.gitConfig.SSHKeyExchanges
+	}
+	if len(s.gitConfig.SSHMACs) > 0 {
+		config.MACs = s.gitConfig.SSHMACs
+	}
+	if s.gitConfig.SSHMaxAuthTries != 0 {
+		config.MaxAuthTries = s.gitConfig.SSHMaxAuthTries
+	}
 
-	if s.gitConfig.KeyDir == "" {
+	if s.gitConfig.KeyDir == "" && len(s.gitConfig.hostKeyTypes()) > 0 {
 		return fmt.Errorf("key directory is not provided")
 	}
 
-	if !s.gitConfig.Auth {
+	if !s.gitConfig.Auth && len(s.AllowedUsers) > 0 && s.UserRejection == RejectUserAuth {
+		s.allowUsers(config)
+	} else if !s.gitConfig.Auth {
 		config.NoClientAuth = true
 	} else {
-		if s.PublicKeyLookupFunc == nil {
+		lookupFunc := s.lookupFunc()
+
+		userCAs, err := parseUserCAKeys(s.gitConfig.UserCAKeys)
+		if err != nil {
+			return err
+		}
+
+		if lookupFunc == nil && len(userCAs) == 0 && s.KeyboardInteractiveFunc == nil {
 			return fmt.Errorf("public key lookup func is not provided")
 		}
+		if s.KeyboardInteractiveFunc != nil {
+			config.KeyboardInteractiveCallback = s.keyboardInteractive
+		}
 
 		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			pkey, err := s.PublicKeyLookupFunc(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+			time.Sleep(s.sshFault().AuthLatency)
+			if err := s.checkUser(conn); err != nil {
+				return nil, err
+			}
+			if cert, ok := key.(*ssh.Certificate); ok && len(userCAs) > 0 {
+				return s.authenticateCert(conn, cert, userCAs)
+			}
+			if lookupFunc == nil && len(userCAs) == 0 {
+				err := fmt.Errorf("public keys are not accepted")
+				s.emit(conn, Event{Type: AuthFailureEvent, Error: err.Error()})
+				return nil, err
+			}
+			if lookupFunc == nil {
+				err := fmt.Errorf("only certificates are accepted")
+				s.emit(conn, Event{Type: AuthFailureEvent, Error: err.Error()})
+				return nil, err
+			}
+
+			pkey, err := lookupFunc(s.handshakes.context(conn.RemoteAddr().String()), newPublicKeyLookup(conn, key))
+			if err == nil && pkey == nil {
+				err = fmt.Errorf("auth handler did not return a key")
+			}
 			if err != nil {
+				s.emit(conn, Event{Type: AuthFailureEvent, Error: err.Error()})
 				return nil, err
 			}
 
-			if pkey == nil {
-				return nil, fmt.Errorf("auth handler did not return a key")
+			s.emit(conn, Event{Type: AuthSuccessEvent, KeyID: pkey.Id})
+			extensions := map[string]string{"key-id": pkey.Id, "key-fingerprint": ssh.FingerprintSHA256(key)}
+			if pkey.Name != "" {
+				extensions["key-name"] = pkey.Name
 			}
+			return &ssh.Permissions{Extensions: extensions}, nil
+		}
+	}
 
-			return &ssh.Permissions{Extensions: map[string]string{"key-id": pkey.Id}}, nil
+	s.hostKeys = nil
+	s.hostSigners = nil
+	s.hostSlots = nil
+	missing := []string{}
+	for _, keyType := range s.gitConfig.hostKeyTypes() {
+		if !fileExists(s.gitConfig.HostKeyPath(keyType)) {
+			missing = append(missing, keyType)
 		}
 	}
+	if err := s.createServerKeys(missing); err != nil {
+		return err
+	}
 
-	keypath := s.gitConfig.KeyPath()
-	if !fileExists(keypath) {
-		if err := s.createServerKey(); err != nil {
+	for _, keyType := range s.gitConfig.hostKeyTypes() {
+		keypath := s.gitConfig.HostKeyPath(keyType)
+		privateBytes, err := ioutil.ReadFile(keypath)
+		if err != nil {
 			return err
 		}
+
+		private, err := ssh.ParsePrivateKey(privateBytes)
+		if err != nil {
+			return err
+		}
+
+		s.addHostKey(config, private)
 	}
 
-	privateBytes, err := ioutil.ReadFile(keypath)
-	if err != nil {
-		return err
+	for _, keypath := range s.gitConfig.HostKeyFiles {
+		private, err := loadHostKey(keypath)
+		if err != nil {
+			return err
+		}
+		s.addHostKey(config, private)
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
+	if len(s.hostKeys) == 0 {
+		return fmt.Errorf("no host key is configured")
+	}
+	if err := s.addHostCertificates(config); err != nil {
+		return err
+	}
+	if err := s.applySSHFault(); err != nil {
 		return err
 	}
 
-	config.AddHostKey(private)
 	s.sshConfig = config
 	return nil
 }
 
 func (s *SSH) Listen(bind string) error {
-	if s.listener != nil {
+	if s.currentListener() != nil {
 		return ErrAlreadyStarted
 	}
 
-	if err := s.setup(); err != nil {
+	if err := s.prepare(); err != nil {
 		return err
 	}
 
-	if err := s.gitConfig.Setup(); err != nil {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
 		return err
 	}
 
-	var err error
-	s.listener, err = net.Listen("tcp", bind)
-	if err != nil {
+	s.setListener(listener)
+	return nil
+}
+
+// prepare sets up the ssh and git configs before listening
+func (s *SSH) prepare() error {
+	if err := s.setup(); err != nil {
 		return err
 	}
+	return s.gitConfig.Setup()
+}
 
-	return nil
+// setListener accepts connections from the socket through the accept gate
+// and tarpit of the server.
+func (s *SSH) setListener(socket net.Listener) {
+	s.listenerMu.Lock()
+	s.socket = socket
+	s.listener = &tarpitListener{Listener: s.accepts.Listener(socket), tarpit: &s.tarpit}
+	s.listenerMu.Unlock()
+	s.conns.open()
+
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	if s.ready == nil {
+		s.ready = make(chan struct{})
+	}
+	close(s.ready)
+}
+
+// unsetListener forgets the listener to close it or hand it off, returning
+// it, or nil if the server was not listening.
+func (s *SSH) unsetListener() net.Listener {
+	s.listenerMu.Lock()
+	listener := s.listener
+	s.listener = nil
+	s.socket = nil
+	s.listenerMu.Unlock()
+
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	s.ready = nil
+	return listener
+}
+
+// currentListener returns the listener the server accepts connections
+// from, or nil.
+func (s *SSH) currentListener() net.Listener {
+	s.listenerMu.RLock()
+	defer s.listenerMu.RUnlock()
+	return s.listener
+}
+
+// currentSocket returns the listener wrapped by the one of the server, or
+// nil.
+func (s *SSH) currentSocket() net.Listener {
+	s.listenerMu.RLock()
+	defer s.listenerMu.RUnlock()
+	return s.socket
+}
+
+// Ready returns a channel closed once the server listens, after which Addr
+// returns the address bound, e.g. by ListenAndServe(":0") in another
+// goroutine. It is renewed when the server stops.
+func (s *SSH) Ready() <-chan struct{} {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	if s.ready == nil {
+		s.ready = make(chan struct{})
+	}
+	return s.ready
+}
+
+// hostSet holds the hosts of the clients connected to a server with
+// SSH.DisableSimultaneousConns
+type hostSet struct {
+	mu    sync.Mutex
+	hosts map[string]bool
 }
 
-var mux sync.Mutex
-var connHosts []string
+// add records the host, unless already connected
+func (h *hostSet) add(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.hosts[host] {
+		return false
+	}
+	if h.hosts == nil {
+		h.hosts = map[string]bool{}
+	}
+	h.hosts[host] = true
+	return true
+}
+
+func (h *hostSet) remove(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.hosts, host)
+}
 
 func getHost(addr string) (string, error) {
 	if !strings.HasPrefix(addr, "ssh://") {
@@ -376,36 +833,38 @@ func getHost(addr string) (string, error) {
 }
 
 func (s *SSH) Serve() error {
-	if s.listener == nil {
+	listener := s.currentListener()
+	if listener == nil {
 		return ErrNoListener
 	}
 
+	// Connections waiting for a slot give up once the server stops
+	stopped := make(chan struct{})
+	defer close(stopped)
+
 	for {
-		// wait for connection or Stop()
-		conn, err := s.listener.Accept()
+		// wait for connection, Stop() or Handoff()
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
+		if s.gitConfig.SSHBandwidth > 0 {
+			conn = throttle(conn, s.gitConfig.SSHBandwidth)
+		}
+		if s.IdleTimeout > 0 {
+			remote := conn.RemoteAddr()
+			conn = closeIdle(conn, s.IdleTimeout, func() {
+				s.gitConfig.logf("ssh: closing %s, idle for %s", remote, s.IdleTimeout)
+			})
+		}
 
 		if s.DisableSimultaneousConns {
-			mux.Lock()
-			defer mux.Unlock()
 			host, _ := getHost(conn.RemoteAddr().String())
-			var matched bool
-			for _, connHost := range connHosts {
-				if host == connHost {
-					log.Println("can't have two multiple simultaneous connections from the same client")
-					err := conn.Close()
-					if err != nil {
-						log.Println("err while closing:", err)
-					}
-					matched = true
-					break
+			if !s.connHosts.add(host) {
+				s.gitConfig.logln("can't have two multiple simultaneous connections from the same client")
+				if err := conn.Close(); err != nil {
+					s.gitConfig.logln("err while closing:", err)
 				}
-			}
-			if !matched {
-				connHosts = append(connHosts, host)
-			} else {
 				continue
 			}
 		}
@@ -417,37 +876,115 @@ func (s *SSH) Serve() error {
 			}(conn)
 		}
 
+		if !s.conns.add(conn) {
+			continue
+		}
+		done := s.resources.goroutine()
 		go func() {
-			log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+			defer done()
+			defer s.conns.remove(conn)
+
+			connected := time.Now()
+			info := s.connected(conn)
+			defer s.disconnected(info, connected)
+
+			if max := s.gitConfig.SSHMaxConnections; max > 0 {
+				release := s.connLimit.acquire(max, s.gitConfig.SSHQueueConnections, stopped)
+				if release == nil && s.gitConfig.SSHQueueConnections {
+					conn.Close()
+					return
+				}
+				if release == nil {
+					s.gitConfig.logError("ssh", fmt.Errorf("%s: %v", conn.RemoteAddr(), ErrTooManyConnections))
+					if err := refuseConnection(conn, s.sshConfig.ServerVersion, ErrTooManyConnections.Error()); err != nil {
+						s.gitConfig.logf("ssh: error refusing connection: %v", err)
+					}
+					return
+				}
+				defer release()
+			}
+
+			s.gitConfig.logf("ssh: handshaking for %s", conn.RemoteAddr())
+			time.Sleep(s.sshFault().HandshakeLatency)
 
+			if s.HandshakeTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+			}
+			handshakeDone := s.handshakes.start(conn.RemoteAddr().String(), s.HandshakeTimeout)
 			sConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+			handshakeDone()
+			s.authenticated(info, sConn, err)
+			if err == nil && s.HandshakeTimeout > 0 {
+				conn.SetDeadline(time.Time{})
+			}
 			if err != nil {
 				if err == io.EOF {
-					log.Printf("ssh: handshaking was terminated: %v", err)
+					s.gitConfig.logf("ssh: handshaking was terminated: %v", err)
 				} else {
-					log.Printf("ssh: error on handshaking: %v", err)
+					s.gitConfig.logf("ssh: error on handshaking: %v", err)
+				}
+				if strings.Contains(err.Error(), ErrTooManyAuthTries.Error()) {
+					s.events.emit(s.gitConfig, s.OnEvent, Event{
+						Type:       AuthFailureEvent,
+						Transport:  SSHTransport,
+						RemoteAddr: conn.RemoteAddr().String(),
+						Error:      ErrTooManyAuthTries.Error(),
+					})
 				}
 				return
 			}
 
-			log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+			s.gitConfig.logf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
 
 			if s.gitConfig.Auth && s.gitConfig.GitUser != "" && sConn.User() != s.gitConfig.GitUser {
 				sConn.Close()
 				return
 			}
+			if s.UserRejection == RejectUserDisconnect && !s.userAllowed(sConn.User()) {
+				err := userError(sConn)
+				s.gitConfig.logError("auth", fmt.Errorf("%s: %v", sConn.RemoteAddr(), err))
+				s.emit(sConn, Event{Type: AuthFailureEvent, Error: err.Error()})
+				sConn.Close()
+				return
+			}
 
 			keyId := ""
 			if sConn.Permissions != nil {
 				keyId = sConn.Permissions.Extensions["key-id"]
 			}
 
+			// Git processes of the connection are killed once it is closed
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				sConn.Wait()
+				cancel()
+			}()
+
+			if s.ClientAliveInterval > 0 {
+				go s.keepAlive(sConn, ctx.Done())
+			}
 			go ssh.DiscardRequests(reqs)
-			go s.handleConnection(keyId, chans, sConn)
+			s.handleConnection(ctx, conn, keyId, chans, sConn)
 		}()
 	}
 }
 
+// ServeListener serves connections accepted from a listener provided by the
+// caller, e.g. one bound beforehand, wrapped, or in memory, instead of one
+// created by Listen. Address returns the address of the listener.
+func (s *SSH) ServeListener(listener net.Listener) error {
+	if s.currentListener() != nil {
+		return ErrAlreadyStarted
+	}
+	if err := s.prepare(); err != nil {
+		return err
+	}
+
+	s.setListener(listener)
+	return s.Serve()
+}
+
 func (s *SSH) ListenAndServe(bind string) error {
 	if err := s.Listen(bind); err != nil {
 		return err
@@ -455,24 +992,73 @@ func (s *SSH) ListenAndServe(bind string) error {
 	return s.Serve()
 }
 
+// ListenAndServeContext is like ListenAndServe, but shuts the server down
+// once ctx is done, e.g. the context of a test, draining the git sessions in
+// flight for up to ShutdownGracePeriod before closing their connections. It
+// then returns the error of ctx.
+func (s *SSH) ListenAndServeContext(ctx context.Context, bind string) error {
+	if err := s.Listen(bind); err != nil {
+		return err
+	}
+
+	served := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// ctx is already done, draining would not wait at all
+			drain, cancel := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
+			defer cancel()
+			s.Shutdown(drain)
+		case <-served:
+		}
+	}()
+
+	err := s.Serve()
+	close(served)
+	<-stopped
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // Stop stops the server if it has been started, otherwise it is a no-op.
+// Connections already accepted are left open, see Shutdown to wait for them.
+// With Config.StrictTeardown, it also reports leaked resources.
 func (s *SSH) Stop() error {
-	if s.listener == nil {
+	listener := s.unsetListener()
+	if listener == nil {
 		return nil
 	}
-	defer func() {
-		s.listener = nil
-	}()
 
-	return s.listener.Close()
+	if err := listener.Close(); err != nil {
+		return err
+	}
+
+	if s.gitConfig.StrictTeardown {
+		return s.CheckLeaks()
+	}
+	return nil
 }
 
 // Address returns the network address of the listener. This is in
 // particular useful when binding to :0 to get a free port assigned by
 // the OS.
 func (s *SSH) Address() string {
-	if s.listener != nil {
-		return s.listener.Addr().String()
+	if listener := s.currentListener(); listener != nil {
+		return listener.Addr().String()
 	}
 	return ""
 }
+
+// Addr returns the network address of the listener, nil if the server is not
+// listening. Wait for Ready before calling it when the server is started in
+// another goroutine.
+func (s *SSH) Addr() net.Addr {
+	if listener := s.currentListener(); listener != nil {
+		return listener.Addr()
+	}
+	return nil
+}
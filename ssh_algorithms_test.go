@@ -0,0 +1,100 @@
+package gitkit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHAlgorithms(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ssh-algorithms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:             dir,
+		KeyDir:          filepath.Join(dir, "keys"),
+		SSHCiphers:      []string{"aes128-ctr", "aes256-ctr"},
+		SSHKeyExchanges: []string{"ecdh-sha2-nistp256"},
+		SSHMACs:         []string{"hmac-sha2-256"},
+	})
+	addr := startSSH(t, server)
+	url := SSHCloneURL("git", addr, repo)
+
+	for _, tc := range []struct {
+		options string
+		success bool
+	}{
+		{"-o Ciphers=aes256-ctr -o KexAlgorithms=ecdh-sha2-nistp256 -o MACs=hmac-sha2-256", true},
+		{"-o Ciphers=chacha20-poly1305@openssh.com", false},
+		{"-o KexAlgorithms=curve25519-sha256", false},
+		{"-o MACs=hmac-sha2-512", false},
+	} {
+		out, err := runGitWithSSHOptions(dir, tc.options, "ls-remote", url)
+		if tc.success {
+			assert.NoError(t, err, tc.options+": "+out)
+		} else {
+			assert.Error(t, err, tc.options+": "+out)
+		}
+	}
+}
+
+func TestSSHMaxAuthTries(t *testing.T) {
+	dir, err := os.MkdirTemp("", "max-auth-tries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewUserStore()
+	if err := users.AddUser("alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	identities := "-o IdentitiesOnly=yes"
+	for i := 0; i < 4; i++ {
+		key, pub, err := createClientKey(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities += " -i " + key
+		if i == 3 {
+			if err := users.AddPublicKey("alice", pub); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Three unknown keys are offered before the one of alice
+	recorder := &EventRecorder{}
+	strict := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true, Users: users, SSHMaxAuthTries: 2})
+	strict.OnEvent = recorder.Record
+	addr := startSSH(t, strict)
+	out, err := runGitWithSSHOptions(dir, identities, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "2: too many authentication failures")
+	// The event is emitted once the handshake fails, possibly after git exited
+	assert.Eventually(t, func() bool {
+		events := recorder.Events()
+		return len(events) > 0 && events[len(events)-1].Error == ErrTooManyAuthTries.Error()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lenient := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true, Users: users})
+	addr = startSSH(t, lenient)
+	out, err = runGitWithSSHOptions(dir, identities, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+}
@@ -0,0 +1,207 @@
+package gitkit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHFault breaks SSH connections to the server, to test how clients report
+// SSH errors.
+type SSHFault struct {
+	// WrongHostKey presents host keys other than the ones of HostKeys and
+	// KnownHosts, of the same types, as if the server was impersonated.
+	// Host certificates are replaced by ones of another authority.
+	WrongHostKey bool `json:"wrong_host_key,omitempty"`
+	// HandshakeLatency delays new connections before the server sends its
+	// version, as if it was slow to accept them.
+	HandshakeLatency time.Duration `json:"handshake_latency,omitempty"`
+	// AuthLatency delays every authentication attempt of clients, before
+	// checking their key or answers.
+	AuthLatency time.Duration `json:"auth_latency,omitempty"`
+	// DataLatency delays every write of the output of git commands, such as
+	// pack data, as if the server was slow to stream it.
+	DataLatency time.Duration `json:"data_latency,omitempty"`
+	// DropAfterBytes closes connections once this many bytes of the output
+	// of a git command were sent, as if the network failed in the middle of
+	// a clone or fetch.
+	DropAfterBytes int64 `json:"drop_after_bytes,omitempty"`
+}
+
+// sshFault returns the SSH fault injected in the server, or no fault
+func (s *SSH) sshFault() SSHFault {
+	if fault := s.sshFaults.get(); fault != nil {
+		return *fault
+	}
+	return SSHFault{}
+}
+
+// dataWriter delays the writes to w by the DataLatency of the fault
+func (f SSHFault) dataWriter(w io.Writer) io.Writer {
+	if f.DataLatency <= 0 {
+		return w
+	}
+	return latencyWriter{w: w, latency: f.DataLatency}
+}
+
+type latencyWriter struct {
+	w       io.Writer
+	latency time.Duration
+}
+
+func (w latencyWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.latency)
+	return w.w.Write(p)
+}
+
+// errConnectionDropped fails the writes cut by DropAfterBytes
+var errConnectionDropped = errors.New("connection dropped by fault")
+
+// dropWriter calls drop once DropAfterBytes of the fault were written to w,
+// failing the writes past it.
+func (f SSHFault) dropWriter(w io.Writer, drop func()) io.Writer {
+	if f.DropAfterBytes <= 0 {
+		return w
+	}
+	return &dropWriter{w: w, remaining: f.DropAfterBytes, drop: drop}
+}
+
+type dropWriter struct {
+	w         io.Writer
+	remaining int64
+	drop      func()
+}
+
+func (w *dropWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) < w.remaining {
+		n, err := w.w.Write(p)
+		w.remaining -= int64(n)
+		return n, err
+	}
+	if w.remaining == 0 {
+		return 0, errConnectionDropped
+	}
+
+	n, err := w.w.Write(p[:w.remaining])
+	w.remaining = 0
+	w.drop()
+	if err == nil {
+		err = errConnectionDropped
+	}
+	return n, err
+}
+
+// sshFaultSet holds the SSH fault injected in a server
+type sshFaultSet struct {
+	mu    sync.RWMutex
+	fault *SSHFault
+}
+
+func (f *sshFaultSet) set(fault *SSHFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = fault
+}
+
+func (f *sshFaultSet) get() *SSHFault {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.fault
+}
+
+// InjectSSHFault breaks new connections with the fault, until ClearSSHFault
+// is called.
+func (s *SSH) InjectSSHFault(fault SSHFault) error {
+	s.sshFaults.set(&fault)
+
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+	return s.applySSHFault()
+}
+
+// ClearSSHFault removes a fault injected with InjectSSHFault.
+func (s *SSH) ClearSSHFault() {
+	s.sshFaults.set(nil)
+
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+	s.applySSHFault()
+}
+
+// applySSHFault swaps the host keys presented to clients for impostor ones
+// while the fault asks for it. The host lock must be held.
+func (s *SSH) applySSHFault() error {
+	fault := s.sshFaults.get()
+	for _, slot := range s.hostSlots {
+		if fault == nil || !fault.WrongHostKey {
+			slot.setImpostor(nil)
+			continue
+		}
+		if slot.impostor() != nil {
+			continue
+		}
+		impostor, err := impostorSigner(slot.real())
+		if err != nil {
+			return err
+		}
+		slot.setImpostor(impostor)
+	}
+	return nil
+}
+
+// impostorSigner returns a new key of the same type as a host key, and for
+// host certificates a certificate of the same principals from another
+// authority.
+func impostorSigner(signer ssh.Signer) (ssh.Signer, error) {
+	cert, ok := signer.PublicKey().(*ssh.Certificate)
+	if !ok {
+		return impostorKey(signer.PublicKey())
+	}
+
+	key, err := impostorKey(cert.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := NewSSHCertificateAuthority()
+	if err != nil {
+		return nil, err
+	}
+	impostor, err := ca.SignHostKey(key.PublicKey(), cert.ValidPrincipals...)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(impostor, key)
+}
+
+func impostorKey(pub ssh.PublicKey) (ssh.Signer, error) {
+	cryptoKey, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported host key type %s", pub.Type())
+	}
+
+	var private crypto.Signer
+	var err error
+	switch key := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		private, err = rsa.GenerateKey(rand.Reader, key.N.BitLen())
+	case *ecdsa.PublicKey:
+		private, err = ecdsa.GenerateKey(key.Curve, rand.Reader)
+	case ed25519.PublicKey:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported host key type %s", pub.Type())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromSigner(private)
+}
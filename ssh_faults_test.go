@@ -0,0 +1,156 @@
+package gitkit
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrongHostKey(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ssh-faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewSSHCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:          dir,
+		KeyDir:       filepath.Join(dir, "keys"),
+		HostKeyTypes: []string{RSAHostKey, Ed25519HostKey},
+		HostCA:       ca,
+	})
+	addr := startSSH(t, server)
+	url := SSHCloneURL("git", addr, repo)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	caKnownHosts := filepath.Join(dir, "ca_known_hosts")
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(server.KnownHosts()), 0644))
+	assert.NoError(t, os.WriteFile(caKnownHosts, []byte(server.CertAuthorityKnownHosts()), 0644))
+	advertised := server.KnownHosts()
+
+	assert.NoError(t, server.InjectSSHFault(SSHFault{WrongHostKey: true}))
+	out, err := lsRemoteWithKnownHosts(knownHosts, url)
+	assert.Error(t, err)
+	assert.Contains(t, out, "REMOTE HOST IDENTIFICATION HAS CHANGED")
+	out, err = lsRemoteWithKnownHosts(caKnownHosts, url)
+	assert.Error(t, err, out)
+	assert.Equal(t, advertised, server.KnownHosts())
+
+	state, err := server.State()
+	assert.NoError(t, err)
+	assert.Equal(t, &SSHFault{WrongHostKey: true}, state.SSHFault)
+
+	server.ClearSSHFault()
+	out, err = lsRemoteWithKnownHosts(knownHosts, url)
+	assert.NoError(t, err, out)
+	out, err = lsRemoteWithKnownHosts(caKnownHosts, url)
+	assert.NoError(t, err, out)
+
+	// Faults injected before listening apply once the server starts
+	other := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	assert.NoError(t, other.InjectSSHFault(SSHFault{WrongHostKey: true}))
+	otherAddr := startSSH(t, other)
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(other.KnownHosts()), 0644))
+	out, err = lsRemoteWithKnownHosts(knownHosts, SSHCloneURL("git", otherAddr, repo))
+	assert.Error(t, err, out)
+}
+
+func TestSSHLatency(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+	server.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+		return &PublicKey{Id: "client"}, nil
+	}
+	addr := startSSH(t, server)
+	url := SSHCloneURL("git", addr, repo)
+
+	latency := 500 * time.Millisecond
+	banner := func() time.Duration {
+		started := time.Now()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(line, "SSH-2.0-"), line)
+		return time.Since(started)
+	}
+	lsRemote := func() time.Duration {
+		started := time.Now()
+		out, err := runGitWithKey(dir, key, "ls-remote", url)
+		assert.NoError(t, err, out)
+		assert.Contains(t, out, "refs/heads/master")
+		return time.Since(started)
+	}
+
+	assert.NoError(t, server.InjectSSHFault(SSHFault{HandshakeLatency: latency}))
+	assert.True(t, banner() >= latency)
+
+	for _, fault := range []SSHFault{{AuthLatency: latency}, {DataLatency: latency}} {
+		assert.NoError(t, server.InjectSSHFault(fault))
+		assert.True(t, banner() < latency)
+		assert.True(t, lsRemote() >= latency)
+	}
+}
+
+func TestDropAfterBytes(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	if _, err := server.Commit(repo, "master", Commit{Files: map[string]string{"random": hex.EncodeToString(content)}}); err != nil {
+		t.Fatal(err)
+	}
+	gone := make(chan ClientGone, 10)
+	server.OnClientGone = func(c ClientGone) { gone <- c }
+	url := SSHCloneURL("git", startSSH(t, server), repo)
+
+	assert.NoError(t, server.InjectSSHFault(SSHFault{DropAfterBytes: 4096}))
+	out, err := runGit(dir, "clone", url, filepath.Join(t.TempDir(), "clone"))
+	assert.Error(t, err, out)
+	select {
+	case c := <-gone:
+		assert.Equal(t, int64(4096), c.Sent)
+	case <-time.After(10 * time.Second):
+		t.Fatal("dropped connection not reported")
+	}
+
+	server.ClearSSHFault()
+	out, err = runGit(dir, "clone", url, filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+}
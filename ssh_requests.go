@@ -0,0 +1,95 @@
+package gitkit
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RejectedRequest is a channel or session request of an SSH client that the
+// server does not serve, such as a shell, a pty or port forwarding.
+type RejectedRequest struct {
+	Type       string // Channel or request type, e.g. direct-tcpip, shell or pty-req
+	User       string
+	RemoteAddr string
+	Message    string // Message the client was sent, if any
+}
+
+// defaultRejectMessages are the messages of rejected requests by type,
+// unless set in SSH.RejectMessages. Other requests are refused without a
+// message, e.g. pty-req, clients going on without a pty.
+var defaultRejectMessages = map[string]string{
+	"direct-tcpip": "port forwarding is disabled",
+}
+
+// rejectMessage returns the message rejecting requests of the type
+func (s *SSH) rejectMessage(requestType string) string {
+	if message, ok := s.RejectMessages[requestType]; ok {
+		return message
+	}
+	return defaultRejectMessages[requestType]
+}
+
+// greeting returns the message printed for shell requests: the one of
+// SSH.GreetingFunc or SSH.RejectMessages, or else a greeting of the user like
+// Git hosting services print, which tools probing SSH connectivity look for.
+func (s *SSH) greeting(conn *ssh.ServerConn) string {
+	user := conn.User()
+	if conn.Permissions != nil && conn.Permissions.Extensions["key-name"] != "" {
+		user = conn.Permissions.Extensions["key-name"]
+	}
+
+	if s.GreetingFunc != nil {
+		return s.GreetingFunc(conn, user)
+	}
+	if message, ok := s.RejectMessages["shell"]; ok {
+		return message
+	}
+	return fmt.Sprintf("Hi %s! You've successfully authenticated, but gitkit does not provide shell access.", user)
+}
+
+// rejected reports a rejected request to SSH.OnRejectedRequest
+func (s *SSH) rejected(conn ssh.ConnMetadata, requestType string, message string) {
+	s.gitConfig.logf("ssh: rejected %s request from %s", requestType, conn.RemoteAddr())
+	if s.OnRejectedRequest != nil {
+		s.OnRejectedRequest(RejectedRequest{Type: requestType, User: conn.User(), RemoteAddr: conn.RemoteAddr().String(), Message: message})
+	}
+}
+
+// rejectChannel refuses a channel other than a session, e.g. the
+// direct-tcpip channels of local port forwarding.
+func (s *SSH) rejectChannel(conn ssh.ConnMetadata, newChan ssh.NewChannel) {
+	message := s.rejectMessage(newChan.ChannelType())
+	reason := ssh.Prohibited
+	if message == "" {
+		reason, message = ssh.UnknownChannelType, "unknown channel type"
+	}
+	newChan.Reject(reason, message)
+	s.rejected(conn, newChan.ChannelType(), message)
+}
+
+// rejectRequest refuses a session request other than exec and env. Shells
+// are accepted to print a greeting on stderr and exit with status 1, like
+// Git hosting services do, ending the session. Other requests are answered
+// with a failure, which clients report themselves, the session going on.
+// It tells whether the session goes on.
+func (s *SSH) rejectRequest(conn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request) bool {
+	if req.Type == "shell" {
+		message := s.greeting(conn)
+		s.rejected(conn, req.Type, message)
+		req.Reply(true, nil)
+		if message != "" {
+			ch.Stderr().Write([]byte(message + "\r\n"))
+		}
+		ch.SendRequest("exit-status", false, []byte{0, 0, 0, 1})
+		return false
+	}
+
+	message := s.rejectMessage(req.Type)
+	s.rejected(conn, req.Type, message)
+	req.Reply(false, nil)
+	if message != "" {
+		ch.Stderr().Write([]byte(message + "\r\n"))
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHRejectedRequests(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	rejected := []RejectedRequest{}
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	server.RejectMessages = map[string]string{"shell": "Hi! You've successfully authenticated, but shells are not provided."}
+	server.OnRejectedRequest = func(r RejectedRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		rejected = append(rejected, r)
+	}
+	addr := startSSH(t, server)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Sessions go on without a pty
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, session.RequestPty("xterm", 80, 40, ssh.TerminalModes{}))
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, session.Start("git-upload-pack '"+repo+"'"))
+	line, err := readPktLine(stdout)
+	assert.NoError(t, err)
+	assert.Contains(t, string(line), "HEAD")
+	session.Close()
+
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+	assert.NoError(t, session.Shell())
+	err = session.Wait()
+	if exit, ok := err.(*ssh.ExitError); assert.True(t, ok, err) {
+		assert.Equal(t, 1, exit.ExitStatus())
+	}
+	assert.Equal(t, "Hi! You've successfully authenticated, but shells are not provided.\r\n", stderr.String())
+
+	_, err = client.Dial("tcp", "127.0.0.1:80")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "port forwarding is disabled")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	types := []string{}
+	for _, r := range rejected {
+		types = append(types, r.Type)
+		assert.Equal(t, "git", r.User)
+	}
+	assert.Equal(t, []string{"pty-req", "shell", "direct-tcpip"}, types)
+}
+
+func TestSSHGreeting(t *testing.T) {
+	dir := t.TempDir()
+	// Servers are configured before starting, their callbacks being read
+	// by the goroutines serving connections
+	start := func(greetingFunc func(ssh.ConnMetadata, string) string) string {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true})
+		server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+			return &PublicKey{Id: "1", Name: "octocat"}, nil
+		}
+		server.GreetingFunc = greetingFunc
+		return startSSH(t, server)
+	}
+	addr := start(nil)
+	custom := start(func(conn ssh.ConnMetadata, user string) string {
+		return "Welcome " + user + " (" + conn.User() + ")"
+	})
+
+	key, block, err := generateHostKey(rand.Reader, ECDSAHostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shell := func(addr string) (string, error) {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stderr := &bytes.Buffer{}
+		session.Stderr = stderr
+		if err := session.Shell(); err != nil {
+			t.Fatal(err)
+		}
+		err = session.Wait()
+		return stderr.String(), err
+	}
+
+	greeting, err := shell(addr)
+	assert.Error(t, err)
+	assert.Equal(t, "Hi octocat! You've successfully authenticated, but gitkit does not provide shell access.\r\n", greeting)
+
+	greeting, _ = shell(custom)
+	assert.Equal(t, "Welcome octocat (git)\r\n", greeting)
+
+	// OpenSSH probes without a pty
+	identity := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := os.WriteFile(identity, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	out, err := exec.Command("ssh", "-T", "-p", port, "-i", identity, "-o", "IdentitiesOnly=yes", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes", "git@"+host).CombinedOutput()
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "Hi octocat! You've successfully authenticated")
+}
@@ -17,8 +17,12 @@ limitations under the License.
 package gitkit
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"os/exec"
@@ -28,6 +32,7 @@ import (
 	"time"
 
 	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestListenAndServe(t *testing.T) {
@@ -87,7 +92,7 @@ func TestListenAndServe(t *testing.T) {
 			defer server.Stop()
 
 			go func() {
-				server.ListenAndServe(":2222")
+				server.ListenAndServe("127.0.0.1:0")
 			}()
 
 			cloned, err := os.MkdirTemp("", "cloned")
@@ -96,14 +101,13 @@ func TestListenAndServe(t *testing.T) {
 			}
 			defer os.RemoveAll(cloned)
 
-			if err = retry(10, time.Second*1, func() error {
-				_, err := net.Dial("tcp", "localhost:2222")
-				return err
-			}); err != nil {
-				t.Fatal(err)
+			select {
+			case <-server.Ready():
+			case <-time.After(10 * time.Second):
+				t.Fatal("server not listening")
 			}
 
-			cmd := exec.Command("git", "clone", "ssh://git@localhost:2222/"+filepath.Base(repo))
+			cmd := exec.Command("git", "clone", SSHCloneURL("git", server.Addr().String(), filepath.Base(repo)))
 			cmd.Dir = cloned
 			cmd.Env = []string{"GIT_SSH_COMMAND=ssh -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
 
@@ -163,18 +167,183 @@ func createRepo() (string, error) {
 	return repo, nil
 }
 
-func retry(attempts int, sleep time.Duration, f func() error) error {
-	if err := f(); err != nil {
-		if attempts--; attempts > 0 {
-			// Add some randomness to prevent creating a Thundering Herd
-			jitter := time.Duration(rand.Int63n(int64(sleep)))
-			sleep = sleep + jitter/2
+// createBareRepo creates a bare clone of a fresh test repository inside dir
+// and returns its name.
+func createBareRepo(dir string) (string, error) {
+	repo, err := createRepo()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(repo)
+
+	name := filepath.Base(repo) + ".git"
+	out, err := exec.Command("git", "clone", "--bare", repo, filepath.Join(dir, name)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to create bare repo: %s", out)
+	}
+	return name, nil
+}
+
+// startSSH starts the server on a random local port and returns its address
+func startSSH(t *testing.T, server *SSH) string {
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() {
+		server.Stop()
+	})
 
-			time.Sleep(sleep)
-			return retry(attempts, 2*sleep, f)
-		}
-		return err
+	return server.Address()
+}
+
+// runGit runs a git command in dir, connecting to ssh servers without
+// host key verification.
+func runGit(dir string, args ...string) (string, error) {
+	return runGitWithKey(dir, "", args...)
+}
+
+// runGitWithKey runs a git command in dir like runGit, authenticating to ssh
+// servers with the given private key file.
+func runGitWithKey(dir string, key string, args ...string) (string, error) {
+	sshOpts := ""
+	if key != "" {
+		sshOpts = "-o IdentitiesOnly=yes -i " + key
 	}
+	return runGitWithSSHOptions(dir, sshOpts, args...)
+}
+
+// runGitWithSSHOptions runs a git command in dir like runGit, passing extra
+// options to ssh.
+func runGitWithSSHOptions(dir string, sshOpts string, args ...string) (string, error) {
+	sshCmd := "ssh -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -o BatchMode=yes -o LogLevel=ERROR " + sshOpts
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND="+sshCmd)
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// createClientKey writes a new ECDSA private key to dir and returns its path
+// along with the public key in authorized_keys format.
+func createClientKey(dir string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := filepath.Join(dir, "id_ecdsa")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return "", "", err
+	}
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	return path, string(ssh.MarshalAuthorizedKey(pub)), nil
+}
+
+func TestSSHRepoPaths(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "ssh-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "org"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name, err := createBareRepo(filepath.Join(dir, "org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := "org/" + name
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+	host, port, _ := net.SplitHostPort(addr)
+
+	urls := []string{
+		SSHCloneURL("git", addr, repo),
+		SSHCloneURL("git", addr, "~/"+repo),
+		SSHCloneURL("git", addr, strings.TrimSuffix(repo, ".git")),
+		"git@" + host + ":" + repo,
+		"git@" + host + ":/" + repo,
+		"git@" + host + ":~/" + strings.TrimSuffix(repo, ".git"),
+	}
+
+	for i, u := range urls {
+		out, err := runGitWithSSHOptions(dir, "-p "+port, "clone", u, fmt.Sprintf("clone-%d", i))
+		g.Expect(err).ToNot(HaveOccurred(), "%s: %s", u, out)
+	}
+}
+
+func TestSSHSessionEnv(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "ssh-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "env")
+	hook := "#!/bin/sh\necho \"$GITKIT_STATIC $GITKIT_SESSION\" > " + output + "\n"
+	if err := os.WriteFile(filepath.Join(dir, repo, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:    dir,
+		KeyDir: filepath.Join(dir, "keys"),
+		SSHEnv: map[string]string{"GITKIT_STATIC": "static", "GITKIT_SESSION": "overridden"},
+	})
+	server.SessionEnvFunc = func(conn ssh.ConnMetadata, cmd *GitCommand) map[string]string {
+		return map[string]string{"GITKIT_SESSION": conn.User() + " " + cmd.Command}
+	}
+	url := SSHCloneURL("git", startSSH(t, server), repo)
+
+	clone := filepath.Join(dir, "clone")
+	out, err := runGit(dir, "clone", url, clone)
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	commitFile(t, clone, "file")
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	g.Expect(err).ToNot(HaveOccurred(), out)
+
+	env, err := os.ReadFile(output)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(env)).To(Equal("static git git-receive-pack\n"))
+}
+
+func TestSSHReady(t *testing.T) {
+	g := NewWithT(t)
+	dir := t.TempDir()
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	ready := server.Ready()
+	g.Expect(server.Addr()).To(BeNil())
+
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe("127.0.0.1:0") }()
+	g.Eventually(ready, 10*time.Second).Should(BeClosed())
+	g.Expect(server.Addr().String()).To(Equal(server.Address()))
+	g.Expect(server.Addr().(*net.TCPAddr).Port).ToNot(BeZero())
 
-	return nil
+	g.Expect(server.Stop()).To(Succeed())
+	g.Eventually(served).Should(Receive())
+	g.Expect(server.Addr()).To(BeNil())
+	g.Consistently(server.Ready(), 100*time.Millisecond).ShouldNot(BeClosed())
 }
@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// State describes a running server: where to reach it, the repositories it
+// serves and the faults injected in it. It serializes to JSON, so that test
+// orchestration can write it to disk for other processes, e.g. test pods, to
+// find and check the server. Repository keys are names without leading or
+// trailing slashes, the empty name standing for every repository.
+type State struct {
+	Transport string `json:"transport"`
+	// Address is the listen address of SSH servers. HTTP servers do not
+	// listen themselves and leave it empty, for callers to set.
+	Address  string         `json:"address,omitempty"`
+	HostKeys []StateHostKey `json:"host_keys,omitempty"`
+	Repos    []string       `json:"repos"`
+
+	Faults         map[string]Fault         `json:"faults,omitempty"`
+	LockedRepos    []string                 `json:"locked_repos,omitempty"`
+	StorageErrors  map[string]string        `json:"storage_errors,omitempty"`
+	PushRejections map[string]PushRejection `json:"push_rejections,omitempty"`
+	TLSFault       *TLSFault                `json:"tls_fault,omitempty"`
+	SSHFault       *SSHFault                `json:"ssh_fault,omitempty"`
+	ClockSkew      time.Duration            `json:"clock_skew,omitempty"`
+}
+
+// StateHostKey is a host key of an SSH server
+type StateHostKey struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"` // SHA256 fingerprint, as printed by ssh-keygen -l
+	// KnownHostsKey is the key in the "<type> <base64>" format of
+	// known_hosts files
+	KnownHostsKey string `json:"known_hosts_key"`
+}
+
+// State returns the description of the server, with its TLS fault
+func (s *Server) State() (*State, error) {
+	state, err := s.state(HTTPTransport)
+	if err != nil {
+		return nil, err
+	}
+	state.TLSFault = s.tlsFaults.get()
+	return state, nil
+}
+
+// State returns the description of the server, with its listen address, host
+// keys and SSH fault
+func (s *SSH) State() (*State, error) {
+	state, err := s.state(SSHTransport)
+	if err != nil {
+		return nil, err
+	}
+	state.Address = s.Address()
+	state.SSHFault = s.sshFaults.get()
+	for _, key := range s.HostKeys() {
+		state.HostKeys = append(state.HostKeys, StateHostKey{
+			Type:          key.Type(),
+			Fingerprint:   ssh.FingerprintSHA256(key),
+			KnownHostsKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		})
+	}
+	return state, nil
+}
+
+// state describes the repositories and controls of the server
+func (c *controls) state(transport string) (*State, error) {
+	repos, err := c.config.repoStore().List()
+	if err != nil {
+		return nil, err
+	}
+
+	return &State{
+		Transport:      transport,
+		Repos:          repos,
+		Faults:         c.faults.all(),
+		LockedRepos:    c.locks.all(),
+		StorageErrors:  c.storageErrors.all(),
+		PushRejections: c.rejections.all(),
+		ClockSkew:      c.clock.getSkew(),
+	}, nil
+}
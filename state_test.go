@@ -0,0 +1,93 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerState(t *testing.T) {
+	dir, err := os.MkdirTemp("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir, ClockSkew: time.Hour})
+	service.InjectFault("", Fault{StatusCode: 500, Message: "down"})
+	service.Lock("/" + repo)
+	service.InjectStorageError(repo, ErrDiskFull)
+	service.RejectPushes(repo, PushRejection{Message: "no"})
+	service.InjectTLSFault(TLSFault{WrongHost: true})
+
+	state, err := service.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// State survives a round trip through JSON
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded State
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+
+	assert.Equal(t, State{
+		Transport:      HTTPTransport,
+		Repos:          []string{repo},
+		Faults:         map[string]Fault{"": {StatusCode: 500, Message: "down"}},
+		LockedRepos:    []string{repo},
+		StorageErrors:  map[string]string{repo: ErrDiskFull.Error()},
+		PushRejections: map[string]PushRejection{repo: {Message: "no"}},
+		TLSFault:       &TLSFault{WrongHost: true},
+		ClockSkew:      time.Hour,
+	}, decoded)
+
+	service.ClearFault("")
+	state, err = service.State()
+	assert.NoError(t, err)
+	assert.Empty(t, state.Faults)
+}
+
+func TestSSHState(t *testing.T) {
+	dir, err := os.MkdirTemp("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+
+	state, err := server.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, SSHTransport, state.Transport)
+	assert.Equal(t, addr, state.Address)
+	assert.Equal(t, []string{repo}, state.Repos)
+	if assert.Len(t, state.HostKeys, 1) {
+		pub, err := os.ReadFile(server.gitConfig.KeyPath() + ".pub")
+		assert.NoError(t, err)
+		assert.Equal(t, strings.TrimSpace(string(pub)), state.HostKeys[0].KnownHostsKey)
+		assert.Equal(t, "ssh-ed25519", state.HostKeys[0].Type)
+		assert.True(t, strings.HasPrefix(state.HostKeys[0].Fingerprint, "SHA256:"))
+	}
+}
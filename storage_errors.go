@@ -0,0 +1,108 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Errors for InjectStorageError, simulating broken repository storage
+var (
+	ErrDiskFull         error = syscall.ENOSPC
+	ErrPermissionDenied error = os.ErrPermission
+)
+
+// storageErrors holds the storage errors injected per repository. The empty
+// repository name applies to all repositories.
+type storageErrors struct {
+	mu   sync.RWMutex
+	errs map[string]error
+}
+
+func (s *storageErrors) set(repo string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.errs == nil {
+		s.errs = map[string]error{}
+	}
+	if err == nil {
+		delete(s.errs, lockKey(repo))
+	} else {
+		s.errs[lockKey(repo)] = err
+	}
+}
+
+func (s *storageErrors) get(repo string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err, ok := s.errs[lockKey(repo)]; ok {
+		return err
+	}
+	return s.errs[""]
+}
+
+// all returns the messages of the storage errors by repository
+func (s *storageErrors) all() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	errs := map[string]string{}
+	for repo, err := range s.errs {
+		errs[repo] = err.Error()
+	}
+	return errs
+}
+
+// InjectStorageError makes all writes to the repository fail with err, e.g.
+// ErrDiskFull or ErrPermissionDenied, until ClearStorageError is called.
+// Pushes are rejected the way receive-pack rejects them when it cannot write
+// objects, automatic creation and server-side changes return the error. An
+// empty repository name applies to every repository.
+func (c *controls) InjectStorageError(repo string, err error) {
+	c.storageErrors.set(repo, err)
+}
+
+// ClearStorageError removes an error injected with InjectStorageError.
+func (c *controls) ClearStorageError(repo string) {
+	c.storageErrors.set(repo, nil)
+}
+
+// faultyStore fails repository creation and deletion with injected storage
+// errors.
+type faultyStore struct {
+	RepoStore
+	errs *storageErrors
+}
+
+func (f *faultyStore) Create(name string) (string, error) {
+	if err := f.errs.get(name); err != nil {
+		return "", err
+	}
+	return f.RepoStore.Create(name)
+}
+
+func (f *faultyStore) Delete(name string) error {
+	if err := f.errs.get(name); err != nil {
+		return err
+	}
+	return f.RepoStore.Delete(name)
+}
+
+// storageErrorMessage returns what git prints when it fails to write objects
+func storageErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return "error: unable to create temporary file: No space left on device"
+	case errors.Is(err, os.ErrPermission):
+		return "error: insufficient permission for adding an object to repository database ./objects"
+	}
+	return fmt.Sprintf("error: unable to write object: %v", err)
+}
@@ -0,0 +1,97 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStorageErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "storage-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir, AutoCreate: true})
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	clone := filepath.Join(dir, "clone")
+	out, err := runGit(dir, "clone", server.URL+"/"+repo, clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+
+	service.InjectStorageError(repo, ErrDiskFull)
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.Error(t, err)
+	assert.Contains(t, out, "No space left on device")
+	assert.Contains(t, out, "unpacker error")
+
+	_, err = service.Commit(repo, "master", Commit{Files: map[string]string{"file": "content"}})
+	assert.Equal(t, ErrDiskFull, err)
+
+	service.InjectStorageError("", ErrPermissionDenied)
+	out, err = runGit(clone, "clone", server.URL+"/new.git", filepath.Join(t.TempDir(), "new"))
+	assert.Error(t, err, out)
+	assert.NoDirExists(t, filepath.Join(dir, "new.git"))
+
+	service.ClearStorageError(repo)
+	service.ClearStorageError("")
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.NoError(t, err, out)
+}
+
+func TestSSHStorageErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "storage-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+
+	clone := filepath.Join(dir, "clone")
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+
+	server.InjectStorageError(repo, ErrPermissionDenied)
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.Error(t, err)
+	assert.Contains(t, out, "insufficient permission")
+	assert.Contains(t, out, "unpacker error")
+
+	server.ClearStorageError(repo)
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.NoError(t, err, out)
+}
+
+// commitFile commits a new file in the working tree at dir
+func commitFile(t *testing.T, dir string, name string) {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", name},
+		{"-c", "user.email=test@gitkit.com", "-c", "user.name=test-user", "commit", "-m", name},
+	} {
+		if out, err := runGit(dir, args...); err != nil {
+			t.Fatal(err, out)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package gitkit
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrRepoNotFound is returned by stores for repositories that do not exist
+var ErrRepoNotFound = errors.New("repository not found")
+
+// RepoStore abstracts where the servers keep repositories. Repositories are
+// served by the git binary, so stores hand out the path of a bare git
+// directory: backends keeping repositories elsewhere materialize them on disk
+// in Open and Create, except for MemoryStore, served with go-git.
+type RepoStore interface {
+	// Open returns the git directory of an existing repository, or
+	// ErrRepoNotFound.
+	Open(name string) (string, error)
+	// Create initializes an empty bare repository and returns its git
+	// directory. Creating an existing repository leaves it untouched.
+	Create(name string) (string, error)
+	// Delete removes a repository
+	Delete(name string) error
+	// List returns the sorted names of all repositories
+	List() ([]string, error)
+	// Resolve returns the stored name of a requested repository, adding or
+	// removing the ".git" suffix if only the other form exists. Unknown
+	// names are returned unchanged.
+	Resolve(name string) string
+}
+
+// FSStore keeps bare repositories in a directory. It is the default store,
+// rooted at Config.Dir.
+type FSStore struct {
+	Dir     string
+	GitPath string       // Path to git binary, defaults to "git"
+	Hooks   *HookScripts // Hooks installed into created repositories
+	// DefaultBranch is the branch HEAD of created repositories points to,
+	// defaulting to the init.defaultBranch of git.
+	DefaultBranch string
+}
+
+func (f *FSStore) Open(name string) (string, error) {
+	dir := f.path(name)
+	if !isRepo(dir) {
+		return "", ErrRepoNotFound
+	}
+	return dir, nil
+}
+
+func (f *FSStore) Create(name string) (string, error) {
+	gitPath := f.GitPath
+	if gitPath == "" {
+		gitPath = "git"
+	}
+
+	// Leave existing repositories untouched, hooks included
+	dir := f.path(name)
+	if isRepo(dir) {
+		return dir, nil
+	}
+
+	args := []string{"init", "--bare", dir}
+	if f.DefaultBranch != "" {
+		args = append([]string{"-c", "init.defaultBranch=" + f.DefaultBranch}, args...)
+	}
+	if err := exec.Command(gitPath, args...).Run(); err != nil {
+		return "", err
+	}
+
+	if f.Hooks != nil {
+		if err := f.Hooks.setupInDir(dir); err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+func (f *FSStore) Delete(name string) error {
+	dir := f.path(name)
+	if !isRepo(dir) {
+		return ErrRepoNotFound
+	}
+	return os.RemoveAll(dir)
+}
+
+func (f *FSStore) List() ([]string, error) {
+	names := []string{}
+
+	err := filepath.Walk(f.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || !isRepo(p) {
+			return nil
+		}
+
+		name, err := filepath.Rel(f.Dir, p)
+		if err != nil {
+			return err
+		}
+		if name != "." {
+			names = append(names, filepath.ToSlash(name))
+		}
+		// Do not list the internals of repositories
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FSStore) Resolve(name string) string {
+	if isRepo(f.path(name)) {
+		return name
+	}
+
+	alt := name + ".git"
+	if strings.HasSuffix(name, ".git") {
+		alt = strings.TrimSuffix(name, ".git")
+	}
+	if alt != "" && isRepo(f.path(alt)) {
+		return alt
+	}
+	return name
+}
+
+func (f *FSStore) path(name string) string {
+	return filepath.Join(f.Dir, filepath.FromSlash(name))
+}
+
+// isRepo reports whether dir is a bare repository or a working tree
+func isRepo(dir string) bool {
+	return repoExists(dir) || repoExists(filepath.Join(dir, ".git"))
+}
+
+// repoStore returns the configured store, or the filesystem store rooted at
+// the repository directory.
+func (c *Config) repoStore() RepoStore {
+	var store RepoStore = c.Store
+	if store == nil {
+		fs := &FSStore{Dir: c.Dir, GitPath: c.GitPath, DefaultBranch: c.DefaultBranch}
+		if c.AutoHooks {
+			fs.Hooks = c.Hooks
+		}
+		store = fs
+	}
+
+	if c.adopted != nil {
+		return &adoptedStore{RepoStore: store, adopted: c.adopted}
+	}
+	return store
+}
@@ -0,0 +1,105 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FSStore{Dir: dir}
+
+	_, err = store.Open("repo.git")
+	assert.Equal(t, ErrRepoNotFound, err)
+
+	for _, name := range []string{"repo.git", "org/team/app", "org/lib.git"} {
+		p, err := store.Create(name)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, name), p)
+	}
+
+	p, err := store.Open("org/team/app")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "org/team/app"), p)
+
+	names, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"org/lib.git", "org/team/app", "repo.git"}, names)
+
+	assert.Equal(t, "repo.git", store.Resolve("repo"))
+	assert.Equal(t, "org/team/app", store.Resolve("org/team/app.git"))
+	assert.Equal(t, "missing", store.Resolve("missing"))
+
+	assert.NoError(t, store.Delete("repo.git"))
+	assert.Equal(t, ErrRepoNotFound, store.Delete("repo.git"))
+
+	names, err = store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"org/lib.git", "org/team/app"}, names)
+
+	// Creating existing repositories keeps their hooks
+	store.Hooks = &HookScripts{PreReceive: "#!/bin/sh\nexit 0\n"}
+	p, err = store.Create("hooked.git")
+	assert.NoError(t, err)
+	hook := filepath.Join(p, "hooks", "pre-receive")
+	assert.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0755))
+	_, err = store.Create("hooked.git")
+	assert.NoError(t, err)
+	content, err := os.ReadFile(hook)
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\nexit 1\n", string(content))
+}
+
+// countingStore records the repositories created through it
+type countingStore struct {
+	FSStore
+	created []string
+}
+
+func (c *countingStore) Create(name string) (string, error) {
+	c.created = append(c.created, name)
+	return c.FSStore.Create(name)
+}
+
+func TestCustomStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "custom-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storeDir := filepath.Join(dir, "store")
+	if err := os.Mkdir(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := createBareRepo(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &countingStore{FSStore: FSStore{Dir: storeDir}}
+	config := Config{Dir: filepath.Join(dir, "unused"), KeyDir: filepath.Join(dir, "keys"), AutoCreate: true, Store: store}
+
+	server := httptest.NewServer(New(config))
+	defer server.Close()
+	addr := startSSH(t, NewSSH(config))
+
+	out, err := runGit(dir, "clone", HTTPCloneURL(server.Listener.Addr().String(), repo), "http")
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "clone", SSHCloneURL("git", addr, repo), "ssh")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(filepath.Join(dir, "ssh"), "push", SSHCloneURL("git", addr, "created.git"), "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+	assert.Equal(t, []string{"created.git"}, store.created)
+	assert.True(t, repoExists(filepath.Join(storeDir, "created.git")))
+}
@@ -0,0 +1,56 @@
+package gitkit
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SuffixPolicy controls whether repositories are addressable with and/or
+// without the ".git" suffix, regardless of how they are named on disk.
+type SuffixPolicy string
+
+const (
+	// SuffixOptional accepts names with and without the suffix (default)
+	SuffixOptional SuffixPolicy = ""
+	// SuffixExact only accepts the name used on disk
+	SuffixExact SuffixPolicy = "exact"
+	// SuffixRequired only accepts names ending with ".git"
+	SuffixRequired SuffixPolicy = "required"
+	// SuffixForbidden only accepts names without ".git"
+	SuffixForbidden SuffixPolicy = "forbidden"
+	// SuffixRedirect redirects HTTP clients to the name used on disk. SSH
+	// clients are served like with SuffixOptional.
+	SuffixRedirect SuffixPolicy = "redirect"
+)
+
+// resolveRepoName applies the suffix policy to a requested repository name.
+// It returns the name to serve, and false if the policy rejects the request.
+func (c *Config) resolveRepoName(name string) (string, bool) {
+	switch c.GitSuffix {
+	case SuffixExact:
+		return name, true
+	case SuffixRequired:
+		if !strings.HasSuffix(name, ".git") {
+			return name, false
+		}
+	case SuffixForbidden:
+		if strings.HasSuffix(name, ".git") {
+			return name, false
+		}
+	}
+	return c.repoStore().Resolve(name), true
+}
+
+// redirectRepo redirects a request addressing repoURLPath to the same
+// location in the named repository.
+func redirectRepo(w http.ResponseWriter, r *http.Request, repoURLPath string, name string) {
+	u := *r.URL
+	u.Path = path.Join("/", name) + strings.TrimPrefix(r.URL.Path, repoURLPath)
+
+	status := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u.String(), status)
+}
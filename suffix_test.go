@@ -0,0 +1,113 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuffixPolicy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "suffix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// One repository named with the suffix on disk, one without
+	withSuffix, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutSuffix, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, withoutSuffix), filepath.Join(dir, strings.TrimSuffix(withoutSuffix, ".git"))); err != nil {
+		t.Fatal(err)
+	}
+	withoutSuffix = strings.TrimSuffix(withoutSuffix, ".git")
+
+	requests := []string{
+		withSuffix,
+		strings.TrimSuffix(withSuffix, ".git"),
+		withoutSuffix,
+		withoutSuffix + ".git",
+	}
+
+	examples := map[SuffixPolicy][]int{
+		SuffixOptional:  {200, 200, 200, 200},
+		SuffixExact:     {200, 404, 200, 404},
+		SuffixRequired:  {200, 404, 404, 200},
+		SuffixForbidden: {404, 200, 200, 404},
+		SuffixRedirect:  {200, 301, 200, 301},
+	}
+
+	for policy, expected := range examples {
+		server := httptest.NewServer(New(Config{Dir: dir, GitSuffix: policy}))
+		client := server.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		for i, repo := range requests {
+			resp, err := client.Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, expected[i], resp.StatusCode, "policy %q, repo %s", policy, repo)
+
+			if resp.StatusCode == 301 {
+				location := resp.Header.Get("Location")
+				assert.NotEqual(t, repo, strings.Split(strings.TrimPrefix(location, "/"), "/")[0])
+				assert.True(t, strings.HasSuffix(location, "/info/refs?service=git-upload-pack"), location)
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestSuffixPolicyRedirectClone(t *testing.T) {
+	dir, err := os.MkdirTemp("", "suffix-redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(New(Config{Dir: dir, GitSuffix: SuffixRedirect}))
+	defer server.Close()
+
+	out, err := runGit(dir, "clone", HTTPCloneURL(server.Listener.Addr().String(), strings.TrimSuffix(repo, ".git")), "clone")
+	assert.NoError(t, err, out)
+}
+
+func TestSuffixPolicySSH(t *testing.T) {
+	dir, err := os.MkdirTemp("", "suffix-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), GitSuffix: SuffixRequired})
+	addr := startSSH(t, server)
+
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), "with")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(dir, "clone", SSHCloneURL("git", addr, strings.TrimSuffix(repo, ".git")), "without")
+	assert.Error(t, err)
+	assert.Contains(t, out, "remote error: repository not found")
+}
@@ -0,0 +1,91 @@
+package gitkit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tarpit holds the delay between bytes written to tarpitted connections,
+// disabled when zero.
+type tarpit struct {
+	interval int64
+}
+
+func (t *tarpit) get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.interval))
+}
+
+func (t *tarpit) set(interval time.Duration) {
+	atomic.StoreInt64(&t.interval, int64(interval))
+}
+
+// Tarpit wraps a listener so that accepted connections write one byte per
+// interval. The server never fails, it only responds extremely slowly, to
+// test client-side deadlines on whole operations rather than connect or read
+// timeouts, which every single byte satisfies. Use it with httptest:
+//
+//	ts := httptest.NewUnstartedServer(service)
+//	ts.Listener = gitkit.Tarpit(ts.Listener, 100*time.Millisecond)
+//	ts.Start()
+func Tarpit(listener net.Listener, interval time.Duration) net.Listener {
+	t := &tarpit{}
+	t.set(interval)
+	return &tarpitListener{Listener: listener, tarpit: t}
+}
+
+type tarpitListener struct {
+	net.Listener
+	tarpit *tarpit
+}
+
+func (l *tarpitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tarpitConn{Conn: conn, tarpit: l.tarpit, closed: make(chan struct{})}, nil
+}
+
+type tarpitConn struct {
+	net.Conn
+	tarpit *tarpit
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Write sends p one byte at a time while the tarpit is enabled, so that
+// enabling or disabling it applies to open connections too.
+func (c *tarpitConn) Write(p []byte) (int, error) {
+	for i := range p {
+		interval := c.tarpit.get()
+		if interval <= 0 {
+			n, err := c.Conn.Write(p[i:])
+			return i + n, err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return i, net.ErrClosed
+		}
+		if _, err := c.Conn.Write(p[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *tarpitConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// SetTarpit makes connections, including open ones, write one byte per
+// interval, see Tarpit. A zero interval disables the tarpit.
+func (s *SSH) SetTarpit(interval time.Duration) {
+	s.tarpit.set(interval)
+}
@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPTarpit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tarpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(New(Config{Dir: dir}))
+	server.Listener = Tarpit(server.Listener, 2*time.Millisecond)
+	server.Start()
+	defer server.Close()
+
+	url := server.URL + "/" + repo + "/info/refs?service=git-upload-pack"
+
+	// Every byte arrives well within a read timeout, the whole response does not
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	_, err = client.Get(url)
+	assert.Error(t, err)
+
+	start := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), "refs/heads/master")
+	assert.Greater(t, int64(time.Since(start)), int64(len(body))*int64(2*time.Millisecond))
+}
+
+func TestSSHTarpit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tarpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+	addr := startSSH(t, server)
+	server.SetTarpit(20 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	version, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(version, "SSH-2.0-"))
+	assert.Greater(t, int64(time.Since(start)), int64(len(version)-1)*int64(20*time.Millisecond))
+
+	server.SetTarpit(0)
+	out, err := runGit(dir, "clone", SSHCloneURL("git", addr, repo), filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+}
@@ -0,0 +1,98 @@
+package gitkit
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// CleanupPolicy controls when temporary files are removed
+type CleanupPolicy string
+
+const (
+	// CleanupAlways removes temporary files once they are used (default)
+	CleanupAlways CleanupPolicy = ""
+	// CleanupOnSuccess keeps the temporary files of failed operations, for
+	// debugging
+	CleanupOnSuccess CleanupPolicy = "on-success"
+	// CleanupNever keeps all temporary files
+	CleanupNever CleanupPolicy = "never"
+)
+
+// TempStats reports the temporary files used by a server
+type TempStats struct {
+	Active  int   // Files and directories in use
+	Kept    int   // Files and directories kept by the cleanup policy
+	Created int   // Files and directories created since the server started
+	Bytes   int64 // Disk usage of active and kept files
+}
+
+// TempStats reports the temporary files created by server-side operations
+func (c *controls) TempStats() TempStats {
+	return c.resources.tempStats()
+}
+
+func (r *resourceTracker) tempStats() TempStats {
+	r.mu.Lock()
+	paths := make([]string, 0, len(r.tempFiles)+len(r.keptFiles))
+	for path := range r.tempFiles {
+		paths = append(paths, path)
+	}
+	for path := range r.keptFiles {
+		paths = append(paths, path)
+	}
+	stats := TempStats{Active: len(r.tempFiles), Kept: len(r.keptFiles), Created: r.created}
+	r.mu.Unlock()
+
+	for _, path := range paths {
+		stats.Bytes += diskUsage(path)
+	}
+	return stats
+}
+
+func diskUsage(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// tempDir returns the directory temporary files are created in, creating it
+// if needed.
+func (c *Config) tempDir() (string, error) {
+	if c.TempDir == "" {
+		return os.TempDir(), nil
+	}
+	return c.TempDir, os.MkdirAll(c.TempDir, 0755)
+}
+
+// mkdirTemp creates a temporary directory tracked by the server
+func (o repoOps) mkdirTemp(pattern string) (string, func(*error), error) {
+	base, err := o.config.tempDir()
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp(base, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, o.resources.tempFile(dir, o.config.TempCleanup), nil
+}
+
+// createTemp creates a temporary file tracked by the server
+func (o repoOps) createTemp(pattern string) (*os.File, func(*error), error) {
+	base, err := o.config.tempDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.CreateTemp(base, pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, o.resources.tempFile(f.Name(), o.config.TempCleanup), nil
+}
@@ -0,0 +1,60 @@
+package gitkit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempCleanup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "temp-cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := Commit{Files: map[string]string{"file": "content"}}
+	bad := Commit{Files: map[string]string{"../outside": "content"}}
+
+	examples := []struct {
+		policy  CleanupPolicy
+		kept    int
+		entries int
+	}{
+		{CleanupAlways, 0, 0},
+		{CleanupOnSuccess, 1, 1},
+		{CleanupNever, 2, 2},
+	}
+
+	for _, example := range examples {
+		tempDir := filepath.Join(dir, "tmp-"+string(example.policy))
+		server := New(Config{Dir: dir, TempDir: tempDir, TempCleanup: example.policy})
+
+		_, err := server.Commit(repo, "master", good)
+		assert.NoError(t, err)
+		_, err = server.Commit(repo, "master", bad)
+		assert.Error(t, err)
+
+		stats := server.TempStats()
+		assert.Equal(t, 0, stats.Active, example.policy)
+		assert.Equal(t, 2, stats.Created, example.policy)
+		assert.Equal(t, example.kept, stats.Kept, example.policy)
+		if example.kept > 0 {
+			assert.NotZero(t, stats.Bytes, example.policy)
+		}
+
+		entries, err := os.ReadDir(tempDir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, example.entries, example.policy)
+
+		// Kept files are not leaks
+		assert.NoError(t, server.CheckLeaks())
+	}
+}
@@ -0,0 +1,58 @@
+package gitkit
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn closes a connection once no data was read or written through it
+// for a timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32 // Set once the timeout fired, accessed atomically
+}
+
+func closeIdle(conn net.Conn, timeout time.Duration, onIdle func()) net.Conn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		// Reads and writes racing with the timeout may have restarted the
+		// timer: only the first firing closes the connection
+		if !atomic.CompareAndSwapInt32(&c.fired, 0, 1) {
+			return
+		}
+		onIdle()
+		conn.Close()
+	})
+	return c
+}
+
+// touch restarts the timeout, unless it already fired
+func (c *idleConn) touch() {
+	if atomic.LoadInt32(&c.fired) == 0 {
+		c.timer.Reset(c.timeout)
+	}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,138 @@
+package gitkit
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHTimeouts(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	// closedWithin returns whether wait returned within the duration
+	closedWithin := func(d time.Duration, wait func()) bool {
+		closed := make(chan struct{})
+		go func() {
+			wait()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+			return true
+		case <-time.After(d):
+			return false
+		}
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+		server.HandshakeTimeout = 200 * time.Millisecond
+		addr := startSSH(t, server)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Never answering the version of the server
+		assert.True(t, closedWithin(5*time.Second, func() {
+			io.Copy(io.Discard, conn)
+		}))
+
+		// Completed handshakes are not limited
+		client, err := ssh.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		assert.False(t, closedWithin(500*time.Millisecond, func() { client.Wait() }))
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+		server.IdleTimeout = 300 * time.Millisecond
+		addr := startSSH(t, server)
+
+		// Active connections stay open
+		client, err := ssh.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		for i := 0; i < 5; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.True(t, closedWithin(5*time.Second, func() { client.Wait() }))
+
+		out, err := runGit(dir, "ls-remote", SSHCloneURL("git", addr, repo))
+		assert.NoError(t, err, out)
+	})
+
+	t.Run("session", func(t *testing.T) {
+		server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys")})
+		server.MaxSessionDuration = 300 * time.Millisecond
+		addr := startSSH(t, server)
+
+		client, err := ssh.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		// upload-pack waiting for the wants of the client
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdin.Close()
+		if err := session.Start("git-upload-pack '" + repo + "'"); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, closedWithin(5*time.Second, func() { session.Wait() }))
+
+		// The connection remains usable for new sessions
+		session, err = client.NewSession()
+		if assert.NoError(t, err) {
+			session.Close()
+		}
+	})
+}
+
+// chattyConn keeps reading data after it was closed, like a connection with
+// buffered input racing with its idle timeout.
+type chattyConn struct {
+	net.Conn
+}
+
+func (chattyConn) Read(p []byte) (int, error) { return len(p), nil }
+
+func (chattyConn) Close() error { return nil }
+
+func TestCloseIdleFiresOnce(t *testing.T) {
+	var idle int32
+	conn := closeIdle(chattyConn{}, 10*time.Millisecond, func() { atomic.AddInt32(&idle, 1) })
+
+	time.Sleep(30 * time.Millisecond)
+	conn.Read(make([]byte, 1))
+	time.Sleep(30 * time.Millisecond)
+	conn.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&idle))
+}
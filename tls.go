@@ -0,0 +1,214 @@
+package gitkit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errTLSFault is returned to the TLS stack by handshakes failed by a TLSFault
+var errTLSFault = errors.New("tls fault injected")
+
+// TLSFault breaks TLS handshakes with the server, to test how clients report
+// TLS errors. Faults only apply to servers using the config of TLSConfig.
+type TLSFault struct {
+	// AbortHandshake closes connections after reading the ClientHello
+	AbortHandshake bool `json:"abort_handshake,omitempty"`
+	// ExpiredCertificate presents a certificate that expired yesterday
+	ExpiredCertificate bool `json:"expired_certificate,omitempty"`
+	// WrongHost presents a certificate valid for another host name and IP
+	// address
+	WrongHost bool `json:"wrong_host,omitempty"`
+	// RejectClientCertificate requires a client certificate, then rejects
+	// it as if it was not trusted
+	RejectClientCertificate bool `json:"reject_client_certificate,omitempty"`
+	// LegacyVersions only negotiates TLS 1.0 and 1.1
+	LegacyVersions bool `json:"legacy_versions,omitempty"`
+}
+
+// tlsFaultSet holds the TLS fault injected in a server
+type tlsFaultSet struct {
+	mu    sync.RWMutex
+	fault *TLSFault
+}
+
+func (f *tlsFaultSet) set(fault *TLSFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = fault
+}
+
+func (f *tlsFaultSet) get() *TLSFault {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.fault
+}
+
+// tlsCertificates holds the certificates served per SNI server name, and
+// whether OCSP responses are stapled to them.
+type tlsCertificates struct {
+	mu     sync.RWMutex
+	certs  map[string]tls.Certificate
+	staple bool
+}
+
+func (c *tlsCertificates) set(serverName string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.certs == nil {
+		c.certs = map[string]tls.Certificate{}
+	}
+
+	if cert == nil {
+		delete(c.certs, strings.ToLower(serverName))
+	} else {
+		c.certs[strings.ToLower(serverName)] = *cert
+	}
+}
+
+func (c *tlsCertificates) get(serverName string) *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if cert, ok := c.certs[strings.ToLower(serverName)]; ok {
+		return &cert
+	}
+	return nil
+}
+
+func (c *tlsCertificates) setStapling(staple bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.staple = staple
+}
+
+func (c *tlsCertificates) stapling() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.staple
+}
+
+// TLSConfig returns a TLS config serving a certificate issued by the
+// authority for the hosts, or the one set with SetSNICertificate for the
+// server name the client asks for, with the TLS faults injected in the
+// server. Certificates are checked against the server clock. Use it with
+// httptest:
+//
+//	ts := httptest.NewUnstartedServer(service)
+//	ts.TLS, err = service.TLSConfig(ca, "127.0.0.1", "localhost")
+//	ts.StartTLS()
+func (s *Server) TLSConfig(ca *CertificateAuthority, hosts ...string) (*tls.Config, error) {
+	cert, err := ca.Issue(CertificateOptions{Hosts: hosts})
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, Time: s.Now}
+	if s.config.MutualTLS {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = ca.CertPool()
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		fault := s.tlsFaults.get()
+		if fault == nil {
+			fault = &TLSFault{}
+		}
+		if fault.AbortHandshake {
+			hello.Conn.Close()
+			return nil, errTLSFault
+		}
+
+		// The certificate is picked here rather than with GetCertificate,
+		// which is not called for clients sending no server name.
+		var err error
+		served := cert
+		if sni := s.tlsCerts.get(hello.ServerName); sni != nil {
+			served = *sni
+		}
+
+		if fault.ExpiredCertificate || fault.WrongHost {
+			options := CertificateOptions{Hosts: hosts}
+			if fault.ExpiredCertificate {
+				options.NotBefore = s.Now().Add(-48 * time.Hour)
+				options.NotAfter = s.Now().Add(-24 * time.Hour)
+			}
+			if fault.WrongHost {
+				options.Hosts = []string{"wrong-host.invalid", "192.0.2.1"}
+			}
+			if served, err = ca.Issue(options); err != nil {
+				return nil, err
+			}
+		}
+
+		if s.tlsCerts.stapling() {
+			if served.OCSPStaple, err = staple(ca, served); err != nil {
+				return nil, err
+			}
+		}
+
+		handshake := config.Clone()
+		handshake.GetConfigForClient = nil
+		handshake.Certificates = []tls.Certificate{served}
+
+		if fault.RejectClientCertificate {
+			handshake.ClientAuth = tls.RequireAnyClientCert
+			handshake.VerifyPeerCertificate = func([][]byte, [][]*x509.Certificate) error {
+				return errTLSFault
+			}
+		}
+
+		if fault.LegacyVersions {
+			handshake.MinVersion = tls.VersionTLS10
+			handshake.MaxVersion = tls.VersionTLS11
+		}
+		return handshake, nil
+	}
+	return config, nil
+}
+
+// staple returns an OCSP response with the current status of the certificate
+func staple(ca *CertificateAuthority, cert tls.Certificate) ([]byte, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return ca.OCSPResponse(leaf)
+}
+
+// InjectTLSFault makes TLS handshakes fail with the fault, until
+// ClearTLSFault is called.
+func (s *Server) InjectTLSFault(fault TLSFault) {
+	s.tlsFaults.set(&fault)
+}
+
+// ClearTLSFault removes a fault injected with InjectTLSFault.
+func (s *Server) ClearTLSFault() {
+	s.tlsFaults.set(nil)
+}
+
+// SetSNICertificate serves the certificate to clients asking for the server
+// name with SNI, instead of the one of TLSConfig. Issue it for another host
+// to test that clients reject certificates not matching the name they dial.
+func (s *Server) SetSNICertificate(serverName string, cert tls.Certificate) {
+	s.tlsCerts.set(serverName, &cert)
+}
+
+// RemoveSNICertificate removes a certificate set with SetSNICertificate.
+func (s *Server) RemoveSNICertificate(serverName string) {
+	s.tlsCerts.set(serverName, nil)
+}
+
+// StapleOCSP staples an OCSP response from the authority of TLSConfig to the
+// certificates served to clients requesting it, with the status of the
+// certificate at the time of the handshake: revoked once revoked with
+// CertificateAuthority.Revoke, good otherwise.
+func (s *Server) StapleOCSP(enabled bool) {
+	s.tlsCerts.setStapling(enabled)
+}
@@ -0,0 +1,305 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestTLSFaults(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ca.Issue(CertificateOptions{CommonName: "client", Client: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir})
+	server := httptest.NewUnstartedServer(service)
+	if server.TLS, err = service.TLSConfig(ca, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.CertificatePEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_SSL_CAINFO", caFile)
+	out, err := runGit(dir, "clone", server.URL+"/"+repo, filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+
+	get := func(certs ...tls.Certificate) error {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.CertPool(), Certificates: certs}}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL + "/" + repo + "/info/refs?service=git-upload-pack")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assert.NoError(t, get())
+
+	for _, tt := range []struct {
+		fault TLSFault
+		err   string
+	}{
+		{TLSFault{AbortHandshake: true}, "EOF"},
+		{TLSFault{ExpiredCertificate: true}, "certificate has expired"},
+		{TLSFault{WrongHost: true}, "certificate is valid for 192.0.2.1, not 127.0.0.1"},
+		{TLSFault{RejectClientCertificate: true}, "bad certificate"},
+		{TLSFault{LegacyVersions: true}, "protocol version"},
+	} {
+		service.InjectTLSFault(tt.fault)
+		err := get(client)
+		if assert.Error(t, err, "%+v", tt.fault) {
+			assert.Contains(t, err.Error(), tt.err)
+		}
+	}
+
+	service.ClearTLSFault()
+	assert.NoError(t, get())
+}
+
+func TestSNICertificates(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := New(Config{Dir: dir})
+	server := httptest.NewUnstartedServer(service)
+	if server.TLS, err = service.TLSConfig(ca, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	for name, hosts := range map[string][]string{
+		"git.example.com":    {"git.example.com"},
+		"mirror.example.com": {"git.example.com"}, // Mismatched
+	} {
+		cert, err := ca.Issue(CertificateOptions{Hosts: hosts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.SetSNICertificate(name, cert)
+	}
+
+	// Every host name resolves to the server
+	get := func(host string) error {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.CertPool()},
+			DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		}
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + host + "/" + repo + "/info/refs?service=git-upload-pack")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, get("git.example.com"))
+	assert.NoError(t, get("GIT.example.com"))
+	assert.NoError(t, get("127.0.0.1"))
+
+	err = get("mirror.example.com")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate is valid for git.example.com, not mirror.example.com")
+	}
+
+	// Other names get the default certificate
+	err = get("other.example.com")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate is not valid for any names")
+	}
+
+	service.RemoveSNICertificate("git.example.com")
+	assert.Error(t, get("git.example.com"))
+}
+
+func TestOCSPAndCRL(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := httptest.NewServer(ca)
+	defer responder.Close()
+	ca.OCSPServer = responder.URL
+	ca.CRLDistributionPoint = responder.URL + "/ca.crl"
+
+	service := New(Config{Dir: t.TempDir()})
+	service.StapleOCSP(true)
+	server := httptest.NewUnstartedServer(service)
+	if server.TLS, err = service.TLSConfig(ca, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	// handshake returns the server certificate and the status stapled to it
+	handshake := func() (*x509.Certificate, int) {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: ca.CertPool()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		state := conn.ConnectionState()
+		resp, err := ocsp.ParseResponse(state.OCSPResponse, ca.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.PeerCertificates[0], resp.Status
+	}
+
+	cert, status := handshake()
+	assert.Equal(t, ocsp.Good, status)
+	assert.Equal(t, []string{responder.URL}, cert.OCSPServer)
+	assert.Equal(t, []string{responder.URL + "/ca.crl"}, cert.CRLDistributionPoints)
+
+	ca.Revoke(cert)
+	_, status = handshake()
+	assert.Equal(t, ocsp.Revoked, status)
+
+	// The responder agrees with the staple
+	req, err := ocsp.CreateRequest(cert, ca.Certificate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(responder.URL, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ocspResp, err := ocsp.ParseResponseForCert(body, cert, ca.Certificate)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ocsp.Revoked, ocspResp.Status)
+	}
+
+	resp, err = http.Get(cert.CRLDistributionPoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "application/pkix-crl", resp.Header.Get("Content-Type"))
+	crl, err := x509.ParseCRL(body)
+	if assert.NoError(t, err) {
+		assert.NoError(t, ca.Certificate.CheckCRLSignature(crl))
+		if assert.Len(t, crl.TBSCertList.RevokedCertificates, 1) {
+			assert.Equal(t, cert.SerialNumber, crl.TBSCertList.RevokedCertificates[0].SerialNumber)
+		}
+	}
+
+	// Without stapling, clients get no OCSP response
+	service.StapleOCSP(false)
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: ca.CertPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, conn.ConnectionState().OCSPResponse)
+	conn.Close()
+}
+
+func TestHostnameCases(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := New(Config{Dir: dir})
+	server := httptest.NewUnstartedServer(service)
+	if server.TLS, err = service.TLSConfig(ca, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.CertificatePEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_SSL_CAINFO", caFile)
+
+	cases, err := service.HostnameCases(ca, server.Listener.Addr().String(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"mismatched-host":  "certificate is valid for other.gitkit.test, not mismatch.gitkit.test",
+		"ip-sans-only":     "certificate is not valid for any names",
+		"common-name-only": "certificate relies on legacy Common Name field",
+		"wildcard-depth":   "certificate is valid for *.gitkit.test, not deep.wildcard.gitkit.test",
+	}
+	names := []string{}
+	for _, c := range cases {
+		names = append(names, c.Name)
+
+		// OpenSSL falls back to the common name of certificates without SANs
+		out, err := runGit(dir, "-c", "http.curloptResolve="+c.Resolve, "ls-remote", c.URL)
+		if c.Name != "common-name-only" {
+			assert.Error(t, err, c.Name)
+			assert.Contains(t, out, "does not match target host name", c.Name)
+		}
+
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.CertPool()},
+			DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		}
+		_, err = (&http.Client{Transport: transport}).Get(c.URL + "/info/refs?service=git-upload-pack")
+		if assert.Error(t, err, c.Name) {
+			assert.Contains(t, err.Error(), expected[c.Name])
+		}
+	}
+	assert.Equal(t, []string{"mismatched-host", "ip-sans-only", "common-name-only", "wildcard-depth"}, names)
+
+	// The address of the server is still served with its certificate
+	out, err := runGit(dir, "ls-remote", server.URL+"/"+repo)
+	assert.NoError(t, err, out)
+}
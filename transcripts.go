@@ -0,0 +1,195 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// transcript records the input, output and error output of an SSH git
+// command to files of a directory of Config.SSHTranscriptDir, along with
+// the pkt-lines exchanged, decoded in the order they were sent.
+type transcript struct {
+	stdinFile  *os.File
+	stdoutFile *os.File
+	stderrFile *os.File
+	pktFile    *os.File
+
+	mu     sync.Mutex // Guards the pkt-lines file and decoders
+	client *pktDecoder
+	server *pktDecoder
+}
+
+// transcript starts the transcript of a git command in a new directory of
+// Config.SSHTranscriptDir, named after its sequence number and command, or
+// returns nil if unset or if it cannot be created.
+func (s *SSH) transcript(gitcmd *GitCommand) *transcript {
+	if s.gitConfig.SSHTranscriptDir == "" {
+		return nil
+	}
+
+	n := atomic.AddInt32(&s.transcripts, 1)
+	dir := filepath.Join(s.gitConfig.SSHTranscriptDir, fmt.Sprintf("%04d-%s", n, gitcmd.Command))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		s.gitConfig.logError("transcript", err)
+		return nil
+	}
+
+	t := &transcript{}
+	for name, file := range map[string]**os.File{"stdin": &t.stdinFile, "stdout": &t.stdoutFile, "stderr": &t.stderrFile, "pkt-lines": &t.pktFile} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			s.gitConfig.logError("transcript", err)
+			t.close()
+			return nil
+		}
+		*file = f
+	}
+	t.client = &pktDecoder{prefix: "C: ", out: t.pktFile}
+	t.server = &pktDecoder{prefix: "S: ", out: t.pktFile}
+	s.gitConfig.logInfo("transcript", fmt.Sprintf("%s: recording %s to %s", gitcmd.Repo, gitcmd.Command, dir))
+	return t
+}
+
+// stdin records what the client sends while reading it from r
+func (t *transcript) stdin(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return io.TeeReader(r, io.MultiWriter(t.stdinFile, t.decoder(t.client)))
+}
+
+// stdout records what the server sends while writing it to w
+func (t *transcript) stdout(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return io.MultiWriter(t.stdoutFile, t.decoder(t.server), w)
+}
+
+// stderr records the error output of the command while writing it to w
+func (t *transcript) stderr(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return io.MultiWriter(t.stderrFile, w)
+}
+
+// decoder returns a writer decoding the pkt-lines of a direction, under the
+// lock of the transcript so that both directions are interleaved by line.
+func (t *transcript) decoder(d *pktDecoder) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		d.write(p)
+		return len(p), nil
+	})
+}
+
+// close ends the transcript once the command exited
+func (t *transcript) close() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		t.client.end()
+		t.server.end()
+	}
+	for _, f := range []*os.File{t.stdinFile, t.stdoutFile, t.stderrFile, t.pktFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// pktDecoder writes a line to out for every pkt-line of a stream, until the
+// data stops being pkt-lines, such as the packfiles of protocol v0 without
+// side-band, which is only counted.
+type pktDecoder struct {
+	prefix string
+	out    io.Writer
+	buf    []byte
+	raw    int64 // Bytes past the pkt-lines
+}
+
+func (d *pktDecoder) write(p []byte) {
+	if d.raw > 0 {
+		d.raw += int64(len(p))
+		return
+	}
+
+	d.buf = append(d.buf, p...)
+	for len(d.buf) >= 4 {
+		length, err := strconv.ParseUint(string(d.buf[:4]), 16, 16)
+		if err != nil || (length > 2 && length < 4) {
+			d.raw, d.buf = int64(len(d.buf)), nil
+			return
+		}
+
+		switch length {
+		case 0:
+			fmt.Fprintf(d.out, "%sflush\n", d.prefix)
+		case 1:
+			fmt.Fprintf(d.out, "%sdelim\n", d.prefix)
+		case 2:
+			fmt.Fprintf(d.out, "%sresponse-end\n", d.prefix)
+		}
+		if length < 4 {
+			d.buf = d.buf[4:]
+			continue
+		}
+
+		if len(d.buf) < int(length) {
+			return
+		}
+		fmt.Fprintf(d.out, "%s%s\n", d.prefix, describePktLine(d.buf[4:length]))
+		d.buf = d.buf[length:]
+	}
+}
+
+// end writes what was left of the stream past its pkt-lines
+func (d *pktDecoder) end() {
+	if d.raw > 0 {
+		fmt.Fprintf(d.out, "%s%d bytes of raw data\n", d.prefix, d.raw)
+	}
+	if len(d.buf) > 0 {
+		fmt.Fprintf(d.out, "%struncated pkt-line %q\n", d.prefix, d.buf)
+	}
+}
+
+// describePktLine quotes the payload of a text pkt-line, and sums up binary
+// ones such as pack data, giving the side-band of multiplexed payloads:
+// pack data in band 1, progress and errors in bands 2 and 3.
+func describePktLine(payload []byte) string {
+	if len(payload) > 0 && payload[0] == 1 {
+		return fmt.Sprintf("band 1: (%d bytes)", len(payload)-1)
+	}
+	if len(payload) > 0 && (payload[0] == 2 || payload[0] == 3) {
+		return fmt.Sprintf("band %d: %s", payload[0], describePktLine(payload[1:]))
+	}
+	if !utf8.Valid(payload) || bytes.IndexFunc(payload, binaryRune) >= 0 {
+		return fmt.Sprintf("(%d bytes)", len(payload))
+	}
+	return strconv.Quote(string(payload))
+}
+
+// binaryRune tells whether a rune is unexpected in text pkt-lines, which
+// may carry capabilities after a NUL and progress ending with a CR.
+func binaryRune(r rune) bool {
+	return r < 0x20 && r != 0 && r != '\t' && r != '\n' && r != '\r'
+}
@@ -0,0 +1,56 @@
+package gitkit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHTranscripts(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcripts := t.TempDir()
+
+	server := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), ProtocolV2: true, SSHTranscriptDir: transcripts})
+	url := SSHCloneURL("git", startSSH(t, server), repo)
+
+	out, err := runGit(dir, "-c", "protocol.version=0", "clone", url, filepath.Join(t.TempDir(), "clone"))
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "-c", "protocol.version=2", "ls-remote", url)
+	assert.NoError(t, err, out)
+
+	entries, err := os.ReadDir(transcripts)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"0001-git-upload-pack", "0002-git-upload-pack"}, names)
+
+	read := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(transcripts, name))
+		assert.NoError(t, err)
+		return string(content)
+	}
+	assert.Contains(t, read("0001-git-upload-pack/stdin"), "want ")
+	assert.Contains(t, read("0001-git-upload-pack/stdout"), "PACK")
+
+	clone := read("0001-git-upload-pack/pkt-lines")
+	assert.Contains(t, clone, " refs/heads/master\\n\"\n")
+	assert.Contains(t, clone, "C: \"want ")
+	assert.Contains(t, clone, "C: flush\n")
+	assert.Contains(t, clone, "C: \"done\\n\"\n")
+	assert.Contains(t, clone, "S: band 1: (")
+	assert.Less(t, strings.Index(clone, "S: flush"), strings.Index(clone, "C: \"want "))
+
+	lsRemote := read("0002-git-upload-pack/pkt-lines")
+	assert.Contains(t, lsRemote, "S: \"version 2\\n\"\n")
+	assert.Contains(t, lsRemote, "C: \"command=ls-refs\\n\"\n")
+	assert.Contains(t, lsRemote, "C: delim\n")
+}
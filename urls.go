@@ -0,0 +1,98 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// HTTPCloneURL returns the clone URL of a repository served over HTTP at
+// addr, which is a host with an optional port.
+func HTTPCloneURL(addr string, repo string) string {
+	return cloneURL("http", nil, addr, "", repo)
+}
+
+// HTTPSCloneURL returns the clone URL of a repository served over HTTPS at
+// addr, which is a host with an optional port.
+func HTTPSCloneURL(addr string, repo string) string {
+	return cloneURL("https", nil, addr, "", repo)
+}
+
+// SSHCloneURL returns the ssh:// clone URL of a repository served at addr.
+// The port is omitted when it is the default one.
+func SSHCloneURL(user string, addr string, repo string) string {
+	var userinfo *url.Userinfo
+	if user != "" {
+		userinfo = url.User(user)
+	}
+	return cloneURL("ssh", userinfo, addr, "22", repo)
+}
+
+// SCPCloneURL returns the scp-like "user@host:repo" clone URL of a repository.
+// That syntax has no room for a port, so addr must not use a port other than
+// the default one.
+func SCPCloneURL(user string, addr string, repo string) (string, error) {
+	host, port := splitHostPort(addr)
+	if port != "" && port != "22" {
+		return "", fmt.Errorf("scp-like URLs do not support port %s, use SSHCloneURL instead", port)
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if user != "" {
+		host = user + "@" + host
+	}
+	return host + ":" + strings.Trim(repo, "/"), nil
+}
+
+// WithCredentials embeds a user and password into an HTTP(S) clone URL. An
+// empty password embeds the user alone, which makes git prompt for it.
+func WithCredentials(rawURL string, user string, password string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("credentials can only be embedded in http(s) URLs, got %q", u.Scheme)
+	}
+
+	if password == "" {
+		u.User = url.User(user)
+	} else {
+		u.User = url.UserPassword(user, password)
+	}
+	return u.String(), nil
+}
+
+// CloneURL returns the ssh:// clone URL of a repository on the server, for
+// the given user. The server must be listening.
+func (s *SSH) CloneURL(user string, repo string) string {
+	return SSHCloneURL(user, s.Address(), repo)
+}
+
+func cloneURL(scheme string, user *url.Userinfo, addr string, defaultPort string, repo string) string {
+	host, port := splitHostPort(addr)
+	if port != "" && port != defaultPort {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	u := url.URL{
+		Scheme: scheme,
+		User:   user,
+		Host:   host,
+		Path:   "/" + strings.Trim(repo, "/"),
+	}
+	return u.String()
+}
+
+// splitHostPort splits an address that may or may not have a port
+func splitHostPort(addr string) (string, string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host, port
+	}
+	return strings.Trim(addr, "[]"), ""
+}
@@ -0,0 +1,75 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseUserCAKeys parses the CA keys of Config.UserCAKeys
+func parseUserCAKeys(keys []string) ([]ssh.PublicKey, error) {
+	cas := []ssh.PublicKey{}
+	for _, key := range keys {
+		ca, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid user CA key: %v", err)
+		}
+		cas = append(cas, ca)
+	}
+	return cas, nil
+}
+
+// principalConn overrides the user of a connection, to check certificates
+// against other principals than the user name.
+type principalConn struct {
+	ssh.ConnMetadata
+	principal string
+}
+
+func (c principalConn) User() string {
+	return c.principal
+}
+
+// authenticateCert accepts user certificates signed by one of the CAs, valid
+// by the server clock for one of the accepted principals. Certificates with
+// critical options other than source-address are rejected, as sshd does for
+// options it does not know.
+func (s *SSH) authenticateCert(conn ssh.ConnMetadata, cert *ssh.Certificate, cas []ssh.PublicKey) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, ca := range cas {
+				if bytes.Equal(auth.Marshal(), ca.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		Clock:                    s.clock.now,
+		SupportedCriticalOptions: []string{"source-address"},
+	}
+
+	principals := s.gitConfig.UserCertPrincipals
+	if len(principals) == 0 {
+		principals = []string{conn.User()}
+	}
+
+	var err error
+	for _, principal := range principals {
+		var perms *ssh.Permissions
+		if perms, err = checker.Authenticate(principalConn{conn, principal}, cert); err == nil {
+			extensions := map[string]string{}
+			for name, value := range perms.Extensions {
+				extensions[name] = value
+			}
+			extensions["key-id"] = cert.KeyId
+			extensions["key-fingerprint"] = ssh.FingerprintSHA256(cert.Key)
+
+			s.emit(conn, Event{Type: AuthSuccessEvent, KeyID: cert.KeyId})
+			return &ssh.Permissions{CriticalOptions: perms.CriticalOptions, Extensions: extensions}, nil
+		}
+	}
+
+	s.emit(conn, Event{Type: AuthFailureEvent, KeyID: cert.KeyId, Error: err.Error()})
+	return nil, err
+}
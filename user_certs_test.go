@@ -0,0 +1,181 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// createUserCA returns a CA signer and its public key in authorized_keys
+// format.
+func createUserCA() (ssh.Signer, string, error) {
+	_, key, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, string(ssh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
+
+// signUserCert writes a certificate for the client key in authorizedKey,
+// signed by the CA, next to the key.
+func signUserCert(ca ssh.Signer, key string, authorizedKey string, cert ssh.Certificate) (string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", err
+	}
+	cert.Key = pub
+	cert.CertType = ssh.UserCert
+	if err := cert.SignCert(cryptorand.Reader, ca); err != nil {
+		return "", err
+	}
+
+	path := key + "-cert.pub"
+	return path, os.WriteFile(path, ssh.MarshalAuthorizedKey(&cert), 0600)
+}
+
+func TestUserCertificates(t *testing.T) {
+	dir, err := os.MkdirTemp("", "user-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, caKey, err := createUserCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, _, err := createUserCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 16)
+	server := NewSSH(Config{
+		Dir:        dir,
+		KeyDir:     filepath.Join(dir, "keys"),
+		Auth:       true,
+		UserCAKeys: []string{caKey},
+	})
+	server.OnEvent = func(e Event) { events <- e }
+	addr := startSSH(t, server)
+
+	now := time.Now()
+	valid := ssh.Certificate{
+		KeyId:           "alice",
+		ValidPrincipals: []string{"git"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	expired := valid
+	expired.ValidBefore = uint64(now.Add(-time.Minute).Unix())
+	wrongPrincipal := valid
+	wrongPrincipal.ValidPrincipals = []string{"bob"}
+	unknownOption := valid
+	unknownOption.CriticalOptions = map[string]string{"force-command": "true"}
+
+	for _, tc := range []struct {
+		name    string
+		ca      ssh.Signer
+		cert    ssh.Certificate
+		success bool
+	}{
+		{"valid", ca, valid, true},
+		{"expired", ca, expired, false},
+		{"wrong principal", ca, wrongPrincipal, false},
+		{"unknown critical option", ca, unknownOption, false},
+		{"untrusted CA", otherCA, valid, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keyDir := t.TempDir()
+			key, pub, err := createClientKey(keyDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := signUserCert(tc.ca, key, pub, tc.cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for len(events) > 0 {
+				<-events
+			}
+			out, err := runGitWithKey(dir, key+" -o CertificateFile="+cert, "ls-remote", SSHCloneURL("git", addr, repo))
+			if !tc.success {
+				assert.Error(t, err, out)
+				return
+			}
+			assert.NoError(t, err, out)
+			event := <-events
+			assert.Equal(t, AuthSuccessEvent, event.Type)
+			assert.Equal(t, "alice", event.KeyID)
+		})
+	}
+
+	// Plain keys are rejected without a public key lookup func
+	key, _, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runGitWithKey(dir, key, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.Error(t, err, out)
+}
+
+func TestUserCertificatePrincipals(t *testing.T) {
+	dir, err := os.MkdirTemp("", "user-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, caKey, err := createUserCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSSH(Config{
+		Dir:                dir,
+		KeyDir:             filepath.Join(dir, "keys"),
+		Auth:               true,
+		UserCAKeys:         []string{caKey},
+		UserCertPrincipals: []string{"deploy", "ci"},
+	})
+	addr := startSSH(t, server)
+
+	key, pub, err := createClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := signUserCert(ca, key, pub, ssh.Certificate{
+		KeyId:           "ci-runner",
+		ValidPrincipals: []string{"ci"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runGitWithKey(dir, key+" -o CertificateFile="+cert, "ls-remote", SSHCloneURL("git", addr, repo))
+	assert.NoError(t, err, out)
+
+	invalid := NewSSH(Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true, UserCAKeys: []string{"not a key"}})
+	assert.Error(t, invalid.Listen("127.0.0.1:0"))
+}
@@ -0,0 +1,250 @@
+package gitkit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// User is a principal that can authenticate over both HTTP and SSH
+type User struct {
+	Name       string
+	Disabled   bool
+	PublicKeys []string // Keys in authorized_keys format
+}
+
+type userEntry struct {
+	User
+	passwordHash []byte
+}
+
+// UserStore holds the users shared by the HTTP and SSH servers. When set in
+// Config.Users, it is used for authentication unless Server.AuthFunc or
+// SSH.PublicKeyLookupFunc are provided.
+type UserStore struct {
+	// HashCost is the bcrypt cost used to hash passwords. Defaults to the
+	// minimum cost, which keeps tests fast.
+	HashCost int
+
+	mu    sync.RWMutex
+	users map[string]*userEntry
+}
+
+func NewUserStore() *UserStore {
+	return &UserStore{users: map[string]*userEntry{}}
+}
+
+// AddUser adds an enabled user, replacing any existing user with that name.
+// Users with an empty password can only authenticate with public keys.
+func (u *UserStore) AddUser(name string, password string) error {
+	if name == "" {
+		return fmt.Errorf("user name is required")
+	}
+
+	entry := &userEntry{User: User{Name: name}}
+	if err := u.hashPassword(entry, password); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.users == nil {
+		u.users = map[string]*userEntry{}
+	}
+	u.users[name] = entry
+	return nil
+}
+
+// RemoveUser removes a user along with its public keys
+func (u *UserStore) RemoveUser(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.users, name)
+}
+
+// SetPassword changes the password of an existing user
+func (u *UserStore) SetPassword(name string, password string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entry, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", name)
+	}
+	return u.hashPassword(entry, password)
+}
+
+// AddPublicKey authorizes an SSH public key, in authorized_keys format, for
+// an existing user.
+func (u *UserStore) AddPublicKey(name string, key string) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entry, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", name)
+	}
+	entry.PublicKeys = append(entry.PublicKeys, marshalPublicKey(pub))
+	return nil
+}
+
+// SetEnabled enables or disables a user. Disabled users are rejected on both
+// transports.
+func (u *UserStore) SetEnabled(name string, enabled bool) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entry, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", name)
+	}
+	entry.Disabled = !enabled
+	return nil
+}
+
+// User returns a copy of the named user
+func (u *UserStore) User(name string) (User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	entry, ok := u.users[name]
+	if !ok {
+		return User{}, false
+	}
+
+	user := entry.User
+	user.PublicKeys = append([]string{}, entry.PublicKeys...)
+	return user, true
+}
+
+// Users returns the sorted names of all users
+func (u *UserStore) Users() []string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	names := make([]string, 0, len(u.users))
+	for name := range u.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Authenticate checks the password of an enabled user
+func (u *UserStore) Authenticate(name string, password string) (bool, error) {
+	u.mu.RLock()
+	entry, ok := u.users[name]
+	var disabled bool
+	var hash []byte
+	if ok {
+		disabled, hash = entry.Disabled, entry.passwordHash
+	}
+	u.mu.RUnlock()
+
+	if !ok {
+		return false, fmt.Errorf("user %s does not exist", name)
+	}
+	if disabled {
+		return false, fmt.Errorf("user %s is disabled", name)
+	}
+	if len(hash) == 0 {
+		return false, fmt.Errorf("user %s has no password", name)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// AuthFunc authenticates HTTP Basic credentials, see Server.AuthFunc, and
+// the enabled users client certificates are mapped to.
+func (u *UserStore) AuthFunc(cred Credential, _ *Request) (bool, error) {
+	if cred.Certificate != nil {
+		return u.authenticateCertificate(cred.Username)
+	}
+	return u.Authenticate(cred.Username, cred.Password)
+}
+
+// authenticateCertificate checks that the user a verified client
+// certificate is mapped to is enabled
+func (u *UserStore) authenticateCertificate(name string) (bool, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	entry, ok := u.users[name]
+	if !ok {
+		return false, fmt.Errorf("user %s does not exist", name)
+	}
+	if entry.Disabled {
+		return false, fmt.Errorf("user %s is disabled", name)
+	}
+	return true, nil
+}
+
+// LookupPublicKey finds the enabled user owning a public key, see
+// SSH.PublicKeyLookupFunc. The returned key is named after the user.
+func (u *UserStore) LookupPublicKey(content string) (*PublicKey, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	key := marshalPublicKey(pub)
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	for _, entry := range u.users {
+		for _, k := range entry.PublicKeys {
+			if k != key {
+				continue
+			}
+			if entry.Disabled {
+				return nil, fmt.Errorf("user %s is disabled", entry.Name)
+			}
+
+			fingerprint := ssh.FingerprintSHA256(pub)
+			return &PublicKey{
+				Id:          fingerprint,
+				Name:        entry.Name,
+				Fingerprint: fingerprint,
+				Content:     key,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown public key")
+}
+
+func (u *UserStore) hashPassword(entry *userEntry, password string) error {
+	if password == "" {
+		entry.passwordHash = nil
+		return nil
+	}
+
+	cost := u.HashCost
+	if cost == 0 {
+		cost = bcrypt.MinCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+	entry.passwordHash = hash
+	return nil
+}
+
+// marshalPublicKey returns a key in authorized_keys format, without comment
+func marshalPublicKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
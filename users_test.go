@@ -0,0 +1,96 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserStore(t *testing.T) {
+	users := NewUserStore()
+	assert.NoError(t, users.AddUser("alice", "secret"))
+	assert.Error(t, users.AddUser("", "secret"))
+
+	ok, err := users.Authenticate("alice", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = users.Authenticate("alice", "wrong")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = users.Authenticate("bob", "secret")
+	assert.Error(t, err)
+
+	assert.NoError(t, users.SetEnabled("alice", false))
+	_, err = users.Authenticate("alice", "secret")
+	assert.Error(t, err)
+
+	assert.NoError(t, users.SetEnabled("alice", true))
+	assert.NoError(t, users.SetPassword("alice", "changed"))
+	ok, _ = users.Authenticate("alice", "changed")
+	assert.True(t, ok)
+
+	assert.Error(t, users.AddPublicKey("alice", "not a key"))
+	assert.Error(t, users.SetEnabled("bob", true))
+	assert.Equal(t, []string{"alice"}, users.Users())
+
+	users.RemoveUser("alice")
+	_, found := users.User("alice")
+	assert.False(t, found)
+}
+
+func TestUserStoreAuth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, authorizedKey, err := createClientKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewUserStore()
+	assert.NoError(t, users.AddUser("alice", "secret"))
+	assert.NoError(t, users.AddPublicKey("alice", authorizedKey))
+
+	config := Config{Dir: dir, KeyDir: filepath.Join(dir, "keys"), Auth: true, Users: users}
+
+	server := httptest.NewServer(New(config))
+	defer server.Close()
+
+	sshServer := NewSSH(config)
+	addr := startSSH(t, sshServer)
+
+	httpURL := func(user, password string) string {
+		u, _ := url.Parse(server.URL + "/" + repo)
+		u.User = url.UserPassword(user, password)
+		return u.String()
+	}
+	sshURL := SSHCloneURL("git", addr, repo)
+
+	out, err := runGitWithKey(dir, key, "clone", httpURL("alice", "secret"), "http-ok")
+	assert.NoError(t, err, out)
+	out, err = runGitWithKey(dir, key, "clone", sshURL, "ssh-ok")
+	assert.NoError(t, err, out)
+
+	out, err = runGitWithKey(dir, key, "-c", "credential.helper=", "clone", httpURL("alice", "wrong"), "http-wrong")
+	assert.Error(t, err, out)
+
+	assert.NoError(t, users.SetEnabled("alice", false))
+	out, err = runGitWithKey(dir, key, "clone", httpURL("alice", "secret"), "http-disabled")
+	assert.Error(t, err, out)
+	out, err = runGitWithKey(dir, key, "clone", sshURL, "ssh-disabled")
+	assert.Error(t, err, out)
+}
@@ -1,10 +1,10 @@
 package gitkit
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"os"
 	"os/exec"
 	"regexp"
 	"strings"
@@ -12,19 +12,6 @@ import (
 
 var reSlashDedup = regexp.MustCompile(`\/{2,}`)
 
-func fail500(w http.ResponseWriter, context string, err error) {
-	http.Error(w, "Internal server error", 500)
-	logError(context, err)
-}
-
-func logError(context string, err error) {
-	log.Printf("%s: %v\n", context, err)
-}
-
-func logInfo(context string, message string) {
-	log.Printf("%s: %s\n", context, message)
-}
-
 func cleanUpProcess(cmd *exec.Cmd) {
 	if cmd == nil {
 		return
@@ -38,6 +25,27 @@ func cleanUpProcess(cmd *exec.Cmd) {
 	go cmd.Wait()
 }
 
+// gitExec runs a git command in dir with extra environment variables and
+// the given stdin, returning its output.
+func gitExec(gitPath string, dir string, env []string, stdin string, args ...string) ([]byte, error) {
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Largest payload of a pkt-line, git rejects longer lines
+const maxPktPayload = 65516
+
 func packLine(w io.Writer, s string) error {
 	_, err := fmt.Fprintf(w, "%04x%s", len(s)+4, s)
 	return err
@@ -65,9 +73,10 @@ func getNamespaceAndRepo(input string) (string, string) {
 	// Remove duplicate slashes
 	input = reSlashDedup.ReplaceAllString(input, "/")
 
-	// Remove leading slash
-	if input[0] == '/' && input != "/" {
-		input = input[1:]
+	// Remove leading and trailing slashes
+	input = strings.Trim(input, "/")
+	if input == "" {
+		return "", ""
 	}
 
 	blocks := strings.Split(input, "/")
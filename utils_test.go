@@ -69,6 +69,7 @@ func Test_getNamespaceAndRepo(t *testing.T) {
 		"/org/repo":         {"org", "repo"},
 		"/org/suborg/repo":  {"org/suborg", "repo"},
 		"//org//org///repo": {"org/org", "repo"},
+		"/org/repo/":        {"org", "repo"},
 	}
 
 	for example, expected := range cases {
@@ -0,0 +1,226 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ConfigError is a problem of a Config field
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ConfigErrors lists every problem found validating a Config
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	problems := []string{}
+	for _, err := range e {
+		problems = append(problems, err.Error())
+	}
+	return fmt.Sprintf("invalid config: %s", strings.Join(problems, "; "))
+}
+
+// AppliedDefault is a default value ApplyDefaults gave to an unset field
+type AppliedDefault struct {
+	Field string
+	Value string
+}
+
+func (d AppliedDefault) String() string {
+	return d.Field + " = " + d.Value
+}
+
+// Validate returns ConfigErrors listing every missing, invalid or
+// conflicting option, or nil. It assumes that Auth relies on Users: servers
+// with their own auth functions are checked with Server.Validate and
+// SSH.Validate instead.
+func (c *Config) Validate() error {
+	return c.validate(c.Users != nil)
+}
+
+// validate checks the config, authenticated tells whether a backend checks
+// the credentials of clients when Auth is set.
+func (c *Config) validate(authenticated bool) error {
+	errs := ConfigErrors{}
+	problem := func(field string, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Dir == "" && c.Store == nil {
+		problem("Dir", "required unless Store is set")
+	}
+	if c.Auth && !authenticated {
+		problem("Auth", "set without Users or an auth function to check credentials")
+	}
+	if c.AutoHooks && c.Hooks == nil {
+		problem("AutoHooks", "set without Hooks")
+	}
+
+	for _, keyType := range c.HostKeyTypes {
+		if keyType != RSAHostKey && keyType != ECDSAHostKey && keyType != Ed25519HostKey {
+			problem("HostKeyTypes", "unknown host key type %q", keyType)
+		}
+	}
+	if len(c.HostCertPrincipals) > 0 && c.HostCA == nil {
+		problem("HostCertPrincipals", "set without HostCA")
+	}
+	if len(c.UserCertPrincipals) > 0 && len(c.UserCAKeys) == 0 {
+		problem("UserCertPrincipals", "set without UserCAKeys")
+	}
+
+	switch c.GitSuffix {
+	case SuffixOptional, SuffixExact, SuffixRequired, SuffixForbidden:
+	default:
+		problem("GitSuffix", "unknown policy %q", c.GitSuffix)
+	}
+	switch c.TempCleanup {
+	case CleanupAlways, CleanupOnSuccess, CleanupNever:
+	default:
+		problem("TempCleanup", "unknown policy %q", c.TempCleanup)
+	}
+	switch c.MemoryOverflow {
+	case OverflowSpill, OverflowReject:
+	default:
+		problem("MemoryOverflow", "unknown policy %q", c.MemoryOverflow)
+	}
+	switch c.FilterPolicy {
+	case FilterAlways, FilterClonesOnly, FilterFetchesOnly:
+	default:
+		problem("FilterPolicy", "unknown policy %q", c.FilterPolicy)
+	}
+	switch c.EmptyRepoAdvertisement {
+	case EmptyRepoUnborn, EmptyRepoCapabilities:
+	default:
+		problem("EmptyRepoAdvertisement", "unknown advertisement %q", c.EmptyRepoAdvertisement)
+	}
+
+	if c.MemoryBudget < 0 {
+		problem("MemoryBudget", "negative budget %d", c.MemoryBudget)
+	}
+	if c.MemoryOverflow != OverflowSpill && c.MemoryBudget == 0 {
+		problem("MemoryOverflow", "set without MemoryBudget")
+	}
+	if c.SSHMaxConnections < 0 {
+		problem("SSHMaxConnections", "negative limit %d", c.SSHMaxConnections)
+	}
+	if c.SSHQueueConnections && c.SSHMaxConnections == 0 {
+		problem("SSHQueueConnections", "set without SSHMaxConnections")
+	}
+	if c.SSHBandwidth < 0 {
+		problem("SSHBandwidth", "negative bandwidth %d", c.SSHBandwidth)
+	}
+	if c.AuthCacheTTL < 0 {
+		problem("AuthCacheTTL", "negative duration %s", c.AuthCacheTTL)
+	}
+	if c.FilterPolicy != FilterAlways && !c.PartialClone {
+		problem("FilterPolicy", "set without PartialClone")
+	}
+	for _, user := range sortedKeys(c.SSHHomeDirs) {
+		if root := c.SSHHomeDirs[user]; path.IsAbs(root) || strings.HasPrefix(path.Clean(root), "..") {
+			problem("SSHHomeDirs", "root %q of %s is not relative to Dir", root, user)
+		}
+	}
+	switch c.ForceProtocolVersion {
+	case "", "0", "1", "2":
+	default:
+		problem("ForceProtocolVersion", "unknown protocol version %q", c.ForceProtocolVersion)
+	}
+	if c.DumbHTTP && c.ProtocolV2 {
+		problem("ProtocolV2", "conflicts with DumbHTTP")
+	}
+	if _, ok := c.Store.(*MemoryStore); ok && c.DumbHTTP {
+		problem("DumbHTTP", "conflicts with a MemoryStore")
+	}
+
+	unknown := []string{}
+	for feature := range c.Features {
+		if checkFeature(feature) != nil {
+			unknown = append(unknown, string(feature))
+		}
+	}
+	sort.Strings(unknown)
+	for _, feature := range unknown {
+		problem("Features", "unknown feature %q", feature)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ApplyDefaults sets the unset fields having a default to it, returning the
+// defaults applied, so that they can be logged or checked instead of being
+// applied silently.
+func (c *Config) ApplyDefaults() []AppliedDefault {
+	applied := []AppliedDefault{}
+	apply := func(field string, value string) {
+		applied = append(applied, AppliedDefault{Field: field, Value: value})
+	}
+
+	if c.GitPath == "" {
+		c.GitPath = "git"
+		apply("GitPath", c.GitPath)
+	}
+	if c.TempDir == "" {
+		c.TempDir = os.TempDir()
+		apply("TempDir", c.TempDir)
+	}
+	if c.LockMessage == "" {
+		c.LockMessage = defaultLockMessage
+		apply("LockMessage", c.LockMessage)
+	}
+	if c.SSHMaxAuthTries == 0 {
+		c.SSHMaxAuthTries = 6 // The default of golang.org/x/crypto/ssh
+		apply("SSHMaxAuthTries", "6")
+	}
+	if len(c.HostKeyTypes) == 0 && len(c.HostKeyFiles) == 0 {
+		c.HostKeyTypes = c.hostKeyTypes()
+		apply("HostKeyTypes", strings.Join(c.HostKeyTypes, ","))
+	}
+	if len(c.HostCertPrincipals) == 0 && c.HostCA != nil {
+		c.HostCertPrincipals = c.hostCertPrincipals()
+		apply("HostCertPrincipals", strings.Join(c.HostCertPrincipals, ","))
+	}
+	return applied
+}
+
+// Validate returns ConfigErrors listing every problem of the config of the
+// server, taking its AuthFunc into account.
+func (s *Server) Validate() error {
+	return s.config.validate(s.config.Users != nil || s.AuthFunc != nil)
+}
+
+// Validate returns ConfigErrors like Server.Validate, taking the key lookup
+// functions, KeyboardInteractiveFunc and UserRejection of the server into
+// account.
+func (s *SSH) Validate() error {
+	authenticated := s.lookupFunc() != nil || s.KeyboardInteractiveFunc != nil
+	errs, _ := s.gitConfig.validate(authenticated).(ConfigErrors)
+	if s.gitConfig.KeyDir == "" && len(s.gitConfig.hostKeyTypes()) > 0 {
+		errs = append(errs, ConfigError{Field: "KeyDir", Message: "required to generate host keys"})
+	}
+
+	switch s.UserRejection {
+	case RejectUserAuth, RejectUserCommand, RejectUserDisconnect:
+	default:
+		errs = append(errs, ConfigError{Field: "UserRejection", Message: fmt.Sprintf("unknown rejection %q", s.UserRejection)})
+	}
+	if s.UserRejection != RejectUserAuth && len(s.AllowedUsers) == 0 {
+		errs = append(errs, ConfigError{Field: "UserRejection", Message: "set without AllowedUsers"})
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
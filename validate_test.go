@@ -0,0 +1,66 @@
+package gitkit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, (&Config{Dir: "/tmp/repos"}).Validate())
+	assert.NoError(t, (&Config{Store: &FSStore{Dir: "/tmp/repos"}, Auth: true, Users: &UserStore{}}).Validate())
+	assert.NoError(t, (&Config{Store: &MemoryStore{}}).Validate())
+	assert.EqualError(t, (&Config{Store: &MemoryStore{}, DumbHTTP: true}).Validate(), "invalid config: DumbHTTP: conflicts with a MemoryStore")
+
+	config := Config{
+		Auth:                true,
+		GitSuffix:           "optional",
+		SSHQueueConnections: true,
+		FilterPolicy:        FilterClonesOnly,
+		HostKeyTypes:        []string{"dsa"},
+	}
+	err := config.Validate()
+	var errs ConfigErrors
+	if !assert.True(t, errors.As(err, &errs), err) {
+		return
+	}
+	fields := []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{"Dir", "Auth", "HostKeyTypes", "GitSuffix", "SSHQueueConnections", "FilterPolicy"}, fields)
+	assert.Contains(t, err.Error(), `GitSuffix: unknown policy "optional"`)
+
+	// Auth functions of the servers count as credentials backends
+	service := New(Config{Dir: "/tmp/repos", Auth: true})
+	assert.Error(t, service.Validate())
+	service.AuthFunc = func(Credential, *Request) (bool, error) { return true, nil }
+	assert.NoError(t, service.Validate())
+
+	sshServer := NewSSH(Config{Dir: "/tmp/repos", Auth: true})
+	sshServer.PublicKeyLookupFunc = func(string) (*PublicKey, error) { return nil, nil }
+	err = sshServer.Validate()
+	if assert.True(t, errors.As(err, &errs), err) {
+		assert.Equal(t, ConfigErrors{{Field: "KeyDir", Message: "required to generate host keys"}}, errs)
+	}
+}
+
+func TestConfigApplyDefaults(t *testing.T) {
+	config := Config{Dir: "/tmp/repos", HostCA: &SSHCertificateAuthority{}, LockMessage: "locked"}
+	applied := config.ApplyDefaults()
+
+	fields := map[string]string{}
+	for _, d := range applied {
+		fields[d.Field] = d.Value
+	}
+	assert.Equal(t, "git", fields["GitPath"])
+	assert.Equal(t, "ed25519", fields["HostKeyTypes"])
+	assert.Equal(t, "localhost,127.0.0.1,::1", fields["HostCertPrincipals"])
+	assert.NotContains(t, fields, "LockMessage")
+	assert.Equal(t, "git", config.GitPath)
+	assert.Equal(t, []string{Ed25519HostKey}, config.HostKeyTypes)
+
+	assert.Empty(t, config.ApplyDefaults(), "defaults are only applied once")
+	assert.NoError(t, config.Validate())
+}
@@ -0,0 +1,278 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// Providers of webhook deliveries
+const (
+	GitHubProvider  = "github"
+	GitLabProvider  = "gitlab"
+	GiteaProvider   = "gitea"
+	UnknownProvider = ""
+)
+
+// maxWebhookPayload is the largest payload accepted, as GitHub caps them
+const maxWebhookPayload = 25 << 20
+
+// WebhookDelivery is a webhook received by a WebhookReceiver
+type WebhookDelivery struct {
+	Provider string // Detected from the headers, e.g. GitHubProvider
+	Event    string // Event name from the provider header, e.g. "push" or "Push Hook"
+	ID       string // Delivery ID, if the provider sends one
+	Header   http.Header
+	Body     []byte
+	// Push is parsed from the body of push events
+	Push *WebhookPush
+}
+
+// WebhookPush holds the fields of a push event delivery common to providers
+type WebhookPush struct {
+	Repo   string // Full name of the repository, e.g. "org/repo"
+	Ref    string
+	Before string
+	After  string
+	Pusher string
+}
+
+// WebhookReceiver is an HTTP handler accepting provider-style webhook
+// deliveries, e.g. to test that pushes to a Server notify its consumers.
+// Accepted deliveries are sent to the Deliveries channel.
+type WebhookReceiver struct {
+	// Secret, if set, must have signed the payload: in X-Hub-Signature-256
+	// (or X-Hub-Signature) for GitHub, X-Gitea-Signature for Gitea, and be
+	// sent as X-Gitlab-Token for GitLab.
+	Secret string
+	// Deliveries receives accepted deliveries. Deliveries arriving while it is
+	// full are answered with 503, so providers retry them.
+	Deliveries chan WebhookDelivery
+}
+
+// NewWebhookReceiver returns a receiver checking deliveries against the
+// secret, buffering up to 100 deliveries.
+func NewWebhookReceiver(secret string) *WebhookReceiver {
+	return &WebhookReceiver{Secret: secret, Deliveries: make(chan WebhookDelivery, 100)}
+}
+
+func (h *WebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxWebhookPayload {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	delivery := WebhookDelivery{Header: r.Header, Body: body}
+	switch {
+	case r.Header.Get("X-Gitea-Event") != "":
+		delivery.Provider = GiteaProvider
+		delivery.Event = r.Header.Get("X-Gitea-Event")
+		delivery.ID = r.Header.Get("X-Gitea-Delivery")
+	case r.Header.Get("X-GitHub-Event") != "":
+		delivery.Provider = GitHubProvider
+		delivery.Event = r.Header.Get("X-GitHub-Event")
+		delivery.ID = r.Header.Get("X-GitHub-Delivery")
+	case r.Header.Get("X-Gitlab-Event") != "":
+		delivery.Provider = GitLabProvider
+		delivery.Event = r.Header.Get("X-Gitlab-Event")
+		delivery.ID = r.Header.Get("X-Gitlab-Event-UUID")
+	}
+
+	if err := h.verify(delivery); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if delivery.Event == "push" || delivery.Event == "Push Hook" {
+		if delivery.Push, err = parseWebhookPush(delivery.Provider, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	select {
+	case h.Deliveries <- delivery:
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "too many pending deliveries", http.StatusServiceUnavailable)
+	}
+}
+
+// verify checks the delivery was signed with the secret
+func (h *WebhookReceiver) verify(delivery WebhookDelivery) error {
+	if h.Secret == "" {
+		return nil
+	}
+
+	header := delivery.Header
+	switch {
+	case delivery.Provider == GitLabProvider:
+		if !hmac.Equal([]byte(header.Get("X-Gitlab-Token")), []byte(h.Secret)) {
+			return fmt.Errorf("invalid X-Gitlab-Token")
+		}
+		return nil
+	case delivery.Provider == GiteaProvider && header.Get("X-Gitea-Signature") != "":
+		return checkSignature(sha256.New, h.Secret, delivery.Body, header.Get("X-Gitea-Signature"))
+	case header.Get("X-Hub-Signature-256") != "":
+		return checkSignature(sha256.New, h.Secret, delivery.Body, strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="))
+	case header.Get("X-Hub-Signature") != "":
+		return checkSignature(sha1.New, h.Secret, delivery.Body, strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha1="))
+	}
+	return fmt.Errorf("missing signature")
+}
+
+func checkSignature(hashFunc func() hash.Hash, secret string, body []byte, signature string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func parseWebhookPush(provider string, body []byte) (*WebhookPush, error) {
+	var payload struct {
+		Ref        string `json:"ref"`
+		Before     string `json:"before"`
+		After      string `json:"after"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Pusher struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		} `json:"pusher"`
+		// GitLab
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+		UserUsername string `json:"user_username"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %v", err)
+	}
+
+	push := &WebhookPush{
+		Repo:   payload.Repository.FullName,
+		Ref:    payload.Ref,
+		Before: payload.Before,
+		After:  payload.After,
+		Pusher: payload.Pusher.Name,
+	}
+	switch provider {
+	case GitLabProvider:
+		push.Repo = payload.Project.PathWithNamespace
+		push.Pusher = payload.UserUsername
+	case GiteaProvider:
+		if push.Pusher == "" {
+			push.Pusher = payload.Pusher.Username
+		}
+	}
+	return push, nil
+}
+
+// Webhook delivers GitHub-style push webhooks for server events, closing
+// the push → webhook loop with a WebhookReceiver or a real consumer:
+//
+//	hook := &gitkit.Webhook{URL: receiver.URL, Secret: "secret"}
+//	server.OnEvent = func(e gitkit.Event) { hook.Send(e) }
+type Webhook struct {
+	URL    string
+	Secret string // Signs payloads in X-Hub-Signature-256 when set
+	Client *http.Client
+}
+
+// Send delivers one push webhook per ref updated by a successful push event.
+// Other events are ignored.
+func (h *Webhook) Send(event Event) error {
+	if event.Type != PushEvent || event.Error != "" {
+		return nil
+	}
+
+	repo := strings.TrimSuffix(event.Repo, ".git")
+	for _, change := range event.Refs {
+		payload := map[string]interface{}{
+			"ref":     change.Ref,
+			"before":  change.OldRev,
+			"after":   change.NewRev,
+			"created": IsZeroSHA(change.OldRev),
+			"deleted": IsZeroSHA(change.NewRev),
+			"repository": map[string]string{
+				"name":      path.Base(repo),
+				"full_name": repo,
+			},
+			"pusher": map[string]string{"name": event.User},
+		}
+		if err := h.deliver("push", payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Webhook) deliver(event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GitHub-Hookshot/gitkit")
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Delivery", id.String())
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook delivery %s failed: %s", id, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookLoop(t *testing.T) {
+	dir, err := os.MkdirTemp("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := createBareRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := NewWebhookReceiver("secret")
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+
+	hook := &Webhook{URL: receiverServer.URL, Secret: "secret"}
+	service := New(Config{Dir: dir})
+	service.OnEvent = func(e Event) {
+		assert.NoError(t, hook.Send(e))
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	out, err := runGit(dir, "clone", server.URL+"/"+repo, clone)
+	assert.NoError(t, err, out)
+	commitFile(t, clone, "notes.txt")
+	out, err = runGit(clone, "push", "origin", "HEAD:master")
+	assert.NoError(t, err, out)
+	rev, err := runGit(clone, "rev-parse", "HEAD")
+	assert.NoError(t, err, rev)
+
+	select {
+	case delivery := <-receiver.Deliveries:
+		assert.Equal(t, GitHubProvider, delivery.Provider)
+		assert.Equal(t, "push", delivery.Event)
+		assert.NotEmpty(t, delivery.ID)
+		assert.Equal(t, strings.TrimSuffix(repo, ".git"), delivery.Push.Repo)
+		assert.Equal(t, "refs/heads/master", delivery.Push.Ref)
+		assert.Equal(t, strings.TrimSpace(rev), delivery.Push.After)
+
+		// The consumer reconciles by fetching the pushed revision
+		mirror := filepath.Join(t.TempDir(), "mirror")
+		out, err = runGit(dir, "clone", server.URL+"/"+delivery.Push.Repo+".git", mirror)
+		assert.NoError(t, err, out)
+		out, err = runGit(mirror, "cat-file", "-e", delivery.Push.After)
+		assert.NoError(t, err, out)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+
+	// Deliveries signed with another secret are refused
+	hook.Secret = "other"
+	assert.Error(t, hook.Send(Event{Type: PushEvent, Repo: repo, Refs: []RefChange{{RefUpdate: RefUpdate{Ref: "refs/heads/master"}}}}))
+	assert.Len(t, receiver.Deliveries, 0)
+}
+
+func TestWebhookReceiver(t *testing.T) {
+	receiver := NewWebhookReceiver("secret")
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	send := func(header map[string]string, body string) int {
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString(body))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	body := `{"object_kind": "push", "ref": "refs/heads/main", "after": "abc", "project": {"path_with_namespace": "org/repo"}, "user_username": "jane"}`
+	assert.Equal(t, 401, send(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, body))
+	assert.Equal(t, 200, send(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "secret"}, body))
+
+	delivery := <-receiver.Deliveries
+	assert.Equal(t, GitLabProvider, delivery.Provider)
+	assert.Equal(t, &WebhookPush{Repo: "org/repo", Ref: "refs/heads/main", After: "abc", Pusher: "jane"}, delivery.Push)
+
+	body = `{"ref": "refs/heads/main", "repository": {"full_name": "org/repo"}, "pusher": {"username": "jane"}}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+	assert.Equal(t, 401, send(map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": strings.Repeat("0", 64)}, body))
+	assert.Equal(t, 200, send(map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": signature}, body))
+
+	delivery = <-receiver.Deliveries
+	assert.Equal(t, GiteaProvider, delivery.Provider)
+	assert.Equal(t, "jane", delivery.Push.Pusher)
+
+	assert.Equal(t, 401, send(map[string]string{"X-GitHub-Event": "ping"}, "{}"))
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	full := &WebhookReceiver{Deliveries: make(chan WebhookDelivery)}
+	fullServer := httptest.NewServer(full)
+	defer fullServer.Close()
+
+	resp, err = http.Post(fullServer.URL, "application/json", bytes.NewBufferString("{}"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}